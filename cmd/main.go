@@ -10,10 +10,12 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -33,6 +35,12 @@ import (
 	protos "github.com/massenz/statemachine-proto/golang/api"
 )
 
+const (
+	// purgeInterval is how often completed FSMs are checked for removal, if a
+	// -completed-retention is configured.
+	purgeInterval = time.Minute
+)
+
 var (
 	logger = zlog.With().Str("logger", "fsmsrv").Logger()
 
@@ -40,7 +48,10 @@ var (
 	pub      *pubsub.SqsPublisher
 	sub      *pubsub.SqsSubscriber
 	store    storage.StoreManager
-	wg       sync.WaitGroup
+	// wg tracks the services which produce events for the listener, which are stopped
+	// before it, and listenerWg the listener itself.
+	wg         sync.WaitGroup
+	listenerWg sync.WaitGroup
 
 	// notificationsCh is the channel over which we send error notifications
 	// to publish on the appropriate queue.
@@ -67,11 +78,20 @@ func main() {
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	zlog.Logger = zlog.Output(os.Stderr)
 
+	var actionsTopic = flag.String("actions", "",
+		"(optional) The name of the topic to publish the configured entry/exit/transition actions to; "+
+			"if not specified, actions are kept in the store until a server publishing them is started")
+	var completedRetention = flag.Duration("completed-retention", 0,
+		"(optional) How long to keep FSMs after they reach a terminal state (as a Duration "+
+			"string, e.g. 72h); if not specified, completed FSMs are kept forever")
 	var awsEndpoint = flag.String("endpoint-url", "",
 		"HTTP URL for AWS SQS to connect to; usually best left undefined, "+
 			"unless required for local testing purposes (LocalStack uses http://localhost:4566)")
 	var cluster = flag.Bool("cluster", false,
 		"If set, connects to Redis with cluster-mode enabled")
+	var dedupWindow = flag.Duration("dedup-window", storage.DefaultDedupWindow,
+		"How long to remember the IDs of processed events, so that duplicates are not processed "+
+			"again (as a Duration string, e.g. 24h); 0 disables deduplication")
 	var debug = flag.Bool("debug", false,
 		"Verbose logs; better to avoid on Production services")
 	var eventsTopic = flag.String("events", "", "Topic name to receive events from")
@@ -85,8 +105,24 @@ func main() {
 	var redisUrl = flag.String("redis", "", "For single node Redis instances: host:port "+
 		"for the Redis instance. For redis clusters: a comma-separated list of redis nodes. "+
 		"If using an ElastiCache Redis cluster with cluster mode enabled, this can also be the configuration endpoint.")
+	var retryDelay = flag.Duration("retry-delay", storage.DefaultRetryInitialDelay,
+		"How long to wait before retrying a Redis operation which failed with a recoverable error "+
+			"(as a Duration string, e.g. 50ms); it grows by -retry-multiplier at every further retry")
+	var retryMaxDelay = flag.Duration("retry-max-delay", storage.DefaultRetryMaxDelay,
+		"The longest wait between retries of a Redis operation (as a Duration string, e.g. 2s)")
+	var retryMultiplier = flag.Float64("retry-multiplier", storage.DefaultRetryMultiplier,
+		"How much the wait between retries of a Redis operation grows at every retry")
+	var storeType = flag.String("store", "redis",
+		"The store for Configurations, FSMs and Events: either `redis` (configured with -redis), "+
+			"a bbolt file for single-node deployments (e.g., bolt:///var/lib/fsm.db), or `memory`, "+
+			"which keeps them in memory, and loses them when the server stops (for local development only)")
 	var timeout = flag.Duration("timeout", storage.DefaultTimeout,
 		"Timeout for Redis (as a Duration string, e.g. 1s, 20ms, etc.)")
+	var timersInterval = flag.Duration("timers-interval", pubsub.DefaultTimersInterval,
+		"How often to check for expired state timers (as a Duration string, e.g. 1s, 500ms, etc.)")
+	var upgradeKeys = flag.Bool("upgrade-keys", false,
+		"If set (with -cluster), before starting the server, renames the Redis keys stored by earlier "+
+			"releases, which were not hash-tagged for Redis clusters")
 	var trace = flag.Bool("trace", false,
 		"Extremely verbose logs for every API request and Pub/Sub event; it may impact"+
 			" performance, do not use in production or on heavily loaded systems (will override the -debug option)")
@@ -94,17 +130,52 @@ func main() {
 
 	logger.Info().Str("release", api.Release).Msg("starting State Machine Server")
 
-	if *redisUrl == "" {
-		logger.Fatal().Err(errors.New("in-memory store deprecated, a Redis server must be configured")).Msg("fatal configuration error")
-	} else {
+	switch {
+	case *storeType == "memory":
+		logger.Warn().Msg("using the in-memory store, all data will be lost when the server stops")
+		store = storage.NewInMemoryStore()
+	case strings.HasPrefix(*storeType, storage.BoltScheme):
+		path := strings.TrimPrefix(*storeType, storage.BoltScheme)
+		logger.Info().Str("bolt_path", path).Msg("opening bbolt store")
+		boltStore, err := storage.NewBoltStore(path, storage.DefaultSweepInterval)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("fatal configuration error")
+		}
+		defer func() {
+			if err := boltStore.Close(); err != nil {
+				logger.Error().Err(err).Msg("could not close the bbolt store")
+			}
+		}()
+		store = boltStore
+	case *storeType == "redis":
+		if *redisUrl == "" {
+			logger.Fatal().Err(errors.New("a Redis server must be configured with -redis")).Msg("fatal configuration error")
+		}
 		logger.Info().
 			Str("redis_addr", *redisUrl).
 			Str("redis_cluster", strconv.FormatBool(*cluster)).
 			Str("redis_timeout", timeout.String()).
 			Str("redis_max_retries", strconv.Itoa(*maxRetries)).
+			Str("redis_retry_delay", retryDelay.String()).
+			Str("redis_retry_max_delay", retryMaxDelay.String()).
 			Msg("connecting to Redis server")
-		store = storage.NewRedisStore(*redisUrl, *cluster, 1, *timeout, *maxRetries)
+		retry := storage.NewRetryPolicy(*maxRetries)
+		retry.InitialDelay = *retryDelay
+		retry.MaxDelay = *retryMaxDelay
+		retry.Multiplier = *retryMultiplier
+		store = storage.NewRedisStore(*redisUrl, *cluster, 1, *timeout, retry)
+		if *upgradeKeys {
+			if !*cluster {
+				logger.Fatal().Err(errors.New("-upgrade-keys can only be used with -cluster")).Msg("fatal configuration error")
+			}
+			if _, err := store.(*storage.RedisStore).UpgradeKeys(context.Background()); err != nil {
+				logger.Fatal().Err(err).Msg("could not upgrade the Redis keys")
+			}
+		}
+	default:
+		logger.Fatal().Err(fmt.Errorf("unknown store %q", *storeType)).Msg("fatal configuration error")
 	}
+	store.SetDedupWindow(*dedupWindow)
 	done := make(chan interface{})
 	if *eventsTopic != "" {
 		logger.Info().
@@ -144,11 +215,47 @@ func main() {
 		// TODO: workers pool not implemented yet.
 		ListenersPoolSize: 0,
 	})
-	logger.Info().Msg("starting events listener")
+	if *completedRetention > 0 {
+		logger.Info().
+			Str("completed_retention", completedRetention.String()).
+			Msg("purging completed FSMs")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			purgeCompleted(*completedRetention, done)
+		}()
+	}
+
+	if *actionsTopic != "" {
+		logger.Info().
+			Str("sqs_actions_topic", *actionsTopic).
+			Str("sqs_endpoint", *awsEndpoint).
+			Msg("publishing actions to SQS topic")
+		publisher := pubsub.NewSqsActionPublisher(*actionsTopic, awsEndpoint)
+		if publisher == nil {
+			logger.Fatal().Err(errors.New("cannot create a valid SQS Actions Publisher")).Msg("fatal error creating SQS publisher")
+		}
+		dispatcher := pubsub.NewActionsDispatcher(store, publisher)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dispatcher.Run(done)
+		}()
+	}
+
+	scheduler := pubsub.NewTimerScheduler(eventsCh, store)
+	scheduler.Interval = *timersInterval
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		listener.ListenForMessages()
+		scheduler.Run(done)
+	}()
+
+	logger.Info().Msg("starting events listener")
+	listenerWg.Add(1)
+	go func() {
+		defer listenerWg.Done()
+		listener.ListenForMessages(context.Background())
 	}()
 
 	logger.Info().Str("grpc_port", strconv.Itoa(*grpcPort)).Msg("gRPC server starting")
@@ -170,10 +277,35 @@ func RunUntilStopped(done chan interface{}, svr *g.Server) {
 	_ = <-c
 	logger.Info().Msg("shutting down services...")
 	close(done)
-	close(eventsCh)
 	svr.GracefulStop()
 	logger.Info().Msg("waiting for services to exit...")
+	// The events channel can only be closed once nothing sends on it any longer (e.g., the
+	// timer scheduler, which may be in the middle of firing timers); until then, the
+	// listener keeps processing the events.
 	wg.Wait()
+	close(eventsCh)
+	listenerWg.Wait()
+}
+
+// purgeCompleted periodically removes from the store, for all Configurations, the FSMs
+// which reached a terminal state more than `retention` ago, until `done` is closed.
+func purgeCompleted(retention time.Duration, done <-chan interface{}) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	ctx := context.Background()
+	for {
+		select {
+		case <-done:
+			logger.Info().Msg("stopped purging completed FSMs")
+			return
+		case <-ticker.C:
+			for _, cfgName := range store.GetAllConfigs(ctx) {
+				if _, err := store.PurgeCompleted(ctx, cfgName, retention); err != nil {
+					logger.Error().Err(err).Str("config", cfgName).Msg("could not purge completed FSMs")
+				}
+			}
+		}
+	}
 }
 
 // setLogLevel sets the global logging level depending on -debug / -trace.
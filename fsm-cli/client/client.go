@@ -19,11 +19,12 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/protobuf/ptypes/wrappers"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 	"gopkg.in/yaml.v3"
 	"io"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -61,7 +62,10 @@ func NewClient(address string, hasTls bool) *CliClient {
 	if err != nil {
 		return nil
 	}
-	return &CliClient{protos.NewStatemachineServiceClient(cc)}
+	return &CliClient{
+		StatemachineServiceClient: protos.NewStatemachineServiceClient(cc),
+		Admin:                     grpc.NewAdminClient(cc),
+	}
 }
 
 // sendEvent is an internal method that encapsulates sending the Event to the server,
@@ -131,6 +135,8 @@ func (c *CliClient) Send(path string) error {
 		code := getStatusCode(grpcErr)
 		if code == codes.AlreadyExists {
 			fmt.Printf("entity `%s` exists\n", entity.Kind)
+		} else if code == codes.InvalidArgument {
+			printViolations(grpcErr)
 		}
 		return grpcErr
 	}
@@ -146,6 +152,260 @@ func (c *CliClient) Send(path string) error {
 	return err
 }
 
+// Migrate processes CLI commands of the form `migrate orders:v3 orders:v4 [old=new ...]`,
+// moving the FSM `id` or, if empty, all those in `state` (or in any state, if empty) to the
+// newer Configuration, mapping the states which are not in it to new ones.
+// FSMs are migrated `batchSize` at a time, starting from the `cursor` (which is printed if
+// the migration is interrupted, so that it can be resumed).
+func (c *CliClient) Migrate(from, to string, mappings []string, id, state string, batchSize int,
+	cursor string) error {
+	if from == "" || to == "" {
+		return fmt.Errorf("expected two configuration IDs (e.g., `orders:v3 orders:v4`)")
+	}
+	states := make(map[string]string, len(mappings))
+	for _, mapping := range mappings {
+		source, target, found := strings.Cut(mapping, "=")
+		if !found || source == "" || target == "" {
+			return fmt.Errorf("expected a state mapping of the form `old=new`, got instead %s", mapping)
+		}
+		states[source] = target
+	}
+	req := grpc.MigrationRequest{
+		From:      from,
+		To:        to,
+		States:    states,
+		Id:        id,
+		State:     state,
+		BatchSize: batchSize,
+		Cursor:    cursor,
+	}
+	count := 0
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		result, err := c.Admin.MigrateStateMachines(ctx, req)
+		cancel()
+		if err != nil {
+			fmt.Printf("Migrated %d FSMs from %s to %s\n", count, from, to)
+			if getStatusCode(err) == codes.InvalidArgument {
+				printViolations(err)
+			} else if req.Cursor != "" {
+				fmt.Printf("Resume the migration with: -cursor %s\n", req.Cursor)
+			}
+			return err
+		}
+		count += len(result.Migrated)
+		if result.Cursor == "" {
+			break
+		}
+		req.Cursor = result.Cursor
+	}
+	fmt.Printf("Migrated %d FSMs from %s to %s\n", count, from, to)
+	return nil
+}
+
+// Diff processes CLI commands of the form `diff orders:v3 orders:v4` and prints, as YAML,
+// the differences between the two Configurations, including how many FSMs are in states
+// which were removed in the newer one.
+func (c *CliClient) Diff(from, to string) error {
+	if from == "" || to == "" {
+		return fmt.Errorf("expected two configuration IDs (e.g., `orders:v3 orders:v4`)")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	diff, err := c.Admin.DiffConfigurations(ctx, from, to)
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(diff)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	if !diff.IsCompatible() {
+		fmt.Printf("WARN: FSMs in states removed from %s would be orphaned\n", to)
+	}
+	return nil
+}
+
+// Graph processes CLI commands of the form `graph orders:v4 [fsm-id]` and prints the
+// diagram of the Configuration in the given `format` (one of `dot`, `mermaid` or
+// `plantuml`); if the ID of an FSM is given, its current state and path are highlighted.
+func (c *CliClient) Graph(cfgId, fsmId, format string) error {
+	if cfgId == "" {
+		return fmt.Errorf("expected a configuration ID (e.g., `orders:v4`)")
+	}
+	graphFormat, err := api.ParseGraphFormat(format)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	graph, err := c.Admin.RenderConfiguration(ctx, cfgId, graphFormat, fsmId)
+	if err != nil {
+		return err
+	}
+	fmt.Print(graph)
+	return nil
+}
+
+// ImportSCXML processes CLI commands of the form `import-scxml orders.scxml v5`, converting
+// the SCXML document (or stdin, if the path is `--`) into a Configuration with the given
+// version, which is then sent to the server.
+func (c *CliClient) ImportSCXML(path, version string) error {
+	if path == "" || version == "" {
+		return fmt.Errorf("expected the path to an SCXML document and a version (e.g., `orders.scxml v5`)")
+	}
+	var data []byte
+	var err error
+	if path == StdinFlag {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %v", path, err)
+	}
+	cfg, err := api.ImportSCXML(data, version)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := c.PutConfiguration(ctx, cfg)
+	if err != nil {
+		code := getStatusCode(err)
+		if code == codes.AlreadyExists {
+			fmt.Printf("configuration `%s` exists\n", api.GetVersionId(cfg))
+		} else if code == codes.InvalidArgument {
+			printViolations(err)
+		}
+		return err
+	}
+	out, err := yaml.Marshal(resp)
+	if err == nil {
+		fmt.Printf("Result:\n%v", string(out))
+	}
+	return err
+}
+
+// ExportSCXML processes CLI commands of the form `export-scxml orders:v5` and prints the
+// Configuration as an SCXML document.
+func (c *CliClient) ExportSCXML(cfgId string) error {
+	if cfgId == "" {
+		return fmt.Errorf("expected a configuration ID (e.g., `orders:v5`)")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg, err := c.GetConfiguration(ctx, &wrapperspb.StringValue{Value: cfgId})
+	if err != nil {
+		return err
+	}
+	data, err := api.ExportSCXML(cfg)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(data))
+	return nil
+}
+
+// Simulate processes CLI commands of the form `simulate config.yaml events.yaml`, sending
+// the events (a YAML list of api.SimulatedEvent) to a new FSM configured with the
+// Configuration (in the same format used by `send`), entirely offline.
+// It prints every step as YAML, and returns an error if any of the outcomes was not the
+// expected one, so that Configurations can be tested in CI pipelines.
+func Simulate(configPath, eventsPath string) error {
+	if configPath == "" || eventsPath == "" {
+		return fmt.Errorf("expected the paths to a configuration and to the events (e.g., `config.yaml events.yaml`)")
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %v", configPath, err)
+	}
+	var cfg ConfigEntity
+	if err = yaml.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	if cfg.Kind != KindConfiguration || cfg.Spec == nil {
+		return fmt.Errorf("%s does not contain a %s", configPath, KindConfiguration)
+	}
+	data, err = os.ReadFile(eventsPath)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %v", eventsPath, err)
+	}
+	var events []api.SimulatedEvent
+	if err = yaml.Unmarshal(data, &events); err != nil {
+		return err
+	}
+	sim, err := api.Simulate(cfg.Spec, events)
+	if err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(sim)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(out))
+	if len(sim.Failures) > 0 {
+		return fmt.Errorf("%d unexpected outcomes simulating %s", len(sim.Failures), sim.Config)
+	}
+	return nil
+}
+
+// Rollback processes CLI commands of the form `rollback orders/fsm-id [steps]`, reverting
+// the last `steps` (by default, one) transitions of the FSM.
+func (c *CliClient) Rollback(id, steps string) error {
+	parts := strings.Split(id, string(os.PathSeparator))
+	if len(parts) != 2 {
+		return fmt.Errorf("expected an FSM ID of the form `config-name/fsm-id`, got instead %s", id)
+	}
+	count := 1
+	if steps != "" {
+		var err error
+		if count, err = strconv.Atoi(steps); err != nil || count <= 0 {
+			return fmt.Errorf("the number of steps must be a positive integer, got instead %s", steps)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	state, err := c.Admin.RollbackStateMachine(ctx, parts[0], parts[1], count)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("FSM %s rolled back by %d steps, now in state %s\n", id, count, state)
+	return nil
+}
+
+// Verify processes CLI commands of the form `verify orders [fsm-id ...]` (or `repair`, if
+// `repair` is true), replaying the History of the FSMs (all of those configured with the
+// Configuration, if none is given) and printing, as YAML, those whose state, data, or
+// `state` SETs disagree with it.
+func (c *CliClient) Verify(cfgName string, ids []string, repair bool) error {
+	if cfgName == "" {
+		return fmt.Errorf("expected a configuration name (e.g., `orders`)")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	result, err := c.Admin.VerifyStateMachines(ctx, cfgName, ids, repair)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Verified %d FSMs, %d inconsistent\n", result.Verified, len(result.Inconsistent))
+	if len(result.Inconsistent) > 0 {
+		data, err := yaml.Marshal(result.Inconsistent)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	}
+	return nil
+}
+
 // Get will retrieve the required entity from the FSM Server and generate the
 // YAML representation accordingly.
 // It takes two arguments, the kind and the id of the entity, and prints the
@@ -157,7 +417,7 @@ func (c *CliClient) Get(kind, id string) error {
 
 	switch kind {
 	case KindConfiguration:
-		cfg, err := c.GetConfiguration(ctx, &wrappers.StringValue{Value: id})
+		cfg, err := c.GetConfiguration(ctx, &wrapperspb.StringValue{Value: id})
 		if err != nil {
 			return err
 		}
@@ -183,6 +443,17 @@ func (c *CliClient) Get(kind, id string) error {
 			return err
 		}
 		fmt.Println(string(data))
+		fsmData, err := api.GetData(fsm)
+		if err != nil {
+			return err
+		}
+		if len(fsmData.GetFields()) > 0 {
+			data, err = yaml.Marshal(map[string]interface{}{"data": fsmData.AsMap()})
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+		}
 	default:
 		return fmt.Errorf("kind `%s` unknown, please note they are case-sensitive (did you mean %s?)", kind,
 			titleCase(kind))
@@ -190,3 +461,35 @@ func (c *CliClient) Get(kind, id string) error {
 
 	return nil
 }
+
+// Delete processes CLI commands of the form `delete Kind id`, where the `id` is that of a
+// Configuration (e.g., `orders:v1`), or of the form `config-name/id` for FSMs and Events.
+// A Configuration which is still in use by FSMs is only deleted if `force` is true.
+func (c *CliClient) Delete(kind, id string, force bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var err error
+	switch kind {
+	case KindConfiguration:
+		err = c.Admin.DeleteConfiguration(ctx, id, force)
+	case KindFiniteStateMachine, KindEvent:
+		parts := strings.Split(id, string(os.PathSeparator))
+		if len(parts) != 2 {
+			return fmt.Errorf("expected an ID of the form `config-name/id`, got instead %s", id)
+		}
+		if kind == KindEvent {
+			err = c.Admin.DeleteEvent(ctx, parts[0], parts[1])
+		} else {
+			err = c.Admin.DeleteStateMachine(ctx, parts[0], parts[1])
+		}
+	default:
+		return fmt.Errorf("kind `%s` unknown, please note they are case-sensitive (did you mean %s?)", kind,
+			titleCase(kind))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %s deleted\n", kind, id)
+	return nil
+}
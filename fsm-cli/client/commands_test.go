@@ -0,0 +1,302 @@
+package client_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/massenz/fsm-cli/client"
+	"github.com/massenz/go-statemachine/pkg/api"
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+// output returns what `fn` prints, along with the error it returns.
+func output(fn func() error) (string, error) {
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	Ω(err).ToNot(HaveOccurred())
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	printed := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		printed <- string(data)
+	}()
+	err = fn()
+	Ω(w.Close()).To(Succeed())
+	return <-printed, err
+}
+
+// putConfig stores a Configuration with the `name` and `version`, whose `states` are a chain
+// of transitions, each triggered by the `next` event.
+// As all the tests share the same server, each of them uses Configurations of its own, which
+// may have been stored already by an earlier test.
+func putConfig(name, version string, states ...string) *protos.Configuration {
+	cfg := &protos.Configuration{
+		Name:          name,
+		Version:       version,
+		States:        states,
+		StartingState: states[0],
+	}
+	for i := 1; i < len(states); i++ {
+		cfg.Transitions = append(cfg.Transitions,
+			&protos.Transition{From: states[i-1], To: states[i], Event: "next"})
+	}
+	_, err := svc.PutConfiguration(context.Background(), cfg)
+	if status.Code(err) != codes.AlreadyExists {
+		Ω(err).ToNot(HaveOccurred())
+	}
+	return cfg
+}
+
+// putFSM stores the FSM `id`, configured with `cfg`, in the given `state`.
+func putFSM(cfg *protos.Configuration, id, state string, history ...*protos.Event) {
+	_, err := svc.PutFiniteStateMachine(context.Background(), &protos.PutFsmRequest{
+		Id:  id,
+		Fsm: &protos.FiniteStateMachine{ConfigId: api.GetVersionId(cfg), State: state, History: history},
+	})
+	Ω(err).ToNot(HaveOccurred())
+}
+
+// getFSM returns the FSM `id`, configured with `cfg`.
+func getFSM(cfg *protos.Configuration, id string) (*protos.FiniteStateMachine, error) {
+	return svc.GetFiniteStateMachine(context.Background(), &protos.GetFsmRequest{
+		Config: cfg.Name,
+		Query:  &protos.GetFsmRequest_Id{Id: id},
+	})
+}
+
+var _ = Describe("Commands", func() {
+	Context("migrating FSMs", func() {
+		var v1, v2 *protos.Configuration
+		BeforeEach(func() {
+			v1 = putConfig("cli-migrate", "v1", "start", "pending", "end")
+			v2 = putConfig("cli-migrate", "v2", "start", "waiting", "end")
+			putFSM(v1, "fsm-1", "start")
+			putFSM(v1, "fsm-2", "pending")
+			putFSM(v1, "fsm-3", "pending")
+		})
+		It("refuses to leave FSMs in states which were removed", func() {
+			Ω(svc.Migrate("cli-migrate:v1", "cli-migrate:v2", nil, "", "", 0, "")).ToNot(Succeed())
+			fsm, err := getFSM(v1, "fsm-2")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(fsm.ConfigId).To(Equal("cli-migrate:v1"))
+		})
+		It("moves all the FSMs, mapping their states", func() {
+			out, err := output(func() error {
+				return svc.Migrate("cli-migrate:v1", "cli-migrate:v2", []string{"pending=waiting"},
+					"", "", 1, "")
+			})
+			Ω(err).ToNot(HaveOccurred())
+			Ω(out).To(ContainSubstring("Migrated 3 FSMs"))
+			fsm, err := getFSM(v2, "fsm-2")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(fsm.ConfigId).To(Equal("cli-migrate:v2"))
+			Ω(fsm.State).To(Equal("waiting"))
+		})
+		It("can move a single FSM", func() {
+			Ω(svc.Migrate("cli-migrate:v1", "cli-migrate:v2", []string{"pending=waiting"},
+				"fsm-3", "", 0, "")).To(Succeed())
+			for id, version := range map[string]string{"fsm-1": "v1", "fsm-3": "v2"} {
+				fsm, err := getFSM(v1, id)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(fsm.ConfigId).To(Equal("cli-migrate:" + version))
+			}
+		})
+		It("rejects malformed state mappings", func() {
+			Ω(svc.Migrate("cli-migrate:v1", "cli-migrate:v2", []string{"pending"}, "", "", 0, "")).
+				To(MatchError(ContainSubstring("`old=new`")))
+		})
+	})
+	Context("diffing Configurations", func() {
+		BeforeEach(func() {
+			v1 := putConfig("cli-diff", "v1", "start", "pending", "end")
+			putConfig("cli-diff", "v2", "start", "waiting", "end")
+			putFSM(v1, "fsm-1", "pending")
+		})
+		It("prints the differences, and the FSMs which would be orphaned", func() {
+			out, err := output(func() error { return svc.Diff("cli-diff:v1", "cli-diff:v2") })
+			Ω(err).ToNot(HaveOccurred())
+			Ω(out).To(ContainSubstring("waiting"))
+			Ω(out).To(ContainSubstring("pending: 1"))
+			Ω(out).To(ContainSubstring("WARN: FSMs in states removed from cli-diff:v2 would be orphaned"))
+		})
+		It("fails for missing Configurations", func() {
+			Ω(svc.Diff("cli-diff:v1", "")).ToNot(Succeed())
+			Ω(svc.Diff("cli-diff:v1", "cli-diff:v3")).To(MatchError(ContainSubstring("NotFound")))
+		})
+	})
+	Context("drawing Configurations", func() {
+		BeforeEach(func() {
+			cfg := putConfig("cli-graph", "v1", "start", "pending", "end")
+			putFSM(cfg, "fsm-1", "pending")
+		})
+		It("prints the diagram in the given format", func() {
+			out, err := output(func() error { return svc.Graph("cli-graph:v1", "", "mermaid") })
+			Ω(err).ToNot(HaveOccurred())
+			Ω(out).To(ContainSubstring("start --> pending : next"))
+			out, err = output(func() error { return svc.Graph("cli-graph:v1", "fsm-1", "dot") })
+			Ω(err).ToNot(HaveOccurred())
+			Ω(out).To(HavePrefix("digraph"))
+		})
+		It("fails for unknown formats and FSMs", func() {
+			Ω(svc.Graph("cli-graph:v1", "", "svg")).ToNot(Succeed())
+			Ω(svc.Graph("cli-graph:v1", "fake", "dot")).To(MatchError(ContainSubstring("NotFound")))
+			Ω(svc.Graph("", "", "dot")).ToNot(Succeed())
+		})
+	})
+	Context("converting Configurations to and from SCXML", func() {
+		var dir string
+		BeforeEach(func() {
+			putConfig("cli-scxml", "v1", "start", "pending", "end")
+			var err error
+			dir, err = os.MkdirTemp("", "fsm-cli")
+			Ω(err).ToNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			Ω(os.RemoveAll(dir)).To(Succeed())
+		})
+		It("exports Configurations, which can be imported again", func() {
+			out, err := output(func() error { return svc.ExportSCXML("cli-scxml:v1") })
+			Ω(err).ToNot(HaveOccurred())
+			Ω(out).To(ContainSubstring("<scxml"))
+			path := filepath.Join(dir, "cli-scxml.scxml")
+			Ω(os.WriteFile(path, []byte(out), 0644)).To(Succeed())
+
+			_, err = output(func() error { return svc.ImportSCXML(path, "v1") })
+			Ω(err).To(MatchError(ContainSubstring("AlreadyExists")))
+			_, err = output(func() error { return svc.ImportSCXML(path, "v2") })
+			Ω(err).ToNot(HaveOccurred())
+			cfg, err := svc.GetConfiguration(context.Background(), &wrapperspb.StringValue{Value: "cli-scxml:v2"})
+			Ω(err).ToNot(HaveOccurred())
+			Ω(cfg.States).To(ConsistOf("start", "pending", "end"))
+			Ω(cfg.StartingState).To(Equal("start"))
+		})
+		It("fails for missing Configurations and documents", func() {
+			Ω(svc.ExportSCXML("cli-scxml:v3")).To(MatchError(ContainSubstring("NotFound")))
+			Ω(svc.ImportSCXML("missing.scxml", "v3")).ToNot(Succeed())
+			Ω(svc.ImportSCXML("missing.scxml", "")).ToNot(Succeed())
+		})
+	})
+	Context("simulating Configurations", func() {
+		var dir string
+		BeforeEach(func() {
+			var err error
+			dir, err = os.MkdirTemp("", "fsm-cli")
+			Ω(err).ToNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			Ω(os.RemoveAll(dir)).To(Succeed())
+		})
+		It("sends the events offline, and checks their outcomes", func() {
+			out, err := output(func() error {
+				return client.Simulate("../../data/config.yaml", "../../data/simulation.yaml")
+			})
+			Ω(err).ToNot(HaveOccurred())
+			Ω(out).To(ContainSubstring("fulfill"))
+		})
+		It("fails if an outcome is not the expected one", func() {
+			path := filepath.Join(dir, "events.yaml")
+			Ω(os.WriteFile(path, []byte("- event: accept\n  state: shipped\n"), 0644)).To(Succeed())
+			_, err := output(func() error { return client.Simulate("../../data/config.yaml", path) })
+			Ω(err).To(MatchError(ContainSubstring("1 unexpected outcomes")))
+			Ω(client.Simulate("../../data/order.yaml", path)).ToNot(Succeed())
+		})
+	})
+	Context("verifying and repairing FSMs", func() {
+		var cfg *protos.Configuration
+		BeforeEach(func() {
+			cfg = putConfig("cli-verify", "v1", "start", "pending", "end")
+			putFSM(cfg, "fsm-1", "pending", &protos.Event{
+				Transition: &protos.Transition{From: "start", To: "pending", Event: "next"},
+			})
+			// The FSM's history does not agree with its state.
+			putFSM(cfg, "fsm-2", "start", &protos.Event{
+				Transition: &protos.Transition{From: "start", To: "pending", Event: "next"},
+			})
+		})
+		It("reports the FSMs which do not agree with their history", func() {
+			out, err := output(func() error { return svc.Verify("cli-verify", nil, false) })
+			Ω(err).ToNot(HaveOccurred())
+			Ω(out).To(ContainSubstring("Verified 2 FSMs, 1 inconsistent"))
+			Ω(out).To(ContainSubstring("fsm-2"))
+			fsm, err := getFSM(cfg, "fsm-2")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(fsm.State).To(Equal("start"))
+		})
+		It("repairs them", func() {
+			out, err := output(func() error { return svc.Verify("cli-verify", []string{"fsm-2"}, true) })
+			Ω(err).ToNot(HaveOccurred())
+			Ω(out).To(ContainSubstring("Verified 1 FSMs, 1 inconsistent"))
+			fsm, err := getFSM(cfg, "fsm-2")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(fsm.State).To(Equal("pending"))
+		})
+		It("needs a Configuration", func() {
+			Ω(svc.Verify("", nil, false)).ToNot(Succeed())
+		})
+	})
+	Context("rolling back FSMs", func() {
+		var cfg *protos.Configuration
+		BeforeEach(func() {
+			cfg = putConfig("cli-rollback", "v1", "start", "pending", "end")
+			putFSM(cfg, "fsm-1", "end", &protos.Event{
+				Transition: &protos.Transition{From: "start", To: "pending", Event: "next"},
+			}, &protos.Event{
+				Transition: &protos.Transition{From: "pending", To: "end", Event: "next"},
+			})
+		})
+		It("reverts the last transitions of an FSM", func() {
+			out, err := output(func() error { return svc.Rollback("cli-rollback/fsm-1", "") })
+			Ω(err).ToNot(HaveOccurred())
+			Ω(out).To(ContainSubstring("now in state pending"))
+			Ω(svc.Rollback("cli-rollback/fsm-1", "1")).To(Succeed())
+			fsm, err := getFSM(cfg, "fsm-1")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(fsm.State).To(Equal("start"))
+			Ω(svc.Rollback("cli-rollback/fsm-1", "1")).To(MatchError(ContainSubstring("FailedPrecondition")))
+		})
+		It("fails for malformed IDs and steps", func() {
+			Ω(svc.Rollback("fsm-1", "1")).ToNot(Succeed())
+			Ω(svc.Rollback("cli-rollback/fsm-1", "0")).ToNot(Succeed())
+			Ω(svc.Rollback("cli-rollback/fsm-1", "two")).ToNot(Succeed())
+			Ω(svc.Rollback("cli-rollback/fake", "1")).To(MatchError(ContainSubstring("NotFound")))
+		})
+	})
+	Context("deleting entities", func() {
+		var cfg *protos.Configuration
+		BeforeEach(func() {
+			cfg = putConfig("cli-delete", "v1", "start", "pending", "end")
+			putFSM(cfg, "fsm-1", "start")
+		})
+		It("removes FSMs", func() {
+			out, err := output(func() error {
+				return svc.Delete(client.KindFiniteStateMachine, "cli-delete/fsm-1", false)
+			})
+			Ω(err).ToNot(HaveOccurred())
+			Ω(out).To(ContainSubstring("FiniteStateMachine cli-delete/fsm-1 deleted"))
+			_, err = getFSM(cfg, "fsm-1")
+			Ω(err).To(MatchError(ContainSubstring("NotFound")))
+		})
+		It("only removes Configurations in use if forced to", func() {
+			Ω(svc.Delete(client.KindConfiguration, "cli-delete:v1", false)).
+				To(MatchError(ContainSubstring("FailedPrecondition")))
+			_, err := output(func() error { return svc.Delete(client.KindConfiguration, "cli-delete:v1", true) })
+			Ω(err).ToNot(HaveOccurred())
+			_, err = svc.GetConfiguration(context.Background(), &wrapperspb.StringValue{Value: "cli-delete:v1"})
+			Ω(err).To(MatchError(ContainSubstring("NotFound")))
+		})
+		It("fails for unknown kinds and malformed IDs", func() {
+			Ω(svc.Delete("fsm", "cli-delete/fsm-1", false)).ToNot(Succeed())
+			Ω(svc.Delete(client.KindEvent, "event-id", false)).ToNot(Succeed())
+			Ω(svc.Delete(client.KindEvent, "cli-delete/fake", false)).To(MatchError(ContainSubstring("NotFound")))
+		})
+	})
+})
@@ -10,7 +10,10 @@
 package client
 
 import (
+	"fmt"
+	"github.com/massenz/go-statemachine/pkg/grpc"
 	protos "github.com/massenz/statemachine-proto/golang/api"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"os"
@@ -24,9 +27,19 @@ const (
 	KindFiniteStateMachine = "FiniteStateMachine"
 	KindEvent              = "EventRequest"
 
-	CmdGet     = "get"
-	CmdSend    = "send"
-	CmdVersion = "version"
+	CmdDelete      = "delete"
+	CmdDiff        = "diff"
+	CmdExportSCXML = "export-scxml"
+	CmdGet         = "get"
+	CmdGraph       = "graph"
+	CmdImportSCXML = "import-scxml"
+	CmdMigrate     = "migrate"
+	CmdRepair      = "repair"
+	CmdRollback    = "rollback"
+	CmdSend        = "send"
+	CmdSimulate    = "simulate"
+	CmdVerify      = "verify"
+	CmdVersion     = "version"
 
 	StdinFlag = "--"
 )
@@ -79,4 +92,21 @@ func getStatusCode(response interface{}) codes.Code {
 
 type CliClient struct {
 	protos.StatemachineServiceClient
+	Admin *grpc.AdminClient
+}
+
+// printViolations prints all the problems reported by the server for an invalid
+// entity (e.g., the validation errors for a Configuration), one per line.
+func printViolations(err error) {
+	s, ok := status.FromError(err)
+	if !ok {
+		return
+	}
+	for _, detail := range s.Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, v := range badRequest.GetFieldViolations() {
+				fmt.Printf("- [%s] %s\n", v.GetField(), v.GetDescription())
+			}
+		}
+	}
 }
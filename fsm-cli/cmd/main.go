@@ -27,13 +27,32 @@ var (
 )
 
 func main() {
+	var batchSize = flag.Int("batch-size", 0,
+		"The number of FSMs moved at a time by the `migrate` command (by default, 100)")
+	var cursor = flag.String("cursor", "",
+		"The cursor from which the `migrate` command resumes an interrupted migration")
+	var force = flag.Bool("force", false,
+		"If set, the `delete` command removes Configurations even if FSMs still use them")
+	var format = flag.String("format", "dot",
+		"The format of the diagrams generated by the `graph` command: dot, mermaid or plantuml")
+	var fsmId = flag.String("id", "", "If set, the `migrate` command only moves this FSM")
 	var insecure = flag.Bool("insecure", false, "If set, TLS will be disabled (NOT recommended)")
 	var serverAddr = flag.String("addr", "localhost:7398",
 		"The address (host:port) for the gRPC server")
+	var state = flag.String("state", "", "If set, the `migrate` command only moves the FSMs in this state")
 
 	flag.Parse()
 	cmd := strings.ToLower(flag.Arg(0))
 
+	// Simulations run offline, and do not need a server.
+	if cmd == CmdSimulate {
+		if err := Simulate(flag.Arg(1), flag.Arg(2)); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	c := NewClient(*serverAddr, !*insecure)
 	if c == nil {
 		fmt.Printf("cannot connect to server at %s", *serverAddr)
@@ -48,8 +67,25 @@ func main() {
 	switch cmd {
 	case CmdSend:
 		err = c.Send(flag.Arg(1))
+	case CmdDelete:
+		err = c.Delete(flag.Arg(1), flag.Arg(2), *force)
+	case CmdDiff:
+		err = c.Diff(flag.Arg(1), flag.Arg(2))
+	case CmdExportSCXML:
+		err = c.ExportSCXML(flag.Arg(1))
 	case CmdGet:
 		err = c.Get(flag.Arg(1), flag.Arg(2))
+	case CmdGraph:
+		err = c.Graph(flag.Arg(1), flag.Arg(2), *format)
+	case CmdImportSCXML:
+		err = c.ImportSCXML(flag.Arg(1), flag.Arg(2))
+	case CmdMigrate:
+		err = c.Migrate(flag.Arg(1), flag.Arg(2), flag.Args()[min(3, flag.NArg()):], *fsmId, *state,
+			*batchSize, *cursor)
+	case CmdRollback:
+		err = c.Rollback(flag.Arg(1), flag.Arg(2))
+	case CmdVerify, CmdRepair:
+		err = c.Verify(flag.Arg(1), flag.Args()[min(2, flag.NArg()):], cmd == CmdRepair)
 	case CmdVersion:
 		fmt.Println("FSM CLI Client Rel.", Release)
 		fmt.Printf("Connected to Server: %s at %s (%s)\n", r.Release, *serverAddr, r.State)
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api
+
+import (
+	"strings"
+
+	"github.com/google/uuid"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+// ActionKind describes what caused an Action to be dispatched.
+type ActionKind string
+
+const (
+	EntryAction      ActionKind = "entry"
+	ExitAction       ActionKind = "exit"
+	TransitionAction ActionKind = "transition"
+)
+
+// An Action is a side effect of a transition, dispatched to the workers that need to react
+// to it (see ProcessEvent): it carries the details of the transition which caused it and,
+// for entry and exit actions, the `State` entered or left.
+type Action struct {
+	Id      string     `json:"id"`
+	Name    string     `json:"name"`
+	Kind    ActionKind `json:"kind"`
+	State   string     `json:"state,omitempty"`
+	FsmId   string     `json:"fsm_id"`
+	Config  string     `json:"config"`
+	EventId string     `json:"event_id"`
+	Event   string     `json:"event"`
+	From    string     `json:"from"`
+	To      string     `json:"to"`
+}
+
+// IsActivity returns true if the Transition declares the entry or exit actions of its
+// origin state, following the UML notation for internal activities, with no destination:
+//
+//	{from: shipped, event: "entry / notify_customer, update_inventory"}
+//	{from: shipped, event: "exit / archive"}
+func IsActivity(t *protos.Transition) bool {
+	if t.GetTo() != "" {
+		return false
+	}
+	name := strings.TrimSpace(t.GetEvent())
+	if i := strings.IndexAny(name, " "+GuardStart+ActionsStart); i >= 0 {
+		name = name[:i]
+	}
+	return name == string(EntryAction) || name == string(ExitAction)
+}
+
+// IsInternal returns true for internal transitions, which have no destination (and are
+// not activities): they are recorded in the FSM's history and cause their Actions, but
+// the FSM does not leave its state, so no exit or entry actions are caused, and no timers
+// are restarted.
+//
+//	{from: shipped, event: "track / update_eta"}
+func IsInternal(t *protos.Transition) bool {
+	return t.GetTo() == "" && !IsActivity(t)
+}
+
+// StateActions returns the names of the actions of the given `kind` (either entry or exit)
+// declared for `state`.
+func StateActions(c *protos.Configuration, state string, kind ActionKind) []string {
+	var actions []string
+	for _, t := range c.Transitions {
+		if !IsActivity(t) || !FromState(c, t, state) {
+			continue
+		}
+		trigger, err := ParseTrigger(t.Event)
+		if err != nil || trigger.Event != string(kind) {
+			continue
+		}
+		actions = append(actions, trigger.Actions...)
+	}
+	return actions
+}
+
+// newActions returns the Actions caused by the `evt`, which moved the FSM along the
+// transition whose Trigger is `trigger`: the exit actions of the states left, then the
+// transition's own, and finally the entry actions of the states entered.
+func (x *ConfiguredStateMachine) newActions(evt *protos.Event, trigger *Trigger,
+	exited, entered []string) []*Action {
+	from, to := evt.Transition.From, evt.Transition.To
+	var actions []*Action
+	add := func(kind ActionKind, state string, names []string) {
+		for _, name := range names {
+			actions = append(actions, &Action{
+				Id:      uuid.NewString(),
+				Name:    name,
+				Kind:    kind,
+				State:   state,
+				Config:  x.FSM.ConfigId,
+				EventId: evt.EventId,
+				Event:   trigger.Event,
+				From:    from,
+				To:      to,
+			})
+		}
+	}
+	for _, state := range exited {
+		add(ExitAction, state, StateActions(x.Config, state, ExitAction))
+	}
+	add(TransitionAction, "", trigger.Actions)
+	for _, state := range entered {
+		add(EntryAction, state, StateActions(x.Config, state, EntryAction))
+	}
+	return actions
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api_test
+
+import (
+	. "github.com/massenz/go-statemachine/pkg/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("Actions", func() {
+	var orders *protos.Configuration
+	BeforeEach(func() {
+		orders = &protos.Configuration{
+			Name:          "orders",
+			Version:       "v1",
+			StartingState: "pending",
+			States:        []string{"pending", "shipping", "shipping/packing", "shipping/transit", "delivered"},
+			Transitions: []*protos.Transition{
+				{From: "pending", To: "shipping/packing", Event: "accept [amount > 0] / charge, notify"},
+				{From: "shipping/packing", To: "shipping/transit", Event: "pack"},
+				{From: "shipping/transit", To: "delivered", Event: "deliver / notify"},
+				{From: "pending", Event: "exit / log"},
+				{From: "shipping", Event: "entry / reserve_truck"},
+				{From: "shipping", Event: "exit / release_truck"},
+				{From: "shipping/transit", Event: "entry / track"},
+			},
+		}
+	})
+	It("can be parsed from the transitions", func() {
+		t, err := ParseTrigger("accept [amount > 0] / charge, notify")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.Event).To(Equal("accept"))
+		Expect(t.Guard.String()).To(Equal("amount > 0"))
+		Expect(t.Actions).To(Equal([]string{"charge", "notify"}))
+
+		t, err = ParseTrigger("deliver/notify")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.Event).To(Equal("deliver"))
+		Expect(t.Actions).To(Equal([]string{"notify"}))
+
+		for _, label := range []string{"deliver /", "deliver / notify,", "/ notify", "deliver [a] notify"} {
+			_, err = ParseTrigger(label)
+			Expect(err).To(HaveOccurred(), label)
+		}
+	})
+	It("are valid", func() {
+		Expect(Validate(orders).Errors()).To(BeEmpty())
+		Expect(StateActions(orders, "shipping", EntryAction)).To(Equal([]string{"reserve_truck"}))
+	})
+	It("must be declared on entry or exit of known states", func() {
+		orders.Transitions = append(orders.Transitions,
+			&protos.Transition{From: "pending", Event: "entry [ready] / poll"},
+			&protos.Transition{From: "delivered", Event: "entry"},
+			&protos.Transition{From: "unknown", Event: "entry / poll"})
+		errs := Validate(orders).Errors()
+		Expect(errs).To(HaveLen(3))
+		Expect(errs[0].State).To(Equal("pending"))
+		Expect(errs[1].State).To(Equal("delivered"))
+		Expect(errs[2].State).To(Equal("unknown"))
+	})
+	It("are returned in order when processing events", func() {
+		fsm, err := NewStateMachine(orders)
+		Expect(err).ToNot(HaveOccurred())
+		evt := NewEvent("accept")
+		evt.Details = `{"amount": 10}`
+		effects, err := fsm.ProcessEvent(evt)
+		Expect(err).ToNot(HaveOccurred())
+		actions := effects.Actions
+		var names []string
+		for _, a := range actions {
+			names = append(names, a.Name)
+			Expect(a.Id).ToNot(BeEmpty())
+			Expect(a.Config).To(Equal("orders:v1"))
+			Expect(a.EventId).To(Equal(evt.EventId))
+			Expect(a.Event).To(Equal("accept"))
+			Expect(a.From).To(Equal("pending"))
+			Expect(a.To).To(Equal("shipping/packing"))
+		}
+		Expect(names).To(Equal([]string{"log", "charge", "notify", "reserve_truck"}))
+		Expect(actions[0].Kind).To(Equal(ExitAction))
+		Expect(actions[0].State).To(Equal("pending"))
+		Expect(actions[1].Kind).To(Equal(TransitionAction))
+		Expect(actions[3].Kind).To(Equal(EntryAction))
+		Expect(actions[3].State).To(Equal("shipping"))
+
+		effects, err = fsm.ProcessEvent(NewEvent("pack"))
+		Expect(err).ToNot(HaveOccurred())
+		actions = effects.Actions
+		Expect(actions).To(HaveLen(1))
+		Expect(actions[0].Name).To(Equal("track"))
+	})
+	It("are not triggered by events named after them", func() {
+		fsm, _ := NewStateMachine(orders)
+		Expect(fsm.SendEvent(NewEvent("exit"))).To(MatchError(UnexpectedTransitionError))
+	})
+})
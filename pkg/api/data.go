@@ -0,0 +1,258 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+const (
+	// DataFieldNumber is the field number under which the FSM's data (see GetData) is
+	// serialized along with the FiniteStateMachine: the message does not declare it, so
+	// the data is preserved (and sent over the wire) as one of its unknown fields.
+	//
+	// The number is well above those of the message's own fields, and must be reserved
+	// should the message ever declare new ones. Only the binary encoding preserves unknown
+	// fields: the JSON one (see protojson) drops them, so FSMs converted to JSON and back
+	// lose their data.
+	DataFieldNumber protowire.Number = 100
+
+	// DataScopeKey is the name under which the FSM's data is made available to guard
+	// expressions (e.g., `$data.total > 1000`).
+	DataScopeKey = "$data"
+
+	DataUpdateStart = "("
+	DataUpdateEnd   = ")"
+)
+
+// DataOp is the operation carried out on the FSM's data by a DataUpdate.
+type DataOp string
+
+const (
+	// DataSet sets the field to the value of the field with the same name in the event's
+	// `Details`, if present.
+	DataSet DataOp = "set"
+	// DataIncr increments the (numeric) field by the value of the field with the same name
+	// in the event's `Details`, or by 1 if not present.
+	DataIncr DataOp = "incr"
+	// DataMerge merges all the fields of the event's `Details` (or, if a field is given, of
+	// the object with that name) into the data.
+	DataMerge DataOp = "merge"
+)
+
+var InvalidDataUpdateError = "cannot %s field `%s`: %v"
+
+// A DataUpdate changes the FSM's data when a transition is taken; it is declared among the
+// transition's actions, using a function-like notation:
+//
+//	pay [amount > 0] / set(currency), incr(total), incr(payments), notify
+type DataUpdate struct {
+	Op    DataOp
+	Field string
+}
+
+func (u DataUpdate) String() string {
+	return string(u.Op) + DataUpdateStart + u.Field + DataUpdateEnd
+}
+
+// IsDataUpdate returns true if the action uses the DataUpdate notation, with one of the
+// DataOp verbs; any other action (e.g., `notify(ops)`) is dispatched as is.
+func IsDataUpdate(action string) bool {
+	start := strings.Index(action, DataUpdateStart)
+	if start < 0 || !strings.HasSuffix(action, DataUpdateEnd) {
+		return false
+	}
+	switch DataOp(strings.TrimSpace(action[:start])) {
+	case DataSet, DataIncr, DataMerge:
+		return true
+	}
+	return false
+}
+
+// ParseDataUpdate parses an action in the `op(field)` notation into a DataUpdate.
+func ParseDataUpdate(action string) (*DataUpdate, error) {
+	start := strings.Index(action, DataUpdateStart)
+	if start < 0 || !strings.HasSuffix(action, DataUpdateEnd) {
+		return nil, fmt.Errorf("`%s` is not a data update, must be `op(field)`", action)
+	}
+	update := &DataUpdate{
+		Op:    DataOp(strings.TrimSpace(action[:start])),
+		Field: strings.TrimSpace(action[start+1 : len(action)-len(DataUpdateEnd)]),
+	}
+	switch update.Op {
+	case DataSet, DataIncr:
+		if update.Field == "" {
+			return nil, fmt.Errorf("missing field name in `%s`", action)
+		}
+	case DataMerge:
+	default:
+		return nil, fmt.Errorf("unknown data update `%s` in `%s`, must be one of %s, %s or %s",
+			update.Op, action, DataSet, DataIncr, DataMerge)
+	}
+	return update, nil
+}
+
+// Apply carries out the DataUpdate on `data`, using the event's `details`.
+func (u DataUpdate) Apply(data, details map[string]interface{}) error {
+	value, found := details[u.Field]
+	switch u.Op {
+	case DataSet:
+		if found {
+			data[u.Field] = value
+		}
+	case DataIncr:
+		step := 1.0
+		if found {
+			n, ok := value.(float64)
+			if !ok {
+				return fmt.Errorf(InvalidDataUpdateError, u.Op, u.Field, "the event's value is not a number")
+			}
+			step = n
+		}
+		current, ok := data[u.Field].(float64)
+		if !ok && data[u.Field] != nil {
+			return fmt.Errorf(InvalidDataUpdateError, u.Op, u.Field, "the current value is not a number")
+		}
+		data[u.Field] = current + step
+	case DataMerge:
+		if u.Field == "" {
+			for k, v := range details {
+				data[k] = v
+			}
+			return nil
+		}
+		if !found {
+			return nil
+		}
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf(InvalidDataUpdateError, u.Op, u.Field, "the event's value is not an object")
+		}
+		target, ok := data[u.Field].(map[string]interface{})
+		if !ok {
+			target = make(map[string]interface{})
+		}
+		for k, v := range fields {
+			target[k] = v
+		}
+		data[u.Field] = target
+	}
+	return nil
+}
+
+// GetData returns the FSM's data, the document its transitions keep up to date, which is
+// empty if none was ever set.
+func GetData(fsm *protos.FiniteStateMachine) (*structpb.Struct, error) {
+	data := &structpb.Struct{}
+	value, err := getUnknownField(fsm, DataFieldNumber)
+	if err != nil || value == nil {
+		return data, err
+	}
+	if err = proto.Unmarshal(value, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// SetData replaces the FSM's data; a `nil` (or empty) `data` removes it.
+func SetData(fsm *protos.FiniteStateMachine, data *structpb.Struct) error {
+	var value []byte
+	if len(data.GetFields()) > 0 {
+		var err error
+		if value, err = proto.Marshal(data); err != nil {
+			return err
+		}
+	}
+	return setUnknownField(fsm, DataFieldNumber, value)
+}
+
+// getUnknownField returns the (last) value of the length-delimited field `num`, among the
+// FSM's unknown fields, or `nil` if there is none.
+func getUnknownField(fsm *protos.FiniteStateMachine, num protowire.Number) ([]byte, error) {
+	var value []byte
+	unknown := fsm.ProtoReflect().GetUnknown()
+	for len(unknown) > 0 {
+		n, typ, tagLen := protowire.ConsumeTag(unknown)
+		if tagLen < 0 {
+			return nil, protowire.ParseError(tagLen)
+		}
+		valueLen := protowire.ConsumeFieldValue(n, typ, unknown[tagLen:])
+		if valueLen < 0 {
+			return nil, protowire.ParseError(valueLen)
+		}
+		if n == num && typ == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(unknown[tagLen : tagLen+valueLen])
+		}
+		unknown = unknown[tagLen+valueLen:]
+	}
+	return value, nil
+}
+
+// setUnknownField replaces the value of the length-delimited field `num`, among the FSM's
+// unknown fields; a `nil` `value` removes it.
+func setUnknownField(fsm *protos.FiniteStateMachine, num protowire.Number, value []byte) error {
+	var fields []byte
+	unknown := fsm.ProtoReflect().GetUnknown()
+	for len(unknown) > 0 {
+		n, typ, tagLen := protowire.ConsumeTag(unknown)
+		if tagLen < 0 {
+			return protowire.ParseError(tagLen)
+		}
+		valueLen := protowire.ConsumeFieldValue(n, typ, unknown[tagLen:])
+		if valueLen < 0 {
+			return protowire.ParseError(valueLen)
+		}
+		if n != num {
+			fields = append(fields, unknown[:tagLen+valueLen]...)
+		}
+		unknown = unknown[tagLen+valueLen:]
+	}
+	if value != nil {
+		fields = protowire.AppendTag(fields, num, protowire.BytesType)
+		fields = protowire.AppendBytes(fields, value)
+	}
+	fsm.ProtoReflect().SetUnknown(fields)
+	return nil
+}
+
+// updateData carries out the `updates` on the FSM's data, using the `evt`'s `Details` (if
+// they are a JSON object); the FSM is left unchanged if any of them fails.
+func (x *ConfiguredStateMachine) updateData(evt *protos.Event, updates []DataUpdate) error {
+	current, err := GetData(x.FSM)
+	if err != nil {
+		return err
+	}
+	data := current.AsMap()
+	details := make(map[string]interface{})
+	if evt.GetDetails() != "" {
+		if err := json.Unmarshal([]byte(evt.GetDetails()), &details); err != nil {
+			Logger.Debug().Msgf("event details are not a JSON object, ignored by data updates: %v", err)
+			details = make(map[string]interface{})
+		}
+	}
+	for _, u := range updates {
+		if err := u.Apply(data, details); err != nil {
+			return err
+		}
+	}
+	updated, err := structpb.NewStruct(data)
+	if err != nil {
+		return err
+	}
+	return SetData(x.FSM, updated)
+}
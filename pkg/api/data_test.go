@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api_test
+
+import (
+	. "github.com/massenz/go-statemachine/pkg/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("FSM data", func() {
+	var orders *protos.Configuration
+	BeforeEach(func() {
+		orders = &protos.Configuration{
+			Name:          "orders",
+			Version:       "v1",
+			StartingState: "pending",
+			States:        []string{"pending", "paid"},
+			Transitions: []*protos.Transition{
+				{From: "pending", Event: "pay / incr(total), incr(payments), set(currency), notify"},
+				{From: "pending", Event: "address / merge(shipping)"},
+				{From: "pending", To: "paid", Event: "close [$data.total >= 100]"},
+				{From: "paid", To: FinalState},
+			},
+		}
+	})
+	pay := func(details string) *protos.Event {
+		evt := NewEvent("pay")
+		evt.Details = details
+		return evt
+	}
+	It("parses the updates among the actions", func() {
+		trigger, err := ParseTrigger(orders.Transitions[0].Event)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(trigger.Actions).To(Equal([]string{"notify"}))
+		Expect(trigger.Updates).To(Equal([]DataUpdate{
+			{Op: DataIncr, Field: "total"},
+			{Op: DataIncr, Field: "payments"},
+			{Op: DataSet, Field: "currency"},
+		}))
+		for _, label := range []string{"pay / set()", "pay / incr( )", "/ merge()"} {
+			_, err := ParseTrigger(label)
+			Expect(err).To(HaveOccurred(), label)
+		}
+	})
+	It("only parses the data update verbs as updates", func() {
+		trigger, err := ParseTrigger("pay / notify(ops), add(total), incr (total)")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(trigger.Actions).To(Equal([]string{"notify(ops)", "add(total)"}))
+		Expect(trigger.Updates).To(Equal([]DataUpdate{{Op: DataIncr, Field: "total"}}))
+	})
+	It("is empty for new FSMs", func() {
+		fsm, _ := NewStateMachine(orders)
+		data, err := GetData(fsm.FSM)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data.GetFields()).To(BeEmpty())
+	})
+	It("is updated by transitions, and used by guards", func() {
+		fsm, _ := NewStateMachine(orders)
+		Expect(fsm.SendEvent(pay(`{"total": 60, "currency": "USD"}`))).To(Succeed())
+		Expect(fsm.SendEvent(NewEvent("close"))).To(MatchError(GuardNotSatisfiedError))
+		Expect(fsm.SendEvent(pay(`{"total": 40}`))).To(Succeed())
+		evt := NewEvent("address")
+		evt.Details = `{"shipping": {"city": "Paris"}}`
+		Expect(fsm.SendEvent(evt)).To(Succeed())
+
+		data, err := GetData(fsm.FSM)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data.AsMap()).To(Equal(map[string]interface{}{
+			"total":    100.0,
+			"payments": 2.0,
+			"currency": "USD",
+			"shipping": map[string]interface{}{"city": "Paris"},
+		}))
+		Expect(fsm.SendEvent(NewEvent("close"))).To(Succeed())
+		Expect(fsm.FSM.State).To(Equal("paid"))
+	})
+	It("leaves the FSM unchanged if an update fails", func() {
+		fsm, _ := NewStateMachine(orders)
+		Expect(fsm.SendEvent(pay(`{"total": 10}`))).To(Succeed())
+		Expect(fsm.SendEvent(pay(`{"total": "ten"}`))).To(HaveOccurred())
+		Expect(fsm.FSM.History).To(HaveLen(1))
+		data, _ := GetData(fsm.FSM)
+		Expect(data.AsMap()["total"]).To(Equal(10.0))
+	})
+	It("is serialized along with the FSM", func() {
+		fsm, _ := NewStateMachine(orders)
+		data, _ := structpb.NewStruct(map[string]interface{}{"total": 42.0})
+		Expect(SetData(fsm.FSM, data)).To(Succeed())
+		bytes, err := proto.Marshal(fsm.FSM)
+		Expect(err).ToNot(HaveOccurred())
+
+		var restored protos.FiniteStateMachine
+		Expect(proto.Unmarshal(bytes, &restored)).To(Succeed())
+		Expect(restored.State).To(Equal("pending"))
+		restoredData, err := GetData(&restored)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(restoredData.AsMap()).To(Equal(data.AsMap()))
+
+		Expect(SetData(&restored, nil)).To(Succeed())
+		restoredData, _ = GetData(&restored)
+		Expect(restoredData.GetFields()).To(BeEmpty())
+	})
+	It("is dropped when the FSM is converted to JSON", func() {
+		fsm, _ := NewStateMachine(orders)
+		Expect(fsm.SendEvent(pay(`{"total": 60}`))).To(Succeed())
+		jsonBytes, err := protojson.Marshal(fsm.FSM)
+		Expect(err).ToNot(HaveOccurred())
+
+		var restored protos.FiniteStateMachine
+		Expect(protojson.Unmarshal(jsonBytes, &restored)).To(Succeed())
+		Expect(restored.State).To(Equal("pending"))
+		Expect(restored.History).To(HaveLen(1))
+		data, err := GetData(&restored)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data.GetFields()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api
+
+import (
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+// A ConfigDiff describes what changed between two versions of a Configuration.
+//
+// `Orphaned` is only filled in by CountOrphaned, with the number of FSMs currently in each of
+// the `RemovedStates`, which could not be processed (or migrated, see Migration) without
+// mapping them to one of the new version's states.
+type ConfigDiff struct {
+	From               string               `json:"from"`
+	To                 string               `json:"to"`
+	StartingState      string               `json:"starting_state,omitempty"`
+	AddedStates        []string             `json:"added_states,omitempty"`
+	RemovedStates      []string             `json:"removed_states,omitempty"`
+	AddedTransitions   []*protos.Transition `json:"added_transitions,omitempty"`
+	RemovedTransitions []*protos.Transition `json:"removed_transitions,omitempty"`
+	AddedEvents        []string             `json:"added_events,omitempty"`
+	RemovedEvents      []string             `json:"removed_events,omitempty"`
+	Orphaned           map[string]int       `json:"orphaned,omitempty"`
+}
+
+// DiffConfigurations compares two Configurations (typically, two versions of the same one)
+// and returns what changed from `from` to `to`; `StartingState` is only set if it changed.
+//
+// Transitions are compared by their origin, destination and event (including any guard,
+// timeout and actions), so that a changed transition is reported as removed and added.
+func DiffConfigurations(from, to *protos.Configuration) *ConfigDiff {
+	diff := &ConfigDiff{From: GetVersionId(from), To: GetVersionId(to)}
+	if from.StartingState != to.StartingState {
+		diff.StartingState = to.StartingState
+	}
+	diff.AddedStates = difference(to.States, from.States)
+	diff.RemovedStates = difference(from.States, to.States)
+
+	key := func(t *protos.Transition) string {
+		return t.From + "\x00" + t.To + "\x00" + t.Event
+	}
+	fromTransitions := make(map[string]bool)
+	for _, t := range from.Transitions {
+		fromTransitions[key(t)] = true
+	}
+	toTransitions := make(map[string]bool)
+	for _, t := range to.Transitions {
+		toTransitions[key(t)] = true
+		if !fromTransitions[key(t)] {
+			diff.AddedTransitions = append(diff.AddedTransitions, t)
+		}
+	}
+	for _, t := range from.Transitions {
+		if !toTransitions[key(t)] {
+			diff.RemovedTransitions = append(diff.RemovedTransitions, t)
+		}
+	}
+	diff.AddedEvents = difference(Events(to), Events(from))
+	diff.RemovedEvents = difference(Events(from), Events(to))
+	return diff
+}
+
+// Events returns the names of the events that the Configuration's transitions are
+// triggered by (excluding entry and exit activities), in the order they are first used.
+func Events(c *protos.Configuration) []string {
+	var events []string
+	seen := make(map[string]bool)
+	for _, t := range c.Transitions {
+		if IsFinal(t) || IsActivity(t) {
+			continue
+		}
+		trigger, err := ParseTrigger(t.Event)
+		if err != nil || seen[trigger.Event] {
+			continue
+		}
+		seen[trigger.Event] = true
+		events = append(events, trigger.Event)
+	}
+	return events
+}
+
+// CountOrphaned counts the FSMs in each of the removed states, using `inState` to look them
+// up (e.g., the store's `GetAllInState`).
+func (d *ConfigDiff) CountOrphaned(inState func(state string) []string) {
+	d.Orphaned = make(map[string]int)
+	for _, state := range d.RemovedStates {
+		if count := len(inState(state)); count > 0 {
+			d.Orphaned[state] = count
+		}
+	}
+}
+
+// IsCompatible returns true if no FSM is in any of the removed states (see CountOrphaned).
+func (d *ConfigDiff) IsCompatible() bool {
+	return len(d.Orphaned) == 0
+}
+
+// difference returns the elements of `a` which are not in `b`, in their original order.
+func difference(a, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, s := range b {
+		in[s] = true
+	}
+	var result []string
+	for _, s := range a {
+		if !in[s] {
+			result = append(result, s)
+		}
+	}
+	return result
+}
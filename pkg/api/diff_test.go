@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api_test
+
+import (
+	. "github.com/massenz/go-statemachine/pkg/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("Configuration diffs", func() {
+	var v3, v4 *protos.Configuration
+	BeforeEach(func() {
+		v3 = &protos.Configuration{
+			Name:          "orders",
+			Version:       "v3",
+			StartingState: "pending",
+			States:        []string{"pending", "shipped", "lost", "delivered"},
+			Transitions: []*protos.Transition{
+				{From: "pending", To: "shipped", Event: "ship"},
+				{From: "shipped", To: "lost", Event: "lose"},
+				{From: "shipped", To: "delivered", Event: "deliver"},
+			},
+		}
+		v4 = &protos.Configuration{
+			Name:          "orders",
+			Version:       "v4",
+			StartingState: "pending",
+			States:        []string{"pending", "shipped", "delivered", "returned"},
+			Transitions: []*protos.Transition{
+				{From: "pending", To: "shipped", Event: "ship"},
+				{From: "shipped", To: "delivered", Event: "deliver / notify"},
+				{From: "delivered", To: "returned", Event: "return"},
+			},
+		}
+	})
+	It("reports what changed", func() {
+		diff := DiffConfigurations(v3, v4)
+		Expect(diff.From).To(Equal("orders:v3"))
+		Expect(diff.To).To(Equal("orders:v4"))
+		Expect(diff.StartingState).To(BeEmpty())
+		Expect(diff.AddedStates).To(Equal([]string{"returned"}))
+		Expect(diff.RemovedStates).To(Equal([]string{"lost"}))
+		Expect(diff.AddedTransitions).To(Equal([]*protos.Transition{v4.Transitions[1], v4.Transitions[2]}))
+		Expect(diff.RemovedTransitions).To(Equal([]*protos.Transition{v3.Transitions[1], v3.Transitions[2]}))
+		Expect(diff.AddedEvents).To(Equal([]string{"return"}))
+		Expect(diff.RemovedEvents).To(Equal([]string{"lose"}))
+	})
+	It("is empty for the same Configuration", func() {
+		diff := DiffConfigurations(v3, v3)
+		Expect(diff.AddedStates).To(BeEmpty())
+		Expect(diff.RemovedStates).To(BeEmpty())
+		Expect(diff.AddedTransitions).To(BeEmpty())
+		Expect(diff.RemovedTransitions).To(BeEmpty())
+	})
+	It("counts the orphaned FSMs", func() {
+		diff := DiffConfigurations(v3, v4)
+		diff.CountOrphaned(func(state string) []string {
+			Expect(state).To(Equal("lost"))
+			return []string{"fsm-1", "fsm-2"}
+		})
+		Expect(diff.Orphaned).To(Equal(map[string]int{"lost": 2}))
+		Expect(diff.IsCompatible()).To(BeFalse())
+
+		diff.CountOrphaned(func(string) []string { return nil })
+		Expect(diff.IsCompatible()).To(BeTrue())
+	})
+})
@@ -0,0 +1,453 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Scope holds the named values against which an Expression is evaluated.
+//
+// Identifiers in an expression may use a dotted notation (e.g. `order.amount`) to reach
+// into nested maps, as they would be obtained by unmarshalling a JSON document.
+type Scope map[string]interface{}
+
+// Lookup resolves a (possibly dotted) identifier in the Scope, returning `nil` if any
+// element of the path is missing.
+func (s Scope) Lookup(name string) interface{} {
+	var current interface{} = map[string]interface{}(s)
+	for _, part := range strings.Split(name, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = m[part]
+	}
+	return current
+}
+
+// An Expression is the parsed form of a simple boolean/arithmetic expression, such as
+// the ones used to guard transitions (e.g., `amount < 1000 && currency == "USD"`).
+//
+// Supported are: numbers, single- or double-quoted strings, `true`, `false` and `null`
+// literals; identifiers (resolved against a Scope); the arithmetic operators `+ - * /`;
+// comparisons `== != < <= > >=`; the logical operators `&& || !` and parentheses.
+type Expression struct {
+	Source string
+	root   node
+}
+
+// ParseExpression parses `source` and returns an Expression which can be evaluated
+// against a Scope.
+func ParseExpression(source string) (*Expression, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("unexpected `%s` in expression `%s`", p.peek().text, source)
+	}
+	return &Expression{Source: source, root: root}, nil
+}
+
+// Eval evaluates the Expression in the given Scope, and returns its value.
+func (e *Expression) Eval(scope Scope) (interface{}, error) {
+	return e.root.eval(scope)
+}
+
+// EvalBool evaluates the Expression and returns its truth value: only `true` is
+// considered true, any other value (including non-boolean ones) is false.
+func (e *Expression) EvalBool(scope Scope) (bool, error) {
+	v, err := e.Eval(scope)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	return ok && b, nil
+}
+
+func (e *Expression) String() string {
+	return e.Source
+}
+
+/////// Tokenizer
+
+type tokenKind int
+
+const (
+	tkNumber tokenKind = iota
+	tkString
+	tkIdent
+	tkOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// Operators are listed longest-first, so that we always match `<=` before `<`.
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/",
+	"(", ")"}
+
+func isIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '$'
+}
+
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tkNumber, string(runes[start:i])})
+		case r == '"' || r == '\'':
+			start := i + 1
+			i++
+			for i < len(runes) && runes[i] != r {
+				i++
+			}
+			if i == len(runes) {
+				return nil, fmt.Errorf("unterminated string in expression `%s`", source)
+			}
+			tokens = append(tokens, token{tkString, string(runes[start:i])})
+			i++
+		case isIdentRune(r):
+			start := i
+			for i < len(runes) && isIdentRune(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tkIdent, string(runes[start:i])})
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					tokens = append(tokens, token{tkOperator, op})
+					i += len([]rune(op))
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character `%c` in expression `%s`", r, source)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+/////// Parser
+//
+// The grammar, in order of increasing precedence:
+//
+//	or         := and ( "||" and )*
+//	and        := comparison ( "&&" comparison )*
+//	comparison := sum ( ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) sum )?
+//	sum        := product ( ( "+" | "-" ) product )*
+//	product    := unary ( ( "*" | "/" ) unary )*
+//	unary      := ( "!" | "-" ) unary | primary
+//	primary    := number | string | identifier | "(" or ")"
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) peek() token {
+	if p.done() {
+		return token{}
+	}
+	return p.tokens[p.pos]
+}
+
+// accept consumes the next token if it is one of the given operators.
+func (p *parser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	if p.done() || t.kind != tkOperator {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) parseBinary(next func() (node, error), ops ...string) (node, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(ops...)
+		if !ok {
+			return left, nil
+		}
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) parseOr() (node, error) {
+	return p.parseBinary(p.parseAnd, "||")
+}
+
+func (p *parser) parseAnd() (node, error) {
+	return p.parseBinary(p.parseComparison, "&&")
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if op, ok := p.accept("==", "!=", "<=", ">=", "<", ">"); ok {
+		right, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryNode{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) parseSum() (node, error) {
+	return p.parseBinary(p.parseProduct, "+", "-")
+}
+
+func (p *parser) parseProduct() (node, error) {
+	return p.parseBinary(p.parseUnary, "*", "/")
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if op, ok := p.accept("!", "-"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.done() {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	switch t.kind {
+	case tkNumber:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number `%s`", t.text)
+		}
+		return &literalNode{value: v}, nil
+	case tkString:
+		return &literalNode{value: t.text}, nil
+	case tkIdent:
+		switch t.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null":
+			return &literalNode{value: nil}, nil
+		}
+		return &identNode{name: t.text}, nil
+	}
+	if t.text == "(" {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return inner, nil
+	}
+	return nil, fmt.Errorf("unexpected `%s`", t.text)
+}
+
+/////// AST
+
+type node interface {
+	eval(scope Scope) (interface{}, error)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(Scope) (interface{}, error) {
+	return n.value, nil
+}
+
+type identNode struct {
+	name string
+}
+
+func (n *identNode) eval(scope Scope) (interface{}, error) {
+	return normalize(scope.Lookup(n.name)), nil
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (n *unaryNode) eval(scope Scope) (interface{}, error) {
+	v, err := n.operand.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		b, _ := v.(bool)
+		return !b, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("cannot negate non-numeric value %v", v)
+	}
+	return -f, nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (n *binaryNode) eval(scope Scope) (interface{}, error) {
+	left, err := n.left.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+	// Logical operators short-circuit.
+	switch n.op {
+	case "&&":
+		if b, _ := left.(bool); !b {
+			return false, nil
+		}
+		right, err := n.right.eval(scope)
+		b, _ := right.(bool)
+		return b, err
+	case "||":
+		if b, _ := left.(bool); b {
+			return true, nil
+		}
+		right, err := n.right.eval(scope)
+		b, _ := right.(bool)
+		return b, err
+	}
+	right, err := n.right.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return reflect.DeepEqual(left, right), nil
+	case "!=":
+		return !reflect.DeepEqual(left, right), nil
+	}
+	// Strings can be concatenated and compared, but not much else.
+	if ls, ok := left.(string); ok {
+		rs, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot apply `%s` to %q and %v", n.op, ls, right)
+		}
+		switch n.op {
+		case "+":
+			return ls + rs, nil
+		case "<":
+			return ls < rs, nil
+		case "<=":
+			return ls <= rs, nil
+		case ">":
+			return ls > rs, nil
+		case ">=":
+			return ls >= rs, nil
+		}
+		return nil, fmt.Errorf("cannot apply `%s` to strings", n.op)
+	}
+	lf, lok := left.(float64)
+	rf, rok := right.(float64)
+	if !lok || !rok {
+		// Comparing against a missing value is never true, but is not an error either,
+		// so that guards can be used on optional fields.
+		switch n.op {
+		case "<", "<=", ">", ">=":
+			return false, nil
+		}
+		return nil, fmt.Errorf("cannot apply `%s` to %v and %v", n.op, left, right)
+	}
+	switch n.op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return lf / rf, nil
+	case "<":
+		return lf < rf, nil
+	case "<=":
+		return lf <= rf, nil
+	case ">":
+		return lf > rf, nil
+	case ">=":
+		return lf >= rf, nil
+	}
+	return nil, fmt.Errorf("unknown operator `%s`", n.op)
+}
+
+// normalize converts numeric values to float64, so that they can be compared and operated
+// upon regardless of how they were originally obtained.
+func normalize(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float32:
+		return float64(n)
+	}
+	return v
+}
@@ -41,8 +41,10 @@ var (
 		"the StartingState must be one of the possible FSM states")
 	EmptyStartingStateConfigurationError = fmt.Errorf("the StartingState must be non-empty")
 	UnexpectedTransitionError            = fmt.Errorf("unexpected event transition")
+	GuardNotSatisfiedError               = fmt.Errorf("transition guard not satisfied")
 	UnexpectedError                      = fmt.Errorf("the request was malformed")
 	UnreachableStateConfigurationError   = "state %s is not used in any of the transitions"
+	InvalidTriggerConfigurationError     = "transition from %s to %s: %v"
 
 	// Logger is made accessible so that its `Level` can be changed or swapped in tests.
 	Logger = log.With().Str("logger", "api").Logger()
@@ -69,28 +71,136 @@ func NewStateMachine(configuration *protos.Configuration) (*ConfiguredStateMachi
 	}, nil
 }
 
+// Effects are the result of processing an Event: the states the FSM left and entered
+// (see ExitedStates and EnteredStates), and the Actions caused by the transition, in the
+// order they should be dispatched.
+type Effects struct {
+	Exited  []string
+	Entered []string
+	Actions []*Action
+}
+
 // SendEvent registers the event with the FSM and effects the transition, if valid.
 // It also creates a new Event, and stores in the provided cache.
+//
+// Transitions from the FSM's current state are tried first; if none matches, the event
+// "bubbles up" to the compound states the current state is nested in (see StateSeparator),
+// from the innermost to the outermost, and finally to the transitions from AnyState.
+//
+// If one or more transitions match the event, but none of their guards is satisfied
+// (see Trigger) a GuardNotSatisfiedError is returned, and the FSM is left unchanged; the
+// same is true if the transition's updates to the FSM's data (see DataUpdate) fail.
+// If any of the guards could not be evaluated, the error is the (first) GuardError.
 func (x *ConfiguredStateMachine) SendEvent(evt *protos.Event) error {
+	_, err := x.ProcessEvent(evt)
+	return err
+}
+
+// ProcessEvent behaves like SendEvent, and also returns the Effects of the transition.
+//
+// The Actions' `FsmId` is not known here, and is left for the caller to fill in.
+func (x *ConfiguredStateMachine) ProcessEvent(evt *protos.Event) (*Effects, error) {
+	if x.IsCompleted() {
+		return nil, UnexpectedTransitionError
+	}
 	// We need to clone the Event, as we will be mutating it,
 	// and storing the pointer in the FSM's `History`:
 	// we cannot be sure what the caller is going to do with it.
 	newEvent := proto.Clone(evt).(*protos.Event)
+	var scope Scope
+	var guardErr error
+	matched := false
+	for _, t := range x.candidates() {
+		trigger, err := ParseTrigger(t.Event)
+		if err != nil {
+			return nil, err
+		}
+		if trigger.Event != newEvent.Transition.Event {
+			continue
+		}
+		matched = true
+		if trigger.Guard != nil {
+			if scope == nil {
+				scope = NewGuardScope(x.FSM, newEvent)
+			}
+			allowed, err := trigger.Allows(scope)
+			if err != nil {
+				Logger.Warn().
+					Str("state", x.FSM.GetState()).
+					Str("event", newEvent.GetTransition().GetEvent()).
+					Msg(err.Error())
+				if guardErr == nil {
+					guardErr = err
+				}
+			}
+			if !allowed {
+				continue
+			}
+		}
+		if len(trigger.Updates) > 0 {
+			if err := x.updateData(newEvent, trigger.Updates); err != nil {
+				return nil, err
+			}
+		}
+		from, to := x.FSM.State, t.To
+		effects := &Effects{}
+		if IsInternal(t) {
+			to = from
+		} else {
+			effects.Exited = ExitedStates(from, to)
+			effects.Entered = EnteredStates(from, to)
+		}
+		newEvent.Transition.From = from
+		newEvent.Transition.To = to
+		x.FSM.State = to
+		x.FSM.History = append(x.FSM.History, newEvent)
+		if x.IsCompleted() {
+			completed := newEvent.GetTimestamp()
+			if completed == nil {
+				completed = timestamppb.Now()
+			}
+			if err := setCompletedAt(x.FSM, completed); err != nil {
+				return nil, err
+			}
+		}
+		effects.Actions = x.newActions(newEvent, trigger, effects.Exited, effects.Entered)
+		return effects, nil
+	}
+	if guardErr != nil {
+		return nil, guardErr
+	}
+	if matched {
+		return nil, GuardNotSatisfiedError
+	}
+	return nil, UnexpectedTransitionError
+}
+
+// candidates returns the transitions which can be taken from the FSM's current state, in
+// order of precedence: those from the state itself, then those from the compound states it
+// is nested in (from the innermost) and finally those from AnyState.
+func (x *ConfiguredStateMachine) candidates() []*protos.Transition {
+	var candidates, wildcards []*protos.Transition
 	for _, t := range x.Config.Transitions {
-		if t.From == x.FSM.State && t.Event == newEvent.Transition.Event {
-			newEvent.Transition.From = x.FSM.State
-			newEvent.Transition.To = t.To
-			x.FSM.State = t.To
-			x.FSM.History = append(x.FSM.History, newEvent)
-			return nil
+		if IsWildcard(t) && !IsFinal(t) && !IsActivity(t) {
+			wildcards = append(wildcards, t)
+		}
+	}
+	for _, state := range Ancestors(x.FSM.State) {
+		for _, t := range x.Config.Transitions {
+			if IsWildcard(t) || IsFinal(t) || IsActivity(t) || !FromState(x.Config, t, state) {
+				continue
+			}
+			candidates = append(candidates, t)
 		}
 	}
-	return UnexpectedTransitionError
+	return append(candidates, wildcards...)
 }
 
 func (x *ConfiguredStateMachine) Reset() {
 	x.FSM.State = x.Config.StartingState
 	x.FSM.History = nil
+	_ = SetData(x.FSM, nil)
+	_ = setCompletedAt(x.FSM, nil)
 }
 
 func GetVersionId(c *protos.Configuration) string {
@@ -98,8 +208,21 @@ func GetVersionId(c *protos.Configuration) string {
 }
 
 // HasState will check whether a given state is either origin or destination for the Transition
+//
+// States are not considered origins of wildcard transitions (see AnyState).
 func HasState(transition *protos.Transition, state string) bool {
-	return state == transition.GetFrom() || state == transition.GetTo()
+	if state == transition.GetTo() {
+		return true
+	}
+	if IsWildcard(transition) {
+		return false
+	}
+	for _, s := range strings.Split(transition.GetFrom(), OriginsSeparator) {
+		if strings.TrimSpace(s) == state {
+			return true
+		}
+	}
+	return false
 }
 
 // CfgHasState checks that `state` is one of the Configuration's `States`
@@ -122,38 +245,17 @@ func (x *ConfiguredStateMachine) CheckValid() bool {
 }
 
 // CheckValid will validate that there is at least one state,
-// and that the starting state is one of the possible states; further for any of the states it
-// will check that they appear in at least one transition.
+// and that the starting state is one of the possible states; further it will build the
+// graph of the states and transitions and check that all states can be reached from the
+// starting state, and that there are no ambiguous transitions.
+//
+// Finally, it will check that the name is valid, that the generated `ConfigId` is a
+// valid URI segment, and that all the transitions' guards (if any) can be parsed.
 //
-// Finally, it will check that the name is valid,
-// and that the generated `ConfigId` is a valid URI segment.
+// If the Configuration is not valid, the returned error is a ValidationError, carrying
+// all the problems found; use Validate to also obtain the warnings.
 func CheckValid(c *protos.Configuration) error {
-	if c.Name == "" {
-		return MissingNameConfigurationError
-	}
-	if len(c.States) == 0 {
-		return MissingStatesConfigurationError
-	}
-	if c.StartingState == "" {
-		return EmptyStartingStateConfigurationError
-	}
-	if !CfgHasState(c, c.StartingState) {
-		return MismatchStartingStateConfigurationError
-	}
-	// TODO: we should actually build the full graph and check it's fully connected.
-	for _, s := range c.States {
-		found := false
-		for _, t := range c.Transitions {
-			if HasState(t, s) {
-				found = true
-				break
-			}
-		}
-		if !found {
-			return fmt.Errorf(UnreachableStateConfigurationError, s)
-		}
-	}
-	return nil
+	return Validate(c).Err()
 }
 
 // NewEvent creates a new Event, with the given `eventName` transition.
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api
+
+import (
+	"strings"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+const (
+	// StateSeparator separates the names of nested states, from the outermost to the
+	// innermost: `processing/packing` is a child of the compound state `processing`, and
+	// inherits all its transitions.
+	StateSeparator = "/"
+)
+
+// Parent returns the state's enclosing compound state, or an empty string for
+// top-level states.
+func Parent(state string) string {
+	if i := strings.LastIndex(state, StateSeparator); i >= 0 {
+		return state[:i]
+	}
+	return ""
+}
+
+// Ancestors returns the state itself, followed by all its enclosing compound states,
+// from the innermost to the outermost.
+func Ancestors(state string) []string {
+	var ancestors []string
+	for ; state != ""; state = Parent(state) {
+		ancestors = append(ancestors, state)
+	}
+	return ancestors
+}
+
+// InState returns true if an FSM in the `current` state is also in `state`, that is, if
+// they are the same state or `current` is nested inside `state`.
+func InState(current, state string) bool {
+	return current == state || strings.HasPrefix(current, state+StateSeparator)
+}
+
+// IsCompound returns true if `state` has nested states in the Configuration.
+//
+// FSMs are never in a compound state only, but always in one of its nested states.
+func IsCompound(c *protos.Configuration, state string) bool {
+	if state == "" {
+		return false
+	}
+	for _, s := range c.States {
+		if Parent(s) == state {
+			return true
+		}
+	}
+	return false
+}
+
+// ExitedStates returns the states the FSM leaves when moving from the `from` state
+// to the `to` state, from the innermost: these are the ones `from` is nested in, which
+// `to` is not nested in.
+//
+// A self-transition exits (and enters again) the state itself.
+func ExitedStates(from, to string) []string {
+	if from == "" {
+		return nil
+	}
+	if from == to {
+		return []string{from}
+	}
+	var exited []string
+	for _, s := range Ancestors(from) {
+		if !InState(to, s) {
+			exited = append(exited, s)
+		}
+	}
+	return exited
+}
+
+// EnteredStates returns the states the FSM enters when moving from the `from` state
+// to the `to` state (which may be empty for a newly created FSM), from the outermost.
+func EnteredStates(from, to string) []string {
+	entered := ExitedStates(to, from)
+	for i, j := 0, len(entered)-1; i < j; i, j = i+1, j-1 {
+		entered[i], entered[j] = entered[j], entered[i]
+	}
+	return entered
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api_test
+
+import (
+	. "github.com/massenz/go-statemachine/pkg/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("Hierarchical states", func() {
+	var orders *protos.Configuration
+	BeforeEach(func() {
+		orders = &protos.Configuration{
+			Name:          "orders",
+			Version:       "v1",
+			StartingState: "processing/picking",
+			States: []string{"processing", "processing/picking", "processing/packing",
+				"processing/packing/wrapping", "processing/packing/boxing", "shipped", "cancelled"},
+			Transitions: []*protos.Transition{
+				{From: "processing/picking", To: "processing/packing/wrapping", Event: "pick"},
+				{From: "processing/packing/wrapping", To: "processing/packing/boxing", Event: "wrap"},
+				{From: "processing/packing", To: "shipped", Event: "ship"},
+				{From: "processing/packing/boxing", To: "processing/picking", Event: "cancel"},
+				{From: "processing", To: "cancelled", Event: "cancel"},
+				{From: "shipped", To: FinalState},
+				{From: "cancelled", To: FinalState},
+			},
+		}
+	})
+	It("can navigate the hierarchy", func() {
+		Expect(Parent("processing/packing/boxing")).To(Equal("processing/packing"))
+		Expect(Parent("processing")).To(BeEmpty())
+		Expect(Ancestors("processing/packing/boxing")).To(Equal(
+			[]string{"processing/packing/boxing", "processing/packing", "processing"}))
+		Expect(InState("processing/packing/boxing", "processing")).To(BeTrue())
+		Expect(InState("processing/packing", "processing/pack")).To(BeFalse())
+		Expect(IsCompound(orders, "processing/packing")).To(BeTrue())
+		Expect(IsCompound(orders, "processing/picking")).To(BeFalse())
+	})
+	It("knows which states are exited and entered", func() {
+		Expect(ExitedStates("processing/packing/boxing", "processing/picking")).To(Equal(
+			[]string{"processing/packing/boxing", "processing/packing"}))
+		Expect(EnteredStates("processing/picking", "processing/packing/wrapping")).To(Equal(
+			[]string{"processing/packing", "processing/packing/wrapping"}))
+		Expect(ExitedStates("shipped", "shipped")).To(Equal([]string{"shipped"}))
+		Expect(EnteredStates("", "processing/picking")).To(Equal(
+			[]string{"processing", "processing/picking"}))
+	})
+	It("is valid", func() {
+		Expect(Validate(orders)).To(BeEmpty())
+	})
+	It("requires compound states to be declared", func() {
+		orders.States = orders.States[1:]
+		orders.Transitions[4].From = "processing/picking"
+		errs := Validate(orders).Errors()
+		Expect(errs).To(HaveLen(2))
+		Expect(errs[0].State).To(Equal("processing/picking"))
+		Expect(errs[1].State).To(Equal("processing/packing"))
+	})
+	It("does not allow FSMs to be in a compound state", func() {
+		orders.StartingState = "processing"
+		orders.Transitions = append(orders.Transitions,
+			&protos.Transition{From: "processing/picking", To: "processing/packing", Event: "skip"})
+		errs := Validate(orders).Errors()
+		Expect(errs).To(HaveLen(2))
+		Expect(errs[0].State).To(Equal("processing"))
+		Expect(errs[1].State).To(Equal("processing/packing"))
+	})
+	It("resolves the innermost transition first, then bubbles up", func() {
+		fsm, err := NewStateMachine(orders)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fsm.SendEvent(NewEvent("ship"))).To(MatchError(UnexpectedTransitionError))
+		Expect(fsm.SendEvent(NewEvent("pick"))).To(Succeed())
+		Expect(fsm.SendEvent(NewEvent("wrap"))).To(Succeed())
+		Expect(fsm.FSM.State).To(Equal("processing/packing/boxing"))
+
+		Expect(fsm.SendEvent(NewEvent("cancel"))).To(Succeed())
+		Expect(fsm.FSM.State).To(Equal("processing/picking"))
+		Expect(fsm.SendEvent(NewEvent("cancel"))).To(Succeed())
+		Expect(fsm.FSM.State).To(Equal("cancelled"))
+		last := fsm.FSM.History[len(fsm.FSM.History)-1]
+		Expect(last.Transition.From).To(Equal("processing/picking"))
+		Expect(fsm.IsCompleted()).To(BeTrue())
+	})
+})
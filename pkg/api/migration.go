@@ -0,0 +1,210 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+const (
+	// MigrationEvent is the event of the entries recorded in an FSM's History when it is
+	// migrated (see Migration): their Details carry the two Configurations, and the FSM's
+	// data at the time.
+	MigrationEvent = "$migrate"
+
+	MigrationOriginator = "migration"
+)
+
+var (
+	MismatchedNamesMigrationError = "cannot migrate from configuration %s to %s, their names differ"
+	UnknownStateMigrationError    = "state %s mapped to %s is not a state of %s"
+	MissingStateMigrationError    = "state %s of %s is not a state of %s, and must be mapped to one"
+	CompoundStateMigrationError   = "state %s of %s cannot be the target of a migration, " +
+		"it is a compound state"
+	WrongVersionMigrationError = "FSM is configured with %s, cannot be migrated from %s"
+	MigratedElsewhereError     = "FSM was migrated to %s, not %s"
+)
+
+// migrationDetails are the Details of the History entries for migrations.
+type migrationDetails struct {
+	From string          `json:"from"`
+	To   string          `json:"to"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// IsMigration returns true if the Event is the History entry for a migration.
+func IsMigration(evt *protos.Event) bool {
+	return evt.GetTransition().GetEvent() == MigrationEvent
+}
+
+// A Migration moves FSMs from one version of a Configuration to another: FSMs in any of
+// the `States` of the original Configuration are moved to the state it is mapped to, all
+// others keep their state.
+//
+// FSMs keep their History and data (see GetData), and an entry (see IsMigration) is
+// recorded in their History, from which Replay resumes, as the events which precede it
+// may not be valid for the new Configuration.
+type Migration struct {
+	From   *protos.Configuration
+	To     *protos.Configuration
+	States map[string]string
+}
+
+// NewMigration creates a Migration between two versions of the same Configuration, after
+// checking that no FSM would end up in a state which does not exist (or is a compound
+// state) in the `to` Configuration.
+//
+// All the problems found are returned in a ValidationError.
+func NewMigration(from, to *protos.Configuration, states map[string]string) (*Migration, error) {
+	var findings Findings
+	addError := func(state string, err error) {
+		findings = append(findings, Finding{Severity: SeverityError, State: state, Err: err})
+	}
+	fromId, toId := GetVersionId(from), GetVersionId(to)
+	if from.Name != to.Name {
+		addError("", fmt.Errorf(MismatchedNamesMigrationError, fromId, toId))
+	}
+	sources := make([]string, 0, len(states))
+	for state := range states {
+		sources = append(sources, state)
+	}
+	sort.Strings(sources)
+	for _, state := range sources {
+		if !CfgHasState(from, state) {
+			addError(state, fmt.Errorf(UnknownStateMigrationError, state, states[state], fromId))
+		}
+	}
+	for _, state := range from.States {
+		if IsCompound(from, state) {
+			continue
+		}
+		target, mapped := states[state]
+		if !mapped {
+			target = state
+		}
+		switch {
+		case !CfgHasState(to, target) && mapped:
+			addError(state, fmt.Errorf(UnknownStateMigrationError, state, target, toId))
+		case !CfgHasState(to, target):
+			addError(state, fmt.Errorf(MissingStateMigrationError, state, fromId, toId))
+		case IsCompound(to, target):
+			addError(state, fmt.Errorf(CompoundStateMigrationError, target, toId))
+		}
+	}
+	if err := findings.Err(); err != nil {
+		return nil, err
+	}
+	return &Migration{From: from, To: to, States: states}, nil
+}
+
+// State returns the state that FSMs in `state` are moved to.
+func (m *Migration) State(state string) string {
+	if target, ok := m.States[state]; ok {
+		return target
+	}
+	return state
+}
+
+// Applies returns true if the FSM is configured with the Migration's original Configuration.
+func (m *Migration) Applies(fsm *protos.FiniteStateMachine) bool {
+	return fsm.GetConfigId() == GetVersionId(m.From)
+}
+
+// Apply moves the FSM to the Migration's target Configuration, and the corresponding state,
+// recording the migration in its History; FSMs moved to a terminal state complete now, and
+// those moved out of one are no longer completed.
+func (m *Migration) Apply(fsm *protos.FiniteStateMachine) error {
+	if !m.Applies(fsm) {
+		return fmt.Errorf(WrongVersionMigrationError, fsm.GetConfigId(), GetVersionId(m.From))
+	}
+	details := migrationDetails{From: GetVersionId(m.From), To: GetVersionId(m.To)}
+	data, err := GetData(fsm)
+	if err != nil {
+		return err
+	}
+	if len(data.GetFields()) > 0 {
+		if details.Data, err = protojson.Marshal(data); err != nil {
+			return err
+		}
+	}
+	encoded, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	evt := NewEvent(MigrationEvent)
+	evt.Originator = MigrationOriginator
+	evt.Details = string(encoded)
+	evt.Transition.From = fsm.State
+	evt.Transition.To = m.State(fsm.State)
+
+	wasCompleted := IsTerminal(m.From, fsm.State)
+	fsm.ConfigId = details.To
+	fsm.State = evt.Transition.To
+	fsm.History = append(fsm.History, evt)
+	switch isCompleted := IsTerminal(m.To, fsm.State); {
+	case isCompleted && !wasCompleted:
+		return setCompletedAt(fsm, evt.GetTimestamp())
+	case !isCompleted:
+		return setCompletedAt(fsm, nil)
+	}
+	return nil
+}
+
+// migrated moves the FSM to the state, and data, recorded by the migration entry `evt`,
+// which must be for a migration to the FSM's Configuration.
+func (x *ConfiguredStateMachine) migrated(evt *protos.Event) error {
+	var details migrationDetails
+	if err := json.Unmarshal([]byte(evt.GetDetails()), &details); err != nil {
+		return fmt.Errorf("invalid migration [%s]: %v", evt.GetEventId(), err)
+	}
+	if details.To != GetVersionId(x.Config) {
+		return fmt.Errorf(MigratedElsewhereError, details.To, GetVersionId(x.Config))
+	}
+	state := evt.GetTransition().GetTo()
+	if !CfgHasState(x.Config, state) {
+		return fmt.Errorf(UnknownStateMigrationError, evt.GetTransition().GetFrom(), state, details.To)
+	}
+	data := &structpb.Struct{}
+	if len(details.Data) > 0 {
+		if err := protojson.Unmarshal(details.Data, data); err != nil {
+			return fmt.Errorf("invalid migration [%s]: %v", evt.GetEventId(), err)
+		}
+	}
+	if err := SetData(x.FSM, data); err != nil {
+		return err
+	}
+	var completedAt = evt.GetTimestamp()
+	if !IsTerminal(x.Config, state) {
+		completedAt = nil
+	}
+	if err := setCompletedAt(x.FSM, completedAt); err != nil {
+		return err
+	}
+	x.FSM.State = state
+	return nil
+}
+
+// sinceMigration returns the index, in the `history`, of the first event which follows the
+// last migration entry, or 0 if the FSM was never migrated.
+func sinceMigration(history []*protos.Event) int {
+	for i := len(history) - 1; i >= 0; i-- {
+		if IsMigration(history[i]) {
+			return i + 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api_test
+
+import (
+	"errors"
+
+	. "github.com/massenz/go-statemachine/pkg/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("Migrations", func() {
+	var v1, v2 *protos.Configuration
+	BeforeEach(func() {
+		v1 = &protos.Configuration{
+			Name:          "orders",
+			Version:       "v1",
+			StartingState: "pending",
+			States:        []string{"pending", "shipped", "delivered"},
+			Transitions: []*protos.Transition{
+				{From: "pending", To: "shipped", Event: "ship"},
+				{From: "shipped", To: "delivered", Event: "deliver"},
+			},
+		}
+		v2 = &protos.Configuration{
+			Name:          "orders",
+			Version:       "v2",
+			StartingState: "pending",
+			States:        []string{"pending", "in_transit", "in_transit/truck", "delivered"},
+			Transitions: []*protos.Transition{
+				{From: "pending", To: "in_transit/truck", Event: "ship"},
+				{From: "in_transit", To: "delivered", Event: "deliver"},
+			},
+		}
+	})
+	It("moves FSMs to the mapped states", func() {
+		m, err := NewMigration(v1, v2, map[string]string{"shipped": "in_transit/truck"})
+		Expect(err).ToNot(HaveOccurred())
+		fsm := &protos.FiniteStateMachine{ConfigId: "orders:v1", State: "shipped",
+			History: []*protos.Event{NewEvent("ship")}}
+		Expect(m.Applies(fsm)).To(BeTrue())
+		Expect(m.Apply(fsm)).To(Succeed())
+		Expect(fsm.ConfigId).To(Equal("orders:v2"))
+		Expect(fsm.State).To(Equal("in_transit/truck"))
+		Expect(fsm.History).To(HaveLen(2))
+		last := fsm.History[1]
+		Expect(IsMigration(last)).To(BeTrue())
+		Expect(last.Originator).To(Equal(MigrationOriginator))
+		Expect(last.Transition.From).To(Equal("shipped"))
+		Expect(last.Transition.To).To(Equal("in_transit/truck"))
+
+		Expect(m.Applies(fsm)).To(BeFalse())
+		Expect(m.Apply(fsm)).ToNot(Succeed())
+		Expect(m.State("pending")).To(Equal("pending"))
+	})
+	It("can be replayed, and rolled back, with the new Configuration", func() {
+		m, err := NewMigration(v1, v2, map[string]string{"shipped": "in_transit/truck"})
+		Expect(err).ToNot(HaveOccurred())
+		sm, _ := NewStateMachine(v1)
+		Expect(sm.SendEvent(NewEvent("ship"))).To(Succeed())
+		data, _ := structpb.NewStruct(map[string]interface{}{"total": 42.0})
+		Expect(SetData(sm.FSM, data)).To(Succeed())
+		Expect(m.Apply(sm.FSM)).To(Succeed())
+		sm = &ConfiguredStateMachine{Config: v2, FSM: sm.FSM}
+		Expect(sm.SendEvent(NewEvent("deliver"))).To(Succeed())
+
+		replayed, err := Replay(v2, sm.FSM.History)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(replayed.FSM.State).To(Equal("delivered"))
+		Expect(replayed.FSM.History).To(HaveLen(3))
+		replayedData, _ := GetData(replayed.FSM)
+		Expect(replayedData.AsMap()).To(Equal(data.AsMap()))
+		_, err = Replay(v1, sm.FSM.History)
+		Expect(err).To(HaveOccurred())
+
+		_, err = sm.Rollback(2, "operator")
+		Expect(err).To(HaveOccurred())
+		_, err = sm.Rollback(1, "operator")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sm.FSM.State).To(Equal("in_transit/truck"))
+		replayed, err = Replay(v2, sm.FSM.History)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(replayed.FSM.State).To(Equal("in_transit/truck"))
+	})
+	It("reports all the states FSMs cannot be moved to", func() {
+		v2.Name = "returns"
+		_, err := NewMigration(v1, v2, map[string]string{
+			"pending":   "in_transit",
+			"cancelled": "delivered",
+		})
+		Expect(err).To(HaveOccurred())
+		var validationErr *ValidationError
+		Expect(errors.As(err, &validationErr)).To(BeTrue())
+		Expect(validationErr.Findings).To(HaveLen(4))
+		var states []string
+		for _, f := range validationErr.Findings {
+			states = append(states, f.State)
+		}
+		Expect(states).To(Equal([]string{"", "cancelled", "pending", "shipped"}))
+	})
+})
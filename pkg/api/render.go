@@ -0,0 +1,337 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+// GraphFormat is one of the text formats a Configuration can be rendered to (see Render).
+type GraphFormat string
+
+const (
+	FormatDot      GraphFormat = "dot"
+	FormatMermaid  GraphFormat = "mermaid"
+	FormatPlantUML GraphFormat = "plantuml"
+)
+
+var UnknownGraphFormatError = "unknown graph format `%s`, must be one of dot, mermaid or plantuml"
+
+// ParseGraphFormat returns the GraphFormat named `name` (case-insensitive).
+func ParseGraphFormat(name string) (GraphFormat, error) {
+	switch format := GraphFormat(strings.ToLower(name)); format {
+	case FormatDot, FormatMermaid, FormatPlantUML:
+		return format, nil
+	}
+	return "", fmt.Errorf(UnknownGraphFormatError, name)
+}
+
+// Render returns the diagram of the Configuration's states and transitions, in the given
+// `format`: Graphviz DOT, Mermaid or PlantUML state diagrams.
+//
+// Compound states (see StateSeparator) are drawn around their nested states; transitions
+// from wildcards (see AnyState) are drawn from each of their non-terminal origins; entry and exit
+// activities, as well as internal transitions, are listed within their state.
+//
+// If an `fsm` is given, its current state is highlighted, along with the states it went
+// through and the transitions it took, as recorded in its History.
+func Render(c *protos.Configuration, format GraphFormat, fsm *protos.FiniteStateMachine) (string, error) {
+	d := newDiagram(c, fsm)
+	switch format {
+	case FormatDot:
+		return d.dot(), nil
+	case FormatMermaid:
+		return d.mermaid(), nil
+	case FormatPlantUML:
+		return d.plantUML(), nil
+	}
+	return "", fmt.Errorf(UnknownGraphFormatError, format)
+}
+
+// An edge is one of the arrows in the diagram, either a transition or from/to the initial
+// and final pseudo-states (whose `from` or `to` are empty).
+type edge struct {
+	from, to, label string
+	traversed       bool
+}
+
+// diagram is the format-independent representation of a rendered Configuration.
+type diagram struct {
+	name         string
+	children     map[string][]string
+	descriptions map[string][]string
+	edges        []edge
+	current      string
+	visited      map[string]bool
+}
+
+func newDiagram(c *protos.Configuration, fsm *protos.FiniteStateMachine) *diagram {
+	d := &diagram{
+		name:         GetVersionId(c),
+		children:     make(map[string][]string),
+		descriptions: make(map[string][]string),
+		visited:      make(map[string]bool),
+	}
+	for _, s := range c.States {
+		d.children[Parent(s)] = append(d.children[Parent(s)], s)
+	}
+	if fsm != nil {
+		d.current = fsm.GetState()
+		d.visited[d.current] = true
+		// The states visited before a migration are those of another Configuration.
+		for _, evt := range fsm.GetHistory()[sinceMigration(fsm.GetHistory()):] {
+			d.visited[evt.GetTransition().GetFrom()] = true
+			d.visited[evt.GetTransition().GetTo()] = true
+		}
+	}
+	d.edges = append(d.edges, edge{to: c.StartingState, traversed: fsm != nil})
+	for _, t := range c.Transitions {
+		switch {
+		case IsActivity(t) || IsInternal(t):
+			for _, s := range Origins(c, t) {
+				d.descriptions[s] = append(d.descriptions[s], t.Event)
+			}
+		case IsFinal(t):
+			for _, s := range Origins(c, t) {
+				d.edges = append(d.edges, edge{from: s, traversed: d.current == s})
+			}
+		default:
+			for _, s := range Origins(c, t) {
+				// Completed FSMs do not process events, even for wildcard transitions.
+				if IsWildcard(t) && IsTerminal(c, s) {
+					continue
+				}
+				d.edges = append(d.edges, edge{from: s, to: t.To, label: t.Event,
+					traversed: traversed(t, s, fsm)})
+			}
+		}
+	}
+	return d
+}
+
+// traversed returns true if the FSM took the transition `t`, from its origin `from`.
+func traversed(t *protos.Transition, from string, fsm *protos.FiniteStateMachine) bool {
+	trigger, err := ParseTrigger(t.Event)
+	if err != nil {
+		return false
+	}
+	for _, evt := range fsm.GetHistory()[sinceMigration(fsm.GetHistory()):] {
+		taken := evt.GetTransition()
+		if taken.GetEvent() == trigger.Event && taken.GetTo() == t.To &&
+			InState(taken.GetFrom(), from) {
+			return true
+		}
+	}
+	return false
+}
+
+// stateLabel returns the name of the state, without the compound states it is nested in.
+func stateLabel(state string) string {
+	return state[strings.LastIndex(state, StateSeparator)+1:]
+}
+
+// stateId returns an identifier for the state which is valid in Mermaid and PlantUML.
+func stateId(state string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, state)
+}
+
+func quoted(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+func (d *diagram) dot() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %s {\n", quoted(d.name))
+	b.WriteString("  compound=true;\n  rankdir=LR;\n  node [shape=box, style=rounded];\n")
+	b.WriteString("  __start [shape=point];\n  __end [shape=doublecircle, label=\"\", width=0.2];\n")
+	var states func(parent, indent string)
+	states = func(parent, indent string) {
+		for _, s := range d.children[parent] {
+			if len(d.children[s]) > 0 {
+				text := strings.Join(append([]string{stateLabel(s)}, d.descriptions[s]...), `\n`)
+				fmt.Fprintf(&b, "%ssubgraph %s {\n%s  label=%s;\n", indent, quoted("cluster_"+s),
+					indent, quoted(text))
+				states(s, indent+"  ")
+				fmt.Fprintf(&b, "%s}\n", indent)
+				continue
+			}
+			text := strings.Join(append([]string{stateLabel(s)}, d.descriptions[s]...), `\n`)
+			attrs := []string{"label=" + quoted(text)}
+			if s == d.current {
+				attrs = append(attrs, `style="rounded,filled"`, "fillcolor=palegreen")
+			} else if d.visited[s] {
+				attrs = append(attrs, "color=blue")
+			}
+			fmt.Fprintf(&b, "%s%s [%s];\n", indent, quoted(s), strings.Join(attrs, ", "))
+		}
+	}
+	states("", "  ")
+	// Graphviz can only draw edges between nodes, so those from and to compound states are
+	// drawn from one of their nested states, and clipped at the cluster's boundary.
+	node := func(state, clip string) (string, string) {
+		if state == "" {
+			return "", ""
+		}
+		if len(d.children[state]) == 0 {
+			return quoted(state), ""
+		}
+		leaf := state
+		for len(d.children[leaf]) > 0 {
+			leaf = d.children[leaf][0]
+		}
+		return quoted(leaf), fmt.Sprintf("%s=%s", clip, quoted("cluster_"+state))
+	}
+	for _, e := range d.edges {
+		from, ltail := node(e.from, "ltail")
+		to, lhead := node(e.to, "lhead")
+		if from == "" {
+			from = "__start"
+		}
+		if to == "" {
+			to = "__end"
+		}
+		var attrs []string
+		if e.label != "" {
+			attrs = append(attrs, "label="+quoted(e.label))
+		}
+		for _, clip := range []string{ltail, lhead} {
+			if clip != "" {
+				attrs = append(attrs, clip)
+			}
+		}
+		if e.traversed {
+			attrs = append(attrs, "color=blue", "penwidth=2")
+		}
+		fmt.Fprintf(&b, "  %s -> %s", from, to)
+		if len(attrs) > 0 {
+			fmt.Fprintf(&b, " [%s]", strings.Join(attrs, ", "))
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func (d *diagram) mermaid() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "---\ntitle: %s\n---\nstateDiagram-v2\n", d.name)
+	var states func(parent, indent string)
+	states = func(parent, indent string) {
+		for _, s := range d.children[parent] {
+			if len(d.children[s]) > 0 {
+				fmt.Fprintf(&b, "%sstate %s {\n", indent, stateId(s))
+				states(s, indent+"  ")
+				fmt.Fprintf(&b, "%s}\n", indent)
+			} else {
+				fmt.Fprintf(&b, "%sstate %s as %s\n", indent, quoted(stateLabel(s)), stateId(s))
+			}
+			for _, desc := range d.descriptions[s] {
+				fmt.Fprintf(&b, "%s%s : %s\n", indent, stateId(s), desc)
+			}
+		}
+	}
+	states("", "  ")
+	for _, e := range d.edges {
+		from, to := "[*]", "[*]"
+		if e.from != "" {
+			from = stateId(e.from)
+		}
+		if e.to != "" {
+			to = stateId(e.to)
+		}
+		fmt.Fprintf(&b, "  %s --> %s", from, to)
+		if e.label != "" {
+			fmt.Fprintf(&b, " : %s", e.label)
+		}
+		b.WriteString("\n")
+	}
+	// Mermaid does not support styling transitions, so only the states are highlighted.
+	if d.current != "" {
+		b.WriteString("  classDef current fill:palegreen\n  classDef visited stroke:blue\n")
+		fmt.Fprintf(&b, "  class %s current\n", stateId(d.current))
+		for _, s := range d.visitedStates() {
+			fmt.Fprintf(&b, "  class %s visited\n", stateId(s))
+		}
+	}
+	return b.String()
+}
+
+func (d *diagram) plantUML() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "@startuml\ntitle %s\n", d.name)
+	var states func(parent, indent string)
+	states = func(parent, indent string) {
+		for _, s := range d.children[parent] {
+			color := ""
+			if s == d.current {
+				color = " #palegreen"
+			} else if d.visited[s] {
+				color = " ##blue"
+			}
+			fmt.Fprintf(&b, "%sstate %s as %s%s", indent, quoted(stateLabel(s)), stateId(s), color)
+			if len(d.children[s]) > 0 {
+				b.WriteString(" {\n")
+				states(s, indent+"  ")
+				fmt.Fprintf(&b, "%s}\n", indent)
+			} else {
+				b.WriteString("\n")
+			}
+			for _, desc := range d.descriptions[s] {
+				fmt.Fprintf(&b, "%s%s : %s\n", indent, stateId(s), desc)
+			}
+		}
+	}
+	states("", "")
+	for _, e := range d.edges {
+		from, to := "[*]", "[*]"
+		if e.from != "" {
+			from = stateId(e.from)
+		}
+		if e.to != "" {
+			to = stateId(e.to)
+		}
+		arrow := "-->"
+		if e.traversed {
+			arrow = "-[#blue,bold]->"
+		}
+		fmt.Fprintf(&b, "%s %s %s", from, arrow, to)
+		if e.label != "" {
+			fmt.Fprintf(&b, " : %s", e.label)
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("@enduml\n")
+	return b.String()
+}
+
+// visitedStates returns the states the FSM went through, other than the current one, in
+// the order they appear in the Configuration.
+func (d *diagram) visitedStates() []string {
+	var visited []string
+	var walk func(parent string)
+	walk = func(parent string) {
+		for _, s := range d.children[parent] {
+			if d.visited[s] && s != d.current {
+				visited = append(visited, s)
+			}
+			walk(s)
+		}
+	}
+	walk("")
+	return visited
+}
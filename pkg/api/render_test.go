@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api_test
+
+import (
+	. "github.com/massenz/go-statemachine/pkg/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("Rendering configurations", func() {
+	var orders *protos.Configuration
+	BeforeEach(func() {
+		orders = &protos.Configuration{
+			Name:          "orders",
+			Version:       "v1",
+			StartingState: "processing/picking",
+			States: []string{"processing", "processing/picking", "processing/packing", "shipped",
+				"cancelled"},
+			Transitions: []*protos.Transition{
+				{From: "processing/picking", To: "processing/packing", Event: "pick"},
+				{From: "processing", To: "shipped", Event: "ship [ok] / notify"},
+				{From: "*", To: "cancelled", Event: "cancel"},
+				{From: "shipped", Event: "entry / invoice"},
+				{From: "shipped", To: FinalState},
+				{From: "cancelled", To: FinalState},
+			},
+		}
+	})
+	It("only knows some formats", func() {
+		format, err := ParseGraphFormat("PlantUML")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(format).To(Equal(FormatPlantUML))
+		_, err = ParseGraphFormat("svg")
+		Expect(err).To(HaveOccurred())
+		_, err = Render(orders, "svg", nil)
+		Expect(err).To(HaveOccurred())
+	})
+	It("can render Graphviz DOT", func() {
+		dot, err := Render(orders, FormatDot, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dot).To(HavePrefix(`digraph "orders:v1" {`))
+		Expect(dot).To(ContainSubstring(`subgraph "cluster_processing" {`))
+		Expect(dot).To(ContainSubstring(`"shipped" [label="shipped\nentry / invoice"];`))
+		Expect(dot).To(ContainSubstring(`__start -> "processing/picking";`))
+		Expect(dot).To(ContainSubstring(
+			`"processing/picking" -> "shipped" [label="ship [ok] / notify", ltail="cluster_processing"];`))
+		Expect(dot).To(ContainSubstring(`"processing/packing" -> "cancelled" [label="cancel"];`))
+		// Terminal states are not the origin of wildcard transitions.
+		Expect(dot).ToNot(ContainSubstring(`"shipped" -> "cancelled"`))
+		Expect(dot).To(ContainSubstring(`"cancelled" -> __end;`))
+	})
+	It("can render Mermaid", func() {
+		mermaid, err := Render(orders, FormatMermaid, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mermaid).To(ContainSubstring("stateDiagram-v2\n"))
+		Expect(mermaid).To(ContainSubstring("  state processing {\n" +
+			"    state \"picking\" as processing_picking\n"))
+		Expect(mermaid).To(ContainSubstring("  shipped : entry / invoice\n"))
+		Expect(mermaid).To(ContainSubstring("  [*] --> processing_picking\n"))
+		Expect(mermaid).To(ContainSubstring("  processing --> shipped : ship [ok] / notify\n"))
+		Expect(mermaid).To(ContainSubstring("  shipped --> [*]\n"))
+		Expect(mermaid).ToNot(ContainSubstring("classDef"))
+	})
+	It("can render PlantUML", func() {
+		uml, err := Render(orders, FormatPlantUML, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(uml).To(HavePrefix("@startuml\n"))
+		Expect(uml).To(HaveSuffix("@enduml\n"))
+		Expect(uml).To(ContainSubstring("state \"processing\" as processing {\n"))
+		Expect(uml).To(ContainSubstring("processing_picking --> processing_packing : pick\n"))
+		Expect(uml).To(ContainSubstring("cancelled --> [*]\n"))
+	})
+	It("highlights the path of an FSM", func() {
+		fsm, _ := NewStateMachine(orders)
+		Expect(fsm.SendEvent(NewEvent("pick"))).To(Succeed())
+
+		uml, err := Render(orders, FormatPlantUML, fsm.FSM)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(uml).To(ContainSubstring(`state "packing" as processing_packing #palegreen`))
+		Expect(uml).To(ContainSubstring(`state "picking" as processing_picking ##blue`))
+		Expect(uml).To(ContainSubstring("processing_picking -[#blue,bold]-> processing_packing : pick\n"))
+		Expect(uml).To(ContainSubstring("processing_picking --> cancelled : cancel\n"))
+
+		dot, _ := Render(orders, FormatDot, fsm.FSM)
+		Expect(dot).To(ContainSubstring(
+			`"processing/picking" -> "processing/packing" [label="pick", color=blue, penwidth=2];`))
+
+		mermaid, _ := Render(orders, FormatMermaid, fsm.FSM)
+		Expect(mermaid).To(ContainSubstring("  class processing_packing current\n"))
+		Expect(mermaid).To(ContainSubstring("  class processing_picking visited\n"))
+	})
+})
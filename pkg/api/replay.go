@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var (
+	InvalidHistoryError   = "invalid history, event #%d `%s` [%s]: %v"
+	DivergentHistoryError = fmt.Errorf("the recorded transition differs from the replayed one")
+)
+
+// Replay rebuilds an FSM configured with `c`, from its starting state, by sending it all
+// the events in its `history`, in order: its state, data (see GetData) and History are
+// those the FSM would have, had it received the same events.
+//
+// The compensating entries of rollbacks (see IsRollback) are replayed too, reverting the
+// FSM as they originally did.
+//
+// FSMs moved to `c` from another Configuration (see Migration) are instead rebuilt from
+// the last migration entry (see IsMigration) in their `history`: the state and data it
+// recorded are restored, and only the events which follow it are replayed; the earlier
+// ones are kept as they are.
+//
+// If any of the events is rejected, or causes a different transition from the one which
+// was recorded in the history, the history is not valid for the Configuration, and an
+// error is returned.
+func Replay(c *protos.Configuration, history []*protos.Event) (*ConfiguredStateMachine, error) {
+	fsm, err := NewStateMachine(c)
+	if err != nil {
+		return nil, err
+	}
+	start := sinceMigration(history)
+	if start > 0 {
+		migration := history[start-1]
+		if err = fsm.migrated(migration); err != nil {
+			return nil, fmt.Errorf(InvalidHistoryError, start, MigrationEvent, migration.GetEventId(), err)
+		}
+		fsm.FSM.History = append(fsm.FSM.History, history[:start]...)
+	}
+	for i := start; i < len(history); i++ {
+		evt := history[i]
+		recorded := evt.GetTransition()
+		if IsRollback(evt) {
+			_, err = fsm.rollback(proto.Clone(evt).(*protos.Event))
+		} else {
+			_, err = fsm.ProcessEvent(evt)
+		}
+		if err != nil {
+			return nil, fmt.Errorf(InvalidHistoryError, i+1, recorded.GetEvent(), evt.GetEventId(), err)
+		}
+		replayed := fsm.FSM.History[len(fsm.FSM.History)-1].Transition
+		if (recorded.GetFrom() != "" && recorded.GetFrom() != replayed.From) ||
+			(recorded.GetTo() != "" && recorded.GetTo() != replayed.To) {
+			return nil, fmt.Errorf(InvalidHistoryError, i+1, recorded.GetEvent(), evt.GetEventId(),
+				fmt.Errorf("%v: from %s to %s, instead of from %s to %s", DivergentHistoryError,
+					recorded.GetFrom(), recorded.GetTo(), replayed.From, replayed.To))
+		}
+	}
+	return fsm, nil
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api_test
+
+import (
+	. "github.com/massenz/go-statemachine/pkg/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("Replaying histories", func() {
+	var orders *protos.Configuration
+	var fsm *ConfiguredStateMachine
+	BeforeEach(func() {
+		orders = &protos.Configuration{
+			Name:          "orders",
+			Version:       "v1",
+			StartingState: "pending",
+			States:        []string{"pending", "shipped", "delivered"},
+			Transitions: []*protos.Transition{
+				{From: "pending", To: "shipped", Event: "ship [weight < 20] / incr(shipments)"},
+				{From: "shipped", To: "pending", Event: "return"},
+				{From: "shipped", To: "delivered", Event: "deliver"},
+			},
+		}
+		fsm, _ = NewStateMachine(orders)
+		for _, name := range []string{"ship", "return", "ship"} {
+			evt := NewEvent(name)
+			evt.Details = `{"weight": 10}`
+			Expect(fsm.SendEvent(evt)).To(Succeed())
+		}
+	})
+	It("rebuilds the state and data", func() {
+		replayed, err := Replay(orders, fsm.FSM.History)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(replayed.FSM.State).To(Equal("shipped"))
+		Expect(replayed.FSM.History).To(HaveLen(3))
+		Expect(replayed.FSM.History[2].EventId).To(Equal(fsm.FSM.History[2].EventId))
+		data, err := GetData(replayed.FSM)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data.AsMap()).To(Equal(map[string]interface{}{"shipments": 2.0}))
+	})
+	It("rejects histories with events which are not accepted", func() {
+		history := append(fsm.FSM.History, NewEvent("ship"))
+		_, err := Replay(orders, history)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix("invalid history, event #4 `ship`"))
+	})
+	It("rejects histories whose transitions differ", func() {
+		fsm.FSM.History[1].Transition.To = "delivered"
+		_, err := Replay(orders, fsm.FSM.History)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(DivergentHistoryError.Error()))
+	})
+})
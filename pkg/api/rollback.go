@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+const (
+	// RollbackEvent is the event of the compensating entries recorded in an FSM's History
+	// when it is rolled back (see Rollback): their Details carry the number of steps.
+	RollbackEvent = "$rollback"
+
+	RollbackOriginator = "rollback"
+)
+
+var (
+	InvalidRollbackError = "cannot roll back %d steps, the FSM only took %d"
+)
+
+// rollbackDetails are the Details of the compensating entries for rollbacks.
+type rollbackDetails struct {
+	Steps int `json:"steps"`
+}
+
+// IsRollback returns true if the Event is the compensating entry for a rollback.
+func IsRollback(evt *protos.Event) bool {
+	return evt.GetTransition().GetEvent() == RollbackEvent
+}
+
+// EffectiveHistory returns the events in the `history` which were not rolled back, leaving
+// out the compensating entries (see IsRollback).
+func EffectiveHistory(history []*protos.Event) ([]*protos.Event, error) {
+	var effective []*protos.Event
+	for _, evt := range history {
+		if !IsRollback(evt) {
+			effective = append(effective, evt)
+			continue
+		}
+		var details rollbackDetails
+		if err := json.Unmarshal([]byte(evt.GetDetails()), &details); err != nil {
+			return nil, fmt.Errorf("invalid rollback [%s]: %v", evt.GetEventId(), err)
+		}
+		if details.Steps <= 0 || details.Steps > len(effective) {
+			return nil, fmt.Errorf(InvalidRollbackError, details.Steps, len(effective))
+		}
+		effective = effective[:len(effective)-details.Steps]
+	}
+	return effective, nil
+}
+
+// Rollback reverts the last `steps` transitions the FSM took, which were not already rolled
+// back: the FSM's state, data and completion time are those it had before them, obtained by
+// replaying the events which remain (see Replay), even if the FSM was completed. Only the
+// transitions taken since the FSM was last migrated (see Migration) can be reverted.
+//
+// The reverted events are not removed from the History: a compensating entry (see
+// IsRollback) is recorded instead, whose transition is from the current state to the
+// restored one. The returned Effects carry the states exited and entered, but no Actions
+// are caused by a rollback.
+func (x *ConfiguredStateMachine) Rollback(steps int, originator string) (*Effects, error) {
+	details, _ := json.Marshal(rollbackDetails{Steps: steps})
+	evt := NewEvent(RollbackEvent)
+	evt.Originator = originator
+	evt.Details = string(details)
+	return x.rollback(evt)
+}
+
+// rollback reverts the FSM as described by the compensating entry `evt`, which is then
+// recorded in the History.
+func (x *ConfiguredStateMachine) rollback(evt *protos.Event) (*Effects, error) {
+	var details rollbackDetails
+	if err := json.Unmarshal([]byte(evt.GetDetails()), &details); err != nil {
+		return nil, fmt.Errorf("invalid rollback [%s]: %v", evt.GetEventId(), err)
+	}
+	effective, err := EffectiveHistory(x.FSM.History)
+	if err != nil {
+		return nil, err
+	}
+	// Migrations (see IsMigration) cannot be rolled back, nor can the events before them.
+	revertible := len(effective) - sinceMigration(effective)
+	if details.Steps <= 0 || details.Steps > revertible {
+		return nil, fmt.Errorf(InvalidRollbackError, details.Steps, revertible)
+	}
+	restored, err := Replay(x.Config, effective[:len(effective)-details.Steps])
+	if err != nil {
+		return nil, err
+	}
+	data, err := GetData(restored.FSM)
+	if err != nil {
+		return nil, err
+	}
+	if err = SetData(x.FSM, data); err != nil {
+		return nil, err
+	}
+	if err = setCompletedAt(x.FSM, GetCompletedAt(restored.FSM)); err != nil {
+		return nil, err
+	}
+	from, to := x.FSM.State, restored.FSM.State
+	evt.Transition.From = from
+	evt.Transition.To = to
+	x.FSM.State = to
+	x.FSM.History = append(x.FSM.History, evt)
+	return &Effects{
+		Exited:  ExitedStates(from, to),
+		Entered: EnteredStates(from, to),
+	}, nil
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api_test
+
+import (
+	. "github.com/massenz/go-statemachine/pkg/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("Rollbacks", func() {
+	var fsm *ConfiguredStateMachine
+	BeforeEach(func() {
+		orders := &protos.Configuration{
+			Name:          "orders",
+			Version:       "v1",
+			StartingState: "pending",
+			States:        []string{"pending", "review", "processing", "processing/picking", "cancelled"},
+			Transitions: []*protos.Transition{
+				{From: "pending", To: "review", Event: "review / incr(reviews)"},
+				{From: "review", To: "processing/picking", Event: "accept"},
+				{From: "pending, review", To: "cancelled", Event: "cancel"},
+				{From: "cancelled", To: FinalState},
+			},
+		}
+		fsm, _ = NewStateMachine(orders)
+		Expect(fsm.SendEvent(NewEvent("review"))).To(Succeed())
+		Expect(fsm.SendEvent(NewEvent("cancel"))).To(Succeed())
+		Expect(fsm.IsCompleted()).To(BeTrue())
+	})
+	It("reverts the last transitions, recording a compensating entry", func() {
+		effects, err := fsm.Rollback(1, "operator")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fsm.FSM.State).To(Equal("review"))
+		Expect(effects.Exited).To(Equal([]string{"cancelled"}))
+		Expect(effects.Entered).To(Equal([]string{"review"}))
+		Expect(effects.Actions).To(BeEmpty())
+		Expect(fsm.FSM.History).To(HaveLen(3))
+		last := fsm.FSM.History[2]
+		Expect(IsRollback(last)).To(BeTrue())
+		Expect(last.Originator).To(Equal("operator"))
+		Expect(last.Transition.From).To(Equal("cancelled"))
+		Expect(last.Transition.To).To(Equal("review"))
+
+		Expect(fsm.SendEvent(NewEvent("accept"))).To(Succeed())
+		Expect(fsm.FSM.State).To(Equal("processing/picking"))
+	})
+	It("restores the FSM's data", func() {
+		_, err := fsm.Rollback(2, "operator")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fsm.FSM.State).To(Equal("pending"))
+		data, _ := GetData(fsm.FSM)
+		Expect(data.GetFields()).To(BeEmpty())
+	})
+	It("does not revert transitions already rolled back", func() {
+		_, err := fsm.Rollback(1, "operator")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = fsm.Rollback(2, "operator")
+		Expect(err).To(HaveOccurred())
+		_, err = fsm.Rollback(1, "operator")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fsm.FSM.State).To(Equal("pending"))
+
+		effective, err := EffectiveHistory(fsm.FSM.History)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(effective).To(BeEmpty())
+	})
+	It("can be replayed", func() {
+		_, err := fsm.Rollback(1, "operator")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fsm.SendEvent(NewEvent("accept"))).To(Succeed())
+
+		replayed, err := Replay(fsm.Config, fsm.FSM.History)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(replayed.FSM.State).To(Equal("processing/picking"))
+		Expect(replayed.FSM.History).To(HaveLen(4))
+		data, _ := GetData(replayed.FSM)
+		Expect(data.AsMap()).To(Equal(map[string]interface{}{"reviews": 1.0}))
+	})
+})
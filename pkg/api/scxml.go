@@ -0,0 +1,392 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+const (
+	SCXMLNamespace = "http://www.w3.org/2005/07/scxml"
+
+	// FSMNamespace qualifies the SCXML attributes which carry the parts of a Configuration
+	// that SCXML has no equivalent for, such as the transitions' timeouts (see Trigger).
+	FSMNamespace = "https://github.com/massenz/go-statemachine"
+
+	// SCXMLIdSeparator replaces the StateSeparator in the IDs of exported nested states, as
+	// SCXML IDs cannot contain slashes.
+	SCXMLIdSeparator = "."
+)
+
+var (
+	UnsupportedSCXMLError = "unsupported SCXML %s in %s"
+	InvalidSCXMLError     = "invalid SCXML %s in %s: %s"
+)
+
+// xmlNode is a generic XML element, which preserves the order of its children (as the
+// order of states and transitions is meaningful) and any unexpected element or attribute.
+type xmlNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Nodes   []*xmlNode `xml:",any"`
+}
+
+func (n *xmlNode) attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name && (a.Name.Space == "" || a.Name.Space == SCXMLNamespace) {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (n *xmlNode) fsmAttr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name && a.Name.Space == FSMNamespace {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (n *xmlNode) setAttr(name, value string) {
+	if value != "" {
+		n.Attrs = append(n.Attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+	}
+}
+
+func (n *xmlNode) add(name string) *xmlNode {
+	child := &xmlNode{XMLName: xml.Name{Local: name}}
+	n.Nodes = append(n.Nodes, child)
+	return child
+}
+
+// ImportSCXML converts an SCXML document into a Configuration, with the given `version`
+// (the SCXML `name` becomes the Configuration's name):
+//
+//   - `<state>` elements become states, with nested ones named after their parent (see
+//     StateSeparator), and `<final>` ones become terminal states;
+//   - `<transition>` elements become transitions, using their `event` and `target`, and
+//     their `cond` as a guard; transitions with no target become internal transitions;
+//   - the events of the `<send>` elements in `<onentry>`, `<onexit>` and `<transition>`
+//     become (respectively) entry, exit and transition actions.
+//
+// Transitions to a compound state are moved to its initial state (recursively, until one
+// which is not compound); `fsm:after` attributes (see FSMNamespace) on transitions become
+// their timeouts.
+//
+// Other SCXML constructs (e.g., `<parallel>` or `<datamodel>`) are not supported: all of
+// those found are reported in the returned ValidationError.
+func ImportSCXML(data []byte, version string) (*protos.Configuration, error) {
+	var root xmlNode
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("cannot parse SCXML: %v", err)
+	}
+	if root.XMLName.Local != "scxml" {
+		return nil, fmt.Errorf("not an SCXML document, found <%s>", root.XMLName.Local)
+	}
+	imp := &scxmlImporter{
+		cfg:      &protos.Configuration{Name: root.attr("name"), Version: version},
+		names:    make(map[string]string),
+		initials: make(map[string]string),
+	}
+	if imp.cfg.Name == "" {
+		imp.addError("", fmt.Errorf(InvalidSCXMLError, "document", "<scxml>",
+			"the `name` attribute is required"))
+	}
+	imp.collectStates(&root, "")
+	imp.cfg.StartingState = imp.resolve(imp.initials[""], "<scxml>")
+	imp.collectTransitions(&root)
+	if err := imp.findings.Err(); err != nil {
+		return nil, err
+	}
+	return imp.cfg, nil
+}
+
+type scxmlImporter struct {
+	cfg      *protos.Configuration
+	findings Findings
+	// names maps the SCXML IDs to the names of the states, and initials the names of
+	// compound states (and the empty string, for the document) to their initial state's ID.
+	names    map[string]string
+	initials map[string]string
+}
+
+func (imp *scxmlImporter) addError(state string, err error) {
+	imp.findings = append(imp.findings, Finding{Severity: SeverityError, State: state, Err: err})
+}
+
+func (imp *scxmlImporter) unsupported(state string, what string, where string) {
+	imp.addError(state, fmt.Errorf(UnsupportedSCXMLError, what, where))
+}
+
+// collectStates walks the states nested in `node` (whose state name is `parent`, or empty
+// for the document itself), recording their names and initial states.
+func (imp *scxmlImporter) collectStates(node *xmlNode, parent string) {
+	where := "<" + node.XMLName.Local + ">"
+	if parent != "" {
+		where = "state " + parent
+	}
+	imp.initials[parent] = node.attr("initial")
+	for _, child := range node.Nodes {
+		switch child.XMLName.Local {
+		case "state", "final":
+			id := child.attr("id")
+			if id == "" {
+				imp.addError(parent, fmt.Errorf(InvalidSCXMLError, "<"+child.XMLName.Local+">", where,
+					"the `id` attribute is required"))
+				continue
+			}
+			name := id
+			if parent != "" {
+				// Exported nested states carry their parent's ID as a prefix.
+				name = parent + StateSeparator + strings.TrimPrefix(id,
+					strings.ReplaceAll(parent, StateSeparator, SCXMLIdSeparator)+SCXMLIdSeparator)
+			}
+			if _, found := imp.names[id]; found {
+				imp.addError(name, fmt.Errorf(InvalidSCXMLError, "state", where,
+					fmt.Sprintf("duplicate id `%s`", id)))
+				continue
+			}
+			imp.names[id] = name
+			imp.cfg.States = append(imp.cfg.States, name)
+			if imp.initials[parent] == "" {
+				imp.initials[parent] = id
+			}
+			if child.XMLName.Local == "final" {
+				if parent != "" {
+					imp.unsupported(name, "<final> nested in a compound state", where)
+					continue
+				}
+				imp.cfg.Transitions = append(imp.cfg.Transitions, &protos.Transition{From: name, To: FinalState})
+			}
+			imp.collectStates(child, name)
+		case "initial":
+			for _, t := range child.Nodes {
+				if t.XMLName.Local == "transition" {
+					imp.initials[parent] = t.attr("target")
+				}
+			}
+		case "transition", "onentry", "onexit":
+			if parent == "" {
+				imp.unsupported("", "<"+child.XMLName.Local+">", where)
+			}
+		default:
+			imp.unsupported(parent, "<"+child.XMLName.Local+">", where)
+		}
+	}
+}
+
+// resolve returns the name of the state whose ID is `id`, moving on to the initial state
+// of compound states, until one which is not compound.
+func (imp *scxmlImporter) resolve(id string, where string) string {
+	name, found := imp.names[id]
+	if !found {
+		imp.addError("", fmt.Errorf(InvalidSCXMLError, "target", where,
+			fmt.Sprintf("unknown state `%s`", id)))
+		return ""
+	}
+	if initial := imp.initials[name]; initial != "" && IsCompound(imp.cfg, name) {
+		return imp.resolve(initial, where)
+	}
+	return name
+}
+
+// collectTransitions walks all the states nested in `node`, converting their transitions
+// and entry/exit actions.
+func (imp *scxmlImporter) collectTransitions(node *xmlNode) {
+	for _, child := range node.Nodes {
+		if child.XMLName.Local != "state" && child.XMLName.Local != "final" {
+			continue
+		}
+		name, found := imp.names[child.attr("id")]
+		if !found {
+			continue
+		}
+		where := "state " + name
+		for _, n := range child.Nodes {
+			switch n.XMLName.Local {
+			case "onentry", "onexit":
+				kind := EntryAction
+				if n.XMLName.Local == "onexit" {
+					kind = ExitAction
+				}
+				if actions := imp.actions(n, name, where); len(actions) > 0 {
+					imp.cfg.Transitions = append(imp.cfg.Transitions, &protos.Transition{
+						From:  name,
+						Event: string(kind) + " " + ActionsStart + " " + strings.Join(actions, ActionsSeparator+" "),
+					})
+				}
+			case "transition":
+				imp.transition(n, name, where)
+			}
+		}
+		imp.collectTransitions(child)
+	}
+}
+
+func (imp *scxmlImporter) transition(n *xmlNode, from string, where string) {
+	events := strings.Fields(n.attr("event"))
+	if len(events) == 0 {
+		imp.unsupported(from, "eventless <transition>", where)
+		return
+	}
+	for _, event := range events {
+		if strings.Contains(event, AnyState) {
+			imp.unsupported(from, fmt.Sprintf("wildcard event `%s`", event), where)
+			return
+		}
+	}
+	to := ""
+	if targets := strings.Fields(n.attr("target")); len(targets) > 1 {
+		imp.unsupported(from, "<transition> with multiple targets", where)
+		return
+	} else if len(targets) == 1 {
+		if to = imp.resolve(targets[0], where); to == "" {
+			return
+		}
+	}
+	var suffix string
+	if after := n.fsmAttr("after"); after != "" {
+		suffix += " " + TimeoutStart + after + TimeoutEnd
+	}
+	if cond := n.attr("cond"); cond != "" {
+		suffix += " " + GuardStart + cond + GuardEnd
+	}
+	if actions := imp.actions(n, from, where); len(actions) > 0 {
+		suffix += " " + ActionsStart + " " + strings.Join(actions, ActionsSeparator+" ")
+	}
+	for _, event := range events {
+		label := event + suffix
+		if _, err := ParseTrigger(label); err != nil {
+			imp.addError(from, fmt.Errorf(InvalidSCXMLError, "<transition>", where, err.Error()))
+			continue
+		}
+		imp.cfg.Transitions = append(imp.cfg.Transitions, &protos.Transition{From: from, To: to, Event: label})
+	}
+}
+
+// actions returns the events of the `<send>` elements in `n`, which are the only supported
+// executable content.
+func (imp *scxmlImporter) actions(n *xmlNode, state string, where string) []string {
+	var actions []string
+	for _, child := range n.Nodes {
+		if child.XMLName.Local != "send" || child.attr("event") == "" {
+			imp.unsupported(state, fmt.Sprintf("<%s> in <%s>", child.XMLName.Local, n.XMLName.Local), where)
+			continue
+		}
+		actions = append(actions, child.attr("event"))
+	}
+	return actions
+}
+
+// ExportSCXML converts the Configuration into an SCXML document, which can be converted
+// back with ImportSCXML (with the exception of the version, which SCXML does not carry).
+//
+// Transitions from several states (see AnyState and OriginsSeparator) are repeated for
+// each of them; timeouts are exported as `fsm:after` attributes.
+func ExportSCXML(c *protos.Configuration) ([]byte, error) {
+	root := &xmlNode{XMLName: xml.Name{Local: "scxml"}}
+	root.setAttr("xmlns", SCXMLNamespace)
+	root.setAttr("xmlns:fsm", FSMNamespace)
+	root.setAttr("version", "1.0")
+	root.setAttr("name", c.Name)
+	root.setAttr("initial", scxmlId(c.StartingState))
+
+	children := make(map[string][]string)
+	for _, s := range c.States {
+		children[Parent(s)] = append(children[Parent(s)], s)
+	}
+	var export func(parent *xmlNode, state string) error
+	export = func(parent *xmlNode, state string) error {
+		element := "state"
+		if IsTerminal(c, state) && !IsCompound(c, state) {
+			element = "final"
+		}
+		node := parent.add(element)
+		node.setAttr("id", scxmlId(state))
+		for _, kind := range []ActionKind{EntryAction, ExitAction} {
+			if actions := StateActions(c, state, kind); len(actions) > 0 {
+				addSends(node.add("on"+string(kind)), actions)
+			}
+		}
+		for _, t := range c.Transitions {
+			if IsFinal(t) || IsActivity(t) || !exportedFrom(c, t, state) {
+				continue
+			}
+			trigger, err := ParseTrigger(t.Event)
+			if err != nil {
+				return err
+			}
+			tn := node.add("transition")
+			tn.setAttr("event", trigger.Event)
+			if trigger.Guard != nil {
+				tn.setAttr("cond", trigger.Guard.Source)
+			}
+			if IsInternal(t) {
+				tn.setAttr("type", "internal")
+			} else {
+				tn.setAttr("target", scxmlId(t.To))
+			}
+			if trigger.Timeout > 0 {
+				tn.setAttr("fsm:after", trigger.Timeout.String())
+			}
+			actions := trigger.Actions
+			for _, u := range trigger.Updates {
+				actions = append(actions, u.String())
+			}
+			addSends(tn, actions)
+		}
+		for _, child := range children[state] {
+			if err := export(node, child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, s := range children[""] {
+		if err := export(root, s); err != nil {
+			return nil, err
+		}
+	}
+	data, err := xml.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
+
+// exportedFrom returns true if the Transition is exported as one of `state`'s own: wildcard
+// ones are exported from all the non-terminal states they can be taken from.
+func exportedFrom(c *protos.Configuration, t *protos.Transition, state string) bool {
+	if IsWildcard(t) {
+		return FromState(c, t, state) && !IsTerminal(c, state)
+	}
+	for _, s := range Origins(c, t) {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+func addSends(node *xmlNode, events []string) {
+	for _, event := range events {
+		node.add("send").setAttr("event", event)
+	}
+}
+
+func scxmlId(state string) string {
+	return strings.ReplaceAll(state, StateSeparator, SCXMLIdSeparator)
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api_test
+
+import (
+	. "github.com/massenz/go-statemachine/pkg/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("SCXML", func() {
+	Context("when importing documents", func() {
+		It("converts states and transitions", func() {
+			cfg, err := ImportSCXML([]byte(`<?xml version="1.0"?>
+<scxml xmlns="http://www.w3.org/2005/07/scxml" version="1.0" name="orders" initial="processing">
+  <state id="processing" initial="picking">
+    <transition event="cancel" target="cancelled"/>
+    <state id="picking">
+      <transition event="pick" target="packing"/>
+    </state>
+    <state id="packing">
+      <transition event="ship" cond="weight &lt; 20" target="shipped">
+        <send event="notify"/>
+      </transition>
+      <transition event="ping pong"/>
+    </state>
+  </state>
+  <final id="shipped">
+    <onentry><send event="invoice"/></onentry>
+  </final>
+  <final id="cancelled"/>
+</scxml>`), "v1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Name).To(Equal("orders"))
+			Expect(cfg.Version).To(Equal("v1"))
+			Expect(cfg.StartingState).To(Equal("processing/picking"))
+			Expect(cfg.States).To(Equal([]string{"processing", "processing/picking", "processing/packing",
+				"shipped", "cancelled"}))
+			Expect(cfg.Transitions).To(ContainElements(
+				&protos.Transition{From: "processing", To: "cancelled", Event: "cancel"},
+				&protos.Transition{From: "processing/picking", To: "processing/packing", Event: "pick"},
+				&protos.Transition{From: "processing/packing", To: "shipped", Event: "ship [weight < 20] / notify"},
+				&protos.Transition{From: "processing/packing", Event: "ping"},
+				&protos.Transition{From: "processing/packing", Event: "pong"},
+				&protos.Transition{From: "shipped", Event: "entry / invoice"},
+				&protos.Transition{From: "shipped", To: FinalState},
+				&protos.Transition{From: "cancelled", To: FinalState},
+			))
+			Expect(Validate(cfg)).To(BeEmpty())
+		})
+		It("reports all unsupported constructs", func() {
+			_, err := ImportSCXML([]byte(`<scxml xmlns="http://www.w3.org/2005/07/scxml" name="orders">
+  <datamodel><data id="count" expr="0"/></datamodel>
+  <state id="pending">
+    <onentry><log expr="'pending'"/></onentry>
+    <transition event="error.*" target="failed"/>
+    <transition target="shipped"/>
+    <history id="last"/>
+  </state>
+  <parallel id="shipped"/>
+</scxml>`), "v1")
+			Expect(err).To(HaveOccurred())
+			var validation *ValidationError
+			Expect(err).To(BeAssignableToTypeOf(validation))
+			Expect(err.Error()).To(ContainSubstring("unsupported SCXML <datamodel> in <scxml>"))
+			Expect(err.Error()).To(ContainSubstring("unsupported SCXML <parallel> in <scxml>"))
+			Expect(err.Error()).To(ContainSubstring("unsupported SCXML <history> in state pending"))
+			Expect(err.Error()).To(ContainSubstring("unsupported SCXML <log> in <onentry>"))
+			Expect(err.Error()).To(ContainSubstring("unsupported SCXML wildcard event `error.*`"))
+			Expect(err.Error()).To(ContainSubstring("unsupported SCXML eventless <transition>"))
+		})
+		It("rejects invalid documents", func() {
+			_, err := ImportSCXML([]byte(`<scxml name="orders"><state id="a">`), "v1")
+			Expect(err).To(HaveOccurred())
+			_, err = ImportSCXML([]byte(`<statechart name="orders"/>`), "v1")
+			Expect(err).To(HaveOccurred())
+			_, err = ImportSCXML([]byte(`<scxml name="orders">
+  <state id="a"><transition event="go" target="b"/></state>
+</scxml>`), "v1")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("unknown state `b`"))
+		})
+	})
+	It("can export and import back a Configuration", func() {
+		orders := &protos.Configuration{
+			Name:          "orders",
+			Version:       "v1",
+			StartingState: "processing/picking",
+			States: []string{"processing", "processing/picking", "processing/packing", "shipped",
+				"cancelled"},
+			Transitions: []*protos.Transition{
+				{From: "processing/picking", To: "processing/packing", Event: "pick after(1h0m0s) / incr(picks)"},
+				{From: "processing", To: "shipped", Event: "ship [weight < 20] / notify"},
+				{From: "*", To: "cancelled", Event: "cancel"},
+				{From: "processing/packing", Event: "ping / pong"},
+				{From: "shipped", Event: "entry / invoice"},
+				{From: "shipped", To: FinalState},
+				{From: "cancelled", To: FinalState},
+			},
+		}
+		data, err := ExportSCXML(orders)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring(`<state id="processing.picking">`))
+		Expect(string(data)).To(ContainSubstring(`<final id="cancelled">`))
+		Expect(string(data)).To(ContainSubstring(
+			`<transition event="pick" target="processing.packing" fsm:after="1h0m0s">`))
+
+		cfg, err := ImportSCXML(data, "v2")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cfg.StartingState).To(Equal(orders.StartingState))
+		Expect(cfg.States).To(Equal(orders.States))
+		// Wildcard transitions are exported for each of their origins.
+		Expect(cfg.Transitions).To(ContainElements(
+			orders.Transitions[0], orders.Transitions[1], orders.Transitions[3], orders.Transitions[4],
+			&protos.Transition{From: "processing/picking", To: "cancelled", Event: "cancel"},
+			&protos.Transition{From: "processing/packing", To: "cancelled", Event: "cancel"},
+		))
+		Expect(cfg.Transitions).To(HaveLen(len(orders.Transitions) + 1))
+		Expect(Validate(cfg)).To(BeEmpty())
+	})
+})
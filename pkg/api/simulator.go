@@ -0,0 +1,227 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+// SimulatorOriginator is the Originator of the events sent by a Simulator.
+const SimulatorOriginator = "simulator"
+
+// A Simulator runs an FSM offline, with neither a store nor a server: each event sent to
+// it is recorded as a SimulationStep, whether it was accepted or rejected.
+//
+// Time is simulated too: timers (see Timer) are started and cancelled as the FSM enters and
+// leaves states, and fire when the simulated time advances past their timeout (see Wait).
+type Simulator struct {
+	*ConfiguredStateMachine
+
+	// Elapsed is the simulated time since the FSM was created.
+	Elapsed time.Duration
+	Steps   []*SimulationStep
+
+	timers []simulatedTimer
+}
+
+type simulatedTimer struct {
+	Timer
+	due time.Duration
+}
+
+// A SimulationStep records the outcome of one of the events sent to a Simulator.
+type SimulationStep struct {
+	Event string `json:"event" yaml:"event"`
+	// Elapsed is the simulated time at which the event was sent.
+	Elapsed string `json:"elapsed,omitempty" yaml:"elapsed,omitempty"`
+	// Timer is true if the event was sent by a Timer, rather than by the user.
+	Timer bool   `json:"timer,omitempty" yaml:"timer,omitempty"`
+	From  string `json:"from" yaml:"from"`
+	// To is the state the FSM transitioned to, and is empty if the event was rejected.
+	To      string   `json:"to,omitempty" yaml:"to,omitempty"`
+	Actions []string `json:"actions,omitempty" yaml:"actions,omitempty"`
+	// Error is the reason the event was rejected, and is empty if it was accepted.
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+func (s *SimulationStep) Rejected() bool {
+	return s.Error != ""
+}
+
+// NewSimulator creates a Simulator for a new FSM configured with `c`, which must be valid
+// (see CheckValid), and starts the timers of its starting state.
+func NewSimulator(c *protos.Configuration) (*Simulator, error) {
+	if err := CheckValid(c); err != nil {
+		return nil, err
+	}
+	fsm, err := NewStateMachine(c)
+	if err != nil {
+		return nil, err
+	}
+	s := &Simulator{ConfiguredStateMachine: fsm}
+	s.startTimers(EnteredStates("", c.StartingState))
+	return s, nil
+}
+
+// Send sends the event to the FSM, with the given `details` (as JSON, see Trigger), and
+// returns the recorded step.
+func (s *Simulator) Send(event, details string) *SimulationStep {
+	evt := NewEvent(event)
+	evt.Originator = SimulatorOriginator
+	evt.Details = details
+	return s.process(evt, false)
+}
+
+// Wait advances the simulated time by `d`, firing all the timers which are due in the
+// meantime (in the order they are due), and returns the steps recorded for them.
+func (s *Simulator) Wait(d time.Duration) []*SimulationStep {
+	var steps []*SimulationStep
+	deadline := s.Elapsed + d
+	for len(s.timers) > 0 && s.timers[0].due <= deadline {
+		timer := s.timers[0]
+		s.timers = s.timers[1:]
+		s.Elapsed = timer.due
+		evt := NewTimerEvent(timer.Timer)
+		steps = append(steps, s.process(evt, true))
+	}
+	s.Elapsed = deadline
+	return steps
+}
+
+func (s *Simulator) process(evt *protos.Event, timer bool) *SimulationStep {
+	step := &SimulationStep{
+		Event: evt.Transition.Event,
+		Timer: timer,
+		From:  s.FSM.State,
+	}
+	if s.Elapsed > 0 {
+		step.Elapsed = s.Elapsed.String()
+	}
+	s.Steps = append(s.Steps, step)
+	effects, err := s.ProcessEvent(evt)
+	if err != nil {
+		step.Error = err.Error()
+		return step
+	}
+	step.To = s.FSM.State
+	for _, action := range effects.Actions {
+		name := action.Name
+		if action.Kind != TransitionAction {
+			name = fmt.Sprintf("%s (%s %s)", action.Name, action.Kind, action.State)
+		}
+		step.Actions = append(step.Actions, name)
+	}
+	s.cancelTimers(effects.Exited)
+	s.startTimers(effects.Entered)
+	return step
+}
+
+func (s *Simulator) startTimers(states []string) {
+	for _, state := range states {
+		for _, timer := range Timers(s.Config, state) {
+			s.timers = append(s.timers, simulatedTimer{Timer: timer, due: s.Elapsed + timer.Timeout})
+		}
+	}
+	sort.SliceStable(s.timers, func(i, j int) bool {
+		return s.timers[i].due < s.timers[j].due
+	})
+}
+
+func (s *Simulator) cancelTimers(states []string) {
+	exited := make(map[string]bool)
+	for _, state := range states {
+		exited[state] = true
+	}
+	running := s.timers[:0]
+	for _, timer := range s.timers {
+		if !exited[timer.State] {
+			running = append(running, timer)
+		}
+	}
+	s.timers = running
+}
+
+// A SimulatedEvent is one of the events of a Simulation, along with its expected outcome.
+type SimulatedEvent struct {
+	// Wait, if set, is how long (e.g., `48h`) the simulated time advances before the event
+	// is sent, firing any timer due in the meantime; the Event can be omitted, to only wait.
+	Wait    string `json:"wait,omitempty" yaml:"wait,omitempty"`
+	Event   string `json:"event,omitempty" yaml:"event,omitempty"`
+	Details string `json:"details,omitempty" yaml:"details,omitempty"`
+	// Rejected is true if the event is expected to be rejected.
+	Rejected bool `json:"rejected,omitempty" yaml:"rejected,omitempty"`
+	// State, if set, is the state the FSM is expected to be in, once the event was sent.
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+}
+
+// A Simulation is the outcome of sending a sequence of events to a new FSM (see Simulate).
+type Simulation struct {
+	Config    string                 `json:"config" yaml:"config"`
+	Steps     []*SimulationStep      `json:"steps" yaml:"steps"`
+	State     string                 `json:"state" yaml:"state"`
+	Completed bool                   `json:"completed,omitempty" yaml:"completed,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty" yaml:"data,omitempty"`
+	// Failures describe all the outcomes which were not the expected ones.
+	Failures []string `json:"failures,omitempty" yaml:"failures,omitempty"`
+}
+
+// Simulate sends the `events` to a new FSM configured with `c`, using a Simulator, and
+// compares their outcomes with the expected ones: events which are not expected to be
+// rejected must be accepted, and vice versa.
+//
+// An error is only returned if the Configuration is not valid, or one of the events is
+// malformed; unexpected outcomes are reported as the Simulation's Failures.
+func Simulate(c *protos.Configuration, events []SimulatedEvent) (*Simulation, error) {
+	s, err := NewSimulator(c)
+	if err != nil {
+		return nil, err
+	}
+	sim := &Simulation{Config: GetVersionId(c)}
+	for i, e := range events {
+		where := fmt.Sprintf("event #%d", i+1)
+		if e.Event != "" {
+			where += fmt.Sprintf(" `%s`", e.Event)
+		}
+		if e.Wait != "" {
+			wait, err := time.ParseDuration(e.Wait)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid wait `%s`: %v", where, e.Wait, err)
+			}
+			s.Wait(wait)
+		} else if e.Event == "" {
+			return nil, fmt.Errorf("%s: %v", where, MissingEventNameError)
+		}
+		if e.Event != "" {
+			step := s.Send(e.Event, e.Details)
+			if step.Rejected() && !e.Rejected {
+				sim.Failures = append(sim.Failures, fmt.Sprintf("%s: rejected in state %s: %s",
+					where, step.From, step.Error))
+			} else if !step.Rejected() && e.Rejected {
+				sim.Failures = append(sim.Failures, fmt.Sprintf("%s: expected to be rejected in state %s",
+					where, step.From))
+			}
+		}
+		if e.State != "" && e.State != s.FSM.State {
+			sim.Failures = append(sim.Failures, fmt.Sprintf("%s: expected state %s, was %s",
+				where, e.State, s.FSM.State))
+		}
+	}
+	sim.Steps = s.Steps
+	sim.State = s.FSM.State
+	sim.Completed = s.IsCompleted()
+	if data, err := GetData(s.FSM); err == nil && len(data.GetFields()) > 0 {
+		sim.Data = data.AsMap()
+	}
+	return sim, nil
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api_test
+
+import (
+	"time"
+
+	. "github.com/massenz/go-statemachine/pkg/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("Simulations", func() {
+	var orders *protos.Configuration
+	BeforeEach(func() {
+		orders = &protos.Configuration{
+			Name:          "orders",
+			Version:       "v1",
+			StartingState: "pending",
+			States:        []string{"pending", "shipped", "delivered", "cancelled"},
+			Transitions: []*protos.Transition{
+				{From: "pending", To: "shipped", Event: "ship [weight < 20] / notify, incr(shipments)"},
+				{From: "pending", To: "cancelled", Event: "cancel after(48h)"},
+				{From: "shipped", To: "delivered", Event: "deliver"},
+				{From: "delivered", Event: "entry / invoice"},
+				{From: "delivered", To: FinalState},
+				{From: "cancelled", To: FinalState},
+			},
+		}
+	})
+	It("records every step", func() {
+		s, err := NewSimulator(orders)
+		Expect(err).ToNot(HaveOccurred())
+		step := s.Send("deliver", "")
+		Expect(step.Rejected()).To(BeTrue())
+		Expect(step.From).To(Equal("pending"))
+		Expect(step.Error).To(Equal(UnexpectedTransitionError.Error()))
+
+		step = s.Send("ship", `{"weight": 10}`)
+		Expect(step.Rejected()).To(BeFalse())
+		Expect(step.To).To(Equal("shipped"))
+		Expect(step.Actions).To(Equal([]string{"notify"}))
+
+		step = s.Send("deliver", "")
+		Expect(step.Actions).To(Equal([]string{"invoice (entry delivered)"}))
+		Expect(s.Steps).To(HaveLen(3))
+		Expect(s.IsCompleted()).To(BeTrue())
+	})
+	It("fires timers as time goes by", func() {
+		s, err := NewSimulator(orders)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Wait(24 * time.Hour)).To(BeEmpty())
+		steps := s.Wait(24 * time.Hour)
+		Expect(steps).To(HaveLen(1))
+		Expect(steps[0].Timer).To(BeTrue())
+		Expect(steps[0].Elapsed).To(Equal("48h0m0s"))
+		Expect(steps[0].To).To(Equal("cancelled"))
+	})
+	It("cancels timers when leaving their state", func() {
+		s, _ := NewSimulator(orders)
+		s.Send("ship", `{"weight": 10}`)
+		Expect(s.Wait(72 * time.Hour)).To(BeEmpty())
+		Expect(s.FSM.State).To(Equal("shipped"))
+	})
+	It("reports unexpected outcomes", func() {
+		sim, err := Simulate(orders, []SimulatedEvent{
+			{Event: "ship", Details: `{"weight": 30}`, Rejected: true},
+			{Event: "ship", Details: `{"weight": 10}`, State: "shipped"},
+			{Event: "cancel"},
+			{Event: "deliver", Rejected: true},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sim.Config).To(Equal("orders:v1"))
+		Expect(sim.Steps).To(HaveLen(4))
+		Expect(sim.State).To(Equal("delivered"))
+		Expect(sim.Completed).To(BeTrue())
+		Expect(sim.Data).To(Equal(map[string]interface{}{"shipments": 1.0}))
+		Expect(sim.Failures).To(Equal([]string{
+			"event #3 `cancel`: rejected in state shipped: unexpected event transition",
+			"event #4 `deliver`: expected to be rejected in state shipped",
+		}))
+	})
+	It("can only simulate valid configurations and events", func() {
+		_, err := Simulate(orders, []SimulatedEvent{{Wait: "forever"}})
+		Expect(err).To(HaveOccurred())
+		_, err = Simulate(orders, []SimulatedEvent{{State: "pending"}})
+		Expect(err).To(HaveOccurred())
+
+		sim, err := Simulate(orders, []SimulatedEvent{{Wait: "48h", State: "cancelled"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sim.Failures).To(BeEmpty())
+		Expect(sim.Steps[0].Timer).To(BeTrue())
+
+		orders.StartingState = "unknown"
+		_, err = NewSimulator(orders)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// FinalState is the pseudo-state (following the UML notation) used as the destination of
+	// a Transition, with no `Event`, to mark its origin as a terminal state:
+	//
+	//	{from: delivered, to: "[*]"}
+	//
+	// FSMs reaching a terminal state are considered completed, and cannot leave it.
+	FinalState = "[*]"
+
+	// CompletedDetailsPrefix starts the `Details` of the `Ok` outcome posted as a notification
+	// when an FSM reaches a terminal state.
+	CompletedDetailsPrefix = "completed"
+	CompletedDetailsFmt    = CompletedDetailsPrefix + ": FSM reached terminal state %s"
+
+	// CompletedFieldNumber is the field number under which the time at which the FSM
+	// reached its terminal state is serialized along with the FiniteStateMachine, as one of
+	// its unknown fields (see DataFieldNumber).
+	CompletedFieldNumber protowire.Number = 101
+)
+
+// IsFinal returns true if the Transition marks its origin as a terminal state.
+func IsFinal(t *protos.Transition) bool {
+	return t.GetTo() == FinalState
+}
+
+// IsTerminal returns true if `state` is one of the Configuration's terminal states.
+func IsTerminal(c *protos.Configuration, state string) bool {
+	for _, t := range c.Transitions {
+		if IsFinal(t) && !IsWildcard(t) && FromState(c, t, state) {
+			return true
+		}
+	}
+	return false
+}
+
+// TerminalStates returns all the Configuration's terminal states.
+func TerminalStates(c *protos.Configuration) []string {
+	var states []string
+	for _, t := range c.Transitions {
+		if IsFinal(t) && !IsWildcard(t) {
+			states = append(states, Origins(c, t)...)
+		}
+	}
+	return states
+}
+
+// IsCompleted returns true if the FSM has reached one of its Configuration's terminal states.
+func (x *ConfiguredStateMachine) IsCompleted() bool {
+	return IsTerminal(x.Config, x.FSM.GetState())
+}
+
+// CompletedAt returns the time at which the FSM reached its terminal state (that is,
+// the timestamp of the Event which caused the transition, or the time of the Migration
+// which moved it there), or `nil` if the FSM has not completed.
+func (x *ConfiguredStateMachine) CompletedAt() *timestamppb.Timestamp {
+	if !x.IsCompleted() {
+		return nil
+	}
+	return GetCompletedAt(x.FSM)
+}
+
+// GetCompletedAt returns the completion time stored with the FSM, if any.
+func GetCompletedAt(fsm *protos.FiniteStateMachine) *timestamppb.Timestamp {
+	value, err := getUnknownField(fsm, CompletedFieldNumber)
+	if err != nil || value == nil {
+		return nil
+	}
+	completed := &timestamppb.Timestamp{}
+	if err = proto.Unmarshal(value, completed); err != nil {
+		return nil
+	}
+	return completed
+}
+
+// setCompletedAt stores the FSM's completion time; a `nil` `completed` removes it.
+func setCompletedAt(fsm *protos.FiniteStateMachine, completed *timestamppb.Timestamp) error {
+	var value []byte
+	if completed != nil {
+		var err error
+		if value, err = proto.Marshal(completed); err != nil {
+			return err
+		}
+	}
+	return setUnknownField(fsm, CompletedFieldNumber, value)
+}
+
+// NewCompletedDetails returns the `Details` for the outcome notifying that an FSM
+// reached the terminal `state`.
+func NewCompletedDetails(state string) string {
+	return fmt.Sprintf(CompletedDetailsFmt, state)
+}
+
+// IsCompletedOutcome returns true if the outcome notifies that an FSM completed.
+func IsCompletedOutcome(outcome *protos.EventOutcome) bool {
+	return outcome.GetCode() == protos.EventOutcome_Ok &&
+		strings.HasPrefix(outcome.GetDetails(), CompletedDetailsPrefix)
+}
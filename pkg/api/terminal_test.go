@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api_test
+
+import (
+	. "github.com/massenz/go-statemachine/pkg/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/protobuf/proto"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("Terminal states", func() {
+	var orders *protos.Configuration
+	BeforeEach(func() {
+		orders = &protos.Configuration{
+			Name:          "orders",
+			Version:       "v1",
+			StartingState: "start",
+			States:        []string{"start", "shipped", "delivered", "cancelled"},
+			Transitions: []*protos.Transition{
+				{From: "start", To: "shipped", Event: "ship"},
+				{From: "start", To: "cancelled", Event: "cancel"},
+				{From: "shipped", To: "delivered", Event: "deliver"},
+				{From: "delivered", To: FinalState},
+				{From: "cancelled", To: FinalState},
+			},
+		}
+	})
+	It("are valid, and are not dead ends", func() {
+		findings := Validate(orders)
+		Expect(findings).To(BeEmpty())
+		Expect(TerminalStates(orders)).To(ConsistOf("delivered", "cancelled"))
+		Expect(IsTerminal(orders, "delivered")).To(BeTrue())
+		Expect(IsTerminal(orders, "shipped")).To(BeFalse())
+	})
+	It("must be reachable", func() {
+		orders.Transitions = orders.Transitions[1:]
+		errs := Validate(orders).Errors()
+		Expect(errs).To(HaveLen(2))
+		Expect(errs[0].State).To(Equal("shipped"))
+		Expect(errs[1].State).To(Equal("delivered"))
+		Expect(errs[1].Err.Error()).To(ContainSubstring("terminal state delivered"))
+	})
+	It("cannot have outgoing transitions", func() {
+		orders.Transitions = append(orders.Transitions,
+			&protos.Transition{From: "cancelled", To: "start", Event: "restart"})
+		errs := Validate(orders).Errors()
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0].State).To(Equal("cancelled"))
+	})
+	It("cannot be marked with an event", func() {
+		orders.Transitions[3].Event = "close"
+		errs := Validate(orders).Errors()
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0].State).To(Equal("delivered"))
+	})
+	It("complete the FSM", func() {
+		fsm, err := NewStateMachine(orders)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fsm.SendEvent(NewEvent("ship"))).To(Succeed())
+		Expect(fsm.IsCompleted()).To(BeFalse())
+		Expect(fsm.CompletedAt()).To(BeNil())
+
+		deliver := NewEvent("deliver")
+		Expect(fsm.SendEvent(deliver)).To(Succeed())
+		Expect(fsm.IsCompleted()).To(BeTrue())
+		Expect(fsm.CompletedAt().AsTime()).To(Equal(deliver.Timestamp.AsTime()))
+		Expect(fsm.SendEvent(NewEvent(""))).To(MatchError(UnexpectedTransitionError))
+	})
+	It("store the completion time with the FSM", func() {
+		fsm, err := NewStateMachine(orders)
+		Expect(err).ToNot(HaveOccurred())
+		cancel := NewEvent("cancel")
+		Expect(fsm.SendEvent(cancel)).To(Succeed())
+		data, err := proto.Marshal(fsm.FSM)
+		Expect(err).ToNot(HaveOccurred())
+		stored := &protos.FiniteStateMachine{}
+		Expect(proto.Unmarshal(data, stored)).To(Succeed())
+		Expect(GetCompletedAt(stored).AsTime()).To(Equal(cancel.Timestamp.AsTime()))
+
+		// Rolled back FSMs are no longer completed, whatever their History.
+		_, err = fsm.Rollback(1, "operator")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fsm.CompletedAt()).To(BeNil())
+		Expect(GetCompletedAt(fsm.FSM)).To(BeNil())
+	})
+	It("complete FSMs migrated to them, even with no History", func() {
+		v2 := proto.Clone(orders).(*protos.Configuration)
+		v2.Version = "v2"
+		v2.States = []string{"start", "delivered", "cancelled"}
+		v2.Transitions = []*protos.Transition{orders.Transitions[1], orders.Transitions[3],
+			orders.Transitions[4], {From: "start", To: "delivered", Event: "deliver"}}
+		m, err := NewMigration(orders, v2, map[string]string{"shipped": "delivered"})
+		Expect(err).ToNot(HaveOccurred())
+		fsm := &ConfiguredStateMachine{Config: v2, FSM: &protos.FiniteStateMachine{
+			ConfigId: GetVersionId(orders),
+			State:    "shipped",
+		}}
+		Expect(m.Apply(fsm.FSM)).To(Succeed())
+		Expect(fsm.IsCompleted()).To(BeTrue())
+		Expect(fsm.CompletedAt()).ToNot(BeNil())
+	})
+	It("are notified with a successful outcome", func() {
+		outcome := &protos.EventOutcome{
+			Code:    protos.EventOutcome_Ok,
+			Details: NewCompletedDetails("delivered"),
+		}
+		Expect(IsCompletedOutcome(outcome)).To(BeTrue())
+		outcome.Details = ""
+		Expect(IsCompletedOutcome(outcome)).To(BeFalse())
+	})
+})
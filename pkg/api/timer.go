@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+const (
+	// TimerOriginator is the `Originator` of the Events emitted when a Timer fires.
+	TimerOriginator = "timer"
+)
+
+// A Timer emits the `Event` for an FSM which has been in `State` for longer than `Timeout`.
+//
+// Timers are defined by transitions whose Trigger carries a timeout, and are started when
+// the FSM enters the transition's origin state, and cancelled when it leaves it.
+type Timer struct {
+	State   string
+	Event   string
+	Timeout time.Duration
+}
+
+// Timers returns the Timers that should be started when an FSM enters `state`.
+//
+// Transitions for the same event (e.g., with different guards) only start one Timer, with
+// the timeout of the first one.
+func Timers(c *protos.Configuration, state string) []Timer {
+	var timers []Timer
+	seen := make(map[string]bool)
+	for _, t := range c.Transitions {
+		if !FromState(c, t, state) || IsFinal(t) || IsActivity(t) {
+			continue
+		}
+		trigger, err := ParseTrigger(t.Event)
+		if err != nil || trigger.Timeout == 0 || seen[trigger.Event] {
+			continue
+		}
+		seen[trigger.Event] = true
+		timers = append(timers, Timer{State: state, Event: trigger.Event, Timeout: trigger.Timeout})
+	}
+	return timers
+}
+
+// NewTimerEvent creates the Event emitted when the Timer fires.
+func NewTimerEvent(timer Timer) *protos.Event {
+	evt := NewEvent(timer.Event)
+	evt.Originator = TimerOriginator
+	return evt
+}
+
+// NewDueTimerEvent creates the Event emitted when the Timer of the FSM `id` fires, having been
+// due at `due`: its ID is derived from them, so that if the Timer is fired more than once
+// (e.g., because its Event was not processed before its lease expired) its Events are
+// detected as duplicates.
+func NewDueTimerEvent(id string, timer Timer, due time.Time) *protos.Event {
+	evt := NewTimerEvent(timer)
+	name := strings.Join([]string{id, timer.State, timer.Event,
+		strconv.FormatInt(due.UnixMilli(), 10)}, "#")
+	evt.EventId = uuid.NewSHA1(uuid.NameSpaceOID, []byte(name)).String()
+	return evt
+}
+
+// FiredTimer returns the Timer which emitted `evt` (see NewTimerEvent) for an FSM in `state`,
+// if `evt` was emitted by one of the Timers running in that state.
+func FiredTimer(c *protos.Configuration, state string, evt *protos.Event) (Timer, bool) {
+	if evt.GetOriginator() != TimerOriginator {
+		return Timer{}, false
+	}
+	for _, s := range Ancestors(state) {
+		for _, timer := range Timers(c, s) {
+			if timer.Event == evt.GetTransition().GetEvent() {
+				return timer, true
+			}
+		}
+	}
+	return Timer{}, false
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api_test
+
+import (
+	"time"
+
+	. "github.com/massenz/go-statemachine/pkg/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("Timers", func() {
+	var orders *protos.Configuration
+	BeforeEach(func() {
+		orders = &protos.Configuration{
+			Name:          "orders",
+			Version:       "v1",
+			StartingState: "pending",
+			States:        []string{"pending", "accepted", "expired"},
+			Transitions: []*protos.Transition{
+				{From: "pending", To: "accepted", Event: "accept"},
+				{From: "pending", To: "expired", Event: "expire after(48h)"},
+				{From: "expired", To: "pending", Event: "retry after(30m) [attempts < 3]"},
+				{From: "accepted", To: FinalState},
+			},
+		}
+	})
+	It("can be parsed from the transitions", func() {
+		t, err := ParseTrigger("expire after(48h)")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.Event).To(Equal("expire"))
+		Expect(t.Timeout).To(Equal(48 * time.Hour))
+		Expect(t.Guard).To(BeNil())
+
+		t, err = ParseTrigger("retry after(30m) [attempts < 3]")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.Event).To(Equal("retry"))
+		Expect(t.Timeout).To(Equal(30 * time.Minute))
+		Expect(t.Guard.String()).To(Equal("attempts < 3"))
+	})
+	It("rejects invalid timeouts", func() {
+		for _, label := range []string{"expire after(48h", "expire after(forever)", "expire after(-1s)",
+			" after(1h)"} {
+			_, err := ParseTrigger(label)
+			Expect(err).To(HaveOccurred(), label)
+		}
+	})
+	It("are started when entering a state", func() {
+		Expect(Timers(orders, "pending")).To(ConsistOf(
+			Timer{State: "pending", Event: "expire", Timeout: 48 * time.Hour}))
+		Expect(Timers(orders, "accepted")).To(BeEmpty())
+	})
+	It("emit their event", func() {
+		fsm, err := NewStateMachine(orders)
+		Expect(err).ToNot(HaveOccurred())
+		evt := NewTimerEvent(Timers(orders, "pending")[0])
+		Expect(evt.Originator).To(Equal(TimerOriginator))
+		Expect(fsm.SendEvent(evt)).To(Succeed())
+		Expect(fsm.FSM.State).To(Equal("expired"))
+	})
+	It("emit the same event each time they fire", func() {
+		timer := Timers(orders, "pending")[0]
+		due := time.Now()
+		evt := NewDueTimerEvent("fsm-1", timer, due)
+		Expect(evt.Originator).To(Equal(TimerOriginator))
+		Expect(evt.Transition.Event).To(Equal("expire"))
+		Expect(NewDueTimerEvent("fsm-1", timer, due).EventId).To(Equal(evt.EventId))
+		Expect(NewDueTimerEvent("fsm-2", timer, due).EventId).ToNot(Equal(evt.EventId))
+		Expect(NewDueTimerEvent("fsm-1", timer, due.Add(time.Minute)).EventId).ToNot(Equal(evt.EventId))
+	})
+	It("can be found from the event they emitted", func() {
+		timer, ok := FiredTimer(orders, "pending", NewTimerEvent(Timers(orders, "pending")[0]))
+		Expect(ok).To(BeTrue())
+		Expect(timer).To(Equal(Timer{State: "pending", Event: "expire", Timeout: 48 * time.Hour}))
+
+		_, ok = FiredTimer(orders, "accepted", NewTimerEvent(Timers(orders, "pending")[0]))
+		Expect(ok).To(BeFalse())
+		_, ok = FiredTimer(orders, "pending", NewEvent("expire"))
+		Expect(ok).To(BeFalse())
+	})
+	It("must have the same timeout for the same event", func() {
+		Expect(Validate(orders).Errors()).To(BeEmpty())
+		orders.Transitions = append(orders.Transitions,
+			&protos.Transition{From: "expired", To: "accepted", Event: "retry [attempts >= 3]"})
+		errs := Validate(orders).Errors()
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0].State).To(Equal("expired"))
+		Expect(errs[0].Event).To(Equal("retry"))
+	})
+})
@@ -0,0 +1,169 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+const (
+	GuardStart   = "["
+	GuardEnd     = "]"
+	TimeoutStart = "after("
+	TimeoutEnd   = ")"
+
+	// ActionsStart separates the Trigger from the (comma-separated) names of its Actions.
+	ActionsStart     = "/"
+	ActionsSeparator = ","
+
+	// StateScopeKey and EventScopeKey are the names under which the FSM's current state
+	// and the incoming event's name are made available to guard expressions.
+	StateScopeKey = "$state"
+	EventScopeKey = "$event"
+)
+
+// A Trigger is the parsed form of a Transition's `Event`, which follows the UML notation
+// for transitions:
+//
+//	event [guard]
+//
+// where the (optional) guard is an Expression that must evaluate to `true` for the
+// transition to be taken; see ParseExpression for the supported syntax.
+//
+// The event can optionally be followed by a timeout, to have it automatically emitted
+// when the FSM has been in the transition's origin state for longer than that (see Timer),
+// and by the names of the Actions to dispatch when the transition is taken, and the
+// updates to the FSM's data (see DataUpdate):
+//
+//	event after(48h) [guard] / action, another_action, incr(count)
+type Trigger struct {
+	Event   string
+	Guard   *Expression
+	Timeout time.Duration
+	Actions []string
+	Updates []DataUpdate
+}
+
+// ParseTrigger parses the `label` of a Transition (its `Event` field) into a Trigger.
+func ParseTrigger(label string) (*Trigger, error) {
+	trigger := &Trigger{}
+	event := label
+	rest := ""
+	if start := strings.Index(label, GuardStart); start >= 0 {
+		end := strings.LastIndex(label, GuardEnd)
+		if end < start {
+			return nil, fmt.Errorf("missing closing `%s` in guard for `%s`", GuardEnd, label)
+		}
+		if rest = strings.TrimSpace(label[end+1:]); rest != "" && !strings.HasPrefix(rest, ActionsStart) {
+			return nil, fmt.Errorf("unexpected `%s` after guard in `%s`", rest, label)
+		}
+		guard, err := ParseExpression(label[start+1 : end])
+		if err != nil {
+			return nil, fmt.Errorf("invalid guard in `%s`: %v", label, err)
+		}
+		trigger.Guard = guard
+		event = label[:start]
+	} else if start := strings.Index(label, ActionsStart); start >= 0 {
+		rest = label[start:]
+		event = label[:start]
+	}
+	if rest != "" {
+		for _, action := range strings.Split(strings.TrimPrefix(rest, ActionsStart), ActionsSeparator) {
+			if action = strings.TrimSpace(action); action == "" {
+				return nil, fmt.Errorf("missing action name in `%s`", label)
+			}
+			if IsDataUpdate(action) {
+				update, err := ParseDataUpdate(action)
+				if err != nil {
+					return nil, fmt.Errorf("invalid data update in `%s`: %v", label, err)
+				}
+				trigger.Updates = append(trigger.Updates, *update)
+				continue
+			}
+			trigger.Actions = append(trigger.Actions, action)
+		}
+	}
+	event = strings.TrimSpace(event)
+	if start := strings.LastIndex(event, TimeoutStart); start == 0 ||
+		(start > 0 && event[start-1] == ' ') {
+		if !strings.HasSuffix(event, TimeoutEnd) {
+			return nil, fmt.Errorf("missing closing `%s` in timeout for `%s`", TimeoutEnd, label)
+		}
+		timeout, err := time.ParseDuration(event[start+len(TimeoutStart) : len(event)-len(TimeoutEnd)])
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout in `%s`, must be a positive duration (e.g., 48h)",
+				label)
+		}
+		trigger.Timeout = timeout
+		event = strings.TrimSpace(event[:start])
+	}
+	if event == "" && (trigger.Guard != nil || trigger.Timeout > 0 || trigger.Actions != nil ||
+		trigger.Updates != nil) {
+		return nil, fmt.Errorf("missing event name in `%s`", label)
+	}
+	trigger.Event = event
+	return trigger, nil
+}
+
+// Allows returns true if the Trigger's Guard (if any) is satisfied in the given Scope.
+//
+// If the Guard cannot be evaluated (e.g., because it compares values of different types)
+// the error is a GuardError.
+func (t *Trigger) Allows(scope Scope) (bool, error) {
+	if t.Guard == nil {
+		return true, nil
+	}
+	allowed, err := t.Guard.EvalBool(scope)
+	if err != nil {
+		return false, &GuardError{Guard: t.Guard.String(), Err: err}
+	}
+	return allowed, nil
+}
+
+// A GuardError is returned when a transition's guard cannot be evaluated: it is also a
+// GuardNotSatisfiedError (as the transition is not taken) but carries the guard's
+// expression, and the reason why it failed, so that it can be told apart from a guard
+// which is simply false.
+type GuardError struct {
+	Guard string
+	Err   error
+}
+
+func (e *GuardError) Error() string {
+	return fmt.Sprintf("transition guard `%s` could not be evaluated: %v", e.Guard, e.Err)
+}
+
+func (e *GuardError) Unwrap() []error {
+	return []error{GuardNotSatisfiedError, e.Err}
+}
+
+// NewGuardScope builds the Scope against which guards are evaluated: the event's
+// `Details` (if they are a JSON object) are exposed as top-level identifiers, alongside
+// the FSM's current state, its data (see GetData) and the event name.
+func NewGuardScope(fsm *protos.FiniteStateMachine, evt *protos.Event) Scope {
+	scope := Scope{}
+	if details := evt.GetDetails(); details != "" {
+		if err := json.Unmarshal([]byte(details), &scope); err != nil {
+			Logger.Debug().Msgf("event details are not a JSON object, ignored by guards: %v", err)
+			scope = Scope{}
+		}
+	}
+	scope[StateScopeKey] = fsm.GetState()
+	scope[EventScopeKey] = evt.GetTransition().GetEvent()
+	if data, err := GetData(fsm); err == nil {
+		scope[DataScopeKey] = data.AsMap()
+	}
+	return scope
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api_test
+
+import (
+	"errors"
+
+	. "github.com/massenz/go-statemachine/pkg/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("Guarded transitions", func() {
+	BeforeEach(func() {
+		zerolog.SetGlobalLevel(zerolog.Disabled)
+	})
+
+	Context("when parsing expressions", func() {
+		scope := Scope{
+			"amount":   float64(250),
+			"currency": "USD",
+			"customer": map[string]interface{}{"tier": "gold", "orders": float64(12)},
+		}
+		It("evaluates correctly", func() {
+			for expr, expected := range map[string]interface{}{
+				"amount < 1000":     true,
+				`currency == "USD"`: true,
+				`currency != 'EUR'`: true,
+				"amount * 2 + 1":    float64(501),
+				"1 + 2 * 3 == 7":    true,
+				"(1 + 2) * 3":       float64(9),
+				"!(amount > 100)":   false,
+				"discount > 0":      false,
+				"discount == null":  true,
+				"customer.orders >= 10 && customer.tier == 'gold'": true,
+				"amount > 1000 && missing / 0 > 1":                 false,
+			} {
+				e, err := ParseExpression(expr)
+				Expect(err).ToNot(HaveOccurred(), expr)
+				Expect(e.Eval(scope)).To(Equal(expected), expr)
+			}
+		})
+		It("rejects malformed expressions", func() {
+			for _, expr := range []string{"amount <", "(amount < 1000", `currency == "USD`,
+				"amount # 3", "amount 1000"} {
+				_, err := ParseExpression(expr)
+				Expect(err).To(HaveOccurred(), expr)
+			}
+		})
+	})
+
+	Context("when parsing triggers", func() {
+		It("can parse plain events", func() {
+			t, err := ParseTrigger("accept")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(t.Event).To(Equal("accept"))
+			Expect(t.Guard).To(BeNil())
+		})
+		It("can parse guarded events", func() {
+			t, err := ParseTrigger("accept [amount < 1000]")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(t.Event).To(Equal("accept"))
+			Expect(t.Guard).ToNot(BeNil())
+			Expect(t.Guard.String()).To(Equal("amount < 1000"))
+		})
+		It("rejects malformed guards", func() {
+			for _, label := range []string{"accept [amount <", "accept [amount <]", "[amount < 1]",
+				"accept [amount < 1] more"} {
+				_, err := ParseTrigger(label)
+				Expect(err).To(HaveOccurred(), label)
+			}
+		})
+	})
+
+	Context("with a guarded configuration", func() {
+		var orders *protos.Configuration
+		BeforeEach(func() {
+			orders = &protos.Configuration{
+				Name:          "orders",
+				Version:       "v1",
+				StartingState: "start",
+				States:        []string{"start", "accepted", "review"},
+				Transitions: []*protos.Transition{
+					{From: "start", To: "accepted", Event: "accept [amount < 1000]"},
+					{From: "start", To: "review", Event: "accept [amount >= 1000 && $state == 'start']"},
+					{From: "review", To: "accepted", Event: "approve"},
+				},
+			}
+		})
+		It("is valid", func() {
+			Expect(CheckValid(orders)).To(Succeed())
+		})
+		It("is not valid if guards cannot be parsed", func() {
+			orders.Transitions[0].Event = "accept [amount <]"
+			Expect(CheckValid(orders)).ToNot(Succeed())
+		})
+		It("selects the transition whose guard is satisfied", func() {
+			fsm, err := NewStateMachine(orders)
+			Expect(err).ToNot(HaveOccurred())
+			evt := NewEvent("accept")
+			evt.Details = `{"amount": 1500}`
+			Expect(fsm.SendEvent(evt)).To(Succeed())
+			Expect(fsm.FSM.State).To(Equal("review"))
+			Expect(fsm.FSM.History[0].Transition.To).To(Equal("review"))
+
+			fsm.Reset()
+			evt = NewEvent("accept")
+			evt.Details = `{"amount": 15}`
+			Expect(fsm.SendEvent(evt)).To(Succeed())
+			Expect(fsm.FSM.State).To(Equal("accepted"))
+		})
+		It("rejects the event if no guard is satisfied", func() {
+			fsm, _ := NewStateMachine(orders)
+			evt := NewEvent("accept")
+			evt.Details = "not JSON"
+			Expect(fsm.SendEvent(evt)).To(MatchError(GuardNotSatisfiedError))
+			Expect(fsm.FSM.State).To(Equal("start"))
+			Expect(fsm.FSM.History).To(BeEmpty())
+		})
+		It("reports the guards which cannot be evaluated", func() {
+			fsm, _ := NewStateMachine(orders)
+			evt := NewEvent("accept")
+			evt.Details = `{"amount": "lots"}`
+			err := fsm.SendEvent(evt)
+			Expect(err).To(MatchError(GuardNotSatisfiedError))
+			var guardErr *GuardError
+			Expect(errors.As(err, &guardErr)).To(BeTrue())
+			Expect(guardErr.Guard).To(Equal("amount < 1000"))
+			Expect(err.Error()).To(ContainSubstring("amount < 1000"))
+			Expect(fsm.FSM.State).To(Equal("start"))
+		})
+		It("still rejects unexpected events", func() {
+			fsm, _ := NewStateMachine(orders)
+			Expect(fsm.SendEvent(NewEvent("approve"))).To(MatchError(UnexpectedTransitionError))
+		})
+	})
+})
@@ -0,0 +1,405 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var (
+	UnknownStateConfigurationError         = "transition `%s` from %s to %s references unknown state %s"
+	UnreachableFromStartConfigurationError = "state %s cannot be reached from the starting state %s"
+	DeadEndStateConfigurationWarning       = "state %s has no outgoing transitions, FSMs will be stuck there"
+	ShadowedTransitionConfigurationError   = "transition `%s` from %s to %s will never be taken, " +
+		"as it is shadowed by the one to %s"
+	FinalTransitionConfigurationError          = "transition from %s to the final state cannot have an event (`%s`)"
+	TerminalStateConfigurationError            = "terminal state %s cannot have outgoing transitions"
+	UnreachableTerminalStateConfigurationError = "terminal state %s cannot be reached from the starting state %s"
+	TimeoutMismatchConfigurationError          = "transitions from %s for event %s have different timeouts " +
+		"(%v and %v)"
+	UndeclaredParentConfigurationError = "state %s is nested in %s, which is not one of the states"
+	CompoundStateConfigurationError    = "compound state %s cannot be %s, only its nested states can"
+	InvalidActivityConfigurationError  = "`%s` for state %s must be either `entry / actions` or " +
+		"`exit / actions`"
+	WildcardFinalConfigurationError = "terminal states must be listed explicitly, not with `%s`"
+)
+
+// Severity of a Finding: only errors make a Configuration invalid.
+type Severity int
+
+const (
+	SeverityWarning Severity = iota
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// A Finding is one of the problems found while validating a Configuration, optionally
+// related to a specific `State` (and the `Event` of one of its transitions).
+type Finding struct {
+	Severity Severity
+	State    string
+	Event    string
+	Err      error
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %v", f.Severity, f.Err)
+}
+
+// Findings collects all the problems found while validating a Configuration.
+type Findings []Finding
+
+func (f Findings) filter(severity Severity) Findings {
+	var result Findings
+	for _, finding := range f {
+		if finding.Severity == severity {
+			result = append(result, finding)
+		}
+	}
+	return result
+}
+
+// Errors returns only the Findings which make the Configuration invalid.
+func (f Findings) Errors() Findings {
+	return f.filter(SeverityError)
+}
+
+// Warnings returns the Findings which signal a potential problem with the Configuration,
+// but do not make it invalid.
+func (f Findings) Warnings() Findings {
+	return f.filter(SeverityWarning)
+}
+
+// Err returns a ValidationError carrying all the error Findings, or `nil` if there are none.
+func (f Findings) Err() error {
+	errs := f.Errors()
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ValidationError{Findings: errs}
+}
+
+// ValidationError is returned by CheckValid for an invalid Configuration, and carries all
+// the problems found, so that they can be reported at once.
+//
+// It wraps the underlying errors, so that `errors.Is` can be used to check for specific
+// ones (e.g., `MissingNameConfigurationError`).
+type ValidationError struct {
+	Findings Findings
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Findings))
+	for i, f := range e.Findings {
+		messages[i] = f.Err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) Unwrap() []error {
+	errs := make([]error, len(e.Findings))
+	for i, f := range e.Findings {
+		errs[i] = f.Err
+	}
+	return errs
+}
+
+// Graph is the directed graph of a Configuration's states (the nodes) and transitions
+// (the edges), indexed by the origin state.
+//
+// Transitions to the FinalState are not edges, but mark their origin as `Terminal`.
+//
+// Edges from a compound state (see StateSeparator) are inherited by all its nested states,
+// and `Wildcard` edges (see AnyState) can be followed from any non-terminal state; internal
+// transitions (see IsInternal) are not edges, as they do not change the state.
+type Graph struct {
+	Start    string
+	Edges    map[string][]*protos.Transition
+	Wildcard []*protos.Transition
+	Terminal map[string]bool
+}
+
+// NewGraph builds the Graph for the given Configuration.
+func NewGraph(c *protos.Configuration) *Graph {
+	g := &Graph{
+		Start:    c.StartingState,
+		Edges:    make(map[string][]*protos.Transition),
+		Terminal: make(map[string]bool),
+	}
+	for _, t := range c.Transitions {
+		if IsActivity(t) || IsInternal(t) {
+			continue
+		}
+		if IsFinal(t) {
+			if !IsWildcard(t) {
+				for _, s := range Origins(c, t) {
+					g.Terminal[s] = true
+				}
+			}
+			continue
+		}
+		if IsWildcard(t) {
+			g.Wildcard = append(g.Wildcard, t)
+			continue
+		}
+		for _, s := range Origins(c, t) {
+			g.Edges[s] = append(g.Edges[s], t)
+		}
+	}
+	return g
+}
+
+// Outgoing returns all the edges that can be followed from `state`: its own, followed by
+// those inherited from the compound states it is nested in and, unless `state` is
+// terminal, the wildcard ones.
+func (g *Graph) Outgoing(state string) []*protos.Transition {
+	var edges []*protos.Transition
+	for _, s := range Ancestors(state) {
+		edges = append(edges, g.Edges[s]...)
+	}
+	if !g.Terminal[state] {
+		edges = append(edges, g.Wildcard...)
+	}
+	return edges
+}
+
+// Reachable returns the set of all the states that can be reached from `state`
+// (including `state` itself), by following any number of transitions.
+//
+// Compound states are reachable if any of their nested states is.
+func (g *Graph) Reachable(state string) map[string]bool {
+	visited := map[string]bool{state: true}
+	queue := []string{state}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, t := range g.Outgoing(current) {
+			if !visited[t.To] {
+				visited[t.To] = true
+				queue = append(queue, t.To)
+			}
+		}
+	}
+	for s := range visited {
+		for _, ancestor := range Ancestors(s) {
+			visited[ancestor] = true
+		}
+	}
+	return visited
+}
+
+// Validate runs all the checks on the Configuration and returns all the problems found;
+// use CheckValid if only interested in whether the Configuration is valid.
+//
+// Errors are reported for missing name or states, an invalid starting state, transitions
+// referencing unknown states or with invalid guards, states that cannot be reached from
+// the starting state and transitions which can never be taken because a previous one (for
+// the same state and event) always matches first; transitions for the same state and event
+// must also all have the same timeout (see Timer).
+//
+// Terminal states (see FinalState) must be reachable, and cannot have outgoing transitions.
+//
+// Entry and exit actions (see IsActivity) must be declared for known states, using the
+// `entry / actions` or `exit / actions` notation; transitions from AnyState are taken into
+// account when checking reachability, but terminal states must be listed explicitly.
+//
+// Nested states must be declared along with all the compound states they are nested in
+// (see StateSeparator); compound states cannot be the starting state, the target of a
+// transition, or a terminal state, as FSMs are always in one of their nested states.
+//
+// Warnings are reported for non-terminal states (other than the starting one) that have
+// no outgoing transitions, as FSMs reaching them can never leave.
+func Validate(c *protos.Configuration) Findings {
+	var findings Findings
+	addError := func(state, event string, err error) {
+		findings = append(findings, Finding{Severity: SeverityError, State: state, Event: event, Err: err})
+	}
+	if c.Name == "" {
+		addError("", "", MissingNameConfigurationError)
+	}
+	if len(c.States) == 0 {
+		addError("", "", MissingStatesConfigurationError)
+		return findings
+	}
+	startValid := false
+	if c.StartingState == "" {
+		addError("", "", EmptyStartingStateConfigurationError)
+	} else if !CfgHasState(c, c.StartingState) {
+		addError(c.StartingState, "", MismatchStartingStateConfigurationError)
+	} else if IsCompound(c, c.StartingState) {
+		addError(c.StartingState, "", fmt.Errorf(CompoundStateConfigurationError, c.StartingState,
+			"the starting state"))
+	} else {
+		startValid = true
+	}
+	for _, s := range c.States {
+		if parent := Parent(s); parent != "" && !CfgHasState(c, parent) {
+			addError(s, "", fmt.Errorf(UndeclaredParentConfigurationError, s, parent))
+		}
+	}
+
+	for _, t := range c.Transitions {
+		if !IsWildcard(t) {
+			for _, s := range Origins(c, t) {
+				if !CfgHasState(c, s) {
+					addError(s, t.Event, fmt.Errorf(UnknownStateConfigurationError, t.Event, t.From, t.To, s))
+				}
+			}
+		}
+		if IsActivity(t) {
+			trigger, err := ParseTrigger(t.Event)
+			if err != nil || trigger.Guard != nil || trigger.Timeout != 0 || len(trigger.Actions) == 0 ||
+				len(trigger.Updates) > 0 {
+				addError(t.From, t.Event, fmt.Errorf(InvalidActivityConfigurationError, t.Event, t.From))
+			}
+			continue
+		}
+		if t.To != "" && !IsFinal(t) && !CfgHasState(c, t.To) {
+			addError(t.To, t.Event, fmt.Errorf(UnknownStateConfigurationError, t.Event, t.From, t.To, t.To))
+		}
+		if IsFinal(t) {
+			if t.Event != "" {
+				addError(t.From, t.Event, fmt.Errorf(FinalTransitionConfigurationError, t.From, t.Event))
+			}
+			if IsWildcard(t) {
+				addError(t.From, "", fmt.Errorf(WildcardFinalConfigurationError, AnyState))
+				continue
+			}
+			for _, s := range Origins(c, t) {
+				if IsCompound(c, s) {
+					addError(s, "", fmt.Errorf(CompoundStateConfigurationError, s, "a terminal state"))
+				}
+			}
+			continue
+		}
+		if IsCompound(c, t.To) {
+			addError(t.To, t.Event, fmt.Errorf(CompoundStateConfigurationError, t.To,
+				"the target of a transition"))
+		}
+		if _, err := ParseTrigger(t.Event); err != nil {
+			addError(t.From, t.Event, fmt.Errorf(InvalidTriggerConfigurationError, t.From, t.To, err))
+		}
+	}
+	findings = append(findings, checkDeterminism(c)...)
+
+	g := NewGraph(c)
+	var reachable map[string]bool
+	if startValid {
+		reachable = g.Reachable(c.StartingState)
+	}
+	for _, s := range c.States {
+		compound := IsCompound(c, s)
+		used := compound
+		for _, t := range c.Transitions {
+			if HasState(t, s) {
+				used = true
+				break
+			}
+		}
+		if !used {
+			addError(s, "", fmt.Errorf(UnreachableStateConfigurationError, s))
+			continue
+		}
+		if reachable != nil && !reachable[s] {
+			if g.Terminal[s] {
+				addError(s, "", fmt.Errorf(UnreachableTerminalStateConfigurationError, s, c.StartingState))
+			} else {
+				addError(s, "", fmt.Errorf(UnreachableFromStartConfigurationError, s, c.StartingState))
+			}
+		}
+		if g.Terminal[s] {
+			if len(g.Edges[s]) > 0 {
+				addError(s, "", fmt.Errorf(TerminalStateConfigurationError, s))
+			}
+			continue
+		}
+		if !compound && len(g.Outgoing(s)) == 0 && s != c.StartingState {
+			findings = append(findings, Finding{
+				Severity: SeverityWarning,
+				State:    s,
+				Err:      fmt.Errorf(DeadEndStateConfigurationWarning, s),
+			})
+		}
+	}
+	return findings
+}
+
+// checkDeterminism reports transitions which can never be taken, because a previous
+// transition from the same state, and for the same event, will always match first: either
+// because it has no guard, or because it has the very same guard.
+//
+// Wildcard transitions are only compared among themselves, as transitions from specific
+// states always take precedence over them.
+//
+// As only one Timer is started for each state and event, it also reports transitions
+// whose timeout differs from the previous ones'.
+func checkDeterminism(c *protos.Configuration) Findings {
+	var findings Findings
+	type match struct {
+		to      string
+		guard   string
+		timeout time.Duration
+	}
+	seen := make(map[[2]string][]match)
+	for _, t := range c.Transitions {
+		if IsFinal(t) || IsActivity(t) {
+			continue
+		}
+		trigger, err := ParseTrigger(t.Event)
+		if err != nil {
+			// Already reported as an invalid trigger.
+			continue
+		}
+		guard := ""
+		if trigger.Guard != nil {
+			guard = strings.TrimSpace(trigger.Guard.Source)
+		}
+		origins := []string{AnyState}
+		if !IsWildcard(t) {
+			origins = Origins(c, t)
+		}
+		for _, from := range origins {
+			key := [2]string{from, trigger.Event}
+			if previous := seen[key]; len(previous) > 0 && previous[0].timeout != trigger.Timeout {
+				findings = append(findings, Finding{
+					Severity: SeverityError,
+					State:    from,
+					Event:    trigger.Event,
+					Err: fmt.Errorf(TimeoutMismatchConfigurationError, from, trigger.Event,
+						previous[0].timeout, trigger.Timeout),
+				})
+			}
+			for _, previous := range seen[key] {
+				if previous.guard == "" || previous.guard == guard {
+					findings = append(findings, Finding{
+						Severity: SeverityError,
+						State:    from,
+						Event:    trigger.Event,
+						Err: fmt.Errorf(ShadowedTransitionConfigurationError, t.Event, from, t.To,
+							previous.to),
+					})
+					break
+				}
+			}
+			seen[key] = append(seen[key], match{to: t.To, guard: guard, timeout: trigger.Timeout})
+		}
+	}
+	return findings
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api_test
+
+import (
+	"errors"
+
+	. "github.com/massenz/go-statemachine/pkg/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("Configuration validation", func() {
+	var orders *protos.Configuration
+	BeforeEach(func() {
+		orders = &protos.Configuration{
+			Name:          "orders",
+			Version:       "v1",
+			StartingState: "start",
+			States:        []string{"start", "pending", "shipped", "end"},
+			Transitions: []*protos.Transition{
+				{From: "start", To: "pending", Event: "accept"},
+				{From: "pending", To: "shipped", Event: "ship"},
+				{From: "pending", To: "start", Event: "review"},
+				{From: "shipped", To: "end", Event: "deliver"},
+			},
+		}
+	})
+	It("accepts a valid configuration, warning about dead ends", func() {
+		findings := Validate(orders)
+		Expect(findings.Errors()).To(BeEmpty())
+		Expect(findings.Warnings()).To(HaveLen(1))
+		Expect(findings.Warnings()[0].State).To(Equal("end"))
+		Expect(CheckValid(orders)).To(Succeed())
+	})
+	It("reports states which cannot be reached from the starting state", func() {
+		orders.States = append(orders.States, "lost")
+		orders.Transitions = append(orders.Transitions,
+			&protos.Transition{From: "lost", To: "end", Event: "found"})
+		errs := Validate(orders).Errors()
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0].State).To(Equal("lost"))
+	})
+	It("reports states which are not used in any transition", func() {
+		orders.States = append(orders.States, "unused")
+		errs := Validate(orders).Errors()
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0].State).To(Equal("unused"))
+	})
+	It("reports transitions referencing unknown states", func() {
+		orders.Transitions = append(orders.Transitions,
+			&protos.Transition{From: "shipped", To: "lost", Event: "misplace"})
+		errs := Validate(orders).Errors()
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0].State).To(Equal("lost"))
+		Expect(errs[0].Event).To(Equal("misplace"))
+	})
+	It("reports transitions shadowed by a previous one", func() {
+		orders.Transitions = append(orders.Transitions,
+			&protos.Transition{From: "pending", To: "end", Event: "ship"})
+		errs := Validate(orders).Errors()
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0].State).To(Equal("pending"))
+		Expect(errs[0].Event).To(Equal("ship"))
+	})
+	It("allows the same event from the same state, if guarded", func() {
+		orders.Transitions[1].Event = "ship [express]"
+		orders.Transitions = append(orders.Transitions,
+			&protos.Transition{From: "pending", To: "end", Event: "ship [!express]"})
+		Expect(Validate(orders).Errors()).To(BeEmpty())
+
+		orders.Transitions[4].Event = "ship [ express ]"
+		Expect(Validate(orders).Errors()).To(HaveLen(1))
+	})
+	It("reports all the errors at once", func() {
+		orders.Name = ""
+		orders.StartingState = "nowhere"
+		orders.States = append(orders.States, "unused")
+		err := CheckValid(orders)
+		Expect(err).To(HaveOccurred())
+		var validationErr *ValidationError
+		Expect(errors.As(err, &validationErr)).To(BeTrue())
+		Expect(validationErr.Findings).To(HaveLen(3))
+		Expect(errors.Is(err, MissingNameConfigurationError)).To(BeTrue())
+		Expect(errors.Is(err, MismatchStartingStateConfigurationError)).To(BeTrue())
+	})
+	It("can build the graph of the configuration", func() {
+		g := NewGraph(orders)
+		Expect(g.Edges["pending"]).To(HaveLen(2))
+		Expect(g.Reachable("shipped")).To(Equal(map[string]bool{"shipped": true, "end": true}))
+		Expect(g.Reachable("start")).To(HaveLen(4))
+	})
+})
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api
+
+import (
+	"strings"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+const (
+	// AnyState can be used as a Transition's `From`, for transitions which can be taken
+	// from any state: transitions from a specific state always take precedence over those.
+	AnyState = "*"
+
+	// OriginsSeparator separates the states in a Transition's `From`, for transitions which
+	// can be taken from any of them (e.g., `pending, accepted`).
+	OriginsSeparator = ","
+)
+
+// IsWildcard returns true if the Transition can be taken from any state.
+func IsWildcard(t *protos.Transition) bool {
+	return strings.TrimSpace(t.GetFrom()) == AnyState
+}
+
+// Origins returns the states the Transition can be taken from: those listed in its `From`
+// or, for wildcards, all the Configuration's simple (that is, not compound) states.
+func Origins(c *protos.Configuration, t *protos.Transition) []string {
+	var origins []string
+	if IsWildcard(t) {
+		for _, s := range c.States {
+			if !IsCompound(c, s) {
+				origins = append(origins, s)
+			}
+		}
+		return origins
+	}
+	for _, s := range strings.Split(t.GetFrom(), OriginsSeparator) {
+		origins = append(origins, strings.TrimSpace(s))
+	}
+	return origins
+}
+
+// FromState returns true if the Transition can be taken from `state`.
+//
+// Wildcards only match simple states: FSMs are always in one of them, and they would
+// otherwise match once for each of the compound states that one is nested in.
+func FromState(c *protos.Configuration, t *protos.Transition, state string) bool {
+	if IsWildcard(t) {
+		return !IsCompound(c, state)
+	}
+	if t.GetFrom() == state {
+		return true
+	}
+	for _, s := range Origins(c, t) {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package api_test
+
+import (
+	. "github.com/massenz/go-statemachine/pkg/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("Wildcard and internal transitions", func() {
+	var orders *protos.Configuration
+	BeforeEach(func() {
+		orders = &protos.Configuration{
+			Name:          "orders",
+			Version:       "v1",
+			StartingState: "pending",
+			States:        []string{"pending", "accepted", "shipped", "delivered", "cancelled"},
+			Transitions: []*protos.Transition{
+				{From: "pending", To: "accepted", Event: "accept"},
+				{From: "accepted", To: "shipped", Event: "ship"},
+				{From: "shipped", To: "delivered", Event: "deliver"},
+				{From: "shipped", To: "delivered", Event: "cancel"},
+				{From: "*", To: "cancelled", Event: "cancel"},
+				{From: "accepted, shipped", Event: "track / update_eta"},
+				{From: "delivered", To: FinalState},
+				{From: "cancelled", To: FinalState},
+			},
+		}
+	})
+	It("is valid", func() {
+		Expect(Validate(orders)).To(BeEmpty())
+	})
+	It("lists the transitions' origins", func() {
+		Expect(Origins(orders, orders.Transitions[5])).To(Equal([]string{"accepted", "shipped"}))
+		Expect(Origins(orders, orders.Transitions[4])).To(Equal(orders.States))
+		Expect(FromState(orders, orders.Transitions[5], "shipped")).To(BeTrue())
+		Expect(FromState(orders, orders.Transitions[5], "pending")).To(BeFalse())
+		Expect(HasState(orders.Transitions[4], "pending")).To(BeFalse())
+	})
+	It("can be taken from any state", func() {
+		fsm, _ := NewStateMachine(orders)
+		Expect(fsm.SendEvent(NewEvent("accept"))).ToNot(HaveOccurred())
+		Expect(fsm.SendEvent(NewEvent("cancel"))).ToNot(HaveOccurred())
+		Expect(fsm.FSM.State).To(Equal("cancelled"))
+		Expect(fsm.IsCompleted()).To(BeTrue())
+	})
+	It("gives precedence to exact matches", func() {
+		fsm, _ := NewStateMachine(orders)
+		fsm.FSM.State = "shipped"
+		Expect(fsm.SendEvent(NewEvent("cancel"))).ToNot(HaveOccurred())
+		Expect(fsm.FSM.State).To(Equal("delivered"))
+	})
+	It("records internal transitions without changing state", func() {
+		fsm, _ := NewStateMachine(orders)
+		Expect(fsm.SendEvent(NewEvent("track"))).To(MatchError(UnexpectedTransitionError))
+		Expect(fsm.SendEvent(NewEvent("accept"))).ToNot(HaveOccurred())
+		effects, err := fsm.ProcessEvent(NewEvent("track"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fsm.FSM.State).To(Equal("accepted"))
+		Expect(effects.Exited).To(BeEmpty())
+		Expect(effects.Entered).To(BeEmpty())
+		Expect(effects.Actions).To(HaveLen(1))
+		Expect(effects.Actions[0].Name).To(Equal("update_eta"))
+		Expect(fsm.FSM.History).To(HaveLen(2))
+		last := fsm.FSM.History[1].Transition
+		Expect(last.From).To(Equal("accepted"))
+		Expect(last.To).To(Equal("accepted"))
+	})
+	It("can reach states via wildcards", func() {
+		orders.Transitions = []*protos.Transition{
+			{From: "pending", To: "accepted", Event: "accept"},
+			{From: "accepted", To: "shipped", Event: "ship"},
+			{From: "*", To: "cancelled", Event: "cancel"},
+			{From: "cancelled", To: FinalState},
+		}
+		orders.States = []string{"pending", "accepted", "shipped", "cancelled"}
+		Expect(Validate(orders).Errors()).To(BeEmpty())
+		Expect(Validate(orders).Warnings()).To(BeEmpty())
+	})
+	It("reports ambiguous or invalid wildcards", func() {
+		orders.Transitions = append(orders.Transitions,
+			&protos.Transition{From: "*", To: "pending", Event: "cancel"},
+			&protos.Transition{From: "*", To: FinalState},
+			&protos.Transition{From: "pending, unknown", Event: "track"})
+		errs := Validate(orders).Errors()
+		Expect(errs).To(HaveLen(3))
+	})
+})
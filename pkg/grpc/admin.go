@@ -0,0 +1,761 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package grpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/massenz/go-statemachine/pkg/api"
+	"github.com/massenz/go-statemachine/pkg/storage"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+// The AdminService groups the administrative RPCs which are not (yet) part of the
+// StatemachineService Protobuf definitions: their requests and responses are
+// `google.protobuf.Struct` messages, whose fields are described by each method.
+const (
+	AdminServiceName = "statemachine.v1beta.AdminService"
+
+	// MigrateStateMachinesMethod takes the `from` and `to` Configuration IDs, optionally the
+	// `states` mapping (see api.NewMigration) and either the `id` of an FSM, or the `state`
+	// of the FSMs to migrate (all of them, if omitted), the `batch_size` and the `cursor`
+	// (see storage.Migrator); it migrates one batch of FSMs, and returns the IDs of those
+	// `migrated` and, unless there are none left, the `cursor` of the next batch.
+	MigrateStateMachinesMethod = "MigrateStateMachines"
+
+	// DiffConfigurationsMethod takes the `from` and `to` Configuration IDs, and returns
+	// their api.ConfigDiff, including the count of orphaned FSMs.
+	DiffConfigurationsMethod = "DiffConfigurations"
+
+	// RenderConfigurationMethod takes the `config` ID, the `format` (see api.GraphFormat)
+	// and, optionally, the `id` of an FSM configured with it, and returns the diagram of
+	// the Configuration as `graph`.
+	RenderConfigurationMethod = "RenderConfiguration"
+
+	// VerifyStateMachinesMethod takes the `config` name and, optionally, the `ids` of the
+	// FSMs to verify (all of them, if omitted) and whether to `repair` them, and returns how
+	// many were `verified`, and the storage.Verification of the `inconsistent` ones.
+	VerifyStateMachinesMethod = "VerifyStateMachines"
+
+	// RollbackStateMachineMethod takes the `config` name, the `id` of an FSM and the number
+	// of `steps` to revert, and returns the FSM's `state` once rolled back.
+	RollbackStateMachineMethod = "RollbackStateMachine"
+
+	// ListConfigurationsMethod takes, optionally, the `config` name, the `page_size` and the
+	// `page_token` (see storage.PageRequest), and returns a page of the `ids` of the versions
+	// of the Configuration (or of the names of all the Configurations, if no `config` is given)
+	// and the `next_page_token`, unless it is the last one.
+	ListConfigurationsMethod = "ListConfigurations"
+
+	// ListStateMachinesMethod takes the `config` name, the `state`, the `page_size` and the
+	// `page_token`, and returns a page of the `ids` of the FSMs in the state, and the
+	// `next_page_token`, unless it is the last one.
+	ListStateMachinesMethod = "ListStateMachines"
+
+	// ScanStateMachinesMethod takes the `config` name and, optionally, the `version`, the
+	// `states` and the `updated_after` and `updated_before` times (in RFC 3339 format) of the
+	// FSMs (see storage.ScanFilter), and streams the FSMs which match them all, as
+	// PutResponse messages.
+	ScanStateMachinesMethod = "ScanStateMachines"
+
+	// DeleteConfigurationMethod takes the `config` ID and whether to `force` its removal,
+	// even if FSMs are still configured with it, and returns an empty response.
+	DeleteConfigurationMethod = "DeleteConfiguration"
+
+	// DeleteStateMachineMethod takes the `config` name and the `id` of an FSM, and returns an
+	// empty response.
+	DeleteStateMachineMethod = "DeleteStateMachine"
+
+	// DeleteEventMethod takes the `config` name and the `id` of an Event, removes it along
+	// with its outcome, and returns an empty response.
+	DeleteEventMethod = "DeleteEvent"
+)
+
+// MaxPageSize is the largest page that can be requested from the List methods.
+const MaxPageSize = 1000
+
+// AdminServer is the server API for the AdminService.
+type AdminServer interface {
+	MigrateStateMachines(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error)
+	DiffConfigurations(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error)
+	RenderConfiguration(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error)
+	VerifyStateMachines(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error)
+	RollbackStateMachine(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error)
+	ListConfigurations(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error)
+	ListStateMachines(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error)
+	ScanStateMachines(in *structpb.Struct, stream grpc.ServerStream) error
+	DeleteConfiguration(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error)
+	DeleteStateMachine(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error)
+	DeleteEvent(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error)
+}
+
+var _ AdminServer = (*grpcSubscriber)(nil)
+
+// AdminServiceDesc describes the AdminService, so that it can be registered with a gRPC
+// server alongside the StatemachineService.
+var AdminServiceDesc = grpc.ServiceDesc{
+	ServiceName: AdminServiceName,
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: MigrateStateMachinesMethod,
+			Handler:    adminHandler(AdminServer.MigrateStateMachines, MigrateStateMachinesMethod),
+		},
+		{
+			MethodName: DiffConfigurationsMethod,
+			Handler:    adminHandler(AdminServer.DiffConfigurations, DiffConfigurationsMethod),
+		},
+		{
+			MethodName: RenderConfigurationMethod,
+			Handler:    adminHandler(AdminServer.RenderConfiguration, RenderConfigurationMethod),
+		},
+		{
+			MethodName: VerifyStateMachinesMethod,
+			Handler:    adminHandler(AdminServer.VerifyStateMachines, VerifyStateMachinesMethod),
+		},
+		{
+			MethodName: RollbackStateMachineMethod,
+			Handler:    adminHandler(AdminServer.RollbackStateMachine, RollbackStateMachineMethod),
+		},
+		{
+			MethodName: ListConfigurationsMethod,
+			Handler:    adminHandler(AdminServer.ListConfigurations, ListConfigurationsMethod),
+		},
+		{
+			MethodName: ListStateMachinesMethod,
+			Handler:    adminHandler(AdminServer.ListStateMachines, ListStateMachinesMethod),
+		},
+		{
+			MethodName: DeleteConfigurationMethod,
+			Handler:    adminHandler(AdminServer.DeleteConfiguration, DeleteConfigurationMethod),
+		},
+		{
+			MethodName: DeleteStateMachineMethod,
+			Handler:    adminHandler(AdminServer.DeleteStateMachine, DeleteStateMachineMethod),
+		},
+		{
+			MethodName: DeleteEventMethod,
+			Handler:    adminHandler(AdminServer.DeleteEvent, DeleteEventMethod),
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    ScanStateMachinesMethod,
+			Handler:       scanStateMachinesHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "admin",
+}
+
+// adminHandler adapts one of the AdminServer's methods to a gRPC method handler.
+func adminHandler(method func(AdminServer, context.Context, *structpb.Struct) (*structpb.Struct, error),
+	name string) func(interface{}, context.Context, func(interface{}) error,
+	grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+		interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		in := new(structpb.Struct)
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return method(srv.(AdminServer), ctx, in)
+		}
+		info := &grpc.UnaryServerInfo{
+			Server:     srv,
+			FullMethod: "/" + AdminServiceName + "/" + name,
+		}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return method(srv.(AdminServer), ctx, req.(*structpb.Struct))
+		}
+		return interceptor(ctx, in, info, handler)
+	}
+}
+
+func scanStateMachinesHandler(srv interface{}, stream grpc.ServerStream) error {
+	in := new(structpb.Struct)
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	return srv.(AdminServer).ScanStateMachines(in, stream)
+}
+
+// AdminClient is the client API for the AdminService.
+type AdminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminClient(cc grpc.ClientConnInterface) *AdminClient {
+	return &AdminClient{cc: cc}
+}
+
+// MigrationRequest describes the FSMs moved by MigrateStateMachines: the FSM `Id` or, if
+// empty, those in `State` (all of them, if empty), in batches of `BatchSize` (the default
+// one, if zero), starting from the `Cursor` returned with the previous batch.
+type MigrationRequest struct {
+	From      string
+	To        string
+	States    map[string]string
+	Id        string
+	State     string
+	BatchSize int
+	Cursor    string
+}
+
+// MigrationResult is the response of the MigrateStateMachines method.
+type MigrationResult struct {
+	Migrated []string `json:"migrated,omitempty"`
+	Cursor   string   `json:"cursor,omitempty"`
+}
+
+// MigrateStateMachines migrates one batch of the FSMs described by the `req` (see
+// storage.Migrator); the migration is complete once the result has no Cursor.
+func (c *AdminClient) MigrateStateMachines(ctx context.Context, req MigrationRequest,
+	opts ...grpc.CallOption) (*MigrationResult, error) {
+	states := make(map[string]interface{}, len(req.States))
+	for state, target := range req.States {
+		states[state] = target
+	}
+	in, err := structpb.NewStruct(map[string]interface{}{
+		"from":       req.From,
+		"to":         req.To,
+		"states":     states,
+		"id":         req.Id,
+		"state":      req.State,
+		"batch_size": req.BatchSize,
+		"cursor":     req.Cursor,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result MigrationResult
+	if err = c.invoke(ctx, MigrateStateMachinesMethod, in, &result, opts...); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DiffConfigurations returns the differences between the `from` and `to` Configurations.
+func (c *AdminClient) DiffConfigurations(ctx context.Context, from, to string,
+	opts ...grpc.CallOption) (*api.ConfigDiff, error) {
+	in, err := structpb.NewStruct(map[string]interface{}{"from": from, "to": to})
+	if err != nil {
+		return nil, err
+	}
+	var diff api.ConfigDiff
+	if err = c.invoke(ctx, DiffConfigurationsMethod, in, &diff, opts...); err != nil {
+		return nil, err
+	}
+	return &diff, nil
+}
+
+// RenderConfiguration returns the diagram of the Configuration `cfgId` in the given
+// `format`, highlighting the path of the FSM `fsmId`, unless empty (see api.Render).
+func (c *AdminClient) RenderConfiguration(ctx context.Context, cfgId string, format api.GraphFormat,
+	fsmId string, opts ...grpc.CallOption) (string, error) {
+	in, err := structpb.NewStruct(map[string]interface{}{
+		"config": cfgId,
+		"format": string(format),
+		"id":     fsmId,
+	})
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		Graph string `json:"graph"`
+	}
+	if err = c.invoke(ctx, RenderConfigurationMethod, in, &out, opts...); err != nil {
+		return "", err
+	}
+	return out.Graph, nil
+}
+
+// VerificationResult is the response of the VerifyStateMachines method.
+type VerificationResult struct {
+	Verified     int                     `json:"verified"`
+	Inconsistent []*storage.Verification `json:"inconsistent,omitempty"`
+}
+
+// VerifyStateMachines verifies (and optionally repairs) the FSMs `ids` configured with
+// `cfgName`, or all of them, if `ids` is empty (see storage.VerifyAll).
+func (c *AdminClient) VerifyStateMachines(ctx context.Context, cfgName string, ids []string, repair bool,
+	opts ...grpc.CallOption) (*VerificationResult, error) {
+	idList := make([]interface{}, len(ids))
+	for i, id := range ids {
+		idList[i] = id
+	}
+	in, err := structpb.NewStruct(map[string]interface{}{
+		"config": cfgName,
+		"ids":    idList,
+		"repair": repair,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result VerificationResult
+	if err = c.invoke(ctx, VerifyStateMachinesMethod, in, &result, opts...); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// RollbackStateMachine reverts the last `steps` transitions of the FSM `id`, configured
+// with `cfgName`, and returns its state once rolled back.
+func (c *AdminClient) RollbackStateMachine(ctx context.Context, cfgName, id string, steps int,
+	opts ...grpc.CallOption) (string, error) {
+	in, err := structpb.NewStruct(map[string]interface{}{
+		"config": cfgName,
+		"id":     id,
+		"steps":  steps,
+	})
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		State string `json:"state"`
+	}
+	if err = c.invoke(ctx, RollbackStateMachineMethod, in, &out, opts...); err != nil {
+		return "", err
+	}
+	return out.State, nil
+}
+
+// ListConfigurations returns the page `req` of the IDs of the versions of the Configuration
+// `cfgName` or, if empty, of the names of all the Configurations.
+func (c *AdminClient) ListConfigurations(ctx context.Context, cfgName string, req storage.PageRequest,
+	opts ...grpc.CallOption) (*storage.Page, error) {
+	return c.list(ctx, ListConfigurationsMethod, map[string]interface{}{"config": cfgName}, req, opts...)
+}
+
+// ListStateMachines returns the page `req` of the IDs of the FSMs configured with `cfgName`
+// which are in the given `state`.
+func (c *AdminClient) ListStateMachines(ctx context.Context, cfgName, state string, req storage.PageRequest,
+	opts ...grpc.CallOption) (*storage.Page, error) {
+	return c.list(ctx, ListStateMachinesMethod, map[string]interface{}{"config": cfgName, "state": state},
+		req, opts...)
+}
+
+func (c *AdminClient) list(ctx context.Context, method string, fields map[string]interface{},
+	req storage.PageRequest, opts ...grpc.CallOption) (*storage.Page, error) {
+	fields["page_size"] = req.Size
+	fields["page_token"] = req.Token
+	in, err := structpb.NewStruct(fields)
+	if err != nil {
+		return nil, err
+	}
+	var page storage.Page
+	if err = c.invoke(ctx, method, in, &page, opts...); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// ScanStateMachines calls `fn` with each of the FSMs configured with `cfgName` which match the
+// `filter` (see storage.ScanFilter), as they are streamed by the server; it stops at the
+// first error returned by `fn`, and returns it.
+func (c *AdminClient) ScanStateMachines(ctx context.Context, cfgName string, filter storage.ScanFilter,
+	fn func(response *protos.PutResponse) error, opts ...grpc.CallOption) error {
+	states := make([]interface{}, len(filter.States))
+	for i, state := range filter.States {
+		states[i] = state
+	}
+	fields := map[string]interface{}{
+		"config":  cfgName,
+		"version": filter.Version,
+		"states":  states,
+	}
+	if !filter.UpdatedAfter.IsZero() {
+		fields["updated_after"] = filter.UpdatedAfter.Format(time.RFC3339Nano)
+	}
+	if !filter.UpdatedBefore.IsZero() {
+		fields["updated_before"] = filter.UpdatedBefore.Format(time.RFC3339Nano)
+	}
+	in, err := structpb.NewStruct(fields)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.cc.NewStream(ctx, &AdminServiceDesc.Streams[0],
+		"/"+AdminServiceName+"/"+ScanStateMachinesMethod, opts...)
+	if err != nil {
+		return err
+	}
+	if err = stream.SendMsg(in); err != nil {
+		return err
+	}
+	if err = stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		response := new(protos.PutResponse)
+		if err = stream.RecvMsg(response); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err = fn(response); err != nil {
+			return err
+		}
+	}
+}
+
+// DeleteConfiguration removes the Configuration `cfgId`; unless `force` is true, it fails
+// with a FailedPrecondition status if any FSM is still configured with it.
+func (c *AdminClient) DeleteConfiguration(ctx context.Context, cfgId string, force bool,
+	opts ...grpc.CallOption) error {
+	return c.delete(ctx, DeleteConfigurationMethod, map[string]interface{}{
+		"config": cfgId,
+		"force":  force,
+	}, opts...)
+}
+
+// DeleteStateMachine removes the FSM `id`, configured with `cfgName`.
+func (c *AdminClient) DeleteStateMachine(ctx context.Context, cfgName, id string,
+	opts ...grpc.CallOption) error {
+	return c.delete(ctx, DeleteStateMachineMethod, map[string]interface{}{"config": cfgName, "id": id},
+		opts...)
+}
+
+// DeleteEvent removes the Event `id`, sent to an FSM configured with `cfgName`, and its outcome.
+func (c *AdminClient) DeleteEvent(ctx context.Context, cfgName, id string, opts ...grpc.CallOption) error {
+	return c.delete(ctx, DeleteEventMethod, map[string]interface{}{"config": cfgName, "id": id}, opts...)
+}
+
+func (c *AdminClient) delete(ctx context.Context, method string, fields map[string]interface{},
+	opts ...grpc.CallOption) error {
+	in, err := structpb.NewStruct(fields)
+	if err != nil {
+		return err
+	}
+	var out struct{}
+	return c.invoke(ctx, method, in, &out, opts...)
+}
+
+func (c *AdminClient) invoke(ctx context.Context, method string, in *structpb.Struct,
+	result interface{}, opts ...grpc.CallOption) error {
+	out := new(structpb.Struct)
+	if err := c.cc.Invoke(ctx, "/"+AdminServiceName+"/"+method, in, out, opts...); err != nil {
+		return err
+	}
+	data, err := protojson.Marshal(out)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, result)
+}
+
+// toStruct converts a response (which must be serializable to a JSON object) to a Struct.
+func toStruct(response interface{}) (*structpb.Struct, error) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	out := new(structpb.Struct)
+	if err = protojson.Unmarshal(data, out); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return out, nil
+}
+
+// pageRequest returns the storage.PageRequest for the `page_size` and `page_token` of `in`.
+func pageRequest(in *structpb.Struct) (storage.PageRequest, error) {
+	req := storage.PageRequest{
+		Token: in.GetFields()["page_token"].GetStringValue(),
+		Size:  int(in.GetFields()["page_size"].GetNumberValue()),
+	}
+	if req.Size < 0 || req.Size > MaxPageSize {
+		return req, status.Errorf(codes.InvalidArgument, "the page size must be at most %d", MaxPageSize)
+	}
+	return req, nil
+}
+
+func (s *grpcSubscriber) MigrateStateMachines(ctx context.Context, in *structpb.Struct) (
+	*structpb.Struct, error) {
+	fromId := in.GetFields()["from"].GetStringValue()
+	toId := in.GetFields()["to"].GetStringValue()
+	if fromId == "" || toId == "" {
+		return nil, status.Error(codes.InvalidArgument, "both `from` and `to` configurations must be specified")
+	}
+	batchSize := int(in.GetFields()["batch_size"].GetNumberValue())
+	if batchSize < 0 || batchSize > MaxPageSize {
+		return nil, status.Errorf(codes.InvalidArgument, "the batch size must be at most %d", MaxPageSize)
+	}
+	from, err := s.Store.GetConfig(ctx, fromId)
+	if err != nil {
+		return nil, storeStatus(err)
+	}
+	to, err := s.Store.GetConfig(ctx, toId)
+	if err != nil {
+		return nil, storeStatus(err)
+	}
+	states := make(map[string]string)
+	for state, target := range in.GetFields()["states"].GetStructValue().GetFields() {
+		states[state] = target.GetStringValue()
+	}
+	migration, err := api.NewMigration(from, to, states)
+	if err != nil {
+		var invalid *api.ValidationError
+		if errors.As(err, &invalid) {
+			return nil, invalidConfigurationStatus(invalid.Findings)
+		}
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	var result MigrationResult
+	if id := in.GetFields()["id"].GetStringValue(); id != "" {
+		migrated, err := s.Store.MigrateStateMachine(ctx, id, migration)
+		if err != nil {
+			return nil, migrationStatus(err)
+		}
+		if migrated {
+			result.Migrated = []string{id}
+		}
+	} else {
+		migrator := storage.NewMigrator(s.Store, migration)
+		if batchSize > 0 {
+			migrator.BatchSize = batchSize
+		}
+		migrator.Cursor = in.GetFields()["cursor"].GetStringValue()
+		migrated, more, err := migrator.Next(ctx, in.GetFields()["state"].GetStringValue())
+		if err != nil {
+			return nil, migrationStatus(err)
+		}
+		result.Migrated = migrated
+		if more {
+			result.Cursor = migrator.Cursor
+		}
+	}
+	s.Logger.Info().Msgf("migrated %d FSMs from %s to %s", len(result.Migrated), fromId, toId)
+	return toStruct(result)
+}
+
+// migrationStatus returns the status for an error returned when migrating FSMs: errors other
+// than the store's mean that an FSM cannot be migrated.
+func migrationStatus(err error) error {
+	var storeErr *storage.StoreError
+	if errors.As(err, &storeErr) {
+		return storeStatus(err)
+	}
+	return status.Error(codes.FailedPrecondition, err.Error())
+}
+
+func (s *grpcSubscriber) DiffConfigurations(ctx context.Context, in *structpb.Struct) (
+	*structpb.Struct, error) {
+	fromId := in.GetFields()["from"].GetStringValue()
+	toId := in.GetFields()["to"].GetStringValue()
+	if fromId == "" || toId == "" {
+		return nil, status.Error(codes.InvalidArgument, "both `from` and `to` configurations must be specified")
+	}
+	from, err := s.Store.GetConfig(ctx, fromId)
+	if err != nil {
+		return nil, storeStatus(err)
+	}
+	to, err := s.Store.GetConfig(ctx, toId)
+	if err != nil {
+		return nil, storeStatus(err)
+	}
+	diff := api.DiffConfigurations(from, to)
+	diff.CountOrphaned(func(state string) []string {
+		return s.Store.GetAllInState(ctx, from.Name, state)
+	})
+	s.Logger.Debug().Msgf("configuration %s differs from %s: %d states removed, %d added",
+		toId, fromId, len(diff.RemovedStates), len(diff.AddedStates))
+	return toStruct(diff)
+}
+
+func (s *grpcSubscriber) RenderConfiguration(ctx context.Context, in *structpb.Struct) (
+	*structpb.Struct, error) {
+	cfgId := in.GetFields()["config"].GetStringValue()
+	if cfgId == "" {
+		return nil, status.Error(codes.InvalidArgument, "configuration must always be specified")
+	}
+	format, err := api.ParseGraphFormat(in.GetFields()["format"].GetStringValue())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	cfg, err := s.Store.GetConfig(ctx, cfgId)
+	if err != nil {
+		return nil, storeStatus(err)
+	}
+	var fsm *protos.FiniteStateMachine
+	if fsmId := in.GetFields()["id"].GetStringValue(); fsmId != "" {
+		fsm, err = s.Store.GetStateMachine(ctx, fsmId, cfg.Name)
+		if err != nil {
+			return nil, storeStatus(err)
+		}
+	}
+	graph, err := api.Render(cfg, format, fsm)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return structpb.NewStruct(map[string]interface{}{"graph": graph})
+}
+
+func (s *grpcSubscriber) VerifyStateMachines(ctx context.Context, in *structpb.Struct) (
+	*structpb.Struct, error) {
+	cfgName := in.GetFields()["config"].GetStringValue()
+	if cfgName == "" {
+		return nil, status.Error(codes.InvalidArgument, "configuration must always be specified")
+	}
+	var ids []string
+	for _, id := range in.GetFields()["ids"].GetListValue().GetValues() {
+		ids = append(ids, id.GetStringValue())
+	}
+	repair := in.GetFields()["repair"].GetBoolValue()
+	verified, inconsistent, err := storage.VerifyAll(ctx, s.Store, cfgName, ids, repair)
+	if err != nil {
+		return nil, storeStatus(err)
+	}
+	s.Logger.Info().Msgf("verified %d FSMs [%s], %d inconsistent (repair: %t)", verified, cfgName,
+		len(inconsistent), repair)
+	return toStruct(VerificationResult{Verified: verified, Inconsistent: inconsistent})
+}
+
+func (s *grpcSubscriber) RollbackStateMachine(ctx context.Context, in *structpb.Struct) (
+	*structpb.Struct, error) {
+	cfgName := in.GetFields()["config"].GetStringValue()
+	id := in.GetFields()["id"].GetStringValue()
+	steps := int(in.GetFields()["steps"].GetNumberValue())
+	if cfgName == "" || id == "" {
+		return nil, status.Error(codes.InvalidArgument, "both configuration and FSM ID must be specified")
+	}
+	if steps <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "the number of steps must be positive")
+	}
+	fsm, err := s.Store.RollbackStateMachine(ctx, id, cfgName, steps)
+	if err != nil {
+		// Errors other than the store's mean that the FSM cannot be rolled back that far.
+		var storeErr *storage.StoreError
+		if errors.As(err, &storeErr) {
+			return nil, storeStatus(err)
+		}
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	s.Logger.Info().Msgf("rolled back FSM [%s#%s] by %d steps, to state %s", cfgName, id, steps,
+		fsm.FSM.GetState())
+	return structpb.NewStruct(map[string]interface{}{"state": fsm.FSM.GetState()})
+}
+
+func (s *grpcSubscriber) ListConfigurations(ctx context.Context, in *structpb.Struct) (
+	*structpb.Struct, error) {
+	req, err := pageRequest(in)
+	if err != nil {
+		return nil, err
+	}
+	var page *storage.Page
+	if cfgName := in.GetFields()["config"].GetStringValue(); cfgName != "" {
+		s.Logger.Trace().Msgf("looking up a page of the versions of configuration %s", cfgName)
+		page, err = s.Store.GetVersionsPage(ctx, cfgName, req)
+	} else {
+		s.Logger.Trace().Msg("looking up a page of the available configurations")
+		page, err = s.Store.GetConfigsPage(ctx, req)
+	}
+	if err != nil {
+		return nil, storeStatus(err)
+	}
+	return toStruct(page)
+}
+
+func (s *grpcSubscriber) ListStateMachines(ctx context.Context, in *structpb.Struct) (
+	*structpb.Struct, error) {
+	cfgName := in.GetFields()["config"].GetStringValue()
+	state := in.GetFields()["state"].GetStringValue()
+	if cfgName == "" || state == "" {
+		return nil, status.Error(codes.InvalidArgument, "both configuration and state must be specified")
+	}
+	req, err := pageRequest(in)
+	if err != nil {
+		return nil, err
+	}
+	page, err := s.Store.GetInStatePage(ctx, cfgName, state, req)
+	if err != nil {
+		return nil, storeStatus(err)
+	}
+	return toStruct(page)
+}
+
+func (s *grpcSubscriber) ScanStateMachines(in *structpb.Struct, stream grpc.ServerStream) error {
+	cfgName := in.GetFields()["config"].GetStringValue()
+	if cfgName == "" {
+		return status.Error(codes.InvalidArgument, "configuration must always be specified")
+	}
+	filter := storage.ScanFilter{Version: in.GetFields()["version"].GetStringValue()}
+	for _, state := range in.GetFields()["states"].GetListValue().GetValues() {
+		filter.States = append(filter.States, state.GetStringValue())
+	}
+	for field, bound := range map[string]*time.Time{
+		"updated_after":  &filter.UpdatedAfter,
+		"updated_before": &filter.UpdatedBefore,
+	} {
+		value := in.GetFields()[field].GetStringValue()
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid `%s` time: %v", field, err)
+		}
+		*bound = t
+	}
+	return s.streamStateMachines(stream, cfgName, filter)
+}
+
+func (s *grpcSubscriber) DeleteConfiguration(ctx context.Context, in *structpb.Struct) (
+	*structpb.Struct, error) {
+	cfgId := in.GetFields()["config"].GetStringValue()
+	force := in.GetFields()["force"].GetBoolValue()
+	if cfgId == "" {
+		return nil, status.Error(codes.InvalidArgument, "configuration must always be specified")
+	}
+	if err := s.Store.DeleteConfiguration(ctx, cfgId, force); err != nil {
+		return nil, storeStatus(err)
+	}
+	s.Logger.Info().Msgf("deleted configuration %s (forced: %t)", cfgId, force)
+	return &structpb.Struct{}, nil
+}
+
+func (s *grpcSubscriber) DeleteStateMachine(ctx context.Context, in *structpb.Struct) (
+	*structpb.Struct, error) {
+	cfgName := in.GetFields()["config"].GetStringValue()
+	id := in.GetFields()["id"].GetStringValue()
+	if cfgName == "" || id == "" {
+		return nil, status.Error(codes.InvalidArgument, "both configuration and FSM ID must be specified")
+	}
+	if err := s.Store.DeleteStateMachine(ctx, id, cfgName); err != nil {
+		return nil, storeStatus(err)
+	}
+	s.Logger.Info().Msgf("deleted FSM [%s#%s]", cfgName, id)
+	return &structpb.Struct{}, nil
+}
+
+func (s *grpcSubscriber) DeleteEvent(ctx context.Context, in *structpb.Struct) (
+	*structpb.Struct, error) {
+	cfgName := in.GetFields()["config"].GetStringValue()
+	id := in.GetFields()["id"].GetStringValue()
+	if cfgName == "" || id == "" {
+		return nil, status.Error(codes.InvalidArgument, "both configuration and event ID must be specified")
+	}
+	if err := s.Store.DeleteEvent(ctx, id, cfgName); err != nil {
+		return nil, storeStatus(err)
+	}
+	s.Logger.Info().Msgf("deleted event %s [%s]", id, cfgName)
+	return &structpb.Struct{}, nil
+}
@@ -13,6 +13,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -25,6 +26,7 @@ import (
 	"github.com/massenz/go-statemachine/pkg/api"
 	"github.com/massenz/go-statemachine/pkg/internal/config"
 	"github.com/massenz/go-statemachine/pkg/storage"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
@@ -94,6 +96,14 @@ func (s *grpcSubscriber) SendEvent(ctx context.Context, request *protos.EventReq
 		request.Event.Transition.GetEvent() == "" {
 		return nil, status.Error(codes.FailedPrecondition, api.MissingEventNameError.Error())
 	}
+	// Events which were already processed are not sent again, and their outcome is returned.
+	if evtId := request.Event.GetEventId(); evtId != "" {
+		outcome, err := s.Store.GetOutcomeForEvent(ctx, evtId, request.GetConfig())
+		if err == nil && outcome.GetId() == request.GetId() {
+			s.Logger.Debug().Msgf("event [%s] was already processed", evtId)
+			return &protos.EventResponse{EventId: evtId, Outcome: outcome}, nil
+		}
+	}
 	// If missing, add ID and timestamp.
 	api.UpdateEvent(request.Event)
 
@@ -115,21 +125,22 @@ func (s *grpcSubscriber) SendEvent(ctx context.Context, request *protos.EventReq
 }
 
 func (s *grpcSubscriber) PutConfiguration(ctx context.Context, cfg *protos.Configuration) (*protos.PutResponse, error) {
-	if err := api.CheckValid(cfg); err != nil {
+	findings := api.Validate(cfg)
+	for _, w := range findings.Warnings() {
+		s.Logger.Warn().Msgf("configuration %s: %v", api.GetVersionId(cfg), w.Err)
+	}
+	if err := findings.Err(); err != nil {
 		s.Logger.Error().Msgf("invalid configuration: %v", err)
-		return nil, status.Errorf(codes.InvalidArgument, "invalid configuration: %v", err)
+		return nil, invalidConfigurationStatus(findings.Errors())
 	}
 	if deadline, ok := ctx.Deadline(); ok {
 		if deadline.Before(time.Now()) {
 			return nil, ctx.Err()
 		}
 	}
-	if err := s.Store.PutConfig(cfg); err != nil {
+	if err := s.Store.PutConfig(ctx, cfg); err != nil {
 		s.Logger.Error().Msgf("could not store configuration: %v", err)
-		if strings.Contains(err.Error(), "already exists") {
-			return nil, status.Errorf(codes.AlreadyExists, "cannot store configuration: %v", err)
-		}
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, status.Errorf(storage.StatusCode(err), "cannot store configuration: %v", err)
 	}
 	if deadline, ok := ctx.Deadline(); ok {
 		if deadline.Before(time.Now()) {
@@ -143,25 +154,50 @@ func (s *grpcSubscriber) PutConfiguration(ctx context.Context, cfg *protos.Confi
 		EntityResponse: &protos.PutResponse_Config{Config: cfg},
 	}, nil
 }
+
+// storeStatus returns the status for an error returned by the store, whose code depends on
+// the kind of error (see storage.StatusCode).
+func storeStatus(err error) error {
+	return status.Error(storage.StatusCode(err), err.Error())
+}
+
+// invalidConfigurationStatus builds an InvalidArgument status, carrying all the validation
+// errors as `BadRequest` field violations, so that clients can report them all at once.
+func invalidConfigurationStatus(errs api.Findings) error {
+	st := status.Newf(codes.InvalidArgument, "invalid configuration: %v", errs.Err())
+	violations := make([]*errdetails.BadRequest_FieldViolation, len(errs))
+	for i, f := range errs {
+		violations[i] = &errdetails.BadRequest_FieldViolation{
+			Field:       f.State,
+			Description: f.Err.Error(),
+		}
+	}
+	detailed, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
 func (s *grpcSubscriber) GetAllConfigurations(ctx context.Context, req *wrapperspb.StringValue) (
 	*protos.ListResponse, error) {
 	cfgName := req.Value
 	if cfgName == "" {
 		s.Logger.Trace().Msg("looking up all available configurations")
-		return &protos.ListResponse{Ids: s.Store.GetAllConfigs()}, nil
+		return &protos.ListResponse{Ids: s.Store.GetAllConfigs(ctx)}, nil
 	}
 	s.Logger.Trace().Msgf("looking up all version for configuration %s", cfgName)
-	return &protos.ListResponse{Ids: s.Store.GetAllVersions(cfgName)}, nil
+	return &protos.ListResponse{Ids: s.Store.GetAllVersions(ctx, cfgName)}, nil
 }
 
 func (s *grpcSubscriber) GetConfiguration(ctx context.Context, configId *wrapperspb.StringValue) (
 	*protos.Configuration, error) {
 	cfgId := configId.Value
 	s.Logger.Trace().Msgf("retrieving Configuration %s", cfgId)
-	cfg, err := s.Store.GetConfig(cfgId)
+	cfg, err := s.Store.GetConfig(ctx, cfgId)
 	if err != nil {
 		s.Logger.Error().Msgf("could not get configuration: %v", err)
-		return nil, status.Errorf(codes.NotFound, "configuration %s not found", cfgId)
+		return nil, storeStatus(err)
 	}
 	return cfg, nil
 }
@@ -170,10 +206,11 @@ func (s *grpcSubscriber) PutFiniteStateMachine(ctx context.Context,
 	request *protos.PutFsmRequest) (*protos.PutResponse, error) {
 	fsm := request.Fsm
 	// First check that the configuration for the FSM is valid
-	cfg, err := s.Store.GetConfig(fsm.ConfigId)
-	if err != nil {
-		return nil, status.Error(codes.FailedPrecondition, storage.NotFoundError(
-			fsm.ConfigId).Error())
+	cfg, err := s.Store.GetConfig(ctx, fsm.ConfigId)
+	if storage.IsNotFoundErr(err) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	} else if err != nil {
+		return nil, storeStatus(err)
 	}
 	if deadline, ok := ctx.Deadline(); ok {
 		if deadline.Before(time.Now()) {
@@ -190,19 +227,17 @@ func (s *grpcSubscriber) PutFiniteStateMachine(ctx context.Context,
 		fsm.State = cfg.StartingState
 	}
 	s.Logger.Trace().Msgf("storing FSM [%s] configured with %s", id, fsm.ConfigId)
-	if err := s.Store.PutStateMachine(id, fsm); err != nil {
+	// The FSM is stored, added to the state SETs, and its timers started, in a single
+	// transaction.
+	if err := s.Store.TxPutStateMachine(ctx, id, fsm); err != nil {
 		s.Logger.Error().Msgf("could not store FSM [%v]: %v", fsm, err)
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-	// we cannot interrupt here, even if deadline is passed, as it would leave the
-	// store in an inconsistent state.
-	if err := s.Store.UpdateState(cfg.Name, id, "", fsm.State); err != nil {
-		s.Logger.Error().Msgf("could not store FSM in state set [%s]: %v", fsm.State, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, storeStatus(err)
 	}
 	return &protos.PutResponse{Id: id, EntityResponse: &protos.PutResponse_Fsm{Fsm: fsm}}, nil
 }
 
+// GetFiniteStateMachine returns the FSM, along with its data (see api.GetData), which
+// clients can extract from the message's unknown fields.
 func (s *grpcSubscriber) GetFiniteStateMachine(ctx context.Context, in *protos.GetFsmRequest) (
 	*protos.FiniteStateMachine, error) {
 	cfg := in.GetConfig()
@@ -214,13 +249,18 @@ func (s *grpcSubscriber) GetFiniteStateMachine(ctx context.Context, in *protos.G
 		return nil, status.Error(codes.InvalidArgument, "ID must always be provided when looking up statemachine")
 	}
 	s.Logger.Debug().Msgf("looking up FSM [%s] (Configuration: %s)", fsmId, cfg)
-	fsm, err := s.Store.GetStateMachine(fsmId, cfg)
+	fsm, err := s.Store.GetStateMachine(ctx, fsmId, cfg)
 	if err != nil {
-		return nil, status.Error(codes.NotFound, storage.NotFoundError(fsmId).Error())
+		return nil, storeStatus(err)
 	}
 	return fsm, nil
 }
 
+// GetAllInState returns the IDs of all the FSMs in the given state.
+//
+// If the state is not given, it returns those of all the FSMs, regardless of their state (see
+// StreamAllInstate), unless there are more than MaxPageSize of them: as the response is not
+// paginated, those must be streamed instead.
 func (s *grpcSubscriber) GetAllInState(ctx context.Context, in *protos.GetFsmRequest) (
 	*protos.ListResponse, error) {
 	cfg := in.GetConfig()
@@ -229,10 +269,27 @@ func (s *grpcSubscriber) GetAllInState(ctx context.Context, in *protos.GetFsmReq
 	}
 	state := in.GetState()
 	if state == "" {
-		// TODO: implement table scanning
-		return nil, status.Errorf(codes.Unimplemented, "missing state, table scan not implemented")
+		var ids []string
+		cfgName, version, _ := strings.Cut(cfg, api.ConfigurationVersionSeparator)
+		err := s.Store.ScanStateMachines(ctx, cfgName, storage.ScanFilter{Version: version},
+			func(id string, _ *protos.FiniteStateMachine) error {
+				if len(ids) == MaxPageSize {
+					return status.Errorf(codes.FailedPrecondition,
+						"there are more than %d FSMs [%s], use StreamAllInstate to list them all",
+						MaxPageSize, cfg)
+				}
+				ids = append(ids, id)
+				return nil
+			})
+		var storeErr *storage.StoreError
+		if errors.As(err, &storeErr) {
+			return nil, storeStatus(err)
+		} else if err != nil {
+			return nil, err
+		}
+		return &protos.ListResponse{Ids: ids}, nil
 	}
-	ids := s.Store.GetAllInState(cfg, state)
+	ids := s.Store.GetAllInState(ctx, cfg, state)
 	return &protos.ListResponse{Ids: ids}, nil
 }
 
@@ -241,9 +298,9 @@ func (s *grpcSubscriber) GetEventOutcome(ctx context.Context, in *protos.EventRe
 	evtId := in.GetId()
 	cfg := in.GetConfig()
 	s.Logger.Debug().Msgf("looking up EventOutcome %s (%s)", evtId, cfg)
-	outcome, err := s.Store.GetOutcomeForEvent(evtId, cfg)
+	outcome, err := s.Store.GetOutcomeForEvent(ctx, evtId, cfg)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "cannot get outcome for event %s: %v", evtId, err)
+		return nil, status.Errorf(storage.StatusCode(err), "cannot get outcome for event %s: %v", evtId, err)
 	}
 	return &protos.EventResponse{
 		EventId: evtId,
@@ -251,24 +308,68 @@ func (s *grpcSubscriber) GetEventOutcome(ctx context.Context, in *protos.EventRe
 	}, nil
 }
 
+// StreamAllInstate streams all the FSMs in the given state, looking them up one page (see
+// storage.PageRequest) at a time, so that the store is never asked for all of them at once.
+//
+// If the state is not given, all the FSMs are streamed, regardless of their state (see
+// storage.ScanFilter); if the configuration is a full `name:version` ID, only those
+// configured with that version.
 func (s *grpcSubscriber) StreamAllInstate(in *protos.GetFsmRequest, stream StatemachineStream) error {
-	response, err := s.GetAllInState(context.Background(), in)
-	if err != nil {
-		return err
-	}
 	cfgName := in.GetConfig()
-	for _, id := range response.GetIds() {
-		fsm, err := s.Store.GetStateMachine(id, cfgName)
+	if cfgName == "" {
+		return status.Errorf(codes.InvalidArgument, "configuration must always be specified")
+	}
+	state := in.GetState()
+	if state == "" {
+		name, version, _ := strings.Cut(cfgName, api.ConfigurationVersionSeparator)
+		return s.streamStateMachines(stream, name, storage.ScanFilter{Version: version})
+	}
+	ctx := stream.Context()
+	req := storage.PageRequest{Size: storage.DefaultPageSize}
+	for {
+		page, err := s.Store.GetInStatePage(ctx, cfgName, state, req)
 		if err != nil {
-			return err
+			return storeStatus(err)
 		}
-		if err = stream.SendMsg(&protos.PutResponse{
-			Id:             id,
-			EntityResponse: &protos.PutResponse_Fsm{Fsm: fsm},
-		}); err != nil {
-			s.Logger.Error().Msgf("could not stream response back: %s", err)
-			return err
+		for _, id := range page.Items {
+			fsm, err := s.Store.GetStateMachine(ctx, id, cfgName)
+			if storage.IsNotFoundErr(err) {
+				// The FSM was deleted after the page was read.
+				continue
+			} else if err != nil {
+				return storeStatus(err)
+			}
+			if err = stream.SendMsg(&protos.PutResponse{
+				Id:             id,
+				EntityResponse: &protos.PutResponse_Fsm{Fsm: fsm},
+			}); err != nil {
+				s.Logger.Error().Msgf("could not stream response back: %s", err)
+				return err
+			}
+		}
+		if page.NextToken == "" {
+			return nil
 		}
+		req.Token = page.NextToken
+	}
+}
+
+// streamStateMachines streams all the FSMs configured with `cfgName` which match the `filter`.
+func (s *grpcSubscriber) streamStateMachines(stream grpc.ServerStream, cfgName string,
+	filter storage.ScanFilter) error {
+	err := s.Store.ScanStateMachines(stream.Context(), cfgName, filter,
+		func(id string, fsm *protos.FiniteStateMachine) error {
+			return stream.SendMsg(&protos.PutResponse{
+				Id:             id,
+				EntityResponse: &protos.PutResponse_Fsm{Fsm: fsm},
+			})
+		})
+	var storeErr *storage.StoreError
+	if errors.As(err, &storeErr) {
+		return storeStatus(err)
+	} else if err != nil {
+		s.Logger.Error().Msgf("could not stream response back: %s", err)
+		return err
 	}
 	return nil
 }
@@ -277,12 +378,13 @@ func (s *grpcSubscriber) StreamAllConfigurations(in *wrapperspb.StringValue, str
 	if in.GetValue() == "" {
 		return status.Errorf(codes.InvalidArgument, "must specify the Configuration name")
 	}
-	response, err := s.GetAllConfigurations(context.Background(), in)
+	ctx := stream.Context()
+	response, err := s.GetAllConfigurations(ctx, in)
 	if err != nil {
 		return nil
 	}
 	for _, cfgId := range response.GetIds() {
-		cfg, err := s.Store.GetConfig(cfgId)
+		cfg, err := s.Store.GetConfig(ctx, cfgId)
 		if err != nil {
 			return err
 		}
@@ -313,7 +415,9 @@ func NewGrpcServer(cfg *Config) (*grpc.Server, error) {
 		cfg.Timeout = DefaultTimeout
 	}
 	server := grpc.NewServer(grpc.Creds(creds))
-	protos.RegisterStatemachineServiceServer(server, &grpcSubscriber{Config: cfg})
+	subscriber := &grpcSubscriber{Config: cfg}
+	protos.RegisterStatemachineServiceServer(server, subscriber)
+	server.RegisterService(&AdminServiceDesc, subscriber)
 	return server, nil
 }
 
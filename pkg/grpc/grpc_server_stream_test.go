@@ -10,11 +10,9 @@
 package grpc_test
 
 import (
-	"context"
 	"io"
 	"net"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	. "github.com/massenz/go-statemachine/pkg/api"
@@ -31,7 +29,7 @@ import (
 )
 
 var _ = Describe("gRPC Server Streams", func() {
-	When("using Redis as the backing store", func() {
+	When("using an in-memory backing store", func() {
 		var (
 			listener net.Listener
 			client   api.StatemachineServiceClient
@@ -41,7 +39,7 @@ var _ = Describe("gRPC Server Streams", func() {
 		)
 		// Server setup
 		BeforeEach(func() {
-			store = storage.NewRedisStoreWithDefaults(redisContainer.Address)
+			store = storage.NewInMemoryStore()
 			zerolog.SetGlobalLevel(zerolog.Disabled)
 			listener, _ = net.Listen("tcp", ":0")
 			cc, _ := g.Dial(listener.Addr().String(),
@@ -61,14 +59,9 @@ var _ = Describe("gRPC Server Streams", func() {
 				server.Stop()
 			}
 		})
-		// Server shutdown & Clean up the DB
+		// Server shutdown; each test has its own (in-memory) store.
 		AfterEach(func() {
 			done()
-			rdb := redis.NewClient(&redis.Options{
-				Addr: redisContainer.Address,
-				DB:   storage.DefaultRedisDb,
-			})
-			rdb.FlushDB(context.Background())
 		})
 		Context("streaming Configurations", func() {
 			var versions []string
@@ -86,7 +79,7 @@ var _ = Describe("gRPC Server Streams", func() {
 				}
 				for _, v := range versions {
 					cfg.Version = v
-					Ω(store.PutConfig(cfg)).ToNot(HaveOccurred())
+					Ω(store.PutConfig(bkgnd, cfg)).ToNot(HaveOccurred())
 				}
 			})
 			It("should find all configurations", func() {
@@ -136,13 +129,13 @@ var _ = Describe("gRPC Server Streams", func() {
 					},
 					StartingState: "start",
 				}
-				Ω(store.PutConfig(cfg)).ShouldNot(HaveOccurred())
+				Ω(store.PutConfig(bkgnd, cfg)).ShouldNot(HaveOccurred())
 				for _, id := range ids {
-					Ω(store.PutStateMachine(id, &api.FiniteStateMachine{
+					Ω(store.PutStateMachine(bkgnd, id, &api.FiniteStateMachine{
 						ConfigId: GetVersionId(cfg),
 						State:    "start",
 					})).ShouldNot(HaveOccurred())
-					Ω(store.UpdateState(cfg.Name, id, "", "start")).
+					Ω(store.UpdateState(bkgnd, cfg.Name, id, "", "start")).
 						ShouldNot(HaveOccurred())
 				}
 			})
@@ -170,6 +163,48 @@ var _ = Describe("gRPC Server Streams", func() {
 					Ω(fsm.ConfigId).Should(Equal(GetVersionId(cfg)))
 				}
 			})
+			It("should skip the FSMs which were deleted", func() {
+				// The FSM is indexed in the state, but it is not (any longer) stored.
+				Ω(store.UpdateState(bkgnd, cfg.Name, "deleted", "", "start")).ShouldNot(HaveOccurred())
+				resp, err := client.StreamAllInstate(bkgnd,
+					&api.GetFsmRequest{
+						Config: cfg.Name,
+						Query:  &api.GetFsmRequest_State{State: "start"},
+					})
+				Ω(err).ShouldNot(HaveOccurred())
+				var found []string
+				for {
+					item, err := resp.Recv()
+					if err == io.EOF {
+						break
+					}
+					Ω(err).ShouldNot(HaveOccurred())
+					found = append(found, item.Id)
+				}
+				Ω(found).Should(ConsistOf(ids))
+			})
+			It("should find all FSMs regardless of state, if none is given", func() {
+				_, err := store.TxProcessEvent(bkgnd, "1", cfg.Name, NewEvent("shutdown"))
+				Ω(err).ShouldNot(HaveOccurred())
+				for cfgId, expected := range map[string][]string{
+					cfg.Name:          ids,
+					GetVersionId(cfg): ids,
+					cfg.Name + ":v2":  nil,
+				} {
+					resp, err := client.StreamAllInstate(bkgnd, &api.GetFsmRequest{Config: cfgId})
+					Ω(err).ShouldNot(HaveOccurred())
+					var found []string
+					for {
+						item, err := resp.Recv()
+						if err == io.EOF {
+							break
+						}
+						Ω(err).ShouldNot(HaveOccurred())
+						found = append(found, item.Id)
+					}
+					Ω(found).Should(ConsistOf(expected))
+				}
+			})
 		})
 	})
 })
@@ -14,13 +14,14 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/mock"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	g "google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 	"net"
@@ -42,61 +43,132 @@ type Mockstore struct {
 	mock.Mock
 }
 
-func (m *Mockstore) GetConfig(versionId string) (*protos.Configuration, storage.StoreErr) {
+func (m *Mockstore) GetConfig(ctx context.Context, versionId string) (*protos.Configuration, storage.StoreErr) {
 	return nil, nil
 }
 
-func (m *Mockstore) PutConfig(cfg *protos.Configuration) storage.StoreErr {
+func (m *Mockstore) PutConfig(ctx context.Context, cfg *protos.Configuration) storage.StoreErr {
 	return NotImplemented
 }
 
-func (m *Mockstore) GetAllConfigs() []string {
+func (m *Mockstore) GetAllConfigs(ctx context.Context) []string {
 	return nil
 }
 
-func (m *Mockstore) GetAllVersions(name string) []string {
+func (m *Mockstore) GetAllVersions(ctx context.Context, name string) []string {
 	return nil
 }
 
-func (m *Mockstore) GetStateMachine(id string, cfg string) (*protos.FiniteStateMachine, storage.StoreErr) {
+func (m *Mockstore) GetConfigsPage(ctx context.Context, req storage.PageRequest) (*storage.Page, storage.StoreErr) {
 	return nil, NotImplemented
 }
 
-func (m *Mockstore) PutStateMachine(id string, fsm *protos.FiniteStateMachine) error {
+func (m *Mockstore) GetVersionsPage(ctx context.Context, name string, req storage.PageRequest) (*storage.Page, storage.StoreErr) {
+	return nil, NotImplemented
+}
+
+func (m *Mockstore) DeleteConfiguration(ctx context.Context, versionId string, force bool) storage.StoreErr {
+	return NotImplemented
+}
+
+func (m *Mockstore) GetStateMachine(ctx context.Context, id string, cfg string) (*protos.FiniteStateMachine, storage.StoreErr) {
+	return nil, NotImplemented
+}
+
+func (m *Mockstore) PutStateMachine(ctx context.Context, id string, fsm *protos.FiniteStateMachine) error {
+	return NotImplemented
+}
+
+func (m *Mockstore) TxPutStateMachine(ctx context.Context, id string, fsm *protos.FiniteStateMachine) error {
+	return NotImplemented
+}
+
+func (m *Mockstore) GetAllInState(ctx context.Context, cfg string, state string) []string {
+	return nil
+}
+
+func (m *Mockstore) GetInStatePage(ctx context.Context, cfg string, state string, req storage.PageRequest) (*storage.Page, storage.StoreErr) {
+	return nil, NotImplemented
+}
+
+func (m *Mockstore) ScanStateMachines(ctx context.Context, cfgName string, filter storage.ScanFilter, fn storage.ScanFunc) storage.StoreErr {
+	return NotImplemented
+}
+
+func (m *Mockstore) DeleteStateMachine(ctx context.Context, id string, cfgName string) storage.StoreErr {
 	return NotImplemented
 }
 
-func (m *Mockstore) GetAllInState(cfg string, state string) []string {
+func (m *Mockstore) UpdateState(ctx context.Context, cfgName string, id string, oldState string, newState string) error {
+	return NotImplemented
+}
+
+func (m *Mockstore) TxProcessEvent(ctx context.Context, id, cfgName string, evt *protos.Event) (*ConfiguredStateMachine, error) {
+	return nil, NotImplemented
+}
+
+func (m *Mockstore) PurgeCompleted(ctx context.Context, cfgName string, retention time.Duration) (int, error) {
+	return 0, NotImplemented
+}
+
+func (m *Mockstore) MigrateStateMachine(ctx context.Context, id string, migration *Migration) (bool, storage.StoreErr) {
+	return false, NotImplemented
+}
+
+func (m *Mockstore) VerifyStateMachine(ctx context.Context, id, cfgName string, repair bool) (*storage.Verification, storage.StoreErr) {
+	return nil, NotImplemented
+}
+
+func (m *Mockstore) RollbackStateMachine(ctx context.Context, id, cfgName string, steps int) (*ConfiguredStateMachine, storage.StoreErr) {
+	return nil, NotImplemented
+}
+
+func (m *Mockstore) ScheduleTimers(ctx context.Context, cfgName string, id string, timers []Timer) storage.StoreErr {
 	return nil
 }
 
-func (m *Mockstore) UpdateState(cfgName string, id string, oldState string, newState string) error {
+func (m *Mockstore) ClaimDueTimers(ctx context.Context, cfgName string, now time.Time, lease time.Duration) ([]storage.DueTimer, storage.StoreErr) {
+	return nil, NotImplemented
+}
+
+func (m *Mockstore) DiscardTimer(ctx context.Context, cfgName string, timer storage.DueTimer) storage.StoreErr {
 	return NotImplemented
 }
 
-func (m *Mockstore) TxProcessEvent(id, cfgName string, evt *protos.Event) error {
+func (m *Mockstore) ClaimActions(ctx context.Context, cfgName string, count int, lease time.Duration) ([]*Action, storage.StoreErr) {
+	return nil, NotImplemented
+}
+
+func (m *Mockstore) AckAction(ctx context.Context, cfgName string, id string) storage.StoreErr {
 	return NotImplemented
 }
 
-func (m *Mockstore) GetEvent(id string, cfg string) (*protos.Event, storage.StoreErr) {
+func (m *Mockstore) GetEvent(ctx context.Context, id string, cfg string) (*protos.Event, storage.StoreErr) {
 	return nil, NotImplemented
 }
 
-func (m *Mockstore) PutEvent(event *protos.Event, cfg string, ttl time.Duration) error {
+func (m *Mockstore) PutEvent(ctx context.Context, event *protos.Event, cfg string, ttl time.Duration) error {
 	return NotImplemented
 }
 
-func (m *Mockstore) AddEventOutcome(eventId string, cfgName string, response *protos.EventOutcome, ttl time.Duration) error {
+func (m *Mockstore) AddEventOutcome(ctx context.Context, eventId string, cfgName string, response *protos.EventOutcome, ttl time.Duration) error {
 	return NotImplemented
 }
 
-func (m *Mockstore) GetOutcomeForEvent(eventId string, cfgName string) (*protos.EventOutcome, storage.StoreErr) {
+func (m *Mockstore) GetOutcomeForEvent(ctx context.Context, eventId string, cfgName string) (*protos.EventOutcome, storage.StoreErr) {
 	return nil, NotImplemented
 }
 
+func (m *Mockstore) DeleteEvent(ctx context.Context, eventId string, cfgName string) storage.StoreErr {
+	return NotImplemented
+}
+
 func (m *Mockstore) SetTimeout(duration time.Duration) {
 }
 
+func (m *Mockstore) SetDedupWindow(window time.Duration) {
+}
+
 func (m *Mockstore) GetTimeout() time.Duration {
 	return 0
 }
@@ -125,7 +197,7 @@ var _ = Describe("the gRPC Server", func() {
 			zerolog.SetGlobalLevel(zerolog.Disabled)
 			// Note the `Config` here has no store configured, because we are
 			// only testing events in this Context, and those are never stored
-			// in Redis by the gRPC Server (other parts of the system do).
+			// in the store by the gRPC Server (other parts of the system do).
 			server, err := grpc.NewGrpcServer(&grpc.Config{
 				EventsChannel: testCh,
 				Logger:        l,
@@ -240,7 +312,7 @@ var _ = Describe("the gRPC Server", func() {
 		})
 	})
 
-	When("using Redis as the backing store", func() {
+	When("using a backing store", func() {
 		var (
 			listener net.Listener
 			client   protos.StatemachineServiceClient
@@ -252,7 +324,7 @@ var _ = Describe("the gRPC Server", func() {
 
 		// Server setup
 		BeforeEach(func() {
-			store = storage.NewRedisStoreWithDefaults(redisContainer.Address)
+			store = storage.NewInMemoryStore()
 			listener, _ = net.Listen("tcp", ":0")
 			cc, _ := g.Dial(listener.Addr().String(),
 				g.WithTransportCredentials(insecure.NewCredentials()))
@@ -273,14 +345,9 @@ var _ = Describe("the gRPC Server", func() {
 				server.Stop()
 			}
 		})
-		// Server shutdown & Clean up the DB
+		// Server shutdown; each test has its own (in-memory) store.
 		AfterEach(func() {
 			done()
-			rdb := redis.NewClient(&redis.Options{
-				Addr: redisContainer.Address,
-				DB:   storage.DefaultRedisDb,
-			})
-			rdb.FlushDB(context.Background())
 		})
 		Context("handling Configuration API requests", func() {
 			// Test data setup
@@ -296,16 +363,21 @@ var _ = Describe("the gRPC Server", func() {
 				}
 			})
 			It("should store valid configurations", func() {
-				_, err := store.GetConfig(GetVersionId(cfg))
+				_, err := store.GetConfig(bkgnd, GetVersionId(cfg))
 				Ω(err).ToNot(BeNil())
 				response, err := client.PutConfiguration(bkgnd, cfg)
 				Ω(err).ToNot(HaveOccurred())
 				Ω(response).ToNot(BeNil())
 				Ω(response.Id).To(Equal(GetVersionId(cfg)))
-				found, err := store.GetConfig(response.Id)
+				found, err := store.GetConfig(bkgnd, response.Id)
 				Ω(err).Should(BeNil())
 				Ω(found).Should(Respect(cfg))
 			})
+			It("should not store the same configuration twice", func() {
+				Ω(store.PutConfig(bkgnd, cfg)).To(Succeed())
+				_, err := client.PutConfiguration(bkgnd, cfg)
+				AssertStatusCode(codes.AlreadyExists, err)
+			})
 			It("should fail for invalid configuration", func() {
 				invalid := &protos.Configuration{
 					Name:          "invalid",
@@ -317,8 +389,31 @@ var _ = Describe("the gRPC Server", func() {
 				_, err := client.PutConfiguration(bkgnd, invalid)
 				AssertStatusCode(codes.InvalidArgument, err)
 			})
+			It("should report all the problems with an invalid configuration", func() {
+				invalid := &protos.Configuration{
+					Name:          "invalid",
+					Version:       "v1",
+					States:        []string{"start", "orphan", "lost", "stop"},
+					StartingState: "start",
+					Transitions: []*protos.Transition{
+						{From: "start", To: "stop", Event: "shutdown"},
+						{From: "start", To: "orphan", Event: "shutdown"},
+						{From: "orphan", To: "start", Event: "restart"},
+						{From: "lost", To: "stop", Event: "found"},
+					},
+				}
+				_, err := client.PutConfiguration(bkgnd, invalid)
+				AssertStatusCode(codes.InvalidArgument, err)
+				st, _ := status.FromError(err)
+				Ω(st.Details()).To(HaveLen(1))
+				badRequest, ok := st.Details()[0].(*errdetails.BadRequest)
+				Ω(ok).To(BeTrue())
+				Ω(badRequest.FieldViolations).To(HaveLen(2))
+				Ω(badRequest.FieldViolations[0].Field).To(Equal("start"))
+				Ω(badRequest.FieldViolations[1].Field).To(Equal("lost"))
+			})
 			It("should retrieve a valid configuration", func() {
-				Ω(store.PutConfig(cfg)).To(Succeed())
+				Ω(store.PutConfig(bkgnd, cfg)).To(Succeed())
 				response, err := client.GetConfiguration(bkgnd,
 					&wrapperspb.StringValue{Value: GetVersionId(cfg)})
 				Ω(err).ToNot(HaveOccurred())
@@ -341,7 +436,7 @@ var _ = Describe("the gRPC Server", func() {
 						},
 						StartingState: "start",
 					}
-					Ω(store.PutConfig(cfg)).Should(Succeed())
+					Ω(store.PutConfig(bkgnd, cfg)).Should(Succeed())
 				}
 				found, err := client.GetAllConfigurations(bkgnd, &wrapperspb.StringValue{})
 				Ω(err).Should(Succeed())
@@ -363,7 +458,7 @@ var _ = Describe("the gRPC Server", func() {
 						},
 						StartingState: "checkout",
 					}
-					Ω(store.PutConfig(cfg)).Should(Succeed())
+					Ω(store.PutConfig(bkgnd, cfg)).Should(Succeed())
 				}
 				found, err := client.GetAllConfigurations(bkgnd, &wrapperspb.StringValue{Value: name})
 				Ω(err).Should(Succeed())
@@ -373,6 +468,279 @@ var _ = Describe("the gRPC Server", func() {
 						strings.Join([]string{name, value}, storage.KeyPrefixComponentsSeparator)))
 				}
 			})
+			It("can migrate FSMs to another version of a configuration", func() {
+				v2 := &protos.Configuration{
+					Name:    cfg.Name,
+					Version: "v2",
+					States:  []string{"start", "halt"},
+					Transitions: []*protos.Transition{
+						{From: "start", To: "halt", Event: "shutdown"},
+					},
+					StartingState: "start",
+				}
+				Ω(store.PutConfig(bkgnd, cfg)).Should(Succeed())
+				Ω(store.PutConfig(bkgnd, v2)).Should(Succeed())
+				for id, state := range map[string]string{
+					"fsm-1": "start", "fsm-2": "start", "fsm-3": "start", "fsm-4": "stop",
+				} {
+					Ω(store.PutStateMachine(bkgnd, id, &protos.FiniteStateMachine{
+						ConfigId: GetVersionId(cfg),
+						State:    state,
+					})).Should(Succeed())
+					Ω(store.UpdateState(bkgnd, cfg.Name, id, "", state)).Should(Succeed())
+				}
+				cc, _ := g.Dial(listener.Addr().String(),
+					g.WithTransportCredentials(insecure.NewCredentials()))
+				admin := grpc.NewAdminClient(cc)
+				req := grpc.MigrationRequest{From: GetVersionId(cfg), To: GetVersionId(v2)}
+				_, err := admin.MigrateStateMachines(bkgnd, req)
+				AssertStatusCode(codes.InvalidArgument, err)
+
+				req.States = map[string]string{"stop": "halt"}
+				req.Id = "fsm-4"
+				result, err := admin.MigrateStateMachines(bkgnd, req)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(result.Migrated).To(ConsistOf("fsm-4"))
+				Ω(result.Cursor).To(BeEmpty())
+				fsm, err := store.GetStateMachine(bkgnd, "fsm-4", cfg.Name)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(fsm.ConfigId).To(Equal(GetVersionId(v2)))
+				Ω(fsm.State).To(Equal("halt"))
+
+				req.Id = ""
+				req.BatchSize = 1
+				var migrated []string
+				for batches := 0; ; batches++ {
+					Ω(batches).To(BeNumerically("<", 10))
+					result, err = admin.MigrateStateMachines(bkgnd, req)
+					Ω(err).ToNot(HaveOccurred())
+					migrated = append(migrated, result.Migrated...)
+					if result.Cursor == "" {
+						break
+					}
+					req.Cursor = result.Cursor
+				}
+				Ω(migrated).To(ConsistOf("fsm-1", "fsm-2", "fsm-3"))
+				Ω(store.GetAllInState(bkgnd, cfg.Name, "halt")).To(ConsistOf("fsm-4"))
+
+				req.Cursor = "not a cursor"
+				_, err = admin.MigrateStateMachines(bkgnd, req)
+				AssertStatusCode(codes.InvalidArgument, err)
+				req.Cursor = ""
+				req.BatchSize = grpc.MaxPageSize + 1
+				_, err = admin.MigrateStateMachines(bkgnd, req)
+				AssertStatusCode(codes.InvalidArgument, err)
+			})
+			It("can diff two versions of a configuration", func() {
+				v2 := &protos.Configuration{
+					Name:    cfg.Name,
+					Version: "v2",
+					States:  []string{"start", "halt"},
+					Transitions: []*protos.Transition{
+						{From: "start", To: "halt", Event: "shutdown"},
+					},
+					StartingState: "start",
+				}
+				Ω(store.PutConfig(bkgnd, cfg)).Should(Succeed())
+				Ω(store.PutConfig(bkgnd, v2)).Should(Succeed())
+				Ω(store.UpdateState(bkgnd, cfg.Name, "fsm-1", "", "stop")).Should(Succeed())
+				cc, _ := g.Dial(listener.Addr().String(),
+					g.WithTransportCredentials(insecure.NewCredentials()))
+				admin := grpc.NewAdminClient(cc)
+				diff, err := admin.DiffConfigurations(bkgnd, GetVersionId(cfg), GetVersionId(v2))
+				Ω(err).ToNot(HaveOccurred())
+				Ω(diff.RemovedStates).To(Equal([]string{"stop"}))
+				Ω(diff.AddedStates).To(Equal([]string{"halt"}))
+				Ω(diff.RemovedTransitions).To(HaveLen(1))
+				Ω(diff.Orphaned).To(Equal(map[string]int{"stop": 1}))
+
+				_, err = admin.DiffConfigurations(bkgnd, GetVersionId(cfg), "test-conf:v3")
+				AssertStatusCode(codes.NotFound, err)
+			})
+			It("can render a configuration", func() {
+				Ω(store.PutConfig(bkgnd, cfg)).Should(Succeed())
+				cc, _ := g.Dial(listener.Addr().String(),
+					g.WithTransportCredentials(insecure.NewCredentials()))
+				admin := grpc.NewAdminClient(cc)
+				graph, err := admin.RenderConfiguration(bkgnd, GetVersionId(cfg), FormatMermaid, "")
+				Ω(err).ToNot(HaveOccurred())
+				Ω(graph).To(ContainSubstring("start --> stop : shutdown"))
+
+				_, err = admin.RenderConfiguration(bkgnd, GetVersionId(cfg), "svg", "")
+				AssertStatusCode(codes.InvalidArgument, err)
+				_, err = admin.RenderConfiguration(bkgnd, GetVersionId(cfg), FormatDot, "fake")
+				AssertStatusCode(codes.NotFound, err)
+			})
+			It("can verify and repair FSMs", func() {
+				Ω(store.PutConfig(bkgnd, cfg)).Should(Succeed())
+				Ω(store.PutStateMachine(bkgnd, "fsm-1", &protos.FiniteStateMachine{
+					ConfigId: GetVersionId(cfg),
+					State:    "start",
+					History: []*protos.Event{{
+						Transition: &protos.Transition{From: "start", To: "stop", Event: "shutdown"},
+					}},
+				})).Should(Succeed())
+				Ω(store.UpdateState(bkgnd, cfg.Name, "fsm-1", "", "start")).Should(Succeed())
+				cc, _ := g.Dial(listener.Addr().String(),
+					g.WithTransportCredentials(insecure.NewCredentials()))
+				admin := grpc.NewAdminClient(cc)
+				result, err := admin.VerifyStateMachines(bkgnd, cfg.Name, nil, false)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(result.Verified).To(Equal(1))
+				Ω(result.Inconsistent).To(HaveLen(1))
+				Ω(result.Inconsistent[0].Replayed).To(Equal("stop"))
+
+				result, err = admin.VerifyStateMachines(bkgnd, cfg.Name, []string{"fsm-1"}, true)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(result.Inconsistent[0].Repaired).To(BeTrue())
+				Ω(store.GetAllInState(bkgnd, cfg.Name, "stop")).To(ConsistOf("fsm-1"))
+
+				_, err = admin.VerifyStateMachines(bkgnd, "", nil, false)
+				AssertStatusCode(codes.InvalidArgument, err)
+			})
+			It("can roll back an FSM", func() {
+				Ω(store.PutConfig(bkgnd, cfg)).Should(Succeed())
+				Ω(store.PutStateMachine(bkgnd, "fsm-1", &protos.FiniteStateMachine{
+					ConfigId: GetVersionId(cfg),
+					State:    "start",
+				})).Should(Succeed())
+				Ω(store.UpdateState(bkgnd, cfg.Name, "fsm-1", "", "start")).Should(Succeed())
+				_, err := store.TxProcessEvent(bkgnd, "fsm-1", cfg.Name, NewEvent("shutdown"))
+				Ω(err).ToNot(HaveOccurred())
+				cc, _ := g.Dial(listener.Addr().String(),
+					g.WithTransportCredentials(insecure.NewCredentials()))
+				admin := grpc.NewAdminClient(cc)
+				state, err := admin.RollbackStateMachine(bkgnd, cfg.Name, "fsm-1", 1)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(state).To(Equal("start"))
+
+				_, err = admin.RollbackStateMachine(bkgnd, cfg.Name, "fsm-1", 1)
+				AssertStatusCode(codes.FailedPrecondition, err)
+				_, err = admin.RollbackStateMachine(bkgnd, cfg.Name, "fake", 1)
+				AssertStatusCode(codes.NotFound, err)
+				_, err = admin.RollbackStateMachine(bkgnd, cfg.Name, "fsm-1", 0)
+				AssertStatusCode(codes.InvalidArgument, err)
+			})
+			It("can list configurations and FSMs by pages", func() {
+				Ω(store.PutConfig(bkgnd, cfg)).Should(Succeed())
+				for _, id := range []string{"fsm-1", "fsm-2", "fsm-3"} {
+					Ω(store.UpdateState(bkgnd, cfg.Name, id, "", "start")).Should(Succeed())
+				}
+				cc, _ := g.Dial(listener.Addr().String(),
+					g.WithTransportCredentials(insecure.NewCredentials()))
+				admin := grpc.NewAdminClient(cc)
+				page, err := admin.ListConfigurations(bkgnd, "", storage.PageRequest{})
+				Ω(err).ToNot(HaveOccurred())
+				Ω(page.Items).To(ContainElement(cfg.Name))
+				page, err = admin.ListConfigurations(bkgnd, cfg.Name, storage.PageRequest{})
+				Ω(err).ToNot(HaveOccurred())
+				Ω(page.Items).To(ConsistOf(GetVersionId(cfg)))
+				Ω(page.NextToken).To(BeEmpty())
+
+				var ids []string
+				req := storage.PageRequest{Size: 1}
+				for {
+					page, err = admin.ListStateMachines(bkgnd, cfg.Name, "start", req)
+					Ω(err).ToNot(HaveOccurred())
+					ids = append(ids, page.Items...)
+					if page.NextToken == "" {
+						break
+					}
+					req.Token = page.NextToken
+				}
+				Ω(ids).To(ConsistOf("fsm-1", "fsm-2", "fsm-3"))
+
+				_, err = admin.ListStateMachines(bkgnd, cfg.Name, "", storage.PageRequest{})
+				AssertStatusCode(codes.InvalidArgument, err)
+				_, err = admin.ListStateMachines(bkgnd, cfg.Name, "start",
+					storage.PageRequest{Token: "not a token!"})
+				AssertStatusCode(codes.InvalidArgument, err)
+				_, err = admin.ListStateMachines(bkgnd, cfg.Name, "start",
+					storage.PageRequest{Size: grpc.MaxPageSize + 1})
+				AssertStatusCode(codes.InvalidArgument, err)
+			})
+			It("can scan FSMs regardless of their state", func() {
+				Ω(store.PutConfig(bkgnd, cfg)).Should(Succeed())
+				for _, id := range []string{"fsm-1", "fsm-2"} {
+					Ω(store.PutStateMachine(bkgnd, id, &protos.FiniteStateMachine{
+						ConfigId: GetVersionId(cfg),
+						State:    "start",
+					})).Should(Succeed())
+					Ω(store.UpdateState(bkgnd, cfg.Name, id, "", "start")).Should(Succeed())
+				}
+				// The index records times in milliseconds.
+				time.Sleep(5 * time.Millisecond)
+				updated := time.Now()
+				time.Sleep(5 * time.Millisecond)
+				_, err := store.TxProcessEvent(bkgnd, "fsm-2", cfg.Name, NewEvent("shutdown"))
+				Ω(err).ToNot(HaveOccurred())
+				cc, _ := g.Dial(listener.Addr().String(),
+					g.WithTransportCredentials(insecure.NewCredentials()))
+				admin := grpc.NewAdminClient(cc)
+				scan := func(filter storage.ScanFilter) []string {
+					var ids []string
+					Ω(admin.ScanStateMachines(bkgnd, cfg.Name, filter, func(response *protos.PutResponse) error {
+						Ω(response.GetFsm().GetConfigId()).To(Equal(GetVersionId(cfg)))
+						ids = append(ids, response.Id)
+						return nil
+					})).To(Succeed())
+					return ids
+				}
+				Ω(scan(storage.ScanFilter{})).To(ConsistOf("fsm-1", "fsm-2"))
+				Ω(scan(storage.ScanFilter{Version: cfg.Version})).To(ConsistOf("fsm-1", "fsm-2"))
+				Ω(scan(storage.ScanFilter{States: []string{"stop"}})).To(ConsistOf("fsm-2"))
+				Ω(scan(storage.ScanFilter{UpdatedAfter: updated})).To(ConsistOf("fsm-2"))
+				Ω(scan(storage.ScanFilter{Version: "v2"})).To(BeEmpty())
+
+				response, err := client.GetAllInState(bkgnd, &protos.GetFsmRequest{Config: cfg.Name})
+				Ω(err).ToNot(HaveOccurred())
+				Ω(response.GetIds()).To(ConsistOf("fsm-1", "fsm-2"))
+				for i := 0; i < grpc.MaxPageSize; i++ {
+					Ω(store.PutStateMachine(bkgnd, fmt.Sprintf("more-%d", i), &protos.FiniteStateMachine{
+						ConfigId: GetVersionId(cfg),
+						State:    "start",
+					})).Should(Succeed())
+				}
+				_, err = client.GetAllInState(bkgnd, &protos.GetFsmRequest{Config: cfg.Name})
+				AssertStatusCode(codes.FailedPrecondition, err)
+
+				err = admin.ScanStateMachines(bkgnd, "", storage.ScanFilter{},
+					func(*protos.PutResponse) error { return nil })
+				AssertStatusCode(codes.InvalidArgument, err)
+			})
+			It("can delete configurations, FSMs and events", func() {
+				Ω(store.PutConfig(bkgnd, cfg)).Should(Succeed())
+				Ω(store.PutStateMachine(bkgnd, "fsm-1", &protos.FiniteStateMachine{
+					ConfigId: GetVersionId(cfg),
+					State:    "start",
+				})).Should(Succeed())
+				Ω(store.UpdateState(bkgnd, cfg.Name, "fsm-1", "", "start")).Should(Succeed())
+				evt := NewEvent("shutdown")
+				Ω(store.PutEvent(bkgnd, evt, cfg.Name, storage.NeverExpire)).Should(Succeed())
+				cc, _ := g.Dial(listener.Addr().String(),
+					g.WithTransportCredentials(insecure.NewCredentials()))
+				admin := grpc.NewAdminClient(cc)
+
+				err := admin.DeleteConfiguration(bkgnd, GetVersionId(cfg), false)
+				AssertStatusCode(codes.FailedPrecondition, err)
+				Ω(admin.DeleteStateMachine(bkgnd, cfg.Name, "fsm-1")).To(Succeed())
+				_, err = store.GetStateMachine(bkgnd, "fsm-1", cfg.Name)
+				Ω(storage.IsNotFoundErr(err)).To(BeTrue())
+				Ω(store.GetAllInState(bkgnd, cfg.Name, "start")).To(BeEmpty())
+				Ω(admin.DeleteConfiguration(bkgnd, GetVersionId(cfg), false)).To(Succeed())
+				_, err = store.GetConfig(bkgnd, GetVersionId(cfg))
+				Ω(storage.IsNotFoundErr(err)).To(BeTrue())
+				Ω(admin.DeleteEvent(bkgnd, cfg.Name, evt.EventId)).To(Succeed())
+				_, err = store.GetEvent(bkgnd, evt.EventId, cfg.Name)
+				Ω(storage.IsNotFoundErr(err)).To(BeTrue())
+
+				AssertStatusCode(codes.NotFound, admin.DeleteStateMachine(bkgnd, cfg.Name, "fsm-1"))
+				AssertStatusCode(codes.NotFound, admin.DeleteConfiguration(bkgnd, GetVersionId(cfg), true))
+				AssertStatusCode(codes.NotFound, admin.DeleteEvent(bkgnd, cfg.Name, evt.EventId))
+				AssertStatusCode(codes.InvalidArgument, admin.DeleteStateMachine(bkgnd, cfg.Name, ""))
+				AssertStatusCode(codes.InvalidArgument, admin.DeleteConfiguration(bkgnd, "", true))
+				AssertStatusCode(codes.InvalidArgument, admin.DeleteEvent(bkgnd, "", evt.EventId))
+			})
 		})
 		Context("handling Statemachine API requests", func() {
 			// Test data setup
@@ -389,7 +757,7 @@ var _ = Describe("the gRPC Server", func() {
 				fsm = &protos.FiniteStateMachine{ConfigId: GetVersionId(cfg)}
 			})
 			It("should store a valid FSM", func() {
-				Ω(store.PutConfig(cfg)).To(Succeed())
+				Ω(store.PutConfig(bkgnd, cfg)).To(Succeed())
 				resp, err := client.PutFiniteStateMachine(bkgnd,
 					&protos.PutFsmRequest{Id: "123456", Fsm: fsm})
 				Ω(err).ToNot(HaveOccurred())
@@ -398,7 +766,7 @@ var _ = Describe("the gRPC Server", func() {
 				Ω(resp.GetFsm()).Should(Respect(fsm))
 				// As we didn't specify a state when creating the FSM, the `StartingState`
 				// was automatically configured.
-				found := store.GetAllInState(cfg.Name, cfg.StartingState)
+				found := store.GetAllInState(bkgnd, cfg.Name, cfg.StartingState)
 				Ω(len(found)).To(Equal(1))
 				Ω(found[0]).To(Equal(resp.Id))
 			})
@@ -410,8 +778,8 @@ var _ = Describe("the gRPC Server", func() {
 			})
 			It("can retrieve a stored FSM", func() {
 				id := "123456"
-				Ω(store.PutConfig(cfg))
-				Ω(store.PutStateMachine(id, fsm)).Should(Succeed())
+				Ω(store.PutConfig(bkgnd, cfg))
+				Ω(store.PutStateMachine(bkgnd, id, fsm)).Should(Succeed())
 				Ω(client.GetFiniteStateMachine(bkgnd,
 					&protos.GetFsmRequest{
 						Config: cfg.Name,
@@ -442,21 +810,21 @@ var _ = Describe("the gRPC Server", func() {
 				const ConfigName = "test.m"
 				for i := 1; i <= 5; i++ {
 					id := fmt.Sprintf("fsm-%d", i)
-					Ω(store.PutStateMachine(id,
+					Ω(store.PutStateMachine(bkgnd, id,
 						&protos.FiniteStateMachine{
 							ConfigId: ConfigName + ":v1",
 							State:    "start",
 						})).Should(Succeed())
-					Ω(store.UpdateState(ConfigName, id, "", "start")).Should(Succeed())
+					Ω(store.UpdateState(bkgnd, ConfigName, id, "", "start")).Should(Succeed())
 				}
 				for i := 10; i < 13; i++ {
 					id := fmt.Sprintf("fsm-%d", i)
-					Ω(store.PutStateMachine(id,
+					Ω(store.PutStateMachine(bkgnd, id,
 						&protos.FiniteStateMachine{
 							ConfigId: ConfigName + ":v1",
 							State:    "stop",
 						})).Should(Succeed())
-					Ω(store.UpdateState(ConfigName, id, "", "stop")).Should(Succeed())
+					Ω(store.UpdateState(bkgnd, ConfigName, id, "", "stop")).Should(Succeed())
 
 				}
 				items, err := client.GetAllInState(bkgnd, &protos.GetFsmRequest{
@@ -10,12 +10,10 @@
 package grpc_test
 
 import (
-	"context"
 	"crypto/tls"
 
 	"github.com/rs/zerolog"
 	"github.com/massenz/go-statemachine/pkg/grpc"
-	internals "github.com/massenz/go-statemachine/pkg/internal/testing"
 	protos "github.com/massenz/statemachine-proto/golang/api"
 	g "google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -34,21 +32,10 @@ func TestGrpc(t *testing.T) {
 	RunSpecs(t, "gRPC Server")
 }
 
-var redisContainer *internals.Container
 var _ = BeforeSuite(func() {
-	var err error
-	redisContainer, err = internals.NewRedisContainer(context.Background())
-	Expect(err).ToNot(HaveOccurred())
 	// Muting global zerolog logging to prevent annoying warning re TLS
 	zerolog.SetGlobalLevel(zerolog.Disabled)
-	// Note the timeout here is in seconds (and it's not a time.Duration either)
-}, 5.0)
-
-var _ = AfterSuite(func() {
-	if redisContainer != nil {
-		Expect(redisContainer.Terminate(context.Background())).To(Succeed())
-	}
-}, 2.0)
+})
 
 // TODO: should be an Omega Matcher
 func AssertStatusCode(code codes.Code, err error) {
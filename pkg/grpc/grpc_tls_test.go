@@ -51,7 +51,7 @@ var _ = Describe("gRPC Server with TLS", func() {
 				EventsChannel: testCh,
 				Logger:        l,
 				ServerAddress: addr,
-				Store:         storage.NewRedisStoreWithDefaults(redisContainer.Address),
+				Store:         storage.NewInMemoryStore(),
 				TlsEnabled:    true,
 				TlsCerts:      "../../certs",
 				// TODO: add mTLS tests
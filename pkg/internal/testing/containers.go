@@ -12,6 +12,11 @@ package testing
 import (
 	"context"
 	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
 )
@@ -92,3 +97,65 @@ func NewRedisContainer(ctx context.Context) (*Container, error) {
 	address := fmt.Sprintf("%s:%s", hostIP, mappedPort.Port())
 	return &Container{Container: container, Address: address}, nil
 }
+
+// NewRedisClusterContainer creates a Redis Cluster with a single node, serving all the hash
+// slots; the node announces the address it is reachable at from the host, so that cluster
+// clients (which look up the nodes of the cluster) can connect to it.
+func NewRedisClusterContainer(ctx context.Context) (*Container, error) {
+	req := testcontainers.ContainerRequest{
+		Image:        redisImage,
+		ExposedPorts: []string{redisPort},
+		Cmd:          []string{"redis-server", "--cluster-enabled", "yes"},
+		WaitingFor:   wait.ForLog("* Ready to accept connections"),
+	}
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mappedPort, err := container.MappedPort(ctx, "6379")
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := container.Host(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hostIP := host
+	if net.ParseIP(host) == nil {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		if err != nil || len(ips) == 0 {
+			return nil, fmt.Errorf("cannot resolve %s: %v", host, err)
+		}
+		hostIP = ips[0].String()
+	}
+
+	address := fmt.Sprintf("%s:%s", hostIP, mappedPort.Port())
+	rdb := redis.NewClient(&redis.Options{Addr: address})
+	defer rdb.Close()
+	setup := []*redis.StatusCmd{
+		rdb.ConfigSet(ctx, "cluster-announce-ip", hostIP),
+		rdb.ConfigSet(ctx, "cluster-announce-port", mappedPort.Port()),
+		rdb.ClusterAddSlotsRange(ctx, 0, 16383),
+	}
+	for _, cmd := range setup {
+		if cmd.Err() != nil {
+			return nil, cmd.Err()
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		info, err := rdb.ClusterInfo(ctx).Result()
+		if err == nil && strings.Contains(info, "cluster_state:ok") {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("the Redis cluster at %s is not ready: %v", address, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return &Container{Container: container, Address: address}, nil
+}
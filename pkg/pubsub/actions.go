@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/massenz/go-statemachine/pkg/api"
+	"github.com/massenz/go-statemachine/pkg/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// NewActionsDispatcher creates a new `ActionsDispatcher` which dispatches the Actions found
+// in `store` via the `publisher`.
+func NewActionsDispatcher(store storage.StoreManager, publisher ActionPublisher) *ActionsDispatcher {
+	return &ActionsDispatcher{
+		logger:    log.With().Str("logger", "Actions").Logger(),
+		store:     store,
+		publisher: publisher,
+		Interval:  DefaultActionsInterval,
+		Lease:     DefaultActionsLease,
+		BatchSize: DefaultActionsBatchSize,
+	}
+}
+
+// Run dispatches the pending Actions every `Interval`, until signaled on the `done` channel.
+func (d *ActionsDispatcher) Run(done <-chan interface{}) {
+	d.logger.Info().Msgf("actions dispatcher started, checking every %v", d.Interval)
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			d.logger.Info().Msg("actions dispatcher terminating")
+			return
+		case <-ticker.C:
+			d.DispatchPending(context.Background())
+		}
+	}
+}
+
+// DispatchPending claims and dispatches the pending Actions for all the Configurations,
+// and returns how many were successfully dispatched.
+//
+// Actions which cannot be dispatched are left in the store, and will be claimed again
+// once their `Lease` expires.
+func (d *ActionsDispatcher) DispatchPending(ctx context.Context) int {
+	dispatched := 0
+	for _, cfgName := range d.store.GetAllConfigs(ctx) {
+		actions, err := d.store.ClaimActions(ctx, cfgName, d.BatchSize, d.Lease)
+		if err != nil {
+			d.logger.Error().Err(err).Str("config", cfgName).Msg("could not claim actions")
+		}
+		for _, action := range actions {
+			if err := d.publisher.PublishAction(action); err != nil {
+				d.logger.Error().Err(err).Msgf("could not dispatch action `%s` [%s], will retry after %v",
+					action.Name, action.Id, d.Lease)
+				continue
+			}
+			if err := d.store.AckAction(ctx, cfgName, action.Id); err != nil {
+				d.logger.Error().Err(err).Msgf("could not remove dispatched action [%s]", action.Id)
+			}
+			d.logger.Debug().Msgf("dispatched action `%s` for FSM [%s#%s]", action.Name, cfgName,
+				action.FsmId)
+			dispatched++
+		}
+	}
+	return dispatched
+}
+
+// NewSqsActionPublisher creates a new `ActionPublisher` which sends the Actions to the
+// SQS queue for `topic`; see NewSqsPublisher for the meaning of `awsUrl`.
+func NewSqsActionPublisher(topic string, awsUrl *string) *SqsActionPublisher {
+	client := getSqsClient(awsUrl)
+	if client == nil {
+		return nil
+	}
+	return &SqsActionPublisher{
+		logger:   log.With().Str("logger", "SQS-Actions").Str("topic", topic).Logger(),
+		client:   client,
+		queueUrl: GetQueueUrl(client, topic),
+	}
+}
+
+func (s *SqsActionPublisher) PublishAction(action *api.Action) error {
+	body, err := json.Marshal(action)
+	if err != nil {
+		return err
+	}
+	msgResult, err := s.client.SendMessage(&sqs.SendMessageInput{
+		MessageBody: aws.String(string(body)),
+		QueueUrl:    &s.queueUrl,
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.Trace().Msgf("action %s posted to SQS: %s", action.Id, *msgResult.MessageId)
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package pubsub_test
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+
+	"github.com/massenz/go-statemachine/pkg/api"
+	"github.com/massenz/go-statemachine/pkg/pubsub"
+	"github.com/massenz/go-statemachine/pkg/storage"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+// testPublisher records the Actions it is asked to publish, failing the first `failures`.
+type testPublisher struct {
+	published []*api.Action
+	failures  int
+}
+
+func (p *testPublisher) PublishAction(action *api.Action) error {
+	if p.failures > 0 {
+		p.failures--
+		return fmt.Errorf("cannot publish %s", action.Name)
+	}
+	p.published = append(p.published, action)
+	return nil
+}
+
+var _ = Describe("An Actions Dispatcher", func() {
+	var (
+		dispatcher *pubsub.ActionsDispatcher
+		publisher  *testPublisher
+		store      storage.StoreManager
+	)
+	BeforeEach(func() {
+		store = storage.NewInMemoryStore()
+		zerolog.SetGlobalLevel(zerolog.Disabled)
+		publisher = &testPublisher{}
+		dispatcher = pubsub.NewActionsDispatcher(store, publisher)
+		// Configurations cannot be overwritten, so the tests share the same one.
+		_ = store.PutConfig(bkgnd, &protos.Configuration{
+			Name:    "actions",
+			Version: "v1",
+			States:  []string{"start", "end"},
+			Transitions: []*protos.Transition{
+				{From: "start", To: "end", Event: "finish / notify"},
+				{From: "end", To: "start", Event: "restart"},
+			},
+			StartingState: "start",
+		})
+		Ω(store.PutStateMachine(bkgnd, "actions-fsm", &protos.FiniteStateMachine{
+			ConfigId: "actions:v1",
+			State:    "start",
+		})).ToNot(HaveOccurred())
+	})
+	It("dispatches the actions of committed transitions", func() {
+		_, err := store.TxProcessEvent(bkgnd, "actions-fsm", "actions", api.NewEvent("finish"))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(dispatcher.DispatchPending(bkgnd)).To(Equal(1))
+		Ω(publisher.published).To(HaveLen(1))
+		Ω(publisher.published[0].Name).To(Equal("notify"))
+		Ω(publisher.published[0].FsmId).To(Equal("actions-fsm"))
+		Ω(dispatcher.DispatchPending(bkgnd)).To(Equal(0))
+	})
+	It("retries the actions which could not be dispatched", func() {
+		dispatcher.Lease = time.Millisecond
+		publisher.failures = 1
+		_, err := store.TxProcessEvent(bkgnd, "actions-fsm", "actions", api.NewEvent("finish"))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(dispatcher.DispatchPending(bkgnd)).To(Equal(0))
+		Eventually(func() int { return dispatcher.DispatchPending(bkgnd) }).Should(Equal(1))
+		Ω(publisher.published).To(HaveLen(1))
+	})
+})
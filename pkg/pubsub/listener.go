@@ -10,9 +10,12 @@
 package pubsub
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"github.com/rs/zerolog/log"
+	"github.com/massenz/go-statemachine/pkg/api"
 	"github.com/massenz/go-statemachine/pkg/storage"
 	protos "github.com/massenz/statemachine-proto/golang/api"
 )
@@ -26,67 +29,96 @@ func NewEventsListener(options *ListenerOptions) *EventsListener {
 	}
 }
 
-func (listener *EventsListener) PostNotificationAndReportOutcome(eventResponse *protos.EventResponse) {
+func (listener *EventsListener) PostNotificationAndReportOutcome(ctx context.Context,
+	eventResponse *protos.EventResponse) {
 	if eventResponse.Outcome.Code != protos.EventOutcome_Ok {
 		listener.logger.Error().Msgf("event [%s]: %s",
 			eventResponse.GetEventId(), eventResponse.GetOutcome().Details)
 	}
-	if listener.notifications != nil {
-		listener.logger.Debug().Msgf("posting notification: %v", eventResponse.GetEventId())
-		listener.notifications <- *eventResponse
-	}
+	listener.postNotification(eventResponse)
 	listener.logger.Debug().Msgf("Reporting outcome: %v", eventResponse.GetEventId())
-	listener.reportOutcome(eventResponse)
+	listener.reportOutcome(ctx, eventResponse)
 }
 
-func (listener *EventsListener) ListenForMessages() {
+// ListenForMessages processes the requests received on the `events` channel, until it is
+// closed; the store is accessed with `ctx`, which is expected to outlive the listener.
+func (listener *EventsListener) ListenForMessages(ctx context.Context) {
 	listener.logger.Info().Msg("Events message listener started")
 	for request := range listener.events {
 		listener.logger.Debug().Msgf("Received request %s", request.Event.String())
 		fsmId := request.GetId()
 		if fsmId == "" {
-			listener.PostNotificationAndReportOutcome(makeResponse(&request,
+			listener.PostNotificationAndReportOutcome(ctx, makeResponse(&request,
 				protos.EventOutcome_MissingDestination,
 				"no statemachine ID specified"))
 			continue
 		}
 		cfgName := request.GetConfig()
 		if cfgName == "" {
-			listener.PostNotificationAndReportOutcome(makeResponse(&request,
+			listener.PostNotificationAndReportOutcome(ctx, makeResponse(&request,
 				protos.EventOutcome_MissingDestination,
 				"no Configuration name specified"))
 			continue
 		}
 		// The event is well-formed, we can store for later retrieval
-		if err := listener.store.PutEvent(request.Event, cfgName, storage.NeverExpire); err != nil {
-			listener.PostNotificationAndReportOutcome(makeResponse(&request,
+		if err := listener.store.PutEvent(ctx, request.Event, cfgName, storage.NeverExpire); err != nil {
+			listener.PostNotificationAndReportOutcome(ctx, makeResponse(&request,
 				protos.EventOutcome_InternalError,
 				fmt.Sprintf("could not store event: %v", err)))
 			continue
 		}
 		listener.logger.Debug().Msgf("preparing to send event `%s` for FSM [%s]",
 			request.Event.Transition.Event, fsmId)
-		if err := listener.store.TxProcessEvent(fsmId, cfgName, request.Event); err != nil {
-			var errCode protos.EventOutcome_StatusCode
-			if storage.IsNotFoundErr(err) {
-				errCode = protos.EventOutcome_FsmNotFound
-			} else {
-				errCode = protos.EventOutcome_InternalError
-			}
-			listener.PostNotificationAndReportOutcome(makeResponse(&request,
-				errCode,
+		sm, err := listener.store.TxProcessEvent(ctx, fsmId, cfgName, request.Event)
+		var duplicate *storage.DuplicateEventError
+		if errors.As(err, &duplicate) {
+			listener.handleDuplicate(ctx, &request, duplicate.Outcome)
+			continue
+		}
+		if err != nil {
+			listener.PostNotificationAndReportOutcome(ctx, makeResponse(&request,
+				storage.OutcomeCode(err),
 				fmt.Sprintf("could not update statemachine [%s#%s] in store: %v",
 					cfgName, fsmId, err)))
 			continue
 		}
 		listener.logger.Debug().Msgf("Event `%s` successfully changed FSM [%s] state",
 			request.Event.Transition.Event, fsmId)
-		listener.reportOutcome(makeResponse(&request, protos.EventOutcome_Ok, ""))
+		listener.reportOutcome(ctx, makeResponse(&request, protos.EventOutcome_Ok, ""))
+		if sm.IsCompleted() {
+			listener.logger.Debug().Msgf("FSM [%s] completed in state %s", fsmId, sm.FSM.State)
+			listener.postNotification(makeResponse(&request, protos.EventOutcome_Ok,
+				api.NewCompletedDetails(sm.FSM.State)))
+		}
+	}
+}
+
+// handleDuplicate keeps the outcome stored when the event was first processed; if that was
+// never stored (e.g., because the server stopped right after processing the event) the
+// `outcome` the store recorded when processing the event is reported instead.
+func (listener *EventsListener) handleDuplicate(ctx context.Context, request *protos.EventRequest,
+	outcome *protos.EventOutcome) {
+	eventId := request.GetEvent().GetEventId()
+	previous, err := listener.store.GetOutcomeForEvent(ctx, eventId, request.GetConfig())
+	if err == nil {
+		listener.logger.Debug().Msgf("event [%s] for FSM [%s] is a duplicate, previous outcome: %s",
+			eventId, request.GetId(), previous.GetCode())
+		return
+	}
+	listener.logger.Debug().Msgf("event [%s] for FSM [%s] is a duplicate, processed with outcome: %s",
+		eventId, request.GetId(), outcome.GetCode())
+	listener.reportOutcome(ctx, makeResponse(request, outcome.GetCode(), outcome.GetDetails()))
+}
+
+func (listener *EventsListener) postNotification(eventResponse *protos.EventResponse) {
+	if listener.notifications != nil {
+		listener.logger.Debug().Msgf("posting notification: %v", eventResponse.GetEventId())
+		listener.notifications <- *eventResponse
 	}
 }
 
-func (listener *EventsListener) reportOutcome(response *protos.EventResponse) {
-	if err := listener.store.AddEventOutcome(response.EventId, response.GetOutcome().GetConfig(),
+func (listener *EventsListener) reportOutcome(ctx context.Context, response *protos.EventResponse) {
+	if err := listener.store.AddEventOutcome(ctx, response.EventId, response.GetOutcome().GetConfig(),
 		response.Outcome, storage.NeverExpire); err != nil {
 		listener.logger.Error().Msgf("could not save event outcome: %v", err)
 	}
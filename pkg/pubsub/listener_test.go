@@ -16,6 +16,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/rs/zerolog"
+	"github.com/massenz/go-statemachine/pkg/api"
 	"github.com/massenz/go-statemachine/pkg/pubsub"
 	"github.com/massenz/go-statemachine/pkg/storage"
 
@@ -33,7 +34,7 @@ var _ = Describe("A Listener", func() {
 		BeforeEach(func() {
 			eventsCh = make(chan protos.EventRequest)
 			notificationsCh = make(chan protos.EventResponse)
-			store = storage.NewRedisStoreWithDefaults(redisContainer.Address)
+			store = storage.NewInMemoryStore()
 			zerolog.SetGlobalLevel(zerolog.Disabled)
 			testListener = pubsub.NewEventsListener(&pubsub.ListenerOptions{
 				EventsChannel:        eventsCh,
@@ -62,7 +63,7 @@ var _ = Describe("A Listener", func() {
 					Details: detail,
 				},
 			}
-			go testListener.PostNotificationAndReportOutcome(notification)
+			go testListener.PostNotificationAndReportOutcome(bkgnd, notification)
 			select {
 			case n := <-notificationsCh:
 				Ω(n.EventId).To(Equal(msg.GetEventId()))
@@ -90,28 +91,28 @@ var _ = Describe("A Listener", func() {
 				Config: "test",
 				Id:     requestId,
 			}
-			Ω(store.PutConfig(&protos.Configuration{
+			Ω(store.PutConfig(bkgnd, &protos.Configuration{
 				Name:          "test",
 				Version:       "v1",
 				States:        []string{"start", "end"},
 				Transitions:   []*protos.Transition{{From: "start", To: "end", Event: "move"}},
 				StartingState: "start",
 			})).ToNot(HaveOccurred())
-			Ω(store.PutStateMachine(requestId, &protos.FiniteStateMachine{
+			Ω(store.PutStateMachine(bkgnd, requestId, &protos.FiniteStateMachine{
 				ConfigId: "test:v1",
 				State:    "start",
 				History:  nil,
 			})).ToNot(HaveOccurred())
 
 			go func() {
-				testListener.ListenForMessages()
+				testListener.ListenForMessages(bkgnd)
 			}()
 			eventsCh <- request
 			close(eventsCh)
 
 			Eventually(func(g Gomega) {
 				// Now we want to test that the state machine was updated
-				fsm, err := store.GetStateMachine(requestId, "test")
+				fsm, err := store.GetStateMachine(bkgnd, requestId, "test")
 				g.Ω(err).To(BeNil())
 				g.Ω(fsm.State).To(Equal("end"))
 				g.Ω(len(fsm.History)).To(Equal(1))
@@ -119,7 +120,7 @@ var _ = Describe("A Listener", func() {
 				g.Ω(fsm.History[0].Transition.Event).To(Equal("move"))
 			}, 120*time.Millisecond, 40*time.Millisecond).Should(Succeed())
 			Eventually(func() storage.StoreErr {
-				_, err := store.GetEvent(event.EventId, "test")
+				_, err := store.GetEvent(bkgnd, event.EventId, "test")
 				return err
 			}).Should(BeNil())
 		})
@@ -137,7 +138,7 @@ var _ = Describe("A Listener", func() {
 				Id:     "fake-fsm",
 			}
 			go func() {
-				testListener.ListenForMessages()
+				testListener.ListenForMessages(bkgnd)
 			}()
 			eventsCh <- request
 			close(eventsCh)
@@ -150,13 +151,115 @@ var _ = Describe("A Listener", func() {
 				Fail("timed out waiting for notification")
 			}
 		})
+		It("sends notifications for events rejected by a guard", func() {
+			Ω(store.PutConfig(bkgnd, &protos.Configuration{
+				Name:          "guarded",
+				Version:       "v1",
+				States:        []string{"start", "end"},
+				Transitions:   []*protos.Transition{{From: "start", To: "end", Event: "move [amount < 10]"}},
+				StartingState: "start",
+			})).ToNot(HaveOccurred())
+			Ω(store.PutStateMachine(bkgnd, "guarded-fsm", &protos.FiniteStateMachine{
+				ConfigId: "guarded:v1",
+				State:    "start",
+			})).ToNot(HaveOccurred())
+			request := protos.EventRequest{
+				Event: &protos.Event{
+					EventId:    eventId,
+					Transition: &protos.Transition{Event: "move"},
+					Details:    `{"amount": 100}`,
+				},
+				Config: "guarded",
+				Id:     "guarded-fsm",
+			}
+			go func() { testListener.ListenForMessages(bkgnd) }()
+			eventsCh <- request
+			close(eventsCh)
+			select {
+			case n := <-notificationsCh:
+				Ω(n.EventId).To(Equal(request.Event.EventId))
+				Ω(n.Outcome.Code).To(Equal(protos.EventOutcome_TransitionNotAllowed))
+			case <-time.After(timeout):
+				Fail("timed out waiting for notification")
+			}
+			fsm, err := store.GetStateMachine(bkgnd, "guarded-fsm", "guarded")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(fsm.State).To(Equal("start"))
+		})
+		It("reports the outcome of duplicate events as when they were first processed", func() {
+			Ω(store.PutConfig(bkgnd, &protos.Configuration{
+				Name:          "duplicated",
+				Version:       "v1",
+				States:        []string{"start", "end"},
+				Transitions:   []*protos.Transition{{From: "start", To: "end", Event: "move [amount < 10]"}},
+				StartingState: "start",
+			})).ToNot(HaveOccurred())
+			Ω(store.PutStateMachine(bkgnd, "duplicated-fsm", &protos.FiniteStateMachine{
+				ConfigId: "duplicated:v1",
+				State:    "start",
+			})).ToNot(HaveOccurred())
+			request := protos.EventRequest{
+				Event: &protos.Event{
+					EventId:    "rejected-event",
+					Transition: &protos.Transition{Event: "move"},
+					Details:    `{"amount": 100}`,
+				},
+				Config: "duplicated",
+				Id:     "duplicated-fsm",
+			}
+			// The event was rejected, but its outcome was never reported.
+			_, err := store.TxProcessEvent(bkgnd, request.Id, request.Config, request.Event)
+			Ω(err).To(MatchError(api.GuardNotSatisfiedError))
+
+			go func() { testListener.ListenForMessages(bkgnd) }()
+			eventsCh <- request
+			close(eventsCh)
+			Eventually(func(g Gomega) {
+				outcome, err := store.GetOutcomeForEvent(bkgnd, request.Event.EventId, request.Config)
+				g.Ω(err).ToNot(HaveOccurred())
+				g.Ω(outcome.Code).To(Equal(protos.EventOutcome_TransitionNotAllowed))
+				g.Ω(outcome.Details).To(Equal(api.GuardNotSatisfiedError.Error()))
+			}, timeout, pollingInterval).Should(Succeed())
+		})
+		It("sends notifications for completed state-machines", func() {
+			Ω(store.PutConfig(bkgnd, &protos.Configuration{
+				Name:          "terminal",
+				Version:       "v1",
+				States:        []string{"start", "end"},
+				Transitions:   []*protos.Transition{{From: "start", To: "end", Event: "move"}, {From: "end", To: api.FinalState}},
+				StartingState: "start",
+			})).ToNot(HaveOccurred())
+			Ω(store.PutStateMachine(bkgnd, "terminal-fsm", &protos.FiniteStateMachine{
+				ConfigId: "terminal:v1",
+				State:    "start",
+			})).ToNot(HaveOccurred())
+			request := protos.EventRequest{
+				Event: &protos.Event{
+					EventId:    eventId,
+					Transition: &protos.Transition{Event: "move"},
+				},
+				Config: "terminal",
+				Id:     "terminal-fsm",
+			}
+			go func() { testListener.ListenForMessages(bkgnd) }()
+			eventsCh <- request
+			close(eventsCh)
+			select {
+			case n := <-notificationsCh:
+				Ω(n.EventId).To(Equal(request.Event.EventId))
+				Ω(n.Outcome.Code).To(Equal(protos.EventOutcome_Ok))
+				Ω(api.IsCompletedOutcome(n.Outcome)).To(BeTrue())
+			case <-time.After(timeout):
+				Fail("timed out waiting for notification")
+			}
+		})
 		It("sends notifications for missing destinations", func() {
 			request := protos.EventRequest{
 				Event: &protos.Event{
 					EventId: eventId,
 				},
 			}
-			go func() { testListener.ListenForMessages() }()
+			go func() { testListener.ListenForMessages(bkgnd) }()
 			eventsCh <- request
 			close(eventsCh)
 			select {
@@ -172,7 +275,7 @@ var _ = Describe("A Listener", func() {
 			done := make(chan interface{})
 			go func() {
 				defer close(done)
-				testListener.ListenForMessages()
+				testListener.ListenForMessages(bkgnd)
 			}()
 			close(eventsCh)
 			Eventually(done).Should(BeClosed())
@@ -190,19 +293,19 @@ var _ = Describe("A Listener", func() {
 				Config: "test",
 				Id:     "1244",
 			}
-			Ω(store.PutConfig(&protos.Configuration{
+			Ω(store.PutConfig(bkgnd, &protos.Configuration{
 				Name:          "test",
 				Version:       "v2",
 				States:        []string{"start", "end"},
 				Transitions:   []*protos.Transition{{From: "start", To: "end", Event: "move"}},
 				StartingState: "start",
 			})).ToNot(HaveOccurred())
-			Ω(store.PutStateMachine("1244", &protos.FiniteStateMachine{
+			Ω(store.PutStateMachine(bkgnd, "1244", &protos.FiniteStateMachine{
 				ConfigId: "test:v2",
 				State:    "start",
 				History:  nil,
 			})).ToNot(HaveOccurred())
-			go func() { testListener.ListenForMessages() }()
+			go func() { testListener.ListenForMessages(bkgnd) }()
 			eventsCh <- request
 			close(eventsCh)
 			Consistently(func() *protos.EventResponse {
@@ -214,7 +317,7 @@ var _ = Describe("A Listener", func() {
 				}
 			}).Should(BeNil())
 			Eventually(func(g Gomega) {
-				evt, err := store.GetEvent(event.EventId, request.Config)
+				evt, err := store.GetEvent(bkgnd, event.EventId, request.Config)
 				Ω(err).ToNot(HaveOccurred())
 				if evt != nil {
 					Ω(evt).To(Respect(&event))
@@ -223,7 +326,7 @@ var _ = Describe("A Listener", func() {
 				}
 			}, 100*time.Millisecond, 20*time.Millisecond).Should(Succeed())
 			Eventually(func(g Gomega) {
-				outcome, err := store.GetOutcomeForEvent(event.EventId, request.Config)
+				outcome, err := store.GetOutcomeForEvent(bkgnd, event.EventId, request.Config)
 				Ω(err).ToNot(HaveOccurred())
 				if outcome != nil {
 					Ω(outcome.Code).To(Equal(protos.EventOutcome_Ok))
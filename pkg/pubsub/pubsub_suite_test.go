@@ -40,11 +40,13 @@ func TestPubSub(t *testing.T) {
 	RunSpecs(t, "Pub/Sub Suite")
 }
 
+// bkgnd is the context with which the store is accessed by the tests.
+var bkgnd = context.Background()
+
 // Although these are constants, we cannot take the pointers unless we declare them vars.
 var (
-	awsLocal       *internals.Container
-	redisContainer *internals.Container
-	testSqsClient  *sqs.SQS
+	awsLocal      *internals.Container
+	testSqsClient *sqs.SQS
 )
 
 var _ = BeforeSuite(func() {
@@ -72,17 +74,12 @@ var _ = BeforeSuite(func() {
 			Expect(err).NotTo(HaveOccurred())
 		}
 	}
-	redisContainer, err = internals.NewRedisContainer(context.Background())
-	Ω(err).ToNot(HaveOccurred())
 }, 2.0)
 
 var _ = AfterSuite(func() {
 	if awsLocal != nil {
 		Ω(awsLocal.Terminate(context.Background())).ToNot(HaveOccurred())
 	}
-	if redisContainer != nil {
-		Ω(redisContainer.Terminate(context.Background())).ToNot(HaveOccurred())
-	}
 }, 2.0)
 
 // getQueueName provides a way to obtain a process-independent name for the SQS queue,
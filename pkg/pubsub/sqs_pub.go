@@ -16,6 +16,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/rs/zerolog/log"
+	"github.com/massenz/go-statemachine/pkg/api"
 	protos "github.com/massenz/statemachine-proto/golang/api"
 	"google.golang.org/protobuf/proto"
 )
@@ -85,8 +86,9 @@ func (s *SqsPublisher) Publish(errorsTopic string) {
 	errorsQueueUrl := GetQueueUrl(s.client, errorsTopic)
 	delay := int64(0)
 	for eventResponse := range s.notifications {
+		// The only successful outcomes that are published are FSMs' completions.
 		isOKOutcome := eventResponse.Outcome != nil && eventResponse.Outcome.Code == protos.EventOutcome_Ok
-		if isOKOutcome {
+		if isOKOutcome && !api.IsCompletedOutcome(eventResponse.Outcome) {
 			s.logger.Warn().Msgf("unexpected notification for Ok outcome [Event ID: %s]", eventResponse.EventId)
 			continue
 		}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/massenz/go-statemachine/pkg/api"
+	"github.com/massenz/go-statemachine/pkg/storage"
+	"github.com/rs/zerolog/log"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+// NewTimerScheduler creates a new `TimerScheduler` which fires the timers found in `store`
+// by posting their events on the `eventsChannel`.
+func NewTimerScheduler(eventsChannel chan<- protos.EventRequest,
+	store storage.StoreManager) *TimerScheduler {
+	return &TimerScheduler{
+		logger:   log.With().Str("logger", "Timers").Logger(),
+		events:   eventsChannel,
+		store:    store,
+		Interval: DefaultTimersInterval,
+		Lease:    DefaultTimersLease,
+	}
+}
+
+// Run fires the due timers every `Interval`, until signaled on the `done` channel.
+func (s *TimerScheduler) Run(done <-chan interface{}) {
+	s.logger.Info().Msgf("timer scheduler started, checking every %v", s.Interval)
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			s.logger.Info().Msg("timer scheduler terminating")
+			return
+		case now := <-ticker.C:
+			s.FireDueTimers(context.Background(), now)
+		}
+	}
+}
+
+// FireDueTimers posts the events for all the timers which are due at `now`, for all the
+// Configurations, and returns how many were fired.
+//
+// Timers are claimed from the store for the `Lease` duration before being fired, so that
+// they are fired only once, even if several servers share the same store, and fired again
+// if their event is not processed by then: as the events of a timer all have the same ID
+// (see api.NewDueTimerEvent) those fired again are then detected as duplicates.
+// Timers for FSMs which are no longer in the timer's state, or which no longer exist, are
+// discarded.
+//
+// This blocks until the events have been posted: the `events` channel must not be closed
+// while it runs.
+func (s *TimerScheduler) FireDueTimers(ctx context.Context, now time.Time) int {
+	fired := 0
+	for _, cfgName := range s.store.GetAllConfigs(ctx) {
+		timers, err := s.store.ClaimDueTimers(ctx, cfgName, now, s.Lease)
+		if err != nil {
+			s.logger.Error().Err(err).Str("config", cfgName).Msg("could not retrieve due timers")
+		}
+		for _, timer := range timers {
+			fsm, err := s.store.GetStateMachine(ctx, timer.Id, cfgName)
+			if err != nil && !storage.IsNotFoundErr(err) && !errors.Is(err, storage.ErrInvalidData) {
+				// The timer will be fired again once its lease expires.
+				s.logger.Error().Err(err).Msgf("could not retrieve FSM [%s#%s] for its timer `%s`",
+					cfgName, timer.Id, timer.Event)
+				continue
+			}
+			if err != nil || !api.InState(fsm.State, timer.State) {
+				s.logger.Debug().Msgf("FSM [%s#%s] no longer in state %s, timer discarded",
+					cfgName, timer.Id, timer.State)
+				if err := s.store.DiscardTimer(ctx, cfgName, timer); err != nil {
+					s.logger.Error().Err(err).Msgf("could not discard timer `%s` for FSM [%s#%s]",
+						timer.Event, cfgName, timer.Id)
+				}
+				continue
+			}
+			s.logger.Debug().Msgf("timer fired for FSM [%s#%s] in state %s: `%s`",
+				cfgName, timer.Id, timer.State, timer.Event)
+			s.events <- protos.EventRequest{
+				Event: api.NewDueTimerEvent(timer.Id,
+					api.Timer{State: timer.State, Event: timer.Event}, timer.Due),
+				Config: cfgName,
+				Id:     timer.Id,
+			}
+			fired++
+		}
+	}
+	return fired
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package pubsub_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+
+	"github.com/massenz/go-statemachine/pkg/api"
+	"github.com/massenz/go-statemachine/pkg/pubsub"
+	"github.com/massenz/go-statemachine/pkg/storage"
+
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("A Timer Scheduler", func() {
+	var (
+		scheduler *pubsub.TimerScheduler
+		eventsCh  chan protos.EventRequest
+		store     storage.StoreManager
+		expire    = []api.Timer{{State: "pending", Event: "expire", Timeout: time.Millisecond}}
+	)
+	BeforeEach(func() {
+		eventsCh = make(chan protos.EventRequest)
+		store = storage.NewInMemoryStore()
+		zerolog.SetGlobalLevel(zerolog.Disabled)
+		scheduler = pubsub.NewTimerScheduler(eventsCh, store)
+		// Configurations cannot be overwritten, so the tests share the same one.
+		_ = store.PutConfig(bkgnd, &protos.Configuration{
+			Name:    "timed",
+			Version: "v1",
+			States:  []string{"pending", "accepted", "expired"},
+			Transitions: []*protos.Transition{
+				{From: "pending", To: "accepted", Event: "accept"},
+				{From: "pending", To: "expired", Event: "expire after(1ms)"},
+			},
+			StartingState: "pending",
+		})
+	})
+	It("posts the events for due timers", func() {
+		Ω(store.PutStateMachine(bkgnd, "timed-fsm", &protos.FiniteStateMachine{
+			ConfigId: "timed:v1",
+			State:    "pending",
+		})).ToNot(HaveOccurred())
+		Ω(store.ScheduleTimers(bkgnd, "timed", "timed-fsm", expire)).ToNot(HaveOccurred())
+
+		fired := make(chan int)
+		go func() { fired <- scheduler.FireDueTimers(bkgnd, time.Now().Add(time.Second)) }()
+		var request protos.EventRequest
+		Eventually(eventsCh, timeout).Should(Receive(&request))
+		Ω(request.Id).To(Equal("timed-fsm"))
+		Ω(request.Config).To(Equal("timed"))
+		Ω(request.Event.Transition.Event).To(Equal("expire"))
+		Ω(request.Event.Originator).To(Equal(api.TimerOriginator))
+		Eventually(fired).Should(Receive(Equal(1)))
+
+		// Until its event is processed, the timer is only fired again once its lease expires.
+		Ω(scheduler.FireDueTimers(bkgnd, time.Now().Add(time.Second))).To(Equal(0))
+		go func() {
+			fired <- scheduler.FireDueTimers(bkgnd, time.Now().Add(time.Second+scheduler.Lease))
+		}()
+		first := request.Event.EventId
+		Eventually(eventsCh, timeout).Should(Receive(&request))
+		Eventually(fired).Should(Receive(Equal(1)))
+		// The timer's events are all the same, so that duplicates can be detected.
+		Ω(request.Event.EventId).To(Equal(first))
+		_, err := store.TxProcessEvent(bkgnd, request.Id, request.Config, request.Event)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(scheduler.FireDueTimers(bkgnd, time.Now().Add(time.Hour))).To(Equal(0))
+	})
+	It("discards timers for FSMs which left the state", func() {
+		Ω(store.PutStateMachine(bkgnd, "moved-fsm", &protos.FiniteStateMachine{
+			ConfigId: "timed:v1",
+			State:    "accepted",
+		})).ToNot(HaveOccurred())
+		Ω(store.ScheduleTimers(bkgnd, "timed", "moved-fsm", expire)).ToNot(HaveOccurred())
+		Ω(scheduler.FireDueTimers(bkgnd, time.Now().Add(time.Second))).To(Equal(0))
+		// The timer was removed, rather than leased.
+		Ω(scheduler.FireDueTimers(bkgnd, time.Now().Add(time.Second+scheduler.Lease))).To(Equal(0))
+		due, err := store.ClaimDueTimers(bkgnd, "timed", time.Now().Add(time.Hour), time.Hour)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(due).To(BeEmpty())
+	})
+	It("discards timers for FSMs which no longer exist", func() {
+		Ω(store.ScheduleTimers(bkgnd, "timed", "deleted-fsm", expire)).ToNot(HaveOccurred())
+		Ω(scheduler.FireDueTimers(bkgnd, time.Now().Add(time.Second))).To(Equal(0))
+		due, err := store.ClaimDueTimers(bkgnd, "timed", time.Now().Add(time.Hour), time.Hour)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(due).To(BeEmpty())
+	})
+})
@@ -14,6 +14,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/rs/zerolog"
+	"github.com/massenz/go-statemachine/pkg/api"
 	"github.com/massenz/go-statemachine/pkg/storage"
 	protos "github.com/massenz/statemachine-proto/golang/api"
 )
@@ -29,6 +30,23 @@ const (
 
 	// DefaultRetries is the number of times we will try to remove the message from the SQS queue
 	DefaultRetries = 3
+
+	// DefaultTimersInterval between checks for due timers.
+	DefaultTimersInterval = time.Second
+
+	// DefaultTimersLease is how long the Event of a fired timer has to be processed, before
+	// the timer is considered failed and is fired again.
+	DefaultTimersLease = 30 * time.Second
+
+	// DefaultActionsInterval between checks for Actions waiting to be dispatched.
+	DefaultActionsInterval = 200 * time.Millisecond
+
+	// DefaultActionsLease is how long a claimed Action has to be dispatched, before it is
+	// considered failed and is claimed again.
+	DefaultActionsLease = 30 * time.Second
+
+	// DefaultActionsBatchSize is the maximum number of Actions claimed at once.
+	DefaultActionsBatchSize = 100
 )
 
 // An EventsListener will process `EventRequests` in a separate goroutine.
@@ -70,3 +88,39 @@ type SqsSubscriber struct {
 	PollingInterval      time.Duration
 	MessageRemoveRetries int
 }
+
+// A TimerScheduler periodically checks the store for due timers (see api.Timer), and posts
+// their events on the `events` channel, from where an `EventsListener` will process them.
+type TimerScheduler struct {
+	logger   zerolog.Logger
+	events   chan<- protos.EventRequest
+	store    storage.StoreManager
+	Interval time.Duration
+	Lease    time.Duration
+}
+
+// An ActionPublisher dispatches Actions to the workers that need to react to them.
+type ActionPublisher interface {
+	// PublishAction returns an error if the Action could not be dispatched, in which case
+	// it will be retried.
+	PublishAction(action *api.Action) error
+}
+
+// An ActionsDispatcher periodically claims from the store the Actions caused by committed
+// transitions, and dispatches them via the `publisher`; Actions are only removed from the
+// store once successfully dispatched, so that they are dispatched at least once.
+type ActionsDispatcher struct {
+	logger    zerolog.Logger
+	store     storage.StoreManager
+	publisher ActionPublisher
+	Interval  time.Duration
+	Lease     time.Duration
+	BatchSize int
+}
+
+// SqsActionPublisher is an ActionPublisher which sends Actions, encoded as JSON, to an SQS queue.
+type SqsActionPublisher struct {
+	logger   zerolog.Logger
+	client   *sqs.SQS
+	queueUrl string
+}
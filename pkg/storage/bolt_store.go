@@ -0,0 +1,313 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	zlog "github.com/rs/zerolog/log"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// BoltScheme is the prefix of the URLs for BoltStore files, e.g. bolt:///var/lib/fsm.db
+	BoltScheme = "bolt://"
+
+	DefaultSweepInterval = time.Minute
+	// boltOpenTimeout is how long to wait for the lock on the file, which another process
+	// may be holding.
+	boltOpenTimeout = 5 * time.Second
+)
+
+// The BoltStore keeps the values, SETs and sorted SETs in separate buckets: each SET and
+// sorted SET is a nested bucket, named after its key, whose keys are the members.
+var (
+	valuesBucket     = []byte("values")
+	setsBucket       = []byte("sets")
+	sortedSetsBucket = []byte("sorted_sets")
+
+	// setMember is the value of the members of SETs.
+	setMember = []byte{1}
+)
+
+// boltKeyspace is a keyspace on a bbolt transaction; as its operations cannot return errors,
+// the first one is kept in `err`, which causes the transaction to be rolled back.
+//
+// Values are stored prefixed by their expiry time (in Unix nanoseconds, zero if never),
+// and the scores of sorted SETs as the bits of their float64 value.
+type boltKeyspace struct {
+	tx  *bbolt.Tx
+	err error
+}
+
+func (b *boltKeyspace) fail(err error) {
+	if b.err == nil && err != nil {
+		b.err = err
+	}
+}
+
+func (b *boltKeyspace) get(key string) ([]byte, bool) {
+	value := b.tx.Bucket(valuesBucket).Get([]byte(key))
+	if len(value) < 8 {
+		return nil, false
+	}
+	expires := int64(binary.BigEndian.Uint64(value))
+	if expires != 0 && time.Now().UnixNano() > expires {
+		return nil, false
+	}
+	// Values are only valid during the transaction.
+	data := make([]byte, len(value)-8)
+	copy(data, value[8:])
+	return data, true
+}
+
+func (b *boltKeyspace) set(key string, data []byte, ttl time.Duration) {
+	value := make([]byte, 8+len(data))
+	if ttl > 0 {
+		binary.BigEndian.PutUint64(value, uint64(time.Now().Add(ttl).UnixNano()))
+	}
+	copy(value[8:], data)
+	b.fail(b.tx.Bucket(valuesBucket).Put([]byte(key), value))
+}
+
+func (b *boltKeyspace) del(key string) {
+	b.fail(b.tx.Bucket(valuesBucket).Delete([]byte(key)))
+}
+
+// nested returns the nested bucket for `key` in `parent`, creating it if `create` is true,
+// or nil if it does not exist.
+func (b *boltKeyspace) nested(parent []byte, key string, create bool) *bbolt.Bucket {
+	if !create {
+		return b.tx.Bucket(parent).Bucket([]byte(key))
+	}
+	bucket, err := b.tx.Bucket(parent).CreateBucketIfNotExists([]byte(key))
+	b.fail(err)
+	return bucket
+}
+
+// remove deletes `member` from the nested bucket for `key` in `parent`, and the bucket
+// itself once empty; it returns whether `member` was there.
+func (b *boltKeyspace) remove(parent []byte, key string, member string) bool {
+	bucket := b.nested(parent, key, false)
+	if bucket == nil || bucket.Get([]byte(member)) == nil {
+		return false
+	}
+	b.fail(bucket.Delete([]byte(member)))
+	if k, _ := bucket.Cursor().First(); k == nil {
+		b.fail(b.tx.Bucket(parent).DeleteBucket([]byte(key)))
+	}
+	return true
+}
+
+func (b *boltKeyspace) sAdd(key string, member string) {
+	if bucket := b.nested(setsBucket, key, true); bucket != nil {
+		b.fail(bucket.Put([]byte(member), setMember))
+	}
+}
+
+func (b *boltKeyspace) sRem(key string, member string) {
+	b.remove(setsBucket, key, member)
+}
+
+func (b *boltKeyspace) sIsMember(key string, member string) bool {
+	bucket := b.nested(setsBucket, key, false)
+	return bucket != nil && bucket.Get([]byte(member)) != nil
+}
+
+func (b *boltKeyspace) sMembers(key string) []string {
+	members := make([]string, 0)
+	if bucket := b.nested(setsBucket, key, false); bucket != nil {
+		// Keys are sorted by their bytes, which sorts the members too.
+		b.fail(bucket.ForEach(func(k, _ []byte) error {
+			members = append(members, string(k))
+			return nil
+		}))
+	}
+	return members
+}
+
+func (b *boltKeyspace) zAdd(key string, member string, score float64) {
+	if bucket := b.nested(sortedSetsBucket, key, true); bucket != nil {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, math.Float64bits(score))
+		b.fail(bucket.Put([]byte(member), value))
+	}
+}
+
+func (b *boltKeyspace) zRem(key string, member string) bool {
+	return b.remove(sortedSetsBucket, key, member)
+}
+
+func (b *boltKeyspace) zScores(key string) map[string]float64 {
+	scores := make(map[string]float64)
+	if bucket := b.nested(sortedSetsBucket, key, false); bucket != nil {
+		b.fail(bucket.ForEach(func(k, v []byte) error {
+			scores[string(k)] = math.Float64frombits(binary.BigEndian.Uint64(v))
+			return nil
+		}))
+	}
+	return scores
+}
+
+func (b *boltKeyspace) zRangeByScore(key string, max float64, count int) []string {
+	return rangeByScore(b.zScores(key), max, count)
+}
+
+// boltBackend runs the keyspaceStore transactions as bbolt ones: read-write transactions
+// are serialized, and rolled back if they fail.
+type boltBackend struct {
+	db *bbolt.DB
+}
+
+func (b *boltBackend) view(fn func(ks keyspace) error) error {
+	return b.run(b.db.View, fn)
+}
+
+func (b *boltBackend) update(fn func(ks keyspace) error) error {
+	return b.run(b.db.Update, fn)
+}
+
+func (b *boltBackend) run(tx func(func(*bbolt.Tx) error) error, fn func(ks keyspace) error) error {
+	var fnErr error
+	err := tx(func(tx *bbolt.Tx) error {
+		ks := &boltKeyspace{tx: tx}
+		if fnErr = fn(ks); fnErr != nil {
+			return fnErr
+		}
+		return ks.err
+	})
+	if err != nil && err != fnErr {
+		return GenericStoreError(err.Error())
+	}
+	return err
+}
+
+// BoltStore is a StoreManager which keeps all the data in a bbolt file, using the same keys
+// (see keys.go) as the RedisStore for its values, SETs and sorted SETs; it is meant for
+// single-node deployments, as only one process at a time can open the file.
+//
+// Every method runs in a bbolt transaction; expired values (Events, their outcomes and the
+// IDs of processed Events) are removed by a background sweeper, until the store is closed.
+type BoltStore struct {
+	keyspaceStore
+	db   *bbolt.DB
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (csm *BoltStore) Health() StoreErr {
+	// This fails if the database is closed.
+	if err := csm.db.View(func(*bbolt.Tx) error { return nil }); err != nil {
+		return GenericStoreError(err.Error())
+	}
+	return nil
+}
+
+// Close stops the sweeper, and closes the file.
+func (csm *BoltStore) Close() error {
+	close(csm.done)
+	csm.wg.Wait()
+	return csm.db.Close()
+}
+
+// Sweep removes all the expired values, and returns how many were removed.
+func (csm *BoltStore) Sweep() (int, StoreErr) {
+	var expired [][]byte
+	err := csm.db.Update(func(tx *bbolt.Tx) error {
+		now := time.Now().UnixNano()
+		bucket := tx.Bucket(valuesBucket)
+		err := bucket.ForEach(func(k, v []byte) error {
+			if len(v) >= 8 {
+				expires := int64(binary.BigEndian.Uint64(v))
+				if expires != 0 && now > expires {
+					expired = append(expired, append([]byte(nil), k...))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err = bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, GenericStoreError(err.Error())
+	}
+	return len(expired), nil
+}
+
+// sweep runs Sweep every `interval`, until the store is closed.
+func (csm *BoltStore) sweep(interval time.Duration) {
+	defer csm.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-csm.done:
+			return
+		case <-ticker.C:
+			swept, err := csm.Sweep()
+			if err != nil {
+				csm.logger.Error().Err(err).Msg("could not remove expired values")
+				continue
+			}
+			csm.logger.Trace().Msgf("removed %d expired values", swept)
+		}
+	}
+}
+
+// NewBoltStore opens (or creates) the bbolt file at `path`, and returns a StoreManager
+// backed by it (see BoltStore), whose expired values are removed every `sweepInterval`.
+//
+// The store must be closed once done with it, to release the file.
+func NewBoltStore(path string, sweepInterval time.Duration) (*BoltStore, StoreErr) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: boltOpenTimeout})
+	if errors.Is(err, bbolt.ErrTimeout) {
+		// Another process is holding the lock on the file.
+		return nil, TimeoutError(path)
+	} else if err != nil {
+		return nil, GenericStoreError(fmt.Sprintf("cannot open %s: %v", path, err))
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{valuesBucket, setsBucket, sortedSetsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, GenericStoreError(err.Error())
+	}
+	store := &BoltStore{
+		keyspaceStore: keyspaceStore{
+			logger:      zlog.With().Str("logger", BoltScheme+path).Logger(),
+			backend:     &boltBackend{db: db},
+			Timeout:     DefaultTimeout,
+			DedupWindow: DefaultDedupWindow,
+		},
+		db:   db,
+		done: make(chan struct{}),
+	}
+	store.wg.Add(1)
+	go store.sweep(sweepInterval)
+	return store, nil
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package storage_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/massenz/go-statemachine/pkg/api"
+	storage2 "github.com/massenz/go-statemachine/pkg/storage"
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("Bolt Store", func() {
+	// See TestConformance for the tests shared with the other stores.
+	var store *storage2.BoltStore
+	var path string
+	BeforeEach(func() {
+		dir, err := os.MkdirTemp("", "fsm-bolt")
+		Ω(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "fsm.db")
+		store, err = storage2.NewBoltStore(path, storage2.DefaultSweepInterval)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(store.PutConfig(bkgnd, &protos.Configuration{
+			Name:          cfgName,
+			Version:       "v4",
+			States:        []string{"in_transit", "delivered"},
+			StartingState: "in_transit",
+			Transitions: []*protos.Transition{
+				{From: "in_transit", Event: "scan / incr(scans)"},
+				{From: "in_transit", To: "delivered", Event: "deliver / notify"},
+				{From: "delivered", To: api.FinalState},
+			},
+		})).To(Succeed())
+		storeSomeFSMs(store, 3)
+	})
+	AfterEach(func() {
+		Ω(store.Close()).To(Succeed())
+		Ω(os.RemoveAll(filepath.Dir(path))).To(Succeed())
+	})
+	It("is healthy until closed", func() {
+		Ω(store.Health()).To(Succeed())
+	})
+	It("keeps the data after being reopened", func() {
+		_, err := store.TxProcessEvent(bkgnd, "fsm-1", cfgName, api.NewEvent("deliver"))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(store.Close()).To(Succeed())
+		Ω(store.Health()).ToNot(Succeed())
+
+		store, err = storage2.NewBoltStore(path, storage2.DefaultSweepInterval)
+		Ω(err).ToNot(HaveOccurred())
+		fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(fsm.State).To(Equal("delivered"))
+		Ω(store.GetAllInState(bkgnd, cfgName, "delivered")).To(ConsistOf("fsm-1"))
+		Ω(store.GetAllVersions(bkgnd, cfgName)).To(ConsistOf(configId))
+		actions, err := store.ClaimActions(bkgnd, cfgName, 10, time.Hour)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(actions).To(HaveLen(1))
+		Ω(actions[0].Name).To(Equal("notify"))
+	})
+	It("removes expired values", func() {
+		evt := api.NewEvent("deliver")
+		Ω(store.PutEvent(bkgnd, evt, cfgName, 10*time.Millisecond)).To(Succeed())
+		Ω(store.PutEvent(bkgnd, api.NewEvent("scan"), cfgName, storage2.NeverExpire)).To(Succeed())
+		_, err := store.GetEvent(bkgnd, evt.EventId, cfgName)
+		Ω(err).ToNot(HaveOccurred())
+		time.Sleep(20 * time.Millisecond)
+		_, err = store.GetEvent(bkgnd, evt.EventId, cfgName)
+		Ω(storage2.IsNotFoundErr(err)).To(BeTrue())
+		swept, err := store.Sweep()
+		Ω(err).ToNot(HaveOccurred())
+		Ω(swept).To(Equal(1))
+	})
+})
@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package storage_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog"
+
+	internals "github.com/massenz/go-statemachine/pkg/internal/testing"
+	storage2 "github.com/massenz/go-statemachine/pkg/storage"
+	"github.com/massenz/go-statemachine/pkg/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	t.Run("memory", func(t *testing.T) {
+		storagetest.RunConformance(t, func(t *testing.T) storage2.StoreManager {
+			return storage2.NewInMemoryStore()
+		})
+	})
+	t.Run("bolt", func(t *testing.T) {
+		storagetest.RunConformance(t, func(t *testing.T) storage2.StoreManager {
+			store, err := storage2.NewBoltStore(filepath.Join(t.TempDir(), "fsm.db"),
+				storage2.DefaultSweepInterval)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = store.Close() })
+			return store
+		})
+	})
+	t.Run("redis", func(t *testing.T) {
+		redisContainer, err := internals.NewRedisContainer(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			timeout := 2 * time.Second
+			_ = redisContainer.Stop(context.Background(), &timeout)
+		}()
+		rdb := redis.NewClient(&redis.Options{
+			Addr: redisContainer.Address,
+			DB:   storage2.DefaultRedisDb,
+		})
+		storagetest.RunConformance(t, func(t *testing.T) storage2.StoreManager {
+			rdb.FlushDB(context.Background())
+			return storage2.NewRedisStoreWithDefaults(redisContainer.Address)
+		})
+	})
+	t.Run("redis-cluster", func(t *testing.T) {
+		clusterContainer, err := internals.NewRedisClusterContainer(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			timeout := 2 * time.Second
+			_ = clusterContainer.Stop(context.Background(), &timeout)
+		}()
+		rdb := redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs: []string{clusterContainer.Address},
+		})
+		storagetest.RunConformance(t, func(t *testing.T) storage2.StoreManager {
+			rdb.FlushDB(context.Background())
+			return storage2.NewRedisStore(clusterContainer.Address, true, storage2.DefaultRedisDb,
+				storage2.DefaultTimeout, storage2.NewRetryPolicy(storage2.DefaultMaxRetries))
+		})
+	})
+}
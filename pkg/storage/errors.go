@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/massenz/go-statemachine/pkg/api"
+	protos "github.com/massenz/statemachine-proto/golang/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+)
+
+type StoreErr = error
+
+// The kinds of errors returned by the StoreManager methods: use errors.Is to find out the
+// kind of an error, and errors.As (with a *StoreError) to find out the key it is about.
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrConfigNotFound is the ErrNotFound for a missing Configuration.
+	ErrConfigNotFound   = fmt.Errorf("configuration %w", ErrNotFound)
+	ErrAlreadyExists    = errors.New("already exists")
+	ErrAlreadyProcessed = errors.New("already processed")
+	ErrConflict         = errors.New("conflict")
+	ErrTimeout          = errors.New("timeout")
+	ErrCanceled         = errors.New("canceled")
+	ErrInvalidData      = errors.New("invalid data")
+	ErrInUse            = errors.New("in use")
+	ErrNotImplemented   = errors.New("not implemented")
+	ErrStore            = errors.New("store error")
+)
+
+// StoreError is the error returned by the StoreManager methods, whose Kind is one of the
+// errors above.
+//
+// The Key is the one the error is about, and is empty for errors not about any key (e.g., a
+// GenericStoreError).
+type StoreError struct {
+	Kind error
+	Key  string
+	msg  string
+}
+
+func (e *StoreError) Error() string {
+	return e.msg
+}
+
+func (e *StoreError) Unwrap() error {
+	return e.Kind
+}
+
+// Error returns a constructor of StoreErrors of the given `kind`, whose message is the
+// `msg` format, with the key.
+func Error(kind error, msg string) func(string) StoreErr {
+	return func(key string) StoreErr {
+		return &StoreError{Kind: kind, Key: key, msg: fmt.Sprintf(msg, key)}
+	}
+}
+
+// Errorf returns a constructor of StoreErrors of the given `kind`, which are not about any
+// key, whose message is the `msg` format, with the details.
+func Errorf(kind error, msg string) func(string) StoreErr {
+	return func(details string) StoreErr {
+		return &StoreError{Kind: kind, msg: fmt.Sprintf(msg, details)}
+	}
+}
+
+var (
+	AlreadyExistsError    = Error(ErrAlreadyExists, "key %s already exists")
+	AlreadyProcessedError = Errorf(ErrAlreadyProcessed, "event %s was already processed")
+	CanceledError         = Error(ErrCanceled, "canceled while accessing key %s")
+	ConfigNotFoundError   = Error(ErrConfigNotFound, "key %s not found")
+	GenericStoreError     = Errorf(ErrStore, "store error: %v")
+	InvalidDataError      = Errorf(ErrInvalidData, "error storing invalid data: %v")
+	InvalidPageTokenError = Errorf(ErrInvalidData, "invalid page token `%s`")
+	InUseError            = Error(ErrInUse, "key %s is still in use")
+	NotFoundError         = Error(ErrNotFound, "key %s not found")
+	NotImplementedError   = Errorf(ErrNotImplemented, "functionality %s has not been implemented yet")
+	TimeoutError          = Error(ErrTimeout, "timed out accessing key %s")
+	TooManyAttempts       = Error(ErrConflict, "retries exceeded updating key %s")
+	UnreadableDataError   = Error(ErrInvalidData, "the data for key %s cannot be read")
+)
+
+// A DuplicateEventError is the AlreadyProcessedError returned by TxProcessEvent for a
+// duplicate Event, along with the Outcome the Event was first processed with.
+type DuplicateEventError struct {
+	StoreErr
+	Outcome *protos.EventOutcome
+}
+
+func (e *DuplicateEventError) Unwrap() error {
+	return e.StoreErr
+}
+
+// processedOutcome returns the outcome that TxProcessEvent records for an Event processed
+// (or rejected, if `err` is not nil) by the FSM `id`.
+func processedOutcome(id string, cfgName string, err error) *protos.EventOutcome {
+	outcome := &protos.EventOutcome{Code: OutcomeCode(err), Config: cfgName, Id: id}
+	if err != nil {
+		outcome.Details = err.Error()
+	}
+	return outcome
+}
+
+// duplicateEventError returns the DuplicateEventError for the Event `eventId`, whose outcome
+// was recorded as `data` (see NewKeyForProcessedEvent); earlier releases only recorded the
+// Events which were processed successfully, without their outcome.
+func duplicateEventError(eventId string, data []byte) StoreErr {
+	outcome := &protos.EventOutcome{}
+	if err := proto.Unmarshal(data, outcome); err != nil {
+		outcome = &protos.EventOutcome{Code: protos.EventOutcome_Ok}
+	}
+	return &DuplicateEventError{StoreErr: AlreadyProcessedError(eventId), Outcome: outcome}
+}
+
+// IsNotFoundErr returns true if the error is a NotFoundError.
+func IsNotFoundErr(err StoreErr) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// IsAlreadyProcessedErr returns true if the error is an AlreadyProcessedError, returned
+// by TxProcessEvent for duplicate events.
+func IsAlreadyProcessedErr(err StoreErr) bool {
+	return errors.Is(err, ErrAlreadyProcessed)
+}
+
+// contextError returns the StoreError for the `ctx` used to access `key`, once it is done:
+// its deadline passing is a TimeoutError, and its cancellation a CanceledError.
+func contextError(ctx context.Context, key string) StoreErr {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return TimeoutError(key)
+	}
+	return CanceledError(key)
+}
+
+// errorCodes maps the kinds of errors to the gRPC status code, and to the EventOutcome
+// code, they are reported with; the errors returned by the FSMs when processing Events
+// (see api.ConfiguredStateMachine) are also mapped here, as TxProcessEvent returns them.
+var errorCodes = []struct {
+	kind    error
+	code    codes.Code
+	outcome protos.EventOutcome_StatusCode
+}{
+	{ErrConfigNotFound, codes.NotFound, protos.EventOutcome_ConfigurationNotFound},
+	{ErrNotFound, codes.NotFound, protos.EventOutcome_FsmNotFound},
+	{ErrAlreadyExists, codes.AlreadyExists, protos.EventOutcome_InternalError},
+	{ErrAlreadyProcessed, codes.AlreadyExists, protos.EventOutcome_EventNotAllowed},
+	{ErrConflict, codes.Aborted, protos.EventOutcome_InternalError},
+	{ErrTimeout, codes.DeadlineExceeded, protos.EventOutcome_InternalError},
+	{ErrCanceled, codes.Canceled, protos.EventOutcome_InternalError},
+	{ErrInvalidData, codes.InvalidArgument, protos.EventOutcome_InternalError},
+	{ErrInUse, codes.FailedPrecondition, protos.EventOutcome_InternalError},
+	{ErrNotImplemented, codes.Unimplemented, protos.EventOutcome_InternalError},
+	{api.GuardNotSatisfiedError, codes.FailedPrecondition, protos.EventOutcome_TransitionNotAllowed},
+	{api.UnexpectedTransitionError, codes.FailedPrecondition, protos.EventOutcome_EventNotAllowed},
+}
+
+// StatusCode returns the gRPC status code for `err`, as returned by a StoreManager method:
+// any error of an unknown kind is an Internal one.
+func StatusCode(err error) codes.Code {
+	if err == nil {
+		return codes.OK
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.kind) {
+			return c.code
+		}
+	}
+	return codes.Internal
+}
+
+// OutcomeCode returns the EventOutcome code for `err`, as returned by TxProcessEvent: any
+// error of an unknown kind is an InternalError.
+func OutcomeCode(err error) protos.EventOutcome_StatusCode {
+	if err == nil {
+		return protos.EventOutcome_Ok
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.kind) {
+			return c.outcome
+		}
+	}
+	return protos.EventOutcome_InternalError
+}
@@ -14,6 +14,7 @@ import (
 )
 
 const (
+	ActionsPrefix = "actions"
 	ConfigsPrefix = "configs"
 	EventsPrefix  = "events"
 	FsmPrefix     = "fsm"
@@ -44,14 +45,103 @@ func NewKeyForMachinesByState(cfgName, state string) string {
 	return strings.Join([]string{prefix, state}, KeyPrefixIDSeparator)
 }
 
+// NewKeyForMachinesIndex fsm:<cfg:name>:index
+//
+// This is a sorted SET of the IDs of all the FSMs configured with (any version of) the
+// Configuration, scored by the (Unix, in milliseconds) time at which they were last stored.
+func NewKeyForMachinesIndex(cfgName string) string {
+	return strings.Join([]string{FsmPrefix, cfgName, "index"}, KeyPrefixComponentsSeparator)
+}
+
+// NewKeyForMachinesIndexed fsm:<cfg:name>:indexed
+//
+// This key marks the index of the FSMs (see NewKeyForMachinesIndex) as complete, once the FSMs
+// stored before it was introduced have been added to it.
+func NewKeyForMachinesIndexed(cfgName string) string {
+	return strings.Join([]string{FsmPrefix, cfgName, "indexed"}, KeyPrefixComponentsSeparator)
+}
+
+// NewKeyForCompleted fsm:<cfg:name>:completed
+//
+// This is a sorted SET of the IDs of the FSMs which reached a terminal state, scored by
+// the (Unix) time of completion.
+func NewKeyForCompleted(cfgName string) string {
+	return strings.Join([]string{FsmPrefix, cfgName, "completed"}, KeyPrefixComponentsSeparator)
+}
+
+// NewKeyForTimers fsm:<cfg:name>:timers
+//
+// This is a sorted SET of the running Timers for the FSMs, scored by the (Unix, in
+// milliseconds) time at which they are due; see NewTimerMember for the format of its members.
+func NewKeyForTimers(cfgName string) string {
+	return strings.Join([]string{FsmPrefix, cfgName, "timers"}, KeyPrefixComponentsSeparator)
+}
+
+// NewKeyForTimerLeases fsm:<cfg:name>:timers:leases
+//
+// This is a sorted SET of the timers (see NewTimerMember) which have been claimed, scored by
+// the (Unix, in milliseconds) time at which their lease expires.
+func NewKeyForTimerLeases(cfgName string) string {
+	return strings.Join([]string{NewKeyForTimers(cfgName), "leases"}, KeyPrefixComponentsSeparator)
+}
+
+// NewTimerMember <machine:id>#<state>#<event>
+func NewTimerMember(id, state, event string) string {
+	return strings.Join([]string{id, state, event}, KeyPrefixIDSeparator)
+}
+
+// ParseTimerMember is the inverse of NewTimerMember; as the FSM ID may contain the separator,
+// the state and event are parsed from the end of the `member`.
+func ParseTimerMember(member string) (id, state, event string, ok bool) {
+	last := strings.LastIndex(member, KeyPrefixIDSeparator)
+	if last < 0 {
+		return "", "", "", false
+	}
+	prev := strings.LastIndex(member[:last], KeyPrefixIDSeparator)
+	if prev < 0 {
+		return "", "", "", false
+	}
+	return member[:prev], member[prev+1 : last], member[last+1:], true
+}
+
+// NewKeyForActions fsm:<cfg:name>:actions
+//
+// This is a sorted SET of the IDs of the Actions waiting to be dispatched (the outbox),
+// scored by the (Unix, in milliseconds) time after which they can be claimed for dispatching.
+func NewKeyForActions(cfgName string) string {
+	return strings.Join([]string{FsmPrefix, cfgName, ActionsPrefix}, KeyPrefixComponentsSeparator)
+}
+
+// NewKeyForAction actions:<cfg:name>#<action:id>
+func NewKeyForAction(id string, cfgName string) string {
+	prefix := strings.Join([]string{ActionsPrefix, cfgName}, KeyPrefixComponentsSeparator)
+	return strings.Join([]string{prefix, id}, KeyPrefixIDSeparator)
+}
+
 // NewKeyForEvent events:<cfg:name>#<event:id>
 func NewKeyForEvent(id string, cfgName string) string {
 	prefix := strings.Join([]string{EventsPrefix, cfgName}, KeyPrefixComponentsSeparator)
 	return strings.Join([]string{prefix, id}, KeyPrefixIDSeparator)
 }
 
+// NewKeyForProcessedEvent events:<cfg:name>:processed#<machine:id>#<event:id>
+//
+// This key marks the event as processed by the FSM, and keeps the outcome (see
+// protos.EventOutcome) it was processed with; it expires after the deduplication window
+// (see RedisStore.DedupWindow).
+func NewKeyForProcessedEvent(id string, fsmId string, cfgName string) string {
+	prefix := strings.Join([]string{EventsPrefix, cfgName, "processed"}, KeyPrefixComponentsSeparator)
+	return strings.Join([]string{prefix, fsmId, id}, KeyPrefixIDSeparator)
+}
+
 // NewKeyForOutcome events:<cfg:name>:outcome#<event:id>
 func NewKeyForOutcome(id string, cfgName string) string {
 	prefix := strings.Join([]string{EventsPrefix, cfgName, "outcome"}, KeyPrefixComponentsSeparator)
 	return strings.Join([]string{prefix, id}, KeyPrefixIDSeparator)
 }
+
+// hashTag wraps the name of a Configuration in a hash tag: Redis Cluster only hashes the part
+// of a key within the first `{...}`, so that all the keys which carry it are in the same slot.
+func hashTag(cfgName string) string {
+	return "{" + cfgName + "}"
+}
@@ -0,0 +1,965 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/massenz/go-statemachine/pkg/api"
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+// A keyspace keeps, by key (see keys.go), values (which may expire), SETs and sorted SETs,
+// the same way Redis does; its operations are all executed within a single transaction.
+type keyspace interface {
+	// get returns the value for `key`, unless it does not exist or it expired.
+	get(key string) ([]byte, bool)
+	// set stores the value for `key`, which expires after `ttl`, unless it is NeverExpire.
+	set(key string, data []byte, ttl time.Duration)
+	del(key string)
+
+	sAdd(key string, member string)
+	sRem(key string, member string)
+	sIsMember(key string, member string) bool
+	// sMembers returns the members of the SET, sorted.
+	sMembers(key string) []string
+
+	zAdd(key string, member string, score float64)
+	// zRem removes the `member` from the sorted SET, and returns whether it was there.
+	zRem(key string, member string) bool
+	// zScores returns the members of the sorted SET, along with their scores.
+	zScores(key string) map[string]float64
+	// zRangeByScore returns up to `count` (or all, if not positive) of the members of the
+	// sorted SET whose score is at most `max`, in order of their score.
+	zRangeByScore(key string, max float64, count int) []string
+}
+
+// A keyspaceBackend runs functions in read-only (`view`) or read-write (`update`)
+// transactions on a keyspace; if `fn` fails, none of its changes are kept, and its error
+// is returned as is.
+type keyspaceBackend interface {
+	view(fn func(ks keyspace) error) error
+	update(fn func(ks keyspace) error) error
+}
+
+// keyspaceStore implements the StoreManager on a keyspaceBackend, with the same semantics as
+// the RedisStore: every method runs in a single transaction.
+type keyspaceStore struct {
+	logger  zerolog.Logger
+	backend keyspaceBackend
+	Timeout time.Duration
+	// DedupWindow is how long the IDs of processed Events are kept, to detect duplicates.
+	DedupWindow time.Duration
+}
+
+// rangeByScore is the implementation of keyspace.zRangeByScore for the `scores` of the
+// members of a sorted SET.
+func rangeByScore(scores map[string]float64, max float64, count int) []string {
+	var members []string
+	for member, score := range scores {
+		if score <= max {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if scores[members[i]] != scores[members[j]] {
+			return scores[members[i]] < scores[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	if count > 0 && len(members) > count {
+		members = members[:count]
+	}
+	return members
+}
+
+/////// Internal methods
+
+func (csm *keyspaceStore) getProto(ks keyspace, key string, value proto.Message) StoreErr {
+	data, found := ks.get(key)
+	if !found {
+		csm.logger.Debug().Msgf("Key `%s` not found", key)
+		return NotFoundError(key)
+	}
+	if err := proto.Unmarshal(data, value); err != nil {
+		csm.logger.Error().Err(err).Msgf("cannot read key `%s`", key)
+		return UnreadableDataError(key)
+	}
+	return nil
+}
+
+func (csm *keyspaceStore) putProto(ks keyspace, key string, value proto.Message, ttl time.Duration) StoreErr {
+	data, err := proto.Marshal(value)
+	if err != nil {
+		csm.logger.Error().Err(err).Msg("cannot convert proto to bytes")
+		return InvalidDataError(err.Error())
+	}
+	ks.set(key, data, ttl)
+	csm.logger.Debug().Msgf("stored value for key `%s`", key)
+	return nil
+}
+
+func (csm *keyspaceStore) getConfig(ks keyspace, id string) (*protos.Configuration, StoreErr) {
+	var cfg protos.Configuration
+	key := NewKeyForConfig(id)
+	if err := csm.getProto(ks, key, &cfg); IsNotFoundErr(err) {
+		return nil, ConfigNotFoundError(key)
+	} else if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (csm *keyspaceStore) getStateMachine(ks keyspace, id string, cfg string) (*protos.FiniteStateMachine, StoreErr) {
+	var stateMachine protos.FiniteStateMachine
+	if err := csm.getProto(ks, NewKeyForMachine(id, cfg), &stateMachine); err != nil {
+		return nil, err
+	}
+	return &stateMachine, nil
+}
+
+// putStateMachine stores the FSM `id`, and adds it to the index of the FSMs configured with
+// `cfgName`, as last stored now.
+func (csm *keyspaceStore) putStateMachine(ks keyspace, id string, cfgName string, fsm *protos.FiniteStateMachine) StoreErr {
+	if err := csm.putProto(ks, NewKeyForMachine(id, cfgName), fsm, NeverExpire); err != nil {
+		return err
+	}
+	csm.indexMachine(ks, cfgName, id)
+	return nil
+}
+
+func (csm *keyspaceStore) indexMachine(ks keyspace, cfgName string, id string) {
+	ks.zAdd(NewKeyForMachinesIndex(cfgName), id, float64(time.Now().UnixMilli()))
+}
+
+func (csm *keyspaceStore) updateState(ks keyspace, cfgName string, id string, oldState string, newState string) {
+	for _, state := range api.ExitedStates(oldState, newState) {
+		ks.sRem(NewKeyForMachinesByState(cfgName, state), id)
+	}
+	for _, state := range api.EnteredStates(oldState, newState) {
+		ks.sAdd(NewKeyForMachinesByState(cfgName, state), id)
+	}
+}
+
+// scheduleTimers adds the `timers` to the sorted SET, scored by the time they will be due.
+func (csm *keyspaceStore) scheduleTimers(ks keyspace, cfgName string, id string, timers []api.Timer) {
+	now := time.Now()
+	for _, timer := range timers {
+		csm.logger.Trace().Msgf("starting timer for FSM [%s#%s] in state %s: `%s` after %v",
+			cfgName, id, timer.State, timer.Event, timer.Timeout)
+		member := NewTimerMember(id, timer.State, timer.Event)
+		ks.zAdd(NewKeyForTimers(cfgName), member, float64(now.Add(timer.Timeout).UnixMilli()))
+		ks.zRem(NewKeyForTimerLeases(cfgName), member)
+	}
+}
+
+// moveTimers is the equivalent of RedisStore.moveTimers: it cancels the timers of the FSM
+// `id` for the states it left, starts those for the states it entered, and records (or
+// removes) its completion.
+func (csm *keyspaceStore) moveTimers(ks keyspace, id string, from *protos.Configuration, oldState string,
+	to *protos.Configuration, newState string) {
+	cfgName := to.Name
+	running := make(map[string]bool)
+	for _, state := range api.Ancestors(oldState) {
+		for _, timer := range api.Timers(from, state) {
+			running[NewTimerMember(id, timer.State, timer.Event)] = true
+		}
+	}
+	var started []api.Timer
+	for _, state := range api.Ancestors(newState) {
+		for _, timer := range api.Timers(to, state) {
+			member := NewTimerMember(id, timer.State, timer.Event)
+			if running[member] {
+				delete(running, member)
+				continue
+			}
+			started = append(started, timer)
+		}
+	}
+	for member := range running {
+		ks.zRem(NewKeyForTimers(cfgName), member)
+	}
+	csm.scheduleTimers(ks, cfgName, id, started)
+	wasCompleted := api.IsTerminal(from, oldState)
+	isCompleted := api.IsTerminal(to, newState)
+	if isCompleted && !wasCompleted {
+		ks.zAdd(NewKeyForCompleted(cfgName), id, float64(time.Now().Unix()))
+	} else if wasCompleted && !isCompleted {
+		ks.zRem(NewKeyForCompleted(cfgName), id)
+	}
+}
+
+// allStates returns all the states of all the versions of the `cfgName` Configuration.
+func (csm *keyspaceStore) allStates(ks keyspace, cfgName string) []string {
+	var states []string
+	seen := make(map[string]bool)
+	for _, versionId := range ks.sMembers(NewKeyForConfig(cfgName)) {
+		cfg, err := csm.getConfig(ks, versionId)
+		if err != nil {
+			continue
+		}
+		for _, s := range cfg.States {
+			if !seen[s] {
+				seen[s] = true
+				states = append(states, s)
+			}
+		}
+	}
+	return states
+}
+
+// view runs `fn` in a read-only transaction on the keyspace, unless `ctx` (used to access
+// `key`) is already done.
+func (csm *keyspaceStore) view(ctx context.Context, key string, fn func(ks keyspace) error) error {
+	if ctx.Err() != nil {
+		return contextError(ctx, key)
+	}
+	return csm.backend.view(fn)
+}
+
+// update runs `fn` in a read-write transaction on the keyspace, unless `ctx` (used to access
+// `key`) is already done.
+func (csm *keyspaceStore) update(ctx context.Context, key string, fn func(ks keyspace) error) error {
+	if ctx.Err() != nil {
+		return contextError(ctx, key)
+	}
+	return csm.backend.update(fn)
+}
+
+// members returns the members of the SET `key`, logging any error.
+func (csm *keyspaceStore) members(ctx context.Context, key string) []string {
+	var members []string
+	err := csm.view(ctx, key, func(ks keyspace) error {
+		members = ks.sMembers(key)
+		return nil
+	})
+	if err != nil {
+		csm.logger.Error().Err(err).Msgf("could not retrieve the members of %s", key)
+		return nil
+	}
+	csm.logger.Debug().Msgf(ReturningItemsFmt, len(members))
+	return members
+}
+
+// page returns the Page of the (sorted) members of the SET `key` requested by `req`; its
+// page tokens encode the last member of the previous Page.
+func (csm *keyspaceStore) page(ctx context.Context, key string, req PageRequest) (*Page, StoreErr) {
+	var last string
+	if req.Token != "" {
+		var err StoreErr
+		if last, err = decodePageToken(req.Token); err != nil {
+			return nil, err
+		}
+	}
+	page := &Page{}
+	err := csm.view(ctx, key, func(ks keyspace) error {
+		members := ks.sMembers(key)
+		start := 0
+		if req.Token != "" {
+			start = sort.Search(len(members), func(i int) bool { return members[i] > last })
+		}
+		end := start + req.size()
+		if end >= len(members) {
+			end = len(members)
+		} else {
+			page.NextToken = encodePageToken(members[end-1])
+		}
+		page.Items = members[start:end]
+		return nil
+	})
+	if err != nil {
+		csm.logger.Error().Err(err).Msgf("could not retrieve the members of %s", key)
+		return nil, err
+	}
+	csm.logger.Debug().Msgf(ReturningItemsFmt, len(page.Items))
+	return page, nil
+}
+
+/////// StoreManager implementation
+
+func (csm *keyspaceStore) SetTimeout(duration time.Duration) {
+	csm.Timeout = duration
+}
+
+func (csm *keyspaceStore) GetTimeout() time.Duration {
+	return csm.Timeout
+}
+
+func (csm *keyspaceStore) SetDedupWindow(window time.Duration) {
+	csm.DedupWindow = window
+}
+
+/////// ConfigStore implementation
+
+func (csm *keyspaceStore) GetConfig(ctx context.Context, id string) (*protos.Configuration, StoreErr) {
+	var cfg *protos.Configuration
+	err := csm.view(ctx, NewKeyForConfig(id), func(ks keyspace) (err error) {
+		cfg, err = csm.getConfig(ks, id)
+		return err
+	})
+	if err != nil {
+		csm.logger.Error().Err(err).Msg("cannot retrieve configuration")
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (csm *keyspaceStore) PutConfig(ctx context.Context, cfg *protos.Configuration) StoreErr {
+	if cfg == nil {
+		return InvalidDataError("nil config")
+	}
+	return csm.update(ctx, NewKeyForConfig(api.GetVersionId(cfg)), func(ks keyspace) error {
+		key := NewKeyForConfig(api.GetVersionId(cfg))
+		if _, found := ks.get(key); found {
+			return AlreadyExistsError(key)
+		}
+		ks.sAdd(ConfigsPrefix, cfg.Name)
+		ks.sAdd(NewKeyForConfig(cfg.Name), api.GetVersionId(cfg))
+		return csm.putProto(ks, key, cfg, NeverExpire)
+	})
+}
+
+func (csm *keyspaceStore) GetAllConfigs(ctx context.Context) []string {
+	csm.logger.Debug().Msg("Looking up all configs in DB")
+	return csm.members(ctx, ConfigsPrefix)
+}
+
+func (csm *keyspaceStore) GetAllVersions(ctx context.Context, name string) []string {
+	csm.logger.Debug().Msgf("Looking up all versions for Configurations %s in DB", name)
+	return csm.members(ctx, NewKeyForConfig(name))
+}
+
+func (csm *keyspaceStore) GetConfigsPage(ctx context.Context, req PageRequest) (*Page, StoreErr) {
+	csm.logger.Debug().Msg("Looking up a page of configs in DB")
+	return csm.page(ctx, ConfigsPrefix, req)
+}
+
+func (csm *keyspaceStore) GetVersionsPage(ctx context.Context, name string, req PageRequest) (*Page, StoreErr) {
+	csm.logger.Debug().Msgf("Looking up a page of versions for Configurations %s in DB", name)
+	return csm.page(ctx, NewKeyForConfig(name), req)
+}
+
+func (csm *keyspaceStore) DeleteConfiguration(ctx context.Context, versionId string, force bool) StoreErr {
+	// FSMs are scanned outside the transaction, as ScanStateMachines runs its own.
+	cfg, err := csm.GetConfig(ctx, versionId)
+	if err != nil {
+		return err
+	}
+	if !force {
+		if err = checkNotInUse(ctx, csm, cfg); err != nil {
+			return err
+		}
+	}
+	key := NewKeyForConfig(versionId)
+	err = csm.update(ctx, key, func(ks keyspace) error {
+		if _, found := ks.get(key); !found {
+			return NotFoundError(key)
+		}
+		ks.del(key)
+		ks.sRem(NewKeyForConfig(cfg.Name), versionId)
+		if len(ks.sMembers(NewKeyForConfig(cfg.Name))) == 0 {
+			ks.sRem(ConfigsPrefix, cfg.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		csm.logger.Error().Err(err).Msgf("could not delete configuration %s", versionId)
+		return err
+	}
+	csm.logger.Debug().Msgf("deleted configuration %s (forced: %t)", versionId, force)
+	return nil
+}
+
+/////// FSMStore implementation
+
+func (csm *keyspaceStore) GetStateMachine(ctx context.Context, id string, cfg string) (*protos.FiniteStateMachine, StoreErr) {
+	var fsm *protos.FiniteStateMachine
+	err := csm.view(ctx, NewKeyForMachine(id, cfg), func(ks keyspace) (err error) {
+		fsm, err = csm.getStateMachine(ks, id, cfg)
+		return err
+	})
+	if err != nil {
+		csm.logger.Error().Err(err).Msgf("error getting FSM %s", NewKeyForMachine(id, cfg))
+		return nil, err
+	}
+	return fsm, nil
+}
+
+func (csm *keyspaceStore) PutStateMachine(ctx context.Context, id string, stateMachine *protos.FiniteStateMachine) StoreErr {
+	if stateMachine == nil {
+		return InvalidDataError("nil statemachine")
+	}
+	configName := strings.Split(stateMachine.ConfigId, api.ConfigurationVersionSeparator)[0]
+	return csm.update(ctx, NewKeyForMachine(id, configName), func(ks keyspace) error {
+		return csm.putStateMachine(ks, id, configName, stateMachine)
+	})
+}
+
+func (csm *keyspaceStore) TxPutStateMachine(ctx context.Context, id string, fsm *protos.FiniteStateMachine) StoreErr {
+	if fsm == nil {
+		return InvalidDataError("nil statemachine")
+	}
+	configName := strings.Split(fsm.ConfigId, api.ConfigurationVersionSeparator)[0]
+	return csm.update(ctx, NewKeyForMachine(id, configName), func(ks keyspace) error {
+		cfg, err := csm.getConfig(ks, fsm.ConfigId)
+		if err != nil {
+			return err
+		}
+		from, oldState := cfg, ""
+		if old, err := csm.getStateMachine(ks, id, cfg.Name); err == nil {
+			oldState = old.GetState()
+			if from, err = csm.getConfig(ks, old.ConfigId); IsNotFoundErr(err) {
+				from = cfg
+			} else if err != nil {
+				return err
+			}
+		} else if !IsNotFoundErr(err) {
+			return err
+		}
+		if err := csm.putStateMachine(ks, id, cfg.Name, fsm); err != nil {
+			return err
+		}
+		csm.updateState(ks, cfg.Name, id, oldState, fsm.GetState())
+		csm.moveTimers(ks, id, from, oldState, cfg, fsm.GetState())
+		return nil
+	})
+}
+
+func (csm *keyspaceStore) GetAllInState(ctx context.Context, cfg string, state string) []string {
+	csm.logger.Debug().Msgf("Looking up all FSMs [%s] in DB with state `%s`", cfg, state)
+	return csm.members(ctx, NewKeyForMachinesByState(cfg, state))
+}
+
+func (csm *keyspaceStore) GetInStatePage(ctx context.Context, cfg string, state string, req PageRequest) (*Page, StoreErr) {
+	csm.logger.Debug().Msgf("Looking up a page of FSMs [%s] in DB with state `%s`", cfg, state)
+	return csm.page(ctx, NewKeyForMachinesByState(cfg, state), req)
+}
+
+func (csm *keyspaceStore) ScanStateMachines(ctx context.Context, cfgName string, filter ScanFilter, fn ScanFunc) StoreErr {
+	csm.logger.Debug().Msgf("Scanning all FSMs [%s] in DB", cfgName)
+	key := NewKeyForMachinesIndex(cfgName)
+	var ids []string
+	err := csm.view(ctx, key, func(ks keyspace) error {
+		for id, updated := range ks.zScores(key) {
+			if filter.updatedBetween(updated) {
+				ids = append(ids, id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(ids)
+	// The FSMs are read a page at a time, so that `fn` is never called within a transaction.
+	for start := 0; start < len(ids); start += DefaultPageSize {
+		end := min(start+DefaultPageSize, len(ids))
+		var found []string
+		var fsms []*protos.FiniteStateMachine
+		err = csm.view(ctx, key, func(ks keyspace) error {
+			for _, id := range ids[start:end] {
+				fsm, err := csm.getStateMachine(ks, id, cfgName)
+				if IsNotFoundErr(err) {
+					// The FSM was removed after the index was read.
+					continue
+				} else if err != nil {
+					return err
+				}
+				if filter.matches(cfgName, fsm) {
+					found = append(found, id)
+					fsms = append(fsms, fsm)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, id := range found {
+			if err = fn(id, fsms[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (csm *keyspaceStore) UpdateState(ctx context.Context, cfgName string, id string, oldState string, newState string) StoreErr {
+	return csm.update(ctx, NewKeyForMachine(id, cfgName), func(ks keyspace) error {
+		csm.updateState(ks, cfgName, id, oldState, newState)
+		return nil
+	})
+}
+
+func (csm *keyspaceStore) TxProcessEvent(ctx context.Context, id, cfgName string, evt *protos.Event) (*api.ConfiguredStateMachine, StoreErr) {
+	var result *api.ConfiguredStateMachine
+	var rejected error
+	err := csm.update(ctx, NewKeyForMachine(id, cfgName), func(ks keyspace) error {
+		// Events with no ID cannot be deduplicated.
+		var processedKey string
+		if csm.DedupWindow > 0 && evt.GetEventId() != "" {
+			processedKey = NewKeyForProcessedEvent(evt.GetEventId(), id, cfgName)
+			if data, found := ks.get(processedKey); found {
+				csm.logger.Debug().Msgf("event [%s] was already processed by FSM [%s#%s]",
+					evt.GetEventId(), cfgName, id)
+				return duplicateEventError(evt.GetEventId(), data)
+			}
+		}
+		fsm, err := csm.getStateMachine(ks, id, cfgName)
+		if err != nil {
+			csm.logger.Debug().Msgf("error looking up FSM %s: %v", id, err)
+			return err
+		}
+		cfg, err := csm.getConfig(ks, fsm.ConfigId)
+		if err != nil {
+			return err
+		}
+		oldState := fsm.GetState()
+		timer, fired := api.FiredTimer(cfg, oldState, evt)
+		sm := &api.ConfiguredStateMachine{Config: cfg, FSM: fsm}
+		effects, err := sm.ProcessEvent(evt)
+		if err != nil {
+			// The rejection is recorded, and the FSM is left unchanged.
+			if processedKey != "" {
+				if err := csm.putProto(ks, processedKey, processedOutcome(id, cfgName, err),
+					csm.DedupWindow); err != nil {
+					return err
+				}
+			}
+			if fired {
+				// The FSM is unchanged, so the Timer's Event would be rejected again.
+				ks.zRem(NewKeyForTimers(cfgName), NewTimerMember(id, timer.State, timer.Event))
+			}
+			rejected = err
+			return nil
+		}
+		// Everything is encoded before changing the keyspace, which is left untouched
+		// if this fails.
+		data, err := proto.Marshal(fsm)
+		if err != nil {
+			csm.logger.Error().Err(err).Msg("cannot convert proto to bytes")
+			return InvalidDataError(err.Error())
+		}
+		outcome, err := proto.Marshal(processedOutcome(id, cfgName, nil))
+		if err != nil {
+			return InvalidDataError(err.Error())
+		}
+		actions := make([][]byte, len(effects.Actions))
+		for i, action := range effects.Actions {
+			action.FsmId = id
+			if actions[i], err = json.Marshal(action); err != nil {
+				return InvalidDataError(err.Error())
+			}
+		}
+		ks.set(NewKeyForMachine(id, cfgName), data, NeverExpire)
+		csm.indexMachine(ks, cfgName, id)
+		if processedKey != "" {
+			ks.set(processedKey, outcome, csm.DedupWindow)
+		}
+		if fired {
+			ks.zRem(NewKeyForTimers(cfgName), NewTimerMember(id, timer.State, timer.Event))
+		}
+		for _, state := range effects.Exited {
+			for _, timer := range api.Timers(cfg, state) {
+				ks.zRem(NewKeyForTimers(cfgName), NewTimerMember(id, timer.State, timer.Event))
+			}
+		}
+		for _, state := range effects.Entered {
+			csm.scheduleTimers(ks, cfgName, id, api.Timers(cfg, state))
+		}
+		now := time.Now().UnixMilli()
+		for i, action := range effects.Actions {
+			ks.set(NewKeyForAction(action.Id, cfgName), actions[i], NeverExpire)
+			// The fractional part keeps the Actions in the order they were caused.
+			ks.zAdd(NewKeyForActions(cfgName), action.Id, float64(now)+float64(i)/1000)
+		}
+		if sm.IsCompleted() {
+			csm.logger.Trace().Msgf("FSM [%s] completed in state %s", id, fsm.State)
+			ks.zAdd(NewKeyForCompleted(cfgName), id, float64(time.Now().Unix()))
+		}
+		csm.updateState(ks, cfgName, id, oldState, fsm.GetState())
+		result = sm
+		return nil
+	})
+	if err == nil {
+		err = rejected
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (csm *keyspaceStore) PurgeCompleted(ctx context.Context, cfgName string, retention time.Duration) (int, StoreErr) {
+	key := NewKeyForCompleted(cfgName)
+	before := time.Now().Add(-retention).Unix()
+	purged := 0
+	err := csm.update(ctx, key, func(ks keyspace) error {
+		for _, id := range ks.zRangeByScore(key, float64(before), 0) {
+			fsm, err := csm.getStateMachine(ks, id, cfgName)
+			if err != nil && !IsNotFoundErr(err) {
+				return err
+			}
+			ks.del(NewKeyForMachine(id, cfgName))
+			if fsm != nil {
+				for _, state := range api.Ancestors(fsm.GetState()) {
+					ks.sRem(NewKeyForMachinesByState(cfgName, state), id)
+				}
+			}
+			ks.zRem(NewKeyForMachinesIndex(cfgName), id)
+			ks.zRem(key, id)
+			purged++
+		}
+		return nil
+	})
+	if err != nil {
+		csm.logger.Error().Err(err).Msgf("could not purge FSMs [%s]", cfgName)
+		return 0, err
+	}
+	csm.logger.Debug().Msgf("purged %d completed FSMs [%s]", purged, cfgName)
+	return purged, nil
+}
+
+func (csm *keyspaceStore) MigrateStateMachine(ctx context.Context, id string, migration *api.Migration) (bool, StoreErr) {
+	cfgName := migration.From.Name
+	migrated := false
+	err := csm.update(ctx, NewKeyForMachine(id, cfgName), func(ks keyspace) error {
+		fsm, err := csm.getStateMachine(ks, id, cfgName)
+		if err != nil {
+			return err
+		}
+		if !migration.Applies(fsm) {
+			return nil
+		}
+		oldState := fsm.GetState()
+		if err = migration.Apply(fsm); err != nil {
+			return err
+		}
+		if err = csm.putStateMachine(ks, id, cfgName, fsm); err != nil {
+			return err
+		}
+		csm.updateState(ks, cfgName, id, oldState, fsm.GetState())
+		csm.moveTimers(ks, id, migration.From, oldState, migration.To, fsm.GetState())
+		migrated = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if migrated {
+		csm.logger.Debug().Msgf("migrated FSM [%s#%s] to %s", cfgName, id,
+			api.GetVersionId(migration.To))
+	}
+	return migrated, nil
+}
+
+func (csm *keyspaceStore) VerifyStateMachine(ctx context.Context, id, cfgName string, repair bool) (*Verification, StoreErr) {
+	var result *Verification
+	err := csm.update(ctx, NewKeyForMachine(id, cfgName), func(ks keyspace) error {
+		fsm, err := csm.getStateMachine(ks, id, cfgName)
+		if err != nil {
+			return err
+		}
+		cfg, err := csm.getConfig(ks, fsm.ConfigId)
+		if err != nil {
+			return err
+		}
+		result = &Verification{Id: id, State: fsm.GetState()}
+		state := fsm.GetState()
+		replayed, err := api.Replay(cfg, fsm.GetHistory())
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			if state != replayed.FSM.GetState() {
+				result.Replayed = replayed.FSM.GetState()
+				state = result.Replayed
+			}
+			data, _ := api.GetData(fsm)
+			replayedData, _ := api.GetData(replayed.FSM)
+			result.Data = !proto.Equal(data, replayedData)
+		}
+		// See RedisStore.VerifyStateMachine
+		expected := make(map[string]bool)
+		for _, s := range api.Ancestors(state) {
+			expected[s] = true
+		}
+		for _, s := range csm.allStates(ks, cfgName) {
+			isMember := ks.sIsMember(NewKeyForMachinesByState(cfgName, s), id)
+			if isMember && !expected[s] {
+				result.ExtraIn = append(result.ExtraIn, s)
+			} else if !isMember && expected[s] {
+				result.MissingFrom = append(result.MissingFrom, s)
+			}
+		}
+		if !repair || result.IsConsistent() || result.Error != "" {
+			return nil
+		}
+		if result.Replayed != "" || result.Data {
+			err = csm.putStateMachine(ks, id, cfgName, replayed.FSM)
+			if err != nil {
+				return err
+			}
+		}
+		for _, s := range result.ExtraIn {
+			ks.sRem(NewKeyForMachinesByState(cfgName, s), id)
+		}
+		for _, s := range result.MissingFrom {
+			ks.sAdd(NewKeyForMachinesByState(cfgName, s), id)
+		}
+		if result.Replayed != "" {
+			csm.moveTimers(ks, id, cfg, result.State, cfg, result.Replayed)
+		}
+		result.Repaired = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Repaired {
+		csm.logger.Info().Msgf("repaired FSM [%s#%s]", cfgName, id)
+	}
+	return result, nil
+}
+
+func (csm *keyspaceStore) RollbackStateMachine(ctx context.Context, id, cfgName string, steps int) (*api.ConfiguredStateMachine, StoreErr) {
+	var result *api.ConfiguredStateMachine
+	err := csm.update(ctx, NewKeyForMachine(id, cfgName), func(ks keyspace) error {
+		fsm, err := csm.getStateMachine(ks, id, cfgName)
+		if err != nil {
+			return err
+		}
+		cfg, err := csm.getConfig(ks, fsm.ConfigId)
+		if err != nil {
+			return err
+		}
+		oldState := fsm.GetState()
+		sm := &api.ConfiguredStateMachine{Config: cfg, FSM: fsm}
+		if _, err = sm.Rollback(steps, api.RollbackOriginator); err != nil {
+			return err
+		}
+		if err = csm.putStateMachine(ks, id, cfgName, fsm); err != nil {
+			return err
+		}
+		csm.updateState(ks, cfgName, id, oldState, fsm.GetState())
+		csm.moveTimers(ks, id, cfg, oldState, cfg, fsm.GetState())
+		result = sm
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	csm.logger.Debug().Msgf("rolled back FSM [%s#%s] by %d steps, to state %s", cfgName, id,
+		steps, result.FSM.GetState())
+	return result, nil
+}
+
+func (csm *keyspaceStore) DeleteStateMachine(ctx context.Context, id string, cfgName string) StoreErr {
+	err := csm.update(ctx, NewKeyForMachine(id, cfgName), func(ks keyspace) error {
+		fsm, err := csm.getStateMachine(ks, id, cfgName)
+		if err != nil {
+			return err
+		}
+		// The FSM's Configuration may have been forcibly deleted, in which case there are no
+		// timers to cancel.
+		cfg, err := csm.getConfig(ks, fsm.ConfigId)
+		if err != nil && !IsNotFoundErr(err) {
+			return err
+		}
+		ks.del(NewKeyForMachine(id, cfgName))
+		for _, state := range api.Ancestors(fsm.GetState()) {
+			ks.sRem(NewKeyForMachinesByState(cfgName, state), id)
+			if cfg == nil {
+				continue
+			}
+			for _, timer := range api.Timers(cfg, state) {
+				ks.zRem(NewKeyForTimers(cfgName), NewTimerMember(id, timer.State, timer.Event))
+			}
+		}
+		ks.zRem(NewKeyForMachinesIndex(cfgName), id)
+		ks.zRem(NewKeyForCompleted(cfgName), id)
+		return nil
+	})
+	if err != nil {
+		csm.logger.Error().Err(err).Msgf("could not delete FSM [%s#%s]", cfgName, id)
+		return err
+	}
+	csm.logger.Debug().Msgf("deleted FSM [%s#%s]", cfgName, id)
+	return nil
+}
+
+/////// TimerStore implementation
+
+func (csm *keyspaceStore) ScheduleTimers(ctx context.Context, cfgName string, id string, timers []api.Timer) StoreErr {
+	if len(timers) == 0 {
+		return nil
+	}
+	return csm.update(ctx, NewKeyForTimers(cfgName), func(ks keyspace) error {
+		csm.scheduleTimers(ks, cfgName, id, timers)
+		return nil
+	})
+}
+
+func (csm *keyspaceStore) ClaimDueTimers(ctx context.Context, cfgName string, now time.Time,
+	lease time.Duration) ([]DueTimer, StoreErr) {
+	key := NewKeyForTimers(cfgName)
+	leases := NewKeyForTimerLeases(cfgName)
+	var due []DueTimer
+	err := csm.update(ctx, key, func(ks keyspace) error {
+		leased := ks.zScores(leases)
+		for member, expiry := range leased {
+			if expiry <= float64(now.UnixMilli()) {
+				ks.zRem(leases, member)
+				delete(leased, member)
+			}
+		}
+		scores := ks.zScores(key)
+		for _, member := range ks.zRangeByScore(key, float64(now.UnixMilli()), 0) {
+			id, state, event, ok := ParseTimerMember(member)
+			if !ok {
+				csm.logger.Error().Msgf("invalid timer %s in %s, removed", member, key)
+				ks.zRem(key, member)
+				continue
+			}
+			if _, found := leased[member]; found {
+				continue
+			}
+			ks.zAdd(leases, member, float64(now.Add(lease).UnixMilli()))
+			due = append(due, DueTimer{Id: id, State: state, Event: event,
+				Due: time.UnixMilli(int64(scores[member]))})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return due, nil
+}
+
+func (csm *keyspaceStore) DiscardTimer(ctx context.Context, cfgName string, timer DueTimer) StoreErr {
+	key := NewKeyForTimers(cfgName)
+	member := NewTimerMember(timer.Id, timer.State, timer.Event)
+	return csm.update(ctx, key, func(ks keyspace) error {
+		if score, found := ks.zScores(key)[member]; found && int64(score) == timer.Due.UnixMilli() {
+			ks.zRem(key, member)
+			ks.zRem(NewKeyForTimerLeases(cfgName), member)
+		}
+		return nil
+	})
+}
+
+/////// ActionStore implementation
+
+func (csm *keyspaceStore) ClaimActions(ctx context.Context, cfgName string, count int, lease time.Duration) ([]*api.Action, StoreErr) {
+	key := NewKeyForActions(cfgName)
+	now := time.Now()
+	var actions []*api.Action
+	err := csm.update(ctx, key, func(ks keyspace) error {
+		for _, id := range ks.zRangeByScore(key, float64(now.UnixMilli()), count) {
+			data, found := ks.get(NewKeyForAction(id, cfgName))
+			if !found {
+				ks.zRem(key, id)
+				continue
+			}
+			ks.zAdd(key, id, float64(now.Add(lease).UnixMilli()))
+			var action api.Action
+			if err := json.Unmarshal(data, &action); err != nil {
+				csm.logger.Error().Err(err).Msgf("invalid action %s, ignored", id)
+				continue
+			}
+			actions = append(actions, &action)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return actions, nil
+}
+
+func (csm *keyspaceStore) AckAction(ctx context.Context, cfgName string, id string) StoreErr {
+	return csm.update(ctx, NewKeyForAction(id, cfgName), func(ks keyspace) error {
+		ks.zRem(NewKeyForActions(cfgName), id)
+		ks.del(NewKeyForAction(id, cfgName))
+		return nil
+	})
+}
+
+/////// EventStore implementation
+
+func (csm *keyspaceStore) GetEvent(ctx context.Context, id string, cfg string) (*protos.Event, StoreErr) {
+	key := NewKeyForEvent(id, cfg)
+	var event protos.Event
+	err := csm.view(ctx, key, func(ks keyspace) error {
+		return csm.getProto(ks, key, &event)
+	})
+	if err != nil {
+		csm.logger.Error().Err(err).Msgf("cannot retrieve event %s", key)
+		return nil, err
+	}
+	return &event, nil
+}
+
+func (csm *keyspaceStore) PutEvent(ctx context.Context, event *protos.Event, cfg string, ttl time.Duration) StoreErr {
+	if event == nil {
+		return InvalidDataError("nil event")
+	}
+	return csm.update(ctx, NewKeyForEvent(event.EventId, cfg), func(ks keyspace) error {
+		return csm.putProto(ks, NewKeyForEvent(event.EventId, cfg), event, ttl)
+	})
+}
+
+func (csm *keyspaceStore) AddEventOutcome(ctx context.Context, id string, cfg string, response *protos.EventOutcome, ttl time.Duration) StoreErr {
+	if response == nil {
+		return InvalidDataError("nil response")
+	}
+	return csm.update(ctx, NewKeyForOutcome(id, cfg), func(ks keyspace) error {
+		return csm.putProto(ks, NewKeyForOutcome(id, cfg), response, ttl)
+	})
+}
+
+func (csm *keyspaceStore) GetOutcomeForEvent(ctx context.Context, id string, cfg string) (*protos.EventOutcome, StoreErr) {
+	key := NewKeyForOutcome(id, cfg)
+	var outcome protos.EventOutcome
+	err := csm.view(ctx, key, func(ks keyspace) error {
+		return csm.getProto(ks, key, &outcome)
+	})
+	if err != nil {
+		csm.logger.Error().Err(err).Msgf("cannot retrieve outcome for event %s", key)
+		return nil, err
+	}
+	return &outcome, nil
+}
+
+func (csm *keyspaceStore) DeleteEvent(ctx context.Context, id string, cfg string) StoreErr {
+	key := NewKeyForEvent(id, cfg)
+	err := csm.update(ctx, key, func(ks keyspace) error {
+		_, eventFound := ks.get(key)
+		_, outcomeFound := ks.get(NewKeyForOutcome(id, cfg))
+		if !eventFound && !outcomeFound {
+			return NotFoundError(key)
+		}
+		ks.del(key)
+		ks.del(NewKeyForOutcome(id, cfg))
+		return nil
+	})
+	if err != nil {
+		csm.logger.Error().Err(err).Msgf("cannot delete event %s", key)
+		return err
+	}
+	csm.logger.Debug().Msgf("deleted event %s", key)
+	return nil
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package storage
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("In-memory keyspace", func() {
+	var m *memoryKeyspace
+	BeforeEach(func() {
+		m = &memoryKeyspace{
+			values:     make(map[string]memoryValue),
+			sets:       make(map[string]map[string]bool),
+			sortedSets: make(map[string]map[string]float64),
+		}
+		Ω(m.update(func(ks keyspace) error {
+			ks.set("value", []byte("old"), NeverExpire)
+			ks.set("removed", []byte("old"), NeverExpire)
+			ks.sAdd("set", "old")
+			ks.zAdd("zset", "old", 1)
+			ks.zAdd("zset", "changed", 2)
+			return nil
+		})).To(Succeed())
+	})
+	It("rolls back the changes of failed transactions", func() {
+		failed := errors.New("failed")
+		Ω(m.update(func(ks keyspace) error {
+			ks.set("value", []byte("new"), NeverExpire)
+			ks.set("added", []byte("new"), NeverExpire)
+			ks.del("removed")
+			ks.sRem("set", "old")
+			ks.sAdd("set", "new")
+			ks.sAdd("new-set", "new")
+			ks.zRem("zset", "old")
+			ks.zAdd("zset", "changed", 3)
+			ks.zAdd("zset", "new", 4)
+			return failed
+		})).To(MatchError(failed))
+		Ω(m.view(func(ks keyspace) error {
+			value, found := ks.get("value")
+			Ω(found).To(BeTrue())
+			Ω(string(value)).To(Equal("old"))
+			_, found = ks.get("removed")
+			Ω(found).To(BeTrue())
+			_, found = ks.get("added")
+			Ω(found).To(BeFalse())
+			Ω(ks.sMembers("set")).To(ConsistOf("old"))
+			Ω(ks.sMembers("new-set")).To(BeEmpty())
+			Ω(ks.zScores("zset")).To(Equal(map[string]float64{"old": 1, "changed": 2}))
+			return nil
+		})).To(Succeed())
+		Ω(m.sets).ToNot(HaveKey("new-set"))
+	})
+	It("keeps the changes of successful transactions", func() {
+		Ω(m.update(func(ks keyspace) error {
+			ks.del("removed")
+			ks.zAdd("zset", "changed", 3)
+			return nil
+		})).To(Succeed())
+		Ω(m.view(func(ks keyspace) error {
+			_, found := ks.get("removed")
+			Ω(found).To(BeFalse())
+			Ω(ks.zScores("zset")).To(HaveKeyWithValue("changed", 3.0))
+			return nil
+		})).To(Succeed())
+	})
+})
@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	zlog "github.com/rs/zerolog/log"
+)
+
+// memoryValue is a value kept by the InMemoryStore, which expires at `expires`, unless zero.
+type memoryValue struct {
+	data    []byte
+	expires time.Time
+}
+
+// memoryKeyspace is a keyspace kept in memory, whose transactions all hold the same lock.
+//
+// Every change records how to undo it, so that a failed transaction is rolled back.
+type memoryKeyspace struct {
+	lock       sync.Mutex
+	values     map[string]memoryValue
+	sets       map[string]map[string]bool
+	sortedSets map[string]map[string]float64
+	undo       []func()
+}
+
+func (m *memoryKeyspace) view(fn func(ks keyspace) error) error {
+	return m.update(fn)
+}
+
+func (m *memoryKeyspace) update(fn func(ks keyspace) error) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.undo = nil
+	err := fn(m)
+	if err != nil {
+		// The changes are undone in reverse order; undoing them records more changes,
+		// which are discarded.
+		undo := m.undo
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+	m.undo = nil
+	return err
+}
+
+// restore records the change of the value for `key`, so that it is restored if the
+// transaction fails.
+func (m *memoryKeyspace) restore(key string) {
+	value, found := m.values[key]
+	m.undo = append(m.undo, func() {
+		if found {
+			m.values[key] = value
+		} else {
+			delete(m.values, key)
+		}
+	})
+}
+
+func (m *memoryKeyspace) get(key string) ([]byte, bool) {
+	value, found := m.values[key]
+	if !found {
+		return nil, false
+	}
+	if !value.expires.IsZero() && time.Now().After(value.expires) {
+		m.del(key)
+		return nil, false
+	}
+	return value.data, true
+}
+
+func (m *memoryKeyspace) set(key string, data []byte, ttl time.Duration) {
+	value := memoryValue{data: data}
+	if ttl > 0 {
+		value.expires = time.Now().Add(ttl)
+	}
+	m.restore(key)
+	m.values[key] = value
+}
+
+func (m *memoryKeyspace) del(key string) {
+	m.restore(key)
+	delete(m.values, key)
+}
+
+func (m *memoryKeyspace) sAdd(key string, member string) {
+	if !m.sIsMember(key, member) {
+		m.undo = append(m.undo, func() { m.sRem(key, member) })
+	}
+	set, found := m.sets[key]
+	if !found {
+		set = make(map[string]bool)
+		m.sets[key] = set
+	}
+	set[member] = true
+}
+
+func (m *memoryKeyspace) sRem(key string, member string) {
+	if set, found := m.sets[key]; found {
+		if set[member] {
+			m.undo = append(m.undo, func() { m.sAdd(key, member) })
+		}
+		delete(set, member)
+		if len(set) == 0 {
+			delete(m.sets, key)
+		}
+	}
+}
+
+func (m *memoryKeyspace) sIsMember(key string, member string) bool {
+	return m.sets[key][member]
+}
+
+func (m *memoryKeyspace) sMembers(key string) []string {
+	members := make([]string, 0, len(m.sets[key]))
+	for member := range m.sets[key] {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func (m *memoryKeyspace) zAdd(key string, member string, score float64) {
+	if previous, found := m.sortedSets[key][member]; found {
+		m.undo = append(m.undo, func() { m.zAdd(key, member, previous) })
+	} else {
+		m.undo = append(m.undo, func() { m.zRem(key, member) })
+	}
+	set, found := m.sortedSets[key]
+	if !found {
+		set = make(map[string]float64)
+		m.sortedSets[key] = set
+	}
+	set[member] = score
+}
+
+func (m *memoryKeyspace) zRem(key string, member string) bool {
+	set, found := m.sortedSets[key]
+	if !found {
+		return false
+	}
+	score, found := set[member]
+	if !found {
+		return false
+	}
+	m.undo = append(m.undo, func() { m.zAdd(key, member, score) })
+	delete(set, member)
+	if len(set) == 0 {
+		delete(m.sortedSets, key)
+	}
+	return true
+}
+
+func (m *memoryKeyspace) zScores(key string) map[string]float64 {
+	scores := make(map[string]float64, len(m.sortedSets[key]))
+	for member, score := range m.sortedSets[key] {
+		scores[member] = score
+	}
+	return scores
+}
+
+func (m *memoryKeyspace) zRangeByScore(key string, max float64, count int) []string {
+	return rangeByScore(m.sortedSets[key], max, count)
+}
+
+// InMemoryStore is a StoreManager which keeps all the data in memory, using the same keys
+// (see keys.go) as the RedisStore for its values, SETs and sorted SETs.
+//
+// It is safe for concurrent use: every method holds a lock for its whole duration, which
+// makes all of them (and, in particular, TxProcessEvent) transactional.
+// All the data is lost when the process exits: it is meant for tests, local development,
+// and for embedding the engine.
+type InMemoryStore struct {
+	keyspaceStore
+}
+
+// Health always succeeds, as there is no server to connect to.
+func (csm *InMemoryStore) Health() StoreErr {
+	return nil
+}
+
+// NewInMemoryStore creates a new, empty, StoreManager which keeps all the data in memory
+// (see InMemoryStore).
+func NewInMemoryStore() StoreManager {
+	return &InMemoryStore{
+		keyspaceStore: keyspaceStore{
+			logger: zlog.With().Str("logger", "memory").Logger(),
+			backend: &memoryKeyspace{
+				values:     make(map[string]memoryValue),
+				sets:       make(map[string]map[string]bool),
+				sortedSets: make(map[string]map[string]float64),
+			},
+			Timeout:     DefaultTimeout,
+			DedupWindow: DefaultDedupWindow,
+		},
+	}
+}
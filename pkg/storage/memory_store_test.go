@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package storage_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/massenz/go-statemachine/pkg/api"
+	storage2 "github.com/massenz/go-statemachine/pkg/storage"
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+var _ = Describe("In-memory Store", func() {
+	// See TestConformance for the tests shared with the other stores.
+	var store storage2.StoreManager
+	BeforeEach(func() {
+		store = storage2.NewInMemoryStore()
+		Ω(store.PutConfig(bkgnd, &protos.Configuration{
+			Name:          cfgName,
+			Version:       "v4",
+			States:        []string{"in_transit", "delivered"},
+			StartingState: "in_transit",
+			Transitions: []*protos.Transition{
+				{From: "in_transit", Event: "scan / incr(scans)"},
+				{From: "in_transit", To: "delivered", Event: "deliver / notify"},
+				{From: "delivered", To: api.FinalState},
+			},
+		})).To(Succeed())
+		storeSomeFSMs(store, 3)
+	})
+	It("returns copies of the stored values", func() {
+		fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+		Ω(err).ToNot(HaveOccurred())
+		fsm.State = "delivered"
+		fsm, err = store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(fsm.State).To(Equal("in_transit"))
+	})
+})
@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package storage
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/massenz/go-statemachine/pkg/api"
+)
+
+const (
+	DefaultMigrationBatchSize = 100
+
+	// migrationCursorSeparator separates the components of a Migrator's `Cursor`.
+	migrationCursorSeparator = ":"
+)
+
+// A Migrator moves, in batches, all the FSMs configured with the original Configuration
+// of a Migration (see api.Migration) to its target one.
+//
+// FSMs are considered one Page (see GetInStatePage) of a `state` SET at a time: the
+// (opaque) `Cursor` is the position of the next Page, and can be saved to resume an
+// interrupted migration with a new Migrator, for the same `state`; as FSMs already
+// migrated are skipped, running a migration again is always safe.
+type Migrator struct {
+	Store     FSMStore
+	Migration *api.Migration
+	BatchSize int
+	Cursor    string
+}
+
+func NewMigrator(store FSMStore, migration *api.Migration) *Migrator {
+	return &Migrator{
+		Store:     store,
+		Migration: migration,
+		BatchSize: DefaultMigrationBatchSize,
+	}
+}
+
+// Next migrates the next batch of FSMs which are in `state` (which may be a compound
+// state) or, if `state` is empty, in any state; it returns the IDs of the FSMs migrated,
+// and whether there are more FSMs left to consider.
+//
+// As with Pages, a batch may contain (a few) more, or fewer, FSMs than the `BatchSize`.
+func (m *Migrator) Next(ctx context.Context, state string) ([]string, bool, StoreErr) {
+	states := m.states(state)
+	i, token, err := m.position()
+	if err != nil || i >= len(states) {
+		return nil, false, err
+	}
+	page, err := m.Store.GetInStatePage(ctx, m.Migration.From.Name, states[i],
+		PageRequest{Token: token, Size: m.BatchSize})
+	if err != nil {
+		return nil, true, err
+	}
+	var migrated []string
+	for _, id := range page.Items {
+		ok, err := m.Store.MigrateStateMachine(ctx, id, m.Migration)
+		if err != nil {
+			return migrated, true, err
+		}
+		if ok {
+			migrated = append(migrated, id)
+		}
+	}
+	if page.NextToken == "" {
+		i++
+	}
+	m.Cursor = strconv.Itoa(i) + migrationCursorSeparator + page.NextToken
+	return migrated, i < len(states), nil
+}
+
+// Run migrates all the FSMs in `state` (or in any state, if empty), one batch at a time,
+// and returns how many were migrated.
+func (m *Migrator) Run(ctx context.Context, state string) (int, StoreErr) {
+	count := 0
+	for {
+		migrated, more, err := m.Next(ctx, state)
+		count += len(migrated)
+		if err != nil || !more {
+			return count, err
+		}
+	}
+}
+
+// states returns the `state` SETs whose FSMs are considered: `state` itself or, if empty,
+// the original Configuration's top-level states (which include all the nested ones).
+func (m *Migrator) states(state string) []string {
+	if state != "" {
+		return []string{state}
+	}
+	var states []string
+	for _, s := range m.Migration.From.States {
+		if api.Parent(s) == "" {
+			states = append(states, s)
+		}
+	}
+	return states
+}
+
+// position parses the `Cursor` into the index of the `state` SET being considered, and
+// the token of its next Page.
+func (m *Migrator) position() (int, string, StoreErr) {
+	if m.Cursor == "" {
+		return 0, "", nil
+	}
+	index, token, found := strings.Cut(m.Cursor, migrationCursorSeparator)
+	i, err := strconv.Atoi(index)
+	if !found || err != nil || i < 0 {
+		return 0, "", InvalidPageTokenError(m.Cursor)
+	}
+	return i, token, nil
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package storage
+
+import (
+	"encoding/base64"
+)
+
+// DefaultPageSize is the number of items returned in a Page, unless the PageRequest
+// specifies otherwise.
+const DefaultPageSize = 100
+
+// A PageRequest asks for the Page of items which follows the one that returned the `Token`
+// (or for the first one, if the `Token` is empty).
+//
+// `Size` is a hint, as is the `COUNT` of Redis' `SSCAN`: a Page may contain (a few) more,
+// or fewer, items than that; if not positive, DefaultPageSize is used.
+type PageRequest struct {
+	Token string
+	Size  int
+}
+
+// A Page is one of the pages of the members of a SET, which can be iterated by asking for
+// the next one with its `NextToken`, until it is empty.
+//
+// Items added to, or removed from, the SET while it is being iterated may or may not be
+// returned, and (only for a RedisStore) items may be returned in more than one Page.
+type Page struct {
+	Items     []string `json:"ids"`
+	NextToken string   `json:"next_page_token,omitempty"`
+}
+
+// size returns the number of items the request asks for.
+func (r PageRequest) size() int {
+	if r.Size <= 0 {
+		return DefaultPageSize
+	}
+	return r.Size
+}
+
+// encodePageToken returns the opaque token for the `position` (which only the store that
+// returned it knows how to interpret) at which the next Page starts.
+func encodePageToken(position string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(position))
+}
+
+// decodePageToken is the inverse of encodePageToken.
+func decodePageToken(token string) (string, StoreErr) {
+	position, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(position) == 0 {
+		return "", InvalidPageTokenError(token)
+	}
+	return string(position), nil
+}
@@ -12,14 +12,17 @@ package storage
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/rs/zerolog"
 	zlog "github.com/rs/zerolog/log"
 	"google.golang.org/protobuf/proto"
-	"math/rand"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,112 +35,227 @@ const (
 	DefaultRedisDb      = 0
 	DefaultMaxRetries   = 3
 	DefaultTimeout      = 200 * time.Millisecond
+	DefaultDedupWindow  = 24 * time.Hour
 	ReturningItemsFmt   = "Returning %d items"
 	NoConfigurationsFmt = "Could not retrieve configurations: %s"
 )
 
+// claimActionsScript atomically looks up the Actions which can be claimed, and pushes them
+// back by the lease duration, so that concurrent servers do not claim them too.
+//
+// KEYS[1]: the Actions' sorted SET; ARGV[1]: now, ARGV[2]: max count, ARGV[3]: lease expiry.
+var claimActionsScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, id in ipairs(ids) do
+	redis.call('ZADD', KEYS[1], ARGV[3], id)
+end
+return ids
+`)
+
+// claimTimersScript atomically looks up the timers which are due, and are not leased, and
+// leases them, so that concurrent servers do not claim them too; the timers keep their score,
+// which is returned along with them.
+//
+// KEYS[1]: the timers, KEYS[2]: their leases; ARGV[1]: now, ARGV[2]: lease expiry.
+var claimTimersScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'WITHSCORES')
+local claimed = {}
+for i = 1, #due, 2 do
+	if not redis.call('ZSCORE', KEYS[2], due[i]) then
+		redis.call('ZADD', KEYS[2], ARGV[2], due[i])
+		table.insert(claimed, due[i])
+		table.insert(claimed, due[i + 1])
+	end
+end
+return claimed
+`)
+
+// discardTimerScript removes a timer (and its lease) unless its score changed, because it
+// was restarted.
+//
+// KEYS[1]: the timers, KEYS[2]: their leases; ARGV[1]: the timer, ARGV[2]: its score.
+var discardTimerScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if score and tonumber(score) == tonumber(ARGV[2]) then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	redis.call('ZREM', KEYS[2], ARGV[1])
+end
+return 0
+`)
+
 type RedisStore struct {
-	logger     zerolog.Logger
-	client     redis.UniversalClient
-	Timeout    time.Duration
-	MaxRetries int
+	logger zerolog.Logger
+	client redis.UniversalClient
+	// isCluster is set when the client is connected to a Redis Cluster (see keyName).
+	isCluster bool
+	Timeout   time.Duration
+	// Retry is the policy for retrying the operations which fail with transient errors.
+	Retry RetryPolicy
+	// DedupWindow is how long the IDs of processed Events are kept, to detect duplicates.
+	DedupWindow time.Duration
 }
 
 /////// Internal methods
 
-// get abstracts away the common functionality of looking for a key in Redis,
-// with a given timeout and a number of retries.
-func (csm *RedisStore) get(key string, value proto.Message) StoreErr {
-	attemptsLeft := csm.MaxRetries
-	csm.logger.Trace().Msgf("Looking up key `%s` (Max retries: %d)", key, attemptsLeft)
-	var cancel context.CancelFunc
-	defer func() {
-		if cancel != nil {
-			cancel()
-		}
-	}()
-	for {
-		var ctx context.Context
-		ctx, cancel = context.WithTimeout(context.Background(), csm.Timeout)
-		attemptsLeft--
-		cmd := csm.client.Get(ctx, key)
-		data, err := cmd.Bytes()
-		if err == redis.Nil {
-			// The key isn't there, no point in retrying
-			csm.logger.Debug().Msgf("Key `%s` not found", key)
-			cancel()
-			return NotFoundError(key)
-		} else if err != nil {
-			if ctx.Err() == context.DeadlineExceeded {
-				// The error here may be recoverable, so we'll keep trying until we run out of attempts
-				csm.logger.Error().Err(err).Msg("redis get timeout")
-				if attemptsLeft == 0 {
-					csm.logger.Error().Msg("max retries reached, giving up")
-					cancel()
-					return err
-				}
-				csm.logger.Trace().Msgf("retrying after timeout, attempts left: %d", attemptsLeft)
-				csm.wait()
-			} else {
-				// This is a different error, we'll just return it
-				csm.logger.Error().Err(err).Msg("redis get error")
-				cancel()
-				return GenericStoreError(err.Error())
-			}
-		} else {
-			cancel()
-			return proto.Unmarshal(data, value)
-		}
+// keyName returns the name of the `cfgName` Configuration, as it appears in its keys: with a
+// Redis Cluster, it is hash-tagged (see hashTag), so that all the keys of the Configuration are
+// in the same hash slot, and can be updated in the same transaction; with a single Redis
+// server, it is left as it is, and the keys are the same as those stored by earlier releases.
+func (csm *RedisStore) keyName(cfgName string) string {
+	if csm.isCluster {
+		return hashTag(cfgName)
 	}
+	return cfgName
 }
 
-func (csm *RedisStore) put(key string, value proto.Message, ttl time.Duration) StoreErr {
-	attemptsLeft := csm.MaxRetries
-	csm.logger.Trace().Msgf("Storing key `%s` (Max retries: %d)", key, attemptsLeft)
-	var cancel context.CancelFunc
-	defer func() {
-		if cancel != nil {
-			cancel()
-		}
-	}()
-	for {
-		var ctx context.Context
-		ctx, cancel = context.WithTimeout(context.Background(), csm.Timeout)
+// configKey returns the key (see NewKeyForConfig) for the Configuration `id`, which is either
+// its name or its `name:version`; the name is hash-tagged as keyName does.
+func (csm *RedisStore) configKey(id string) string {
+	name, version, found := strings.Cut(id, api.ConfigurationVersionSeparator)
+	if !found {
+		return NewKeyForConfig(csm.keyName(name))
+	}
+	return NewKeyForConfig(strings.Join([]string{csm.keyName(name), version},
+		api.ConfigurationVersionSeparator))
+}
 
-		attemptsLeft--
-		data, err := proto.Marshal(value)
+// get abstracts away the common functionality of looking for a key in Redis, retrying
+// as the store's `Retry` policy dictates.
+func (csm *RedisStore) get(ctx context.Context, key string, value proto.Message) StoreErr {
+	csm.logger.Trace().Msgf("Looking up key `%s` (Max attempts: %d)", key, csm.Retry.MaxAttempts)
+	err := csm.retry(ctx, key, func(ctx context.Context) error {
+		return csm.read(ctx, csm.client, key, value)
+	})
+	if err != nil {
+		csm.logger.Error().Err(err).Msg("redis get error")
+		return err
+	}
+	return nil
+}
+
+// read looks up the `key` once, with the `client`: transactions (see watch) use it to read
+// their keys, as it is the whole transaction which is retried, if it fails.
+func (csm *RedisStore) read(ctx context.Context, client redis.Cmdable, key string, value proto.Message) error {
+	data, err := client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		// The key isn't there, no point in retrying
+		csm.logger.Debug().Msgf("Key `%s` not found", key)
+		return NotFoundError(key)
+	} else if err != nil {
+		return err
+	}
+	if err = proto.Unmarshal(data, value); err != nil {
+		csm.logger.Error().Err(err).Msgf("cannot read key `%s`", key)
+		return UnreadableDataError(key)
+	}
+	return nil
+}
+
+// put stores the `value` for `key`, retrying as the store's `Retry` policy dictates.
+func (csm *RedisStore) put(ctx context.Context, key string, value proto.Message, ttl time.Duration) StoreErr {
+	csm.logger.Trace().Msgf("Storing key `%s` (Max attempts: %d)", key, csm.Retry.MaxAttempts)
+	data, err := proto.Marshal(value)
+	if err != nil {
+		csm.logger.Error().Err(err).Msg("cannot convert proto to bytes")
+		return InvalidDataError(err.Error())
+	}
+	err = csm.retry(ctx, key, func(ctx context.Context) error {
+		return csm.client.Set(ctx, key, data, ttl).Err()
+	})
+	if err != nil {
+		return err
+	}
+	csm.logger.Debug().Msgf("stored value for key `%s`", key)
+	return nil
+}
+
+// members returns the members of the SET `key`, logging any error.
+func (csm *RedisStore) members(ctx context.Context, key string) []string {
+	var members []string
+	err := csm.retry(ctx, key, func(ctx context.Context) (err error) {
+		members, err = csm.client.SMembers(ctx, key).Result()
+		return err
+	})
+	if err != nil {
+		csm.logger.Error().Err(err).Msgf("could not retrieve the members of %s", key)
+		return nil
+	}
+	csm.logger.Debug().Msgf(ReturningItemsFmt, len(members))
+	return members
+}
+
+// scan returns the Page of the members of the SET `key` requested by `req`, using `SSCAN`,
+// whose cursor is encoded in the page tokens.
+func (csm *RedisStore) scan(ctx context.Context, key string, req PageRequest) (*Page, StoreErr) {
+	var cursor uint64
+	if req.Token != "" {
+		position, err := decodePageToken(req.Token)
 		if err != nil {
-			csm.logger.Error().Err(err).Msg("cannot convert proto to bytes")
-			return InvalidDataError(err.Error())
+			return nil, err
 		}
-		cmd := csm.client.Set(ctx, key, data, ttl)
-		_, err = cmd.Result()
+		if cursor, err = strconv.ParseUint(position, 10, 64); err != nil || cursor == 0 {
+			return nil, InvalidPageTokenError(req.Token)
+		}
+	}
+	page := &Page{}
+	// SSCAN may return fewer members than asked for (even none) before the end of the SET.
+	for {
+		var members []string
+		var next uint64
+		err := csm.retry(ctx, key, func(ctx context.Context) (err error) {
+			members, next, err = csm.client.SScan(ctx, key, cursor, "",
+				int64(req.size()-len(page.Items))).Result()
+			return err
+		})
 		if err != nil {
-			if ctx.Err() == context.DeadlineExceeded {
-				// The error here may be recoverable, so we'll keep trying until we run out of attempts
-				if attemptsLeft == 0 {
-					return TooManyAttempts("")
-				}
-				csm.logger.Debug().Msgf("retrying after timeout, attempts left: %d", attemptsLeft)
-				csm.wait()
-			} else {
-				return GenericStoreError(err.Error())
-			}
-		} else {
-			csm.logger.Debug().Msgf("stored value for key `%s`", key)
-			return nil
+			csm.logger.Error().Err(err).Msgf("could not scan the members of %s", key)
+			return nil, err
+		}
+		page.Items = append(page.Items, members...)
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+		if len(page.Items) >= req.size() {
+			page.NextToken = encodePageToken(strconv.FormatUint(cursor, 10))
+			break
 		}
 	}
+	csm.logger.Debug().Msgf(ReturningItemsFmt, len(page.Items))
+	return page, nil
 }
 
-// wait is a helper function that sleeps for a random amount of time between 0 and half second.
-// Poor man's backoff.
-//
-// TODO: should use some form of exponential backoff
-// TODO: wait time should be configurable
-func (csm *RedisStore) wait() {
-	waitForMsec := rand.Intn(500)
-	time.Sleep(time.Duration(waitForMsec) * time.Millisecond)
+// redisError returns the errors returned by the transactions as they are, if they are
+// StoreErrors, or errors of the FSMs (see api.ConfiguredStateMachine); those returned by
+// Redis itself are converted to StoreErrors about `key`.
+func redisError(err error, key string) StoreErr {
+	var storeErr *StoreError
+	var redisErr redis.Error
+	var netErr net.Error
+	switch {
+	case errors.As(err, &storeErr):
+		return err
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return TimeoutError(key)
+	case errors.Is(err, context.Canceled):
+		return CanceledError(key)
+	case errors.As(err, &redisErr), errors.As(err, &netErr), errors.Is(err, redis.ErrClosed):
+		return GenericStoreError(err.Error())
+	}
+	return err
+}
+
+// watch runs the transaction `txf`, watching the `keys`, and retries it (see retry) if any
+// of them changed in the meantime; errors are about the first of the `keys`.
+func (csm *RedisStore) watch(ctx context.Context, txf func(ctx context.Context, tx *redis.Tx) error,
+	keys ...string) StoreErr {
+	return csm.retry(ctx, keys[0], func(ctx context.Context) error {
+		csm.logger.Trace().Msgf("watching %s", keys[0])
+		return csm.client.Watch(ctx, func(tx *redis.Tx) error {
+			return txf(ctx, tx)
+		}, keys...)
+	})
 }
 
 /////// StoreManager implementation
@@ -163,64 +281,156 @@ func (csm *RedisStore) GetTimeout() time.Duration {
 	return csm.Timeout
 }
 
+func (csm *RedisStore) SetDedupWindow(window time.Duration) {
+	csm.DedupWindow = window
+}
+
 // SetLogLevel is no longer needed; RedisStore relies on zerolog's global log level.
 
 /////// ConfigStore implementation
 
-func (csm *RedisStore) GetConfig(id string) (*protos.Configuration, StoreErr) {
-	key := NewKeyForConfig(id)
-	var cfg protos.Configuration
-	err := csm.get(key, &cfg)
+func (csm *RedisStore) GetConfig(ctx context.Context, id string) (*protos.Configuration, StoreErr) {
+	var cfg *protos.Configuration
+	err := csm.retry(ctx, csm.configKey(id), func(ctx context.Context) (err error) {
+		cfg, err = csm.readConfig(ctx, csm.client, id)
+		return err
+	})
 	if err != nil {
 		csm.logger.Error().Err(err).Msg("cannot retrieve configuration")
 		return nil, err
 	}
+	return cfg, nil
+}
+
+// readConfig looks up the Configuration `id` once, with the `client` (see read).
+func (csm *RedisStore) readConfig(ctx context.Context, client redis.Cmdable, id string) (*protos.Configuration, error) {
+	key := csm.configKey(id)
+	var cfg protos.Configuration
+	if err := csm.read(ctx, client, key, &cfg); IsNotFoundErr(err) {
+		return nil, ConfigNotFoundError(key)
+	} else if err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
 
-func (csm *RedisStore) PutConfig(cfg *protos.Configuration) StoreErr {
+func (csm *RedisStore) PutConfig(ctx context.Context, cfg *protos.Configuration) StoreErr {
 	if cfg == nil {
 		return InvalidDataError("nil config")
 	}
-	key := NewKeyForConfig(api.GetVersionId(cfg))
-	if csm.client.Exists(context.Background(), key).Val() == 1 {
+	key := csm.configKey(api.GetVersionId(cfg))
+	var exists int64
+	err := csm.retry(ctx, key, func(ctx context.Context) (err error) {
+		exists, err = csm.client.Exists(ctx, key).Result()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if exists == 1 {
 		return AlreadyExistsError(key)
 	}
-	// TODO: Find out whether the client allows to batch requests, instead of sending multiple cmd requests
-	csm.client.SAdd(context.Background(), ConfigsPrefix, cfg.Name)
-	csm.client.SAdd(context.Background(), NewKeyForConfig(cfg.Name), api.GetVersionId(cfg))
-	return csm.put(key, cfg, NeverExpire)
+	// The version is added before the name, as DeleteConfiguration removes the name once
+	// there are no versions left.
+	err = csm.retry(ctx, key, func(ctx context.Context) error {
+		return csm.client.SAdd(ctx, csm.configKey(cfg.Name), api.GetVersionId(cfg)).Err()
+	})
+	if err != nil {
+		return err
+	}
+	if err = csm.addConfigName(ctx, cfg.Name); err != nil {
+		return err
+	}
+	return csm.put(ctx, key, cfg, NeverExpire)
 }
 
-func (csm *RedisStore) GetAllConfigs() []string {
-	// TODO: enable splitting results with a (cursor, count)
+func (csm *RedisStore) GetAllConfigs(ctx context.Context) []string {
 	csm.logger.Debug().Msg("Looking up all configs in DB")
-	configs, err := csm.client.SMembers(context.Background(), ConfigsPrefix).Result()
-	if err != nil {
-		csm.logger.Error().Err(err).Msg(NoConfigurationsFmt)
-		return nil
-	}
-	csm.logger.Debug().Msgf(ReturningItemsFmt, len(configs))
-	return configs
+	return csm.members(ctx, ConfigsPrefix)
 }
 
-func (csm *RedisStore) GetAllVersions(name string) []string {
+func (csm *RedisStore) GetAllVersions(ctx context.Context, name string) []string {
 	csm.logger.Debug().Msgf("Looking up all versions for Configurations %s in DB", name)
-	configs, err := csm.client.SMembers(context.Background(), NewKeyForConfig(name)).Result()
+	return csm.members(ctx, csm.configKey(name))
+}
+
+func (csm *RedisStore) GetConfigsPage(ctx context.Context, req PageRequest) (*Page, StoreErr) {
+	csm.logger.Debug().Msg("Looking up a page of configs in DB")
+	return csm.scan(ctx, ConfigsPrefix, req)
+}
+
+func (csm *RedisStore) GetVersionsPage(ctx context.Context, name string, req PageRequest) (*Page, StoreErr) {
+	csm.logger.Debug().Msgf("Looking up a page of versions for Configurations %s in DB", name)
+	return csm.scan(ctx, csm.configKey(name), req)
+}
+
+func (csm *RedisStore) DeleteConfiguration(ctx context.Context, versionId string, force bool) StoreErr {
+	cfg, err := csm.GetConfig(ctx, versionId)
 	if err != nil {
-		csm.logger.Error().Err(err).Msg(NoConfigurationsFmt)
-		return nil
+		return err
+	}
+	if !force {
+		if err = checkNotInUse(ctx, csm, cfg); err != nil {
+			return err
+		}
+	}
+	key := csm.configKey(versionId)
+	versions := csm.configKey(cfg.Name)
+	txf := func(ctx context.Context, tx *redis.Tx) error {
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.SRem(ctx, versions, versionId)
+			return nil
+		})
+		return err
+	}
+	if err = csm.watch(ctx, txf, key); err != nil {
+		csm.logger.Error().Err(err).Msgf("could not delete configuration %s", versionId)
+		return err
+	}
+	// The SET of the names is in a different hash slot from the versions (see configKey),
+	// so the name is removed outside the transaction, and added back if a version was added
+	// meanwhile (see PutConfig).
+	var remaining int64
+	err = csm.retry(ctx, versions, func(ctx context.Context) (err error) {
+		remaining, err = csm.client.SCard(ctx, versions).Result()
+		return err
+	})
+	if err == nil && remaining == 0 {
+		err = csm.retry(ctx, ConfigsPrefix, func(ctx context.Context) error {
+			return csm.client.SRem(ctx, ConfigsPrefix, cfg.Name).Err()
+		})
+		if err == nil {
+			err = csm.retry(ctx, versions, func(ctx context.Context) (err error) {
+				remaining, err = csm.client.SCard(ctx, versions).Result()
+				return err
+			})
+		}
+		if err == nil && remaining > 0 {
+			err = csm.addConfigName(ctx, cfg.Name)
+		}
 	}
-	csm.logger.Debug().Msgf(ReturningItemsFmt, len(configs))
-	return configs
+	if err != nil {
+		csm.logger.Error().Err(err).Msgf("could not remove configuration %s from the names", cfg.Name)
+		return err
+	}
+	csm.logger.Debug().Msgf("deleted configuration %s (forced: %t)", versionId, force)
+	return nil
+}
+
+// addConfigName adds `name` to the SET of the names of the Configurations.
+func (csm *RedisStore) addConfigName(ctx context.Context, name string) StoreErr {
+	return csm.retry(ctx, ConfigsPrefix, func(ctx context.Context) error {
+		return csm.client.SAdd(ctx, ConfigsPrefix, name).Err()
+	})
 }
 
 /////// FSMStore implementation
 
-func (csm *RedisStore) GetStateMachine(id string, cfg string) (*protos.FiniteStateMachine, StoreErr) {
-	key := NewKeyForMachine(id, cfg)
+func (csm *RedisStore) GetStateMachine(ctx context.Context, id string, cfg string) (*protos.FiniteStateMachine, StoreErr) {
+	key := NewKeyForMachine(id, csm.keyName(cfg))
 	var stateMachine protos.FiniteStateMachine
-	err := csm.get(key, &stateMachine)
+	err := csm.get(ctx, key, &stateMachine)
 	if err != nil {
 		csm.logger.Error().Err(err).Msgf("error getting FSM %s", key)
 		return nil, err
@@ -228,73 +438,305 @@ func (csm *RedisStore) GetStateMachine(id string, cfg string) (*protos.FiniteSta
 	return &stateMachine, nil
 }
 
-func (csm *RedisStore) PutStateMachine(id string, stateMachine *protos.FiniteStateMachine) StoreErr {
+func (csm *RedisStore) PutStateMachine(ctx context.Context, id string, stateMachine *protos.FiniteStateMachine) StoreErr {
 	if stateMachine == nil {
 		return InvalidDataError("nil statemachine")
 	}
 	configName := strings.Split(stateMachine.ConfigId, api.ConfigurationVersionSeparator)[0]
-	key := NewKeyForMachine(id, configName)
-	return csm.put(key, stateMachine, NeverExpire)
+	key := NewKeyForMachine(id, csm.keyName(configName))
+	data, err := proto.Marshal(stateMachine)
+	if err != nil {
+		csm.logger.Error().Err(err).Msg("cannot convert proto to bytes")
+		return InvalidDataError(err.Error())
+	}
+	// Storing the FSM and indexing it are both idempotent, so they can always be retried.
+	err = csm.retry(ctx, key, func(ctx context.Context) error {
+		_, err := csm.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, NeverExpire)
+			csm.indexMachine(ctx, pipe, configName, id)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	csm.logger.Debug().Msgf("stored value for key `%s`", key)
+	return nil
 }
 
-func (csm *RedisStore) GetAllInState(cfg string, state string) []string {
-	// TODO: enable splitting results with a (cursor, count)
-	csm.logger.Debug().Msgf("Looking up all FSMs [%s] in DB with state `%s`", cfg, state)
-	key := NewKeyForMachinesByState(cfg, state)
-	fsms, err := csm.client.SMembers(context.Background(), key).Result()
+func (csm *RedisStore) TxPutStateMachine(ctx context.Context, id string, fsm *protos.FiniteStateMachine) StoreErr {
+	if fsm == nil {
+		return InvalidDataError("nil statemachine")
+	}
+	configName := strings.Split(fsm.ConfigId, api.ConfigurationVersionSeparator)[0]
+	key := NewKeyForMachine(id, csm.keyName(configName))
+	data, err := proto.Marshal(fsm)
 	if err != nil {
-		csm.logger.Error().Err(err).Msgf("Could not retrieve FSMs for state %s", state)
-		return nil
+		csm.logger.Error().Err(err).Msg("cannot convert proto to bytes")
+		return InvalidDataError(err.Error())
+	}
+	txf := func(ctx context.Context, tx *redis.Tx) error {
+		cfg, err := csm.readConfig(ctx, tx, fsm.ConfigId)
+		if err != nil {
+			return err
+		}
+		from, oldState := cfg, ""
+		old := &protos.FiniteStateMachine{}
+		if err := csm.read(ctx, tx, key, old); err == nil {
+			oldState = old.GetState()
+			if from, err = csm.readConfig(ctx, tx, old.ConfigId); IsNotFoundErr(err) {
+				from = cfg
+			} else if err != nil {
+				return err
+			}
+		} else if !IsNotFoundErr(err) {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, NeverExpire)
+			csm.indexMachine(ctx, pipe, configName, id)
+			csm.updateState(ctx, pipe, configName, id, oldState, fsm.GetState())
+			csm.moveTimers(ctx, pipe, id, from, oldState, cfg, fsm.GetState())
+			return nil
+		})
+		return err
+	}
+	if err := csm.watch(ctx, txf, key); err != nil {
+		csm.logger.Error().Err(err).Msgf("could not store FSM [%s#%s]", configName, id)
+		return err
 	}
-	csm.logger.Debug().Msgf(ReturningItemsFmt, len(fsms))
-	return fsms
+	csm.logger.Debug().Msgf("stored FSM [%s#%s] in state %s", configName, id, fsm.GetState())
+	return nil
+}
+
+func (csm *RedisStore) GetAllInState(ctx context.Context, cfg string, state string) []string {
+	csm.logger.Debug().Msgf("Looking up all FSMs [%s] in DB with state `%s`", cfg, state)
+	return csm.members(ctx, NewKeyForMachinesByState(csm.keyName(cfg), state))
+}
+
+func (csm *RedisStore) GetInStatePage(ctx context.Context, cfg string, state string, req PageRequest) (*Page, StoreErr) {
+	csm.logger.Debug().Msgf("Looking up a page of FSMs [%s] in DB with state `%s`", cfg, state)
+	return csm.scan(ctx, NewKeyForMachinesByState(csm.keyName(cfg), state), req)
 }
 
-func (csm *RedisStore) UpdateState(cfgName string, id string, oldState string, newState string) StoreErr {
-	var key string
-	var err error
-	if oldState != "" {
-		key = NewKeyForMachinesByState(cfgName, oldState)
-		err = csm.client.SRem(context.Background(), key, id).Err()
+func (csm *RedisStore) ScanStateMachines(ctx context.Context, cfgName string, filter ScanFilter, fn ScanFunc) StoreErr {
+	csm.logger.Debug().Msgf("Scanning all FSMs [%s] in DB", cfgName)
+	if err := csm.backfillIndex(ctx, cfgName); err != nil {
+		return err
+	}
+	key := NewKeyForMachinesIndex(csm.keyName(cfgName))
+	var cursor uint64
+	for {
+		var members []string
+		var next uint64
+		err := csm.retry(ctx, key, func(ctx context.Context) (err error) {
+			members, next, err = csm.client.ZScan(ctx, key, cursor, "", DefaultPageSize).Result()
+			return err
+		})
 		if err != nil {
-			return fmt.Errorf(
-				"cannot remove FSM [%s#%s] from state set `%s`: %s",
-				cfgName, id, oldState, err)
+			csm.logger.Error().Err(err).Msgf("could not scan the members of %s", key)
+			return err
+		}
+		// ZSCAN returns each member followed by its score.
+		for i := 0; i+1 < len(members); i += 2 {
+			id := members[i]
+			updated, err := strconv.ParseFloat(members[i+1], 64)
+			if err != nil || !filter.updatedBetween(updated) {
+				continue
+			}
+			fsm, err := csm.GetStateMachine(ctx, id, cfgName)
+			if IsNotFoundErr(err) {
+				// The FSM was removed after the index was scanned.
+				continue
+			} else if err != nil {
+				return err
+			}
+			if !filter.matches(cfgName, fsm) {
+				continue
+			}
+			if err = fn(id, fsm); err != nil {
+				return err
+			}
 		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
 	}
-	if newState != "" {
-		key = NewKeyForMachinesByState(cfgName, newState)
-		err = csm.client.SAdd(context.Background(), key, id).Err()
-		if err != nil {
-			return fmt.Errorf(
-				"cannot add FSM [%s#%s] to state set `%s`: %s",
-				cfgName, id, newState, err)
+}
+
+// backfillIndex adds to the index of the FSMs configured with `cfgName` (see
+// NewKeyForMachinesIndex) those stored by earlier releases, which did not index them: they are
+// found in the `state` SETs, and indexed as last stored at the time of their last event (or,
+// if they have none, at the Unix epoch).
+//
+// This only runs until it completes once for the Configuration; as FSMs are only added to the
+// index if they are not already in it, concurrent backfills are harmless.
+func (csm *RedisStore) backfillIndex(ctx context.Context, cfgName string) StoreErr {
+	indexed := NewKeyForMachinesIndexed(csm.keyName(cfgName))
+	var found int64
+	err := csm.retry(ctx, indexed, func(ctx context.Context) (err error) {
+		found, err = csm.client.Exists(ctx, indexed).Result()
+		return err
+	})
+	if err != nil || found > 0 {
+		return err
+	}
+	var states []string
+	err = csm.retry(ctx, indexed, func(ctx context.Context) (err error) {
+		states, err = csm.allStates(ctx, csm.client, cfgName)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	key := NewKeyForMachinesIndex(csm.keyName(cfgName))
+	backfilled := 0
+	for _, state := range states {
+		if api.Parent(state) != "" {
+			// The FSMs in nested states are also in the SETs of their enclosing states.
+			continue
+		}
+		req := PageRequest{Size: DefaultPageSize}
+		for {
+			page, err := csm.scan(ctx, NewKeyForMachinesByState(csm.keyName(cfgName), state), req)
+			if err != nil {
+				return err
+			}
+			var members []*redis.Z
+			for _, id := range page.Items {
+				fsm, err := csm.GetStateMachine(ctx, id, cfgName)
+				if IsNotFoundErr(err) {
+					continue
+				} else if err != nil {
+					return err
+				}
+				var updated int64
+				if history := fsm.GetHistory(); len(history) > 0 {
+					updated = history[len(history)-1].GetTimestamp().AsTime().UnixMilli()
+				}
+				members = append(members, &redis.Z{Score: float64(updated), Member: id})
+			}
+			if len(members) > 0 {
+				var added int64
+				err = csm.retry(ctx, key, func(ctx context.Context) (err error) {
+					added, err = csm.client.ZAddNX(ctx, key, members...).Result()
+					return err
+				})
+				if err != nil {
+					return err
+				}
+				backfilled += int(added)
+			}
+			if page.NextToken == "" {
+				break
+			}
+			req.Token = page.NextToken
 		}
 	}
+	err = csm.retry(ctx, indexed, func(ctx context.Context) error {
+		return csm.client.Set(ctx, indexed, time.Now().Unix(), NeverExpire).Err()
+	})
+	if err != nil {
+		return err
+	}
+	csm.logger.Info().Msgf("indexed %d FSMs [%s] stored by earlier releases", backfilled, cfgName)
+	return nil
+}
+
+// updateState moves the FSM `id` from the `state` SETs of `oldState` to those of `newState`.
+//
+// FSMs are also kept in the SETs of the compound states their state is nested in.
+func (csm *RedisStore) updateState(ctx context.Context, pipe redis.Pipeliner, cfgName string, id string,
+	oldState string, newState string) {
+	for _, state := range api.ExitedStates(oldState, newState) {
+		pipe.SRem(ctx, NewKeyForMachinesByState(csm.keyName(cfgName), state), id)
+	}
+	for _, state := range api.EnteredStates(oldState, newState) {
+		pipe.SAdd(ctx, NewKeyForMachinesByState(csm.keyName(cfgName), state), id)
+	}
+}
+
+func (csm *RedisStore) UpdateState(ctx context.Context, cfgName string, id string, oldState string, newState string) StoreErr {
+	// Adding and removing members is idempotent, so it can always be retried.
+	err := csm.retry(ctx, NewKeyForMachine(id, csm.keyName(cfgName)), func(ctx context.Context) error {
+		_, err := csm.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			csm.updateState(ctx, pipe, cfgName, id, oldState, newState)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		csm.logger.Error().Err(err).Msgf("cannot move FSM [%s#%s] from state `%s` to `%s`",
+			cfgName, id, oldState, newState)
+		return err
+	}
 	return nil
 }
 
-func (csm *RedisStore) TxProcessEvent(id, cfgName string, evt *protos.Event) StoreErr {
-	ctx, _ := context.WithTimeout(context.Background(), DefaultTimeout)
+func (csm *RedisStore) TxProcessEvent(ctx context.Context, id, cfgName string, evt *protos.Event) (*api.ConfiguredStateMachine, StoreErr) {
+	var result *api.ConfiguredStateMachine
 	// See Tx example at https://redis.uptrace.dev/guide/go-redis-pipelines.html#transactions
-	txf := func(tx *redis.Tx) error {
+	// Events with no ID cannot be deduplicated.
+	var processedKey string
+	if csm.DedupWindow > 0 && evt.GetEventId() != "" {
+		processedKey = NewKeyForProcessedEvent(evt.GetEventId(), id, csm.keyName(cfgName))
+	}
+	txf := func(ctx context.Context, tx *redis.Tx) error {
 		csm.logger.Trace().Msg("Tx starts")
-		fsm, err := csm.GetStateMachine(id, cfgName)
-		if err != nil {
+		if processedKey != "" {
+			data, err := tx.Get(ctx, processedKey).Bytes()
+			if err == nil {
+				csm.logger.Debug().Msgf("event [%s] was already processed by FSM [%s#%s]",
+					evt.GetEventId(), cfgName, id)
+				return duplicateEventError(evt.GetEventId(), data)
+			} else if err != redis.Nil {
+				return err
+			}
+		}
+		fsm := &protos.FiniteStateMachine{}
+		if err := csm.read(ctx, tx, NewKeyForMachine(id, csm.keyName(cfgName)), fsm); err != nil {
 			csm.logger.Debug().Msgf("error looking up FSM %s: %v", id, err)
-			return NotFoundError(NewKeyForMachine(id, cfgName))
+			return err
 		}
 		csm.logger.Trace().Msgf("Tx got SM [%s]", id)
-		cfg, err := csm.GetConfig(fsm.ConfigId)
+		cfg, err := csm.readConfig(ctx, tx, fsm.ConfigId)
 		if err != nil {
-			return NotFoundError(err.Error())
+			return err
 		}
 		oldState := fsm.GetState()
 		csm.logger.Trace().Msgf("Tx got CFG [%s]", api.GetVersionId(cfg))
-		if err = (&api.ConfiguredStateMachine{Config: cfg, FSM: fsm}).SendEvent(evt); err != nil {
+		timer, fired := api.FiredTimer(cfg, oldState, evt)
+		sm := &api.ConfiguredStateMachine{Config: cfg, FSM: fsm}
+		effects, err := sm.ProcessEvent(evt)
+		if err != nil {
+			// The rejection is recorded, and the FSM is left unchanged.
+			outcome, txErr := proto.Marshal(processedOutcome(id, cfgName, err))
+			if txErr != nil {
+				return InvalidDataError(txErr.Error())
+			}
+			if processedKey != "" || fired {
+				if _, txErr := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+					if processedKey != "" {
+						pipe.Set(ctx, processedKey, outcome, csm.DedupWindow)
+					}
+					if fired {
+						// The FSM is unchanged, so the Timer's Event would be rejected again.
+						pipe.ZRem(ctx, NewKeyForTimers(csm.keyName(cfgName)), NewTimerMember(id, timer.State, timer.Event))
+					}
+					return nil
+				}); txErr != nil {
+					return txErr
+				}
+			}
 			return err
 		}
 		csm.logger.Trace().Msgf("Tx changed SM to: %s", fsm.State)
+		outcome, err := proto.Marshal(processedOutcome(id, cfgName, nil))
+		if err != nil {
+			return InvalidDataError(err.Error())
+		}
 		// If the watched keys are unchanged, the Tx is committed
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 			csm.logger.Trace().Msg("Tx committing change")
@@ -303,44 +745,537 @@ func (csm *RedisStore) TxProcessEvent(id, cfgName string, evt *protos.Event) Sto
 				csm.logger.Error().Err(err).Msg("cannot convert proto to bytes")
 				return InvalidDataError(err.Error())
 			}
-			cmd := pipe.Set(ctx, NewKeyForMachine(id, cfgName), data, NeverExpire)
+			cmd := pipe.Set(ctx, NewKeyForMachine(id, csm.keyName(cfgName)), data, NeverExpire)
 			if cmd.Err() != nil {
 				csm.logger.Error().Err(cmd.Err()).Msgf("could not update fsm [%s](Configuration: %s)", id, cfgName)
-				return cmd.Err()
+				return GenericStoreError(cmd.Err().Error())
+			}
+			csm.indexMachine(ctx, pipe, cfgName, id)
+			if processedKey != "" {
+				pipe.Set(ctx, processedKey, outcome, csm.DedupWindow)
+			}
+			if fired {
+				pipe.ZRem(ctx, NewKeyForTimers(csm.keyName(cfgName)), NewTimerMember(id, timer.State, timer.Event))
+			}
+			for _, state := range effects.Exited {
+				for _, timer := range api.Timers(cfg, state) {
+					pipe.ZRem(ctx, NewKeyForTimers(csm.keyName(cfgName)), NewTimerMember(id, timer.State, timer.Event))
+				}
+			}
+			for _, state := range effects.Entered {
+				csm.scheduleTimers(ctx, pipe, cfgName, id, api.Timers(cfg, state))
+			}
+			now := time.Now().UnixMilli()
+			for i, action := range effects.Actions {
+				action.FsmId = id
+				data, err := json.Marshal(action)
+				if err != nil {
+					return InvalidDataError(err.Error())
+				}
+				pipe.Set(ctx, NewKeyForAction(action.Id, csm.keyName(cfgName)), data, NeverExpire)
+				// The fractional part keeps the Actions in the order they were caused.
+				pipe.ZAdd(ctx, NewKeyForActions(csm.keyName(cfgName)), &redis.Z{
+					Score:  float64(now) + float64(i)/1000,
+					Member: action.Id,
+				})
+			}
+			if sm.IsCompleted() {
+				csm.logger.Trace().Msgf("FSM [%s] completed in state %s", id, fsm.State)
+				pipe.ZAdd(ctx, NewKeyForCompleted(csm.keyName(cfgName)), &redis.Z{
+					Score:  float64(time.Now().Unix()),
+					Member: id,
+				})
 			}
-			csm.logger.Trace().Msg("Tx committed")
-			csm.logger.Trace().Msg("updating SET of FSM states")
-			err = csm.UpdateState(cfgName, id, oldState, fsm.GetState())
+			csm.updateState(ctx, pipe, cfgName, id, oldState, fsm.GetState())
+			return nil
+		})
+		if err == nil {
+			result = sm
+		}
+		return err
+	}
+	key := NewKeyForMachine(id, csm.keyName(cfgName))
+	keys := []string{key}
+	if processedKey != "" {
+		keys = append(keys, processedKey)
+	}
+	err := csm.watch(ctx, txf, keys...)
+	csm.logger.Trace().Msgf("returning with (%v)", err)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (csm *RedisStore) PurgeCompleted(ctx context.Context, cfgName string, retention time.Duration) (int, StoreErr) {
+	key := NewKeyForCompleted(csm.keyName(cfgName))
+	before := time.Now().Add(-retention).Unix()
+	var ids []string
+	err := csm.retry(ctx, key, func(ctx context.Context) (err error) {
+		ids, err = csm.client.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+			Min: "-inf",
+			Max: strconv.FormatInt(before, 10),
+		}).Result()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, id := range ids {
+		fsm, err := csm.GetStateMachine(ctx, id, cfgName)
+		if err != nil && !IsNotFoundErr(err) {
+			return purged, err
+		}
+		err = csm.retry(ctx, NewKeyForMachine(id, csm.keyName(cfgName)), func(ctx context.Context) error {
+			_, err := csm.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, NewKeyForMachine(id, csm.keyName(cfgName)))
+				if fsm != nil {
+					for _, state := range api.Ancestors(fsm.GetState()) {
+						pipe.SRem(ctx, NewKeyForMachinesByState(csm.keyName(cfgName), state), id)
+					}
+				}
+				pipe.ZRem(ctx, NewKeyForMachinesIndex(csm.keyName(cfgName)), id)
+				pipe.ZRem(ctx, key, id)
+				return nil
+			})
+			return err
+		})
+		if err != nil {
+			csm.logger.Error().Err(err).Msgf("could not purge FSM [%s#%s]", cfgName, id)
+			return purged, err
+		}
+		purged++
+	}
+	csm.logger.Debug().Msgf("purged %d completed FSMs [%s]", purged, cfgName)
+	return purged, nil
+}
+
+func (csm *RedisStore) MigrateStateMachine(ctx context.Context, id string, migration *api.Migration) (bool, StoreErr) {
+	cfgName := migration.From.Name
+	key := NewKeyForMachine(id, csm.keyName(cfgName))
+	migrated := false
+	txf := func(ctx context.Context, tx *redis.Tx) error {
+		fsm := &protos.FiniteStateMachine{}
+		err := csm.read(ctx, tx, key, fsm)
+		if err != nil {
+			return err
+		}
+		if !migration.Applies(fsm) {
+			return nil
+		}
+		oldState := fsm.GetState()
+		if err = migration.Apply(fsm); err != nil {
+			return err
+		}
+		newState := fsm.GetState()
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			data, err := proto.Marshal(fsm)
+			if err != nil {
+				return InvalidDataError(err.Error())
+			}
+			pipe.Set(ctx, key, data, NeverExpire)
+			csm.indexMachine(ctx, pipe, cfgName, id)
+			csm.updateState(ctx, pipe, cfgName, id, oldState, newState)
+			csm.moveTimers(ctx, pipe, id, migration.From, oldState, migration.To, newState)
+			return nil
+		})
+		if err == nil {
+			migrated = true
+		}
+		return err
+	}
+	if err := csm.watch(ctx, txf, key); err != nil {
+		return false, err
+	}
+	if migrated {
+		csm.logger.Debug().Msgf("migrated FSM [%s#%s] to %s", cfgName, id,
+			api.GetVersionId(migration.To))
+	}
+	return migrated, nil
+}
+
+func (csm *RedisStore) VerifyStateMachine(ctx context.Context, id, cfgName string, repair bool) (*Verification, StoreErr) {
+	key := NewKeyForMachine(id, csm.keyName(cfgName))
+	var result *Verification
+	txf := func(ctx context.Context, tx *redis.Tx) error {
+		fsm := &protos.FiniteStateMachine{}
+		err := csm.read(ctx, tx, key, fsm)
+		if err != nil {
+			return err
+		}
+		cfg, err := csm.readConfig(ctx, tx, fsm.ConfigId)
+		if err != nil {
+			return err
+		}
+		result = &Verification{Id: id, State: fsm.GetState()}
+		state := fsm.GetState()
+		replayed, err := api.Replay(cfg, fsm.GetHistory())
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			if state != replayed.FSM.GetState() {
+				result.Replayed = replayed.FSM.GetState()
+				state = result.Replayed
+			}
+			data, _ := api.GetData(fsm)
+			replayedData, _ := api.GetData(replayed.FSM)
+			result.Data = !proto.Equal(data, replayedData)
+		}
+		// The FSM should be in the SETs of its state, and of the compound states it is
+		// nested in, in any of the Configuration's versions, and in none of the others.
+		expected := make(map[string]bool)
+		for _, s := range api.Ancestors(state) {
+			expected[s] = true
+		}
+		states, err := csm.allStates(ctx, tx, cfgName)
+		if err != nil {
+			return err
+		}
+		for _, s := range states {
+			isMember, err := tx.SIsMember(ctx, NewKeyForMachinesByState(csm.keyName(cfgName), s), id).Result()
 			if err != nil {
-				csm.logger.Error().Err(err).Msg("could not update the SET containing FSM per state")
 				return err
 			}
+			if isMember && !expected[s] {
+				result.ExtraIn = append(result.ExtraIn, s)
+			} else if !isMember && expected[s] {
+				result.MissingFrom = append(result.MissingFrom, s)
+			}
+		}
+		if !repair || result.IsConsistent() || result.Error != "" {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if result.Replayed != "" || result.Data {
+				data, err := proto.Marshal(replayed.FSM)
+				if err != nil {
+					return InvalidDataError(err.Error())
+				}
+				pipe.Set(ctx, key, data, NeverExpire)
+				csm.indexMachine(ctx, pipe, cfgName, id)
+			}
+			for _, s := range result.ExtraIn {
+				pipe.SRem(ctx, NewKeyForMachinesByState(csm.keyName(cfgName), s), id)
+			}
+			for _, s := range result.MissingFrom {
+				pipe.SAdd(ctx, NewKeyForMachinesByState(csm.keyName(cfgName), s), id)
+			}
+			if result.Replayed != "" {
+				csm.moveTimers(ctx, pipe, id, cfg, result.State, cfg, result.Replayed)
+			}
 			return nil
 		})
+		if err == nil {
+			result.Repaired = true
+		}
 		return err
 	}
-	for i := 0; i < DefaultMaxRetries; i++ {
-		key := NewKeyForMachine(id, cfgName)
-		csm.logger.Trace().Msgf("(%d) watching %s", i, key)
-			err := csm.client.Watch(ctx, txf, key)
-			if err == redis.TxFailedErr {
-				// We may be able to retry
-				csm.logger.Trace().Msgf("(%d) Tx failed, retrying", i)
+	if err := csm.watch(ctx, txf, key); err != nil {
+		return nil, err
+	}
+	if result.Repaired {
+		csm.logger.Info().Msgf("repaired FSM [%s#%s]", cfgName, id)
+	}
+	return result, nil
+}
+
+func (csm *RedisStore) RollbackStateMachine(ctx context.Context, id, cfgName string, steps int) (*api.ConfiguredStateMachine, StoreErr) {
+	key := NewKeyForMachine(id, csm.keyName(cfgName))
+	var result *api.ConfiguredStateMachine
+	txf := func(ctx context.Context, tx *redis.Tx) error {
+		fsm := &protos.FiniteStateMachine{}
+		err := csm.read(ctx, tx, key, fsm)
+		if err != nil {
+			return err
+		}
+		cfg, err := csm.readConfig(ctx, tx, fsm.ConfigId)
+		if err != nil {
+			return err
+		}
+		oldState := fsm.GetState()
+		sm := &api.ConfiguredStateMachine{Config: cfg, FSM: fsm}
+		effects, err := sm.Rollback(steps, api.RollbackOriginator)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			data, err := proto.Marshal(fsm)
+			if err != nil {
+				return InvalidDataError(err.Error())
+			}
+			pipe.Set(ctx, key, data, NeverExpire)
+			csm.indexMachine(ctx, pipe, cfgName, id)
+			for _, state := range effects.Exited {
+				pipe.SRem(ctx, NewKeyForMachinesByState(csm.keyName(cfgName), state), id)
+			}
+			for _, state := range effects.Entered {
+				pipe.SAdd(ctx, NewKeyForMachinesByState(csm.keyName(cfgName), state), id)
+			}
+			csm.moveTimers(ctx, pipe, id, cfg, oldState, cfg, fsm.GetState())
+			return nil
+		})
+		if err == nil {
+			result = sm
+		}
+		return err
+	}
+	if err := csm.watch(ctx, txf, key); err != nil {
+		return nil, err
+	}
+	csm.logger.Debug().Msgf("rolled back FSM [%s#%s] by %d steps, to state %s", cfgName, id,
+		steps, result.FSM.GetState())
+	return result, nil
+}
+
+func (csm *RedisStore) DeleteStateMachine(ctx context.Context, id string, cfgName string) StoreErr {
+	key := NewKeyForMachine(id, csm.keyName(cfgName))
+	txf := func(ctx context.Context, tx *redis.Tx) error {
+		fsm := &protos.FiniteStateMachine{}
+		err := csm.read(ctx, tx, key, fsm)
+		if err != nil {
+			return err
+		}
+		// The FSM's Configuration may have been forcibly deleted, in which case there are no
+		// timers to cancel.
+		cfg, err := csm.readConfig(ctx, tx, fsm.ConfigId)
+		if err != nil && !IsNotFoundErr(err) {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			for _, state := range api.Ancestors(fsm.GetState()) {
+				pipe.SRem(ctx, NewKeyForMachinesByState(csm.keyName(cfgName), state), id)
+				if cfg == nil {
+					continue
+				}
+				for _, timer := range api.Timers(cfg, state) {
+					pipe.ZRem(ctx, NewKeyForTimers(csm.keyName(cfgName)), NewTimerMember(id, timer.State, timer.Event))
+				}
+			}
+			pipe.ZRem(ctx, NewKeyForMachinesIndex(csm.keyName(cfgName)), id)
+			pipe.ZRem(ctx, NewKeyForCompleted(csm.keyName(cfgName)), id)
+			return nil
+		})
+		return err
+	}
+	if err := csm.watch(ctx, txf, key); err != nil {
+		csm.logger.Error().Err(err).Msgf("could not delete FSM [%s#%s]", cfgName, id)
+		return err
+	}
+	csm.logger.Debug().Msgf("deleted FSM [%s#%s]", cfgName, id)
+	return nil
+}
+
+// indexMachine adds the FSM `id` to the index of the FSMs configured with `cfgName`, as
+// last stored now.
+func (csm *RedisStore) indexMachine(ctx context.Context, pipe redis.Pipeliner, cfgName string, id string) {
+	pipe.ZAdd(ctx, NewKeyForMachinesIndex(csm.keyName(cfgName)), &redis.Z{
+		Score:  float64(time.Now().UnixMilli()),
+		Member: id,
+	})
+}
+
+// allStates returns all the states of all the versions of the `cfgName` Configuration,
+// read once with the `client` (see read).
+func (csm *RedisStore) allStates(ctx context.Context, client redis.Cmdable, cfgName string) ([]string, error) {
+	versions, err := client.SMembers(ctx, csm.configKey(cfgName)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var states []string
+	seen := make(map[string]bool)
+	for _, versionId := range versions {
+		cfg, err := csm.readConfig(ctx, client, versionId)
+		if IsNotFoundErr(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, s := range cfg.States {
+			if !seen[s] {
+				seen[s] = true
+				states = append(states, s)
+			}
+		}
+	}
+	return states, nil
+}
+
+// moveTimers cancels the timers of the FSM `id` for the states it left, and starts those for
+// the states it entered, when moving from `oldState` (in the `from` Configuration) to
+// `newState` (in `to`); timers defined in both keep running.
+// The FSM's completion is also recorded, or removed, accordingly.
+func (csm *RedisStore) moveTimers(ctx context.Context, pipe redis.Pipeliner, id string,
+	from *protos.Configuration, oldState string, to *protos.Configuration, newState string) {
+	cfgName := to.Name
+	running := make(map[string]bool)
+	for _, state := range api.Ancestors(oldState) {
+		for _, timer := range api.Timers(from, state) {
+			running[NewTimerMember(id, timer.State, timer.Event)] = true
+		}
+	}
+	var started []api.Timer
+	for _, state := range api.Ancestors(newState) {
+		for _, timer := range api.Timers(to, state) {
+			member := NewTimerMember(id, timer.State, timer.Event)
+			if running[member] {
+				delete(running, member)
+				continue
+			}
+			started = append(started, timer)
+		}
+	}
+	for member := range running {
+		pipe.ZRem(ctx, NewKeyForTimers(csm.keyName(cfgName)), member)
+	}
+	csm.scheduleTimers(ctx, pipe, cfgName, id, started)
+	wasCompleted := api.IsTerminal(from, oldState)
+	isCompleted := api.IsTerminal(to, newState)
+	if isCompleted && !wasCompleted {
+		pipe.ZAdd(ctx, NewKeyForCompleted(csm.keyName(cfgName)), &redis.Z{
+			Score:  float64(time.Now().Unix()),
+			Member: id,
+		})
+	} else if wasCompleted && !isCompleted {
+		pipe.ZRem(ctx, NewKeyForCompleted(csm.keyName(cfgName)), id)
+	}
+}
+
+/////// TimerStore implementation
+
+func (csm *RedisStore) ScheduleTimers(ctx context.Context, cfgName string, id string, timers []api.Timer) StoreErr {
+	if len(timers) == 0 {
+		return nil
+	}
+	err := csm.retry(ctx, NewKeyForTimers(csm.keyName(cfgName)), func(ctx context.Context) error {
+		_, err := csm.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			csm.scheduleTimers(ctx, pipe, cfgName, id, timers)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		csm.logger.Error().Err(err).Msgf("could not schedule timers for FSM [%s#%s]", cfgName, id)
+		return err
+	}
+	return nil
+}
+
+// scheduleTimers adds the `timers` to the sorted SET, scored by the time they will be due.
+func (csm *RedisStore) scheduleTimers(ctx context.Context, pipe redis.Pipeliner, cfgName string,
+	id string, timers []api.Timer) {
+	now := time.Now()
+	for _, timer := range timers {
+		csm.logger.Trace().Msgf("starting timer for FSM [%s#%s] in state %s: `%s` after %v",
+			cfgName, id, timer.State, timer.Event, timer.Timeout)
+		member := NewTimerMember(id, timer.State, timer.Event)
+		pipe.ZAdd(ctx, NewKeyForTimers(csm.keyName(cfgName)), &redis.Z{
+			Score:  float64(now.Add(timer.Timeout).UnixMilli()),
+			Member: member,
+		})
+		pipe.ZRem(ctx, NewKeyForTimerLeases(csm.keyName(cfgName)), member)
+	}
+}
+
+func (csm *RedisStore) ClaimDueTimers(ctx context.Context, cfgName string, now time.Time,
+	lease time.Duration) ([]DueTimer, StoreErr) {
+	key := NewKeyForTimers(csm.keyName(cfgName))
+	var claimed []string
+	// Claims whose reply was lost are retried: the timers will be claimed again once their
+	// lease expires.
+	err := csm.retry(ctx, key, func(ctx context.Context) (err error) {
+		claimed, err = claimTimersScript.Run(ctx, csm.client,
+			[]string{key, NewKeyForTimerLeases(csm.keyName(cfgName))},
+			now.UnixMilli(), now.Add(lease).UnixMilli()).StringSlice()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var due []DueTimer
+	for i := 0; i+1 < len(claimed); i += 2 {
+		member := claimed[i]
+		id, state, event, ok := ParseTimerMember(member)
+		score, err := strconv.ParseFloat(claimed[i+1], 64)
+		if !ok || err != nil {
+			csm.logger.Error().Msgf("invalid timer %s in %s, removed", member, key)
+			csm.client.ZRem(ctx, key, member)
 			continue
 		}
-		// err may be nil here, in which case, success!
-		csm.logger.Trace().Msgf("returning with (%v)", err)
+		due = append(due, DueTimer{Id: id, State: state, Event: event, Due: time.UnixMilli(int64(score))})
+	}
+	return due, nil
+}
+
+func (csm *RedisStore) DiscardTimer(ctx context.Context, cfgName string, timer DueTimer) StoreErr {
+	key := NewKeyForTimers(csm.keyName(cfgName))
+	return csm.retry(ctx, key, func(ctx context.Context) error {
+		return discardTimerScript.Run(ctx, csm.client, []string{key, NewKeyForTimerLeases(csm.keyName(cfgName))},
+			NewTimerMember(timer.Id, timer.State, timer.Event), timer.Due.UnixMilli()).Err()
+	})
+}
+
+/////// ActionStore implementation
+
+func (csm *RedisStore) ClaimActions(ctx context.Context, cfgName string, count int, lease time.Duration) ([]*api.Action, StoreErr) {
+	key := NewKeyForActions(csm.keyName(cfgName))
+	now := time.Now()
+	var ids []string
+	// Claims whose reply was lost are retried: the Actions will be claimed again once
+	// their lease expires.
+	err := csm.retry(ctx, key, func(ctx context.Context) (err error) {
+		ids, err = claimActionsScript.Run(ctx, csm.client, []string{key},
+			now.UnixMilli(), count, now.Add(lease).UnixMilli()).StringSlice()
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	return TooManyAttempts("")
+	var actions []*api.Action
+	for _, id := range ids {
+		var data []byte
+		err := csm.retry(ctx, NewKeyForAction(id, csm.keyName(cfgName)), func(ctx context.Context) (err error) {
+			data, err = csm.client.Get(ctx, NewKeyForAction(id, csm.keyName(cfgName))).Bytes()
+			if err == redis.Nil {
+				return NotFoundError(NewKeyForAction(id, csm.keyName(cfgName)))
+			}
+			return err
+		})
+		if IsNotFoundErr(err) {
+			// Acknowledged in the meantime by another server.
+			csm.client.ZRem(ctx, key, id)
+			continue
+		} else if err != nil {
+			return actions, err
+		}
+		var action api.Action
+		if err = json.Unmarshal(data, &action); err != nil {
+			csm.logger.Error().Err(err).Msgf("invalid action %s, ignored", id)
+			continue
+		}
+		actions = append(actions, &action)
+	}
+	return actions, nil
+}
+
+func (csm *RedisStore) AckAction(ctx context.Context, cfgName string, id string) StoreErr {
+	return csm.retry(ctx, NewKeyForAction(id, csm.keyName(cfgName)), func(ctx context.Context) error {
+		_, err := csm.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZRem(ctx, NewKeyForActions(csm.keyName(cfgName)), id)
+			pipe.Del(ctx, NewKeyForAction(id, csm.keyName(cfgName)))
+			return nil
+		})
+		return err
+	})
 }
 
 /////// EventStore implementation
 
-func (csm *RedisStore) GetEvent(id string, cfg string) (*protos.Event, StoreErr) {
-	key := NewKeyForEvent(id, cfg)
+func (csm *RedisStore) GetEvent(ctx context.Context, id string, cfg string) (*protos.Event, StoreErr) {
+	key := NewKeyForEvent(id, csm.keyName(cfg))
 	var event protos.Event
-	err := csm.get(key, &event)
+	err := csm.get(ctx, key, &event)
 	if err != nil {
 		csm.logger.Error().Err(err).Msgf("cannot retrieve event %s", key)
 		return nil, err
@@ -348,26 +1283,26 @@ func (csm *RedisStore) GetEvent(id string, cfg string) (*protos.Event, StoreErr)
 	return &event, nil
 }
 
-func (csm *RedisStore) PutEvent(event *protos.Event, cfg string, ttl time.Duration) StoreErr {
+func (csm *RedisStore) PutEvent(ctx context.Context, event *protos.Event, cfg string, ttl time.Duration) StoreErr {
 	if event == nil {
 		return InvalidDataError("nil event")
 	}
-	key := NewKeyForEvent(event.EventId, cfg)
-	return csm.put(key, event, ttl)
+	key := NewKeyForEvent(event.EventId, csm.keyName(cfg))
+	return csm.put(ctx, key, event, ttl)
 }
 
-func (csm *RedisStore) AddEventOutcome(id string, cfg string, response *protos.EventOutcome, ttl time.Duration) StoreErr {
+func (csm *RedisStore) AddEventOutcome(ctx context.Context, id string, cfg string, response *protos.EventOutcome, ttl time.Duration) StoreErr {
 	if response == nil {
 		return InvalidDataError("nil response")
 	}
-	key := NewKeyForOutcome(id, cfg)
-	return csm.put(key, response, ttl)
+	key := NewKeyForOutcome(id, csm.keyName(cfg))
+	return csm.put(ctx, key, response, ttl)
 }
 
-func (csm *RedisStore) GetOutcomeForEvent(id string, cfg string) (*protos.EventOutcome, StoreErr) {
-	key := NewKeyForOutcome(id, cfg)
+func (csm *RedisStore) GetOutcomeForEvent(ctx context.Context, id string, cfg string) (*protos.EventOutcome, StoreErr) {
+	key := NewKeyForOutcome(id, csm.keyName(cfg))
 	var outcome protos.EventOutcome
-	err := csm.get(key, &outcome)
+	err := csm.get(ctx, key, &outcome)
 	if err != nil {
 		csm.logger.Error().Err(err).Msgf("cannot retrieve outcome for event %s", key)
 		return nil, err
@@ -375,22 +1310,50 @@ func (csm *RedisStore) GetOutcomeForEvent(id string, cfg string) (*protos.EventO
 	return &outcome, nil
 }
 
+func (csm *RedisStore) DeleteEvent(ctx context.Context, id string, cfg string) StoreErr {
+	key := NewKeyForEvent(id, csm.keyName(cfg))
+	var deleted int64
+	err := csm.retry(ctx, key, func(ctx context.Context) error {
+		// The keys are deleted separately, as they may be in different slots of a cluster.
+		cmds, err := csm.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.Del(ctx, NewKeyForOutcome(id, csm.keyName(cfg)))
+			return nil
+		})
+		deleted = 0
+		for _, cmd := range cmds {
+			deleted += cmd.(*redis.IntCmd).Val()
+		}
+		return err
+	})
+	if err != nil {
+		csm.logger.Error().Err(err).Msgf("cannot delete event %s", key)
+		return err
+	}
+	if deleted == 0 {
+		return NotFoundError(key)
+	}
+	csm.logger.Debug().Msgf("deleted event %s", key)
+	return nil
+}
+
 /////// Constructor methods
 
 // NewRedisStoreWithDefaults creates a new StoreManager backed by a Redis cmd, with
 // all default settings, in a single node configuration.
 func NewRedisStoreWithDefaults(address string) StoreManager {
-	return NewRedisStore(address, false, DefaultRedisDb, DefaultTimeout, DefaultMaxRetries)
+	return NewRedisStore(address, false, DefaultRedisDb, DefaultTimeout,
+		NewRetryPolicy(DefaultMaxRetries))
 }
 
 // NewRedisStore creates a new StoreManager backed by a Redis cmd, reachable at address, in
 // cluster configuration if isCluster is set to true.
 // The db value indicates which database to use.
 //
-// Some store queries (typically the get and put actions) will be retried up to maxRetries times,
-// if they time out after timeout expires.
+// Each store query times out after timeout expires; those which fail with a transient error
+// (see RetryPolicy) are retried as the retry policy dictates.
 // Use the [Health] function to check whether the store is reachable.
-func NewRedisStore(address string, isCluster bool, db int, timeout time.Duration, maxRetries int) StoreManager {
+func NewRedisStore(address string, isCluster bool, db int, timeout time.Duration, retry RetryPolicy) StoreManager {
 	logger := zlog.With().Str("logger", fmt.Sprintf("redis://%s/%d", address, db)).Logger()
 
 	var tlsConfig *tls.Config
@@ -415,9 +1378,11 @@ func NewRedisStore(address string, isCluster bool, db int, timeout time.Duration
 	}
 
 	return &RedisStore{
-		logger:     logger,
-		client:     client,
-		Timeout:    timeout,
-		MaxRetries: maxRetries,
+		logger:      logger,
+		client:      client,
+		isCluster:   isCluster,
+		Timeout:     timeout,
+		Retry:       retry,
+		DedupWindow: DefaultDedupWindow,
 	}
 }
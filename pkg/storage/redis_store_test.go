@@ -23,7 +23,9 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"strings"
+	"time"
 )
 
 const (
@@ -48,6 +50,11 @@ func setupStoreRedis() (storage2.StoreManager, *redis.Client) {
 	return store, rdb
 }
 
+// dueTimer matches the DueTimer of the FSM `id`, regardless of when it was due.
+func dueTimer(id, state, event string) OmegaMatcher {
+	return SatisfyAll(HaveField("Id", id), HaveField("State", state), HaveField("Event", event))
+}
+
 func storeSomeFSMs(store storage2.StoreManager, count int) {
 	for id := 1; id < count; id++ {
 		fsm := &protos.FiniteStateMachine{
@@ -59,8 +66,8 @@ func storeSomeFSMs(store storage2.StoreManager, count int) {
 			},
 		}
 		fsmId := fmt.Sprintf(fsmIdFmt, id)
-		Ω(store.PutStateMachine(fsmId, fsm)).ToNot(HaveOccurred())
-		Ω(store.UpdateState("orders", fsmId, "", fsm.State))
+		Ω(store.PutStateMachine(bkgnd, fsmId, fsm)).ToNot(HaveOccurred())
+		Ω(store.UpdateState(bkgnd, "orders", fsmId, "", fsm.State))
 	}
 }
 
@@ -95,20 +102,20 @@ var _ = Describe("Redis Store", func() {
 			Ω(err).ToNot(HaveOccurred())
 			Ω(res).To(Equal("OK"))
 
-			data, err := store.GetConfig(id)
+			data, err := store.GetConfig(bkgnd, id)
 			Ω(err).To(BeNil())
 			Ω(data).ToNot(BeNil())
 			Ω(api.GetVersionId(data)).To(Equal(api.GetVersionId(cfg)))
 		})
 		It("will return orderly if the id does not exist", func() {
 			id := "fake"
-			data, err := store.GetConfig(id)
+			data, err := store.GetConfig(bkgnd, id)
 			Ω(err).ToNot(BeNil())
 			Ω(data).To(BeNil())
 		})
 		It("can save configurations", func() {
 			var found protos.Configuration
-			Ω(store.PutConfig(cfg)).ToNot(HaveOccurred())
+			Ω(store.PutConfig(bkgnd, cfg)).ToNot(HaveOccurred())
 			val, err := rdb.Get(context.Background(),
 				storage2.NewKeyForConfig(api.GetVersionId(cfg))).Bytes()
 			Ω(err).ToNot(HaveOccurred())
@@ -117,11 +124,11 @@ var _ = Describe("Redis Store", func() {
 			Ω(&found).To(Respect(cfg))
 		})
 		It("will not save a duplicate configurations", func() {
-			Ω(store.PutConfig(cfg)).ToNot(HaveOccurred())
-			Ω(store.PutConfig(cfg)).To(HaveOccurred())
+			Ω(store.PutConfig(bkgnd, cfg)).ToNot(HaveOccurred())
+			Ω(store.PutConfig(bkgnd, cfg)).To(HaveOccurred())
 		})
 		It("should not fail for a non-existent FSM", func() {
-			_, err := store.GetStateMachine("fake", "bad-config")
+			_, err := store.GetStateMachine(bkgnd, "fake", "bad-config")
 			Ω(err).ToNot(BeNil())
 		})
 		It("can get an FSM back", func() {
@@ -139,7 +146,7 @@ var _ = Describe("Redis Store", func() {
 			Ω(err).ToNot(HaveOccurred())
 			Ω(res).To(Equal("OK"))
 
-			data, err := store.GetStateMachine(id, "cfg_id")
+			data, err := store.GetStateMachine(bkgnd, id, "cfg_id")
 			Ω(err).To(BeNil())
 			Ω(data).ToNot(BeNil())
 			Ω(data).To(Respect(fsm))
@@ -155,7 +162,7 @@ var _ = Describe("Redis Store", func() {
 					{Transition: &protos.Transition{Event: "shipped"}, Originator: "bot"},
 				},
 			}
-			Ω(store.PutStateMachine(id, fsm)).ToNot(HaveOccurred())
+			Ω(store.PutStateMachine(bkgnd, id, fsm)).ToNot(HaveOccurred())
 			val, err := rdb.Get(context.Background(), storage2.NewKeyForMachine(id, cfgName)).Bytes()
 			Ω(err).ToNot(HaveOccurred())
 
@@ -178,14 +185,14 @@ var _ = Describe("Redis Store", func() {
 			_, err := rdb.Set(context.Background(), key, val, storage2.NeverExpire).Result()
 			Ω(err).ToNot(HaveOccurred())
 
-			found, err := store.GetEvent(id, cfgName)
+			found, err := store.GetEvent(bkgnd, id, cfgName)
 			Ω(err).To(BeNil())
 			Ω(found).To(Respect(ev))
 		})
 		It("can save events", func() {
 			ev := api.NewEvent("confirmed")
 			id := ev.EventId
-			Ω(store.PutEvent(ev, cfgName, storage2.NeverExpire)).ToNot(HaveOccurred())
+			Ω(store.PutEvent(bkgnd, ev, cfgName, storage2.NeverExpire)).ToNot(HaveOccurred())
 			val, err := rdb.Get(context.Background(), storage2.NewKeyForEvent(id, cfgName)).Bytes()
 			Ω(err).ToNot(HaveOccurred())
 
@@ -194,7 +201,7 @@ var _ = Describe("Redis Store", func() {
 			Ω(&found).To(Respect(ev))
 		})
 		It("will return an error for a non-existent event", func() {
-			_, err := store.GetEvent("fake", cfgName)
+			_, err := store.GetEvent(bkgnd, "fake", cfgName)
 			Ω(err).To(HaveOccurred())
 		})
 		It("can save an event Outcome", func() {
@@ -206,7 +213,7 @@ var _ = Describe("Redis Store", func() {
 				Id:      "1234-feed-beef",
 				Details: "this was just a test",
 			}
-			Ω(store.AddEventOutcome(id, cfg, response, storage2.NeverExpire)).ToNot(HaveOccurred())
+			Ω(store.AddEventOutcome(bkgnd, id, cfg, response, storage2.NeverExpire)).ToNot(HaveOccurred())
 
 			key := storage2.NewKeyForOutcome(id, cfg)
 			val, err := rdb.Get(context.Background(), key).Bytes()
@@ -227,21 +234,21 @@ var _ = Describe("Redis Store", func() {
 			val, _ := proto.Marshal(response)
 			_, err := rdb.Set(context.Background(), key, val, storage2.NeverExpire).Result()
 			Ω(err).ToNot(HaveOccurred())
-			found, err := store.GetOutcomeForEvent(id, cfg)
+			found, err := store.GetOutcomeForEvent(bkgnd, id, cfg)
 			Ω(err).ToNot(HaveOccurred())
 			Ω(found).To(Respect(response))
 		})
 		It("should gracefully handle a nil Configuration", func() {
-			Ω(store.PutConfig(nil)).To(HaveOccurred())
+			Ω(store.PutConfig(bkgnd, nil)).To(HaveOccurred())
 		})
 		It("should gracefully handle a nil Statemachine", func() {
-			Ω(store.PutStateMachine("fake", nil)).To(HaveOccurred())
+			Ω(store.PutStateMachine(bkgnd, "fake", nil)).To(HaveOccurred())
 		})
 		It("should gracefully handle a nil Event", func() {
-			Ω(store.PutEvent(nil, cfgName, storage2.NeverExpire)).To(HaveOccurred())
+			Ω(store.PutEvent(bkgnd, nil, cfgName, storage2.NeverExpire)).To(HaveOccurred())
 		})
 		It("should gracefully handle a nil Outcome", func() {
-			Ω(store.AddEventOutcome("fake", "test", nil,
+			Ω(store.AddEventOutcome(bkgnd, "fake", "test", nil,
 				storage2.NeverExpire)).To(HaveOccurred())
 		})
 	})
@@ -260,24 +267,24 @@ var _ = Describe("Redis Store", func() {
 
 		It("can get all configuration names", func() {
 			for _, name := range []string{cfgName, "devices", "users"} {
-				Ω(store.PutConfig(&protos.Configuration{Name: name, Version: "v3", StartingState: "start"})).
+				Ω(store.PutConfig(bkgnd, &protos.Configuration{Name: name, Version: "v3", StartingState: "start"})).
 					ToNot(HaveOccurred())
 			}
-			configs := store.GetAllConfigs()
+			configs := store.GetAllConfigs(bkgnd)
 			Ω(len(configs)).To(Equal(3))
 			Ω(configs).To(ContainElements(cfgName, "devices", "users"))
 		})
 		It("can get all versions of a configuration", func() {
 			for _, version := range []string{"v1alpha1", "v1beta", "v1"} {
-				Ω(store.PutConfig(&protos.Configuration{Name: cfgName, Version: version, StartingState: "start"})).
+				Ω(store.PutConfig(bkgnd, &protos.Configuration{Name: cfgName, Version: version, StartingState: "start"})).
 					ToNot(HaveOccurred())
 			}
-			configs := store.GetAllVersions(cfgName)
+			configs := store.GetAllVersions(bkgnd, cfgName)
 			Ω(len(configs)).To(Equal(3))
 			Ω(configs).To(ContainElements("orders:v1alpha1", "orders:v1beta", "orders:v1"))
 		})
 		It("returns an empty slice for a non-existent config", func() {
-			configs := store.GetAllVersions("fake")
+			configs := store.GetAllVersions(bkgnd, "fake")
 			Ω(len(configs)).To(Equal(0))
 		})
 	})
@@ -294,12 +301,65 @@ var _ = Describe("Redis Store", func() {
 		}, 0.2)
 		It("finds them by state", func() {
 			storeSomeFSMs(store, 5)
-			res := store.GetAllInState(cfgName, "in_transit")
+			res := store.GetAllInState(bkgnd, cfgName, "in_transit")
 			Ω(len(res)).To(Equal(4))
 			for id := 1; id < 5; id++ {
 				Ω(res).To(ContainElement(fmt.Sprintf(fsmIdFmt, id)))
 			}
 		})
+		It("scans those stored before they were indexed", func() {
+			Ω(store.PutConfig(bkgnd, &protos.Configuration{Name: cfgName, Version: "v4",
+				States: []string{"pending", "in_transit"}, StartingState: "pending"})).To(Succeed())
+			shipped := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+			// FSMs as stored by earlier releases: only in the `state` SETs, and not in the index.
+			for id, state := range map[string]string{"fsm-1": "pending", "fsm-2": "in_transit"} {
+				fsm := &protos.FiniteStateMachine{ConfigId: configId, State: state}
+				if state == "in_transit" {
+					fsm.History = []*protos.Event{{Timestamp: timestamppb.New(shipped),
+						Transition: &protos.Transition{From: "pending", To: state, Event: "ship"}}}
+				}
+				data, err := proto.Marshal(fsm)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(rdb.Set(bkgnd, storage2.NewKeyForMachine(id, cfgName), data,
+					storage2.NeverExpire).Err()).ToNot(HaveOccurred())
+				Ω(rdb.SAdd(bkgnd, storage2.NewKeyForMachinesByState(cfgName, state), id).Err()).
+					ToNot(HaveOccurred())
+			}
+			// A stale member, whose FSM is gone.
+			Ω(rdb.SAdd(bkgnd, storage2.NewKeyForMachinesByState(cfgName, "pending"), "fsm-3").Err()).
+				ToNot(HaveOccurred())
+			Ω(rdb.Exists(bkgnd, storage2.NewKeyForMachinesIndex(cfgName)).Val()).To(BeZero())
+
+			var found []string
+			scan := func(filter storage2.ScanFilter) []string {
+				found = nil
+				Ω(store.ScanStateMachines(bkgnd, cfgName, filter,
+					func(id string, _ *protos.FiniteStateMachine) error {
+						found = append(found, id)
+						return nil
+					})).To(Succeed())
+				return found
+			}
+			Ω(scan(storage2.ScanFilter{})).To(ConsistOf("fsm-1", "fsm-2"))
+			// They are indexed as last updated when their last event happened.
+			Ω(scan(storage2.ScanFilter{UpdatedAfter: shipped})).To(ConsistOf("fsm-2"))
+			Ω(scan(storage2.ScanFilter{UpdatedBefore: shipped})).To(ConsistOf("fsm-1"))
+		})
+		It("does not delete Configurations used by FSMs stored before they were indexed", func() {
+			Ω(store.PutConfig(bkgnd, &protos.Configuration{Name: cfgName, Version: "v4",
+				States: []string{"pending"}, StartingState: "pending"})).To(Succeed())
+			data, err := proto.Marshal(&protos.FiniteStateMachine{ConfigId: configId, State: "pending"})
+			Ω(err).ToNot(HaveOccurred())
+			Ω(rdb.Set(bkgnd, storage2.NewKeyForMachine("fsm-1", cfgName), data,
+				storage2.NeverExpire).Err()).ToNot(HaveOccurred())
+			Ω(rdb.SAdd(bkgnd, storage2.NewKeyForMachinesByState(cfgName, "pending"), "fsm-1").Err()).
+				ToNot(HaveOccurred())
+
+			Ω(store.DeleteConfiguration(bkgnd, configId, false)).To(MatchError(storage2.ErrInUse))
+			Ω(store.DeleteStateMachine(bkgnd, "fsm-1", cfgName)).To(Succeed())
+			Ω(store.DeleteConfiguration(bkgnd, configId, false)).To(Succeed())
+			Ω(store.GetAllConfigs(bkgnd)).ToNot(ContainElement(cfgName))
+		})
 		When("transitioning state", func() {
 			BeforeEach(func() {
 				storeSomeFSMs(store, 10)
@@ -307,22 +367,482 @@ var _ = Describe("Redis Store", func() {
 			It("finds them", func() {
 				for id := 3; id < 6; id++ {
 					fsmId := fmt.Sprintf(fsmIdFmt, id)
-					Ω(store.UpdateState(cfgName, fsmId, "in_transit", "shipped"))
+					Ω(store.UpdateState(bkgnd, cfgName, fsmId, "in_transit", "shipped"))
 				}
-				res := store.GetAllInState(cfgName, "shipped")
+				res := store.GetAllInState(bkgnd, cfgName, "shipped")
 				Ω(len(res)).To(Equal(3))
 				for id := 3; id < 6; id++ {
 					Ω(res).To(ContainElement(fmt.Sprintf(fsmIdFmt, id)))
 				}
-				res = store.GetAllInState(cfgName, "in_transit")
+				res = store.GetAllInState(bkgnd, cfgName, "in_transit")
 				Ω(len(res)).To(Equal(6))
 			})
 			It("will remove with an empty newState", func() {
-				Ω(store.UpdateState(cfgName, "fsm-1", "in_transit", "")).To(Succeed())
-				res := store.GetAllInState(cfgName, "in_transit")
+				Ω(store.UpdateState(bkgnd, cfgName, "fsm-1", "in_transit", "")).To(Succeed())
+				res := store.GetAllInState(bkgnd, cfgName, "in_transit")
 				Ω(res).ToNot(ContainElement("fsm-1"))
 			})
+			It("finds them by any of the compound states they are in", func() {
+				Ω(store.UpdateState(bkgnd, cfgName, "fsm-1", "in_transit", "in_transit/truck")).To(Succeed())
+				Ω(store.UpdateState(bkgnd, cfgName, "fsm-2", "in_transit", "in_transit/plane")).To(Succeed())
+				Ω(store.GetAllInState(bkgnd, cfgName, "in_transit/truck")).To(ConsistOf("fsm-1"))
+				Ω(store.GetAllInState(bkgnd, cfgName, "in_transit")).To(HaveLen(9))
+
+				Ω(store.UpdateState(bkgnd, cfgName, "fsm-1", "in_transit/truck", "shipped")).To(Succeed())
+				Ω(store.GetAllInState(bkgnd, cfgName, "in_transit/truck")).To(BeEmpty())
+				Ω(store.GetAllInState(bkgnd, cfgName, "in_transit")).ToNot(ContainElement("fsm-1"))
+				Ω(store.GetAllInState(bkgnd, cfgName, "in_transit")).To(ContainElement("fsm-2"))
+			})
+		})
+		When("reaching a terminal state", func() {
+			BeforeEach(func() {
+				Ω(store.PutConfig(bkgnd, &protos.Configuration{
+					Name:          cfgName,
+					Version:       "v4",
+					States:        []string{"in_transit", "delivered"},
+					StartingState: "in_transit",
+					Transitions: []*protos.Transition{
+						{From: "in_transit", To: "delivered", Event: "deliver"},
+						{From: "delivered", To: api.FinalState},
+					},
+				})).To(Succeed())
+				storeSomeFSMs(store, 3)
+			})
+			It("records their completion", func() {
+				sm, err := store.TxProcessEvent(bkgnd, "fsm-1", cfgName, api.NewEvent("deliver"))
+				Ω(err).ToNot(HaveOccurred())
+				Ω(sm.IsCompleted()).To(BeTrue())
+				Ω(sm.FSM.State).To(Equal("delivered"))
+				completed, err := rdb.ZRange(context.Background(),
+					storage2.NewKeyForCompleted(cfgName), 0, -1).Result()
+				Ω(err).ToNot(HaveOccurred())
+				Ω(completed).To(ConsistOf("fsm-1"))
+			})
+			It("can purge them after the retention period", func() {
+				_, err := store.TxProcessEvent(bkgnd, "fsm-1", cfgName, api.NewEvent("deliver"))
+				Ω(err).ToNot(HaveOccurred())
+				purged, err := store.PurgeCompleted(bkgnd, cfgName, time.Hour)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(purged).To(Equal(0))
+
+				purged, err = store.PurgeCompleted(bkgnd, cfgName, -time.Second)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(purged).To(Equal(1))
+				_, err = store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+				Ω(storage2.IsNotFoundErr(err)).To(BeTrue())
+				Ω(store.GetAllInState(bkgnd, cfgName, "delivered")).To(BeEmpty())
+				Ω(store.GetAllInState(bkgnd, cfgName, "in_transit")).To(ConsistOf("fsm-2"))
+			})
+		})
+		When("transitions cause actions", func() {
+			BeforeEach(func() {
+				Ω(store.PutConfig(bkgnd, &protos.Configuration{
+					Name:          cfgName,
+					Version:       "v4",
+					States:        []string{"in_transit", "delivered"},
+					StartingState: "in_transit",
+					Transitions: []*protos.Transition{
+						{From: "in_transit", To: "delivered", Event: "deliver / notify, invoice"},
+						{From: "delivered", Event: "entry / archive"},
+					},
+				})).To(Succeed())
+				storeSomeFSMs(store, 2)
+			})
+			It("stores them to be dispatched, until acknowledged", func() {
+				_, err := store.TxProcessEvent(bkgnd, "fsm-1", cfgName, api.NewEvent("deliver"))
+				Ω(err).ToNot(HaveOccurred())
+				actions, err := store.ClaimActions(bkgnd, cfgName, 10, time.Hour)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(actions).To(HaveLen(3))
+				Ω(actions[0].Name).To(Equal("notify"))
+				Ω(actions[1].Name).To(Equal("invoice"))
+				Ω(actions[2].Name).To(Equal("archive"))
+				Ω(actions[2].FsmId).To(Equal("fsm-1"))
+
+				// Claimed actions are not claimed again until the lease expires.
+				again, err := store.ClaimActions(bkgnd, cfgName, 10, time.Hour)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(again).To(BeEmpty())
+
+				Ω(store.AckAction(bkgnd, cfgName, actions[0].Id)).To(Succeed())
+				Ω(rdb.Exists(context.Background(),
+					storage2.NewKeyForAction(actions[0].Id, cfgName)).Val()).To(BeZero())
+			})
+			It("claims them again if not acknowledged in time", func() {
+				_, err := store.TxProcessEvent(bkgnd, "fsm-1", cfgName, api.NewEvent("deliver"))
+				Ω(err).ToNot(HaveOccurred())
+				actions, err := store.ClaimActions(bkgnd, cfgName, 1, -time.Second)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(actions).To(HaveLen(1))
+				again, err := store.ClaimActions(bkgnd, cfgName, 10, time.Hour)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(again).To(HaveLen(3))
+			})
+			It("does not store them for rejected events", func() {
+				_, err := store.TxProcessEvent(bkgnd, "fsm-1", cfgName, api.NewEvent("lose"))
+				Ω(err).To(HaveOccurred())
+				actions, err := store.ClaimActions(bkgnd, cfgName, 10, time.Hour)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(actions).To(BeEmpty())
+			})
+		})
+		When("transitions update the FSM's data", func() {
+			BeforeEach(func() {
+				Ω(store.PutConfig(bkgnd, &protos.Configuration{
+					Name:          cfgName,
+					Version:       "v4",
+					States:        []string{"in_transit", "delivered"},
+					StartingState: "in_transit",
+					Transitions: []*protos.Transition{
+						{From: "in_transit", Event: "scan / incr(scans), set(location)"},
+						{From: "in_transit", To: "delivered", Event: "deliver [$data.scans > 1]"},
+					},
+				})).To(Succeed())
+				storeSomeFSMs(store, 2)
+			})
+			It("stores the data along with the FSM", func() {
+				evt := api.NewEvent("scan")
+				evt.Details = `{"location": "depot"}`
+				_, err := store.TxProcessEvent(bkgnd, "fsm-1", cfgName, evt)
+				Ω(err).ToNot(HaveOccurred())
+				_, err = store.TxProcessEvent(bkgnd, "fsm-1", cfgName, api.NewEvent("deliver"))
+				Ω(err).To(MatchError(api.GuardNotSatisfiedError))
+				_, err = store.TxProcessEvent(bkgnd, "fsm-1", cfgName, api.NewEvent("scan"))
+				Ω(err).ToNot(HaveOccurred())
+
+				fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+				Ω(err).ToNot(HaveOccurred())
+				data, err := api.GetData(fsm)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(data.AsMap()).To(Equal(map[string]interface{}{"scans": 2.0, "location": "depot"}))
+				_, err = store.TxProcessEvent(bkgnd, "fsm-1", cfgName, api.NewEvent("deliver"))
+				Ω(err).ToNot(HaveOccurred())
+			})
+		})
+		When("receiving the same event twice", func() {
+			BeforeEach(func() {
+				Ω(store.PutConfig(bkgnd, &protos.Configuration{
+					Name:          cfgName,
+					Version:       "v4",
+					States:        []string{"in_transit"},
+					StartingState: "in_transit",
+					Transitions: []*protos.Transition{
+						{From: "in_transit", Event: "scan / incr(scans)"},
+					},
+				})).To(Succeed())
+				storeSomeFSMs(store, 2)
+			})
+			It("processes it only once", func() {
+				evt := api.NewEvent("scan")
+				_, err := store.TxProcessEvent(bkgnd, "fsm-1", cfgName, evt)
+				Ω(err).ToNot(HaveOccurred())
+				_, err = store.TxProcessEvent(bkgnd, "fsm-1", cfgName, evt)
+				Ω(storage2.IsAlreadyProcessedErr(err)).To(BeTrue())
+				fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(fsm.History).To(HaveLen(1))
+
+				// The same event can still be sent to a different FSM.
+				_, err = store.TxProcessEvent(bkgnd, "fsm-2", cfgName, evt)
+				Ω(err).ToNot(HaveOccurred())
+			})
+			It("processes it again with deduplication disabled", func() {
+				store.SetDedupWindow(0)
+				evt := api.NewEvent("scan")
+				for i := 0; i < 2; i++ {
+					_, err := store.TxProcessEvent(bkgnd, "fsm-1", cfgName, evt)
+					Ω(err).ToNot(HaveOccurred())
+				}
+				fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(fsm.History).To(HaveLen(2))
+			})
+		})
+		When("migrating to a new version", func() {
+			var migration *api.Migration
+			BeforeEach(func() {
+				v4 := &protos.Configuration{
+					Name:          cfgName,
+					Version:       "v4",
+					States:        []string{"in_transit", "delivered"},
+					StartingState: "in_transit",
+					Transitions: []*protos.Transition{
+						{From: "in_transit", To: "delivered", Event: "deliver"},
+					},
+				}
+				v5 := &protos.Configuration{
+					Name:          cfgName,
+					Version:       "v5",
+					States:        []string{"shipping", "shipping/truck", "delivered"},
+					StartingState: "shipping/truck",
+					Transitions: []*protos.Transition{
+						{From: "shipping", To: "delivered", Event: "deliver"},
+						{From: "shipping/truck", To: "delivered", Event: "lose after(1h)"},
+						{From: "delivered", To: api.FinalState},
+					},
+				}
+				Ω(store.PutConfig(bkgnd, v4)).To(Succeed())
+				Ω(store.PutConfig(bkgnd, v5)).To(Succeed())
+				var err error
+				migration, err = api.NewMigration(v4, v5, map[string]string{"in_transit": "shipping/truck"})
+				Ω(err).ToNot(HaveOccurred())
+				storeSomeFSMs(store, 6)
+			})
+			It("moves a single FSM", func() {
+				ok, err := store.MigrateStateMachine(bkgnd, "fsm-1", migration)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(ok).To(BeTrue())
+				fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(fsm.ConfigId).To(Equal("orders:v5"))
+				Ω(fsm.State).To(Equal("shipping/truck"))
+				Ω(fsm.History).To(HaveLen(3))
+				Ω(store.GetAllInState(bkgnd, cfgName, "in_transit")).ToNot(ContainElement("fsm-1"))
+				Ω(store.GetAllInState(bkgnd, cfgName, "shipping")).To(ConsistOf("fsm-1"))
+				due, err := store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(2*time.Hour), time.Hour)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(due).To(ConsistOf(dueTimer("fsm-1", "shipping/truck", "lose")))
+
+				ok, err = store.MigrateStateMachine(bkgnd, "fsm-1", migration)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(ok).To(BeFalse())
+			})
+			It("moves all FSMs in batches, and can be resumed", func() {
+				migrator := storage2.NewMigrator(store, migration)
+				migrator.BatchSize = 2
+				// SSCAN may return more FSMs than the batch size, so the first batch may
+				// well be the last one.
+				migrated, _, err := migrator.Next(bkgnd, "in_transit")
+				Ω(err).ToNot(HaveOccurred())
+				Ω(migrated).ToNot(BeEmpty())
+
+				resumed := storage2.NewMigrator(store, migration)
+				resumed.Cursor = migrator.Cursor
+				count, err := resumed.Run(bkgnd, "in_transit")
+				Ω(err).ToNot(HaveOccurred())
+				Ω(len(migrated) + count).To(Equal(5))
+				Ω(store.GetAllInState(bkgnd, cfgName, "in_transit")).To(BeEmpty())
+				Ω(store.GetAllInState(bkgnd, cfgName, "shipping/truck")).To(HaveLen(5))
+			})
+		})
+		When("verifying FSMs against their history", func() {
+			BeforeEach(func() {
+				Ω(store.PutConfig(bkgnd, &protos.Configuration{
+					Name:          cfgName,
+					Version:       "v4",
+					States:        []string{"in_transit", "delivered"},
+					StartingState: "in_transit",
+					Transitions: []*protos.Transition{
+						{From: "in_transit", To: "delivered", Event: "deliver"},
+						{From: "delivered", To: api.FinalState},
+					},
+				})).To(Succeed())
+				// The FSM was delivered, but its state was never updated.
+				Ω(store.PutStateMachine(bkgnd, "fsm-1", &protos.FiniteStateMachine{
+					ConfigId: configId,
+					State:    "in_transit",
+					History: []*protos.Event{{
+						Transition: &protos.Transition{From: "in_transit", To: "delivered", Event: "deliver"},
+					}},
+				})).To(Succeed())
+				Ω(store.UpdateState(bkgnd, cfgName, "fsm-1", "", "in_transit")).To(Succeed())
+			})
+			It("reports and repairs inconsistencies", func() {
+				v, err := store.VerifyStateMachine(bkgnd, "fsm-1", cfgName, false)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(v.IsConsistent()).To(BeFalse())
+				Ω(v.State).To(Equal("in_transit"))
+				Ω(v.Replayed).To(Equal("delivered"))
+				Ω(v.MissingFrom).To(Equal([]string{"delivered"}))
+				Ω(v.ExtraIn).To(Equal([]string{"in_transit"}))
+				Ω(v.Repaired).To(BeFalse())
+
+				verified, inconsistent, err := storage2.VerifyAll(bkgnd, store, cfgName, nil, true)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(verified).To(Equal(1))
+				Ω(inconsistent).To(HaveLen(1))
+				Ω(inconsistent[0].Repaired).To(BeTrue())
+
+				fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(fsm.State).To(Equal("delivered"))
+				Ω(store.GetAllInState(bkgnd, cfgName, "in_transit")).To(BeEmpty())
+				Ω(store.GetAllInState(bkgnd, cfgName, "delivered")).To(ConsistOf("fsm-1"))
+				v, err = store.VerifyStateMachine(bkgnd, "fsm-1", cfgName, false)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(v.IsConsistent()).To(BeTrue())
+			})
+			It("does not repair FSMs with invalid histories", func() {
+				storeSomeFSMs(store, 2)
+				v, err := store.VerifyStateMachine(bkgnd, "fsm-1", cfgName, true)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(v.Error).To(ContainSubstring("invalid history"))
+				Ω(v.Repaired).To(BeFalse())
+			})
+		})
+		When("rolling back FSMs", func() {
+			BeforeEach(func() {
+				Ω(store.PutConfig(bkgnd, &protos.Configuration{
+					Name:          cfgName,
+					Version:       "v4",
+					States:        []string{"in_transit", "delivered", "lost"},
+					StartingState: "in_transit",
+					Transitions: []*protos.Transition{
+						{From: "in_transit", To: "delivered", Event: "deliver"},
+						{From: "in_transit", To: "lost", Event: "lose after(1h)"},
+						{From: "delivered", To: api.FinalState},
+					},
+				})).To(Succeed())
+				Ω(store.PutStateMachine(bkgnd, "fsm-1", &protos.FiniteStateMachine{
+					ConfigId: configId,
+					State:    "in_transit",
+				})).To(Succeed())
+				Ω(store.UpdateState(bkgnd, cfgName, "fsm-1", "", "in_transit")).To(Succeed())
+				_, err := store.TxProcessEvent(bkgnd, "fsm-1", cfgName, api.NewEvent("deliver"))
+				Ω(err).ToNot(HaveOccurred())
+			})
+			It("reverts the FSM's state, SETs and timers", func() {
+				sm, err := store.RollbackStateMachine(bkgnd, "fsm-1", cfgName, 1)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(sm.FSM.State).To(Equal("in_transit"))
+
+				fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(fsm.State).To(Equal("in_transit"))
+				Ω(fsm.History).To(HaveLen(2))
+				Ω(api.IsRollback(fsm.History[1])).To(BeTrue())
+				Ω(store.GetAllInState(bkgnd, cfgName, "delivered")).To(BeEmpty())
+				Ω(store.GetAllInState(bkgnd, cfgName, "in_transit")).To(ConsistOf("fsm-1"))
+				due, err := store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(2*time.Hour), time.Hour)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(due).To(ConsistOf(dueTimer("fsm-1", "in_transit", "lose")))
+
+				v, err := store.VerifyStateMachine(bkgnd, "fsm-1", cfgName, false)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(v.IsConsistent()).To(BeTrue())
+			})
+			It("cannot revert more steps than were taken", func() {
+				_, err := store.RollbackStateMachine(bkgnd, "fsm-1", cfgName, 2)
+				Ω(err).To(HaveOccurred())
+				fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(fsm.State).To(Equal("delivered"))
+			})
+		})
+		When("running timers", func() {
+			var timers = []api.Timer{{State: "in_transit", Event: "lose", Timeout: time.Hour}}
+			BeforeEach(func() {
+				Ω(store.PutConfig(bkgnd, &protos.Configuration{
+					Name:          cfgName,
+					Version:       "v4",
+					States:        []string{"in_transit", "delivered", "lost"},
+					StartingState: "in_transit",
+					Transitions: []*protos.Transition{
+						{From: "in_transit", To: "delivered", Event: "deliver"},
+						{From: "in_transit", To: "lost", Event: "lose after(1h)"},
+					},
+				})).To(Succeed())
+				storeSomeFSMs(store, 3)
+				for _, id := range []string{"fsm-1", "fsm-2"} {
+					Ω(store.ScheduleTimers(bkgnd, cfgName, id, timers)).To(Succeed())
+				}
+			})
+			It("claims them only once they are due", func() {
+				due, err := store.ClaimDueTimers(bkgnd, cfgName, time.Now(), time.Hour)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(due).To(BeEmpty())
+
+				due, err = store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(2*time.Hour), time.Hour)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(due).To(ConsistOf(
+					dueTimer("fsm-1", "in_transit", "lose"),
+					dueTimer("fsm-2", "in_transit", "lose")))
+
+				due, err = store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(2*time.Hour), time.Hour)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(due).To(BeEmpty())
+			})
+			It("cancels them when the FSM leaves the state", func() {
+				_, err := store.TxProcessEvent(bkgnd, "fsm-1", cfgName, api.NewEvent("deliver"))
+				Ω(err).ToNot(HaveOccurred())
+				due, err := store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(2*time.Hour), time.Hour)
+				Ω(err).ToNot(HaveOccurred())
+				Ω(due).To(HaveLen(1))
+				Ω(due[0].Id).To(Equal("fsm-2"))
+			})
 		})
 	})
 
+	Context("with a Redis cluster", func() {
+		var store storage2.StoreManager
+		var rdb *redis.ClusterClient
+		var cfg *protos.Configuration
+		BeforeEach(func() {
+			store = storage2.NewRedisStore(clusterContainer.Address, true, storage2.DefaultRedisDb,
+				storage2.DefaultTimeout, storage2.NewRetryPolicy(storage2.DefaultMaxRetries))
+			rdb = redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{clusterContainer.Address}})
+			Ω(rdb.FlushDB(bkgnd).Err()).ToNot(HaveOccurred())
+			cfg = &protos.Configuration{
+				Name:          "my_conf",
+				Version:       "v1",
+				States:        []string{"start", "end"},
+				StartingState: "start",
+				Transitions:   []*protos.Transition{{From: "start", To: "end", Event: "finish"}},
+			}
+		})
+		AfterEach(func() {
+			_ = rdb.Close()
+		})
+		It("hash-tags all the keys of a Configuration", func() {
+			Ω(store.PutConfig(bkgnd, cfg)).To(Succeed())
+			fsm := &protos.FiniteStateMachine{ConfigId: "my_conf:v1", State: "start"}
+			Ω(store.PutStateMachine(bkgnd, "fsm-1", fsm)).To(Succeed())
+			_, err := store.TxProcessEvent(bkgnd, "fsm-1", "my_conf", api.NewEvent("finish"))
+			Ω(err).ToNot(HaveOccurred())
+
+			Ω(rdb.Exists(bkgnd, "configs#{my_conf}", "configs#{my_conf}:v1", "fsm:{my_conf}#fsm-1",
+				"fsm:{my_conf}:state#end").Result()).To(Equal(int64(4)))
+			// Keys in different hash slots cannot be looked up together.
+			for _, key := range []string{"configs#my_conf:v1", "fsm:my_conf#fsm-1"} {
+				Ω(rdb.Exists(bkgnd, key).Result()).To(BeZero())
+			}
+		})
+		It("can upgrade the keys stored by earlier releases", func() {
+			cfgData, _ := proto.Marshal(cfg)
+			fsm := &protos.FiniteStateMachine{ConfigId: "my_conf:v1", State: "start"}
+			fsmData, _ := proto.Marshal(fsm)
+			// The keys as stored before they were hash-tagged.
+			Ω(rdb.SAdd(bkgnd, storage2.ConfigsPrefix, "my_conf").Err()).ToNot(HaveOccurred())
+			Ω(rdb.SAdd(bkgnd, "configs#my_conf", "my_conf:v1").Err()).ToNot(HaveOccurred())
+			Ω(rdb.Set(bkgnd, "configs#my_conf:v1", cfgData, storage2.NeverExpire).Err()).ToNot(HaveOccurred())
+			Ω(rdb.Set(bkgnd, "fsm:my_conf#fsm-1", fsmData, storage2.NeverExpire).Err()).ToNot(HaveOccurred())
+			Ω(rdb.SAdd(bkgnd, "fsm:my_conf:state#start", "fsm-1").Err()).ToNot(HaveOccurred())
+			Ω(rdb.Set(bkgnd, "events:my_conf:outcome#evt-1", "ok", time.Hour).Err()).ToNot(HaveOccurred())
+			// Another Configuration, whose name starts with the same characters.
+			Ω(rdb.Set(bkgnd, "fsm:my_conf_2#fsm-1", fsmData, storage2.NeverExpire).Err()).ToNot(HaveOccurred())
+
+			upgraded, err := store.(*storage2.RedisStore).UpgradeKeys(bkgnd)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(upgraded).To(Equal(5))
+			Ω(store.GetAllVersions(bkgnd, "my_conf")).To(ConsistOf("my_conf:v1"))
+			found, err := store.GetConfig(bkgnd, "my_conf:v1")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(found).To(Respect(cfg))
+			_, err = store.GetStateMachine(bkgnd, "fsm-1", "my_conf")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(store.GetAllInState(bkgnd, "my_conf", "start")).To(ConsistOf("fsm-1"))
+			ttl, err := rdb.TTL(bkgnd, "events:{my_conf}:outcome#evt-1").Result()
+			Ω(err).ToNot(HaveOccurred())
+			Ω(ttl).To(BeNumerically(">", 0))
+			for _, key := range []string{"configs#my_conf", "fsm:my_conf#fsm-1"} {
+				Ω(rdb.Exists(bkgnd, key).Result()).To(BeZero())
+			}
+			Ω(rdb.Exists(bkgnd, "fsm:my_conf_2#fsm-1").Result()).To(Equal(int64(1)))
+
+			// Upgrading again is a no-op.
+			upgraded, err = store.(*storage2.RedisStore).UpgradeKeys(bkgnd)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(upgraded).To(BeZero())
+		})
+	})
 })
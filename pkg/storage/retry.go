@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	DefaultRetryInitialDelay = 50 * time.Millisecond
+	DefaultRetryMultiplier   = 2.0
+	DefaultRetryMaxDelay     = 2 * time.Second
+)
+
+// retryableRedisErrors are the prefixes of the errors returned by a Redis cluster while its
+// slots are being moved, or a node is failing over or loading its data.
+var retryableRedisErrors = []string{"MOVED ", "ASK ", "TRYAGAIN", "CLUSTERDOWN", "LOADING"}
+
+// A RetryPolicy decides which failed Redis operations are retried, how many times, and how
+// long to wait between attempts.
+//
+// The delay before the n-th retry grows exponentially, from `InitialDelay` by `Multiplier`
+// each time, up to `MaxDelay`; a random jitter of up to half the delay is subtracted, so
+// that clients which failed together do not all retry at the same time.
+type RetryPolicy struct {
+	InitialDelay time.Duration
+	Multiplier   float64
+	MaxDelay     time.Duration
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// Retryable returns true if an operation which failed with `err` may succeed if
+	// attempted again; if nil, IsRetryableErr is used.
+	Retryable func(err error) bool
+}
+
+// NewRetryPolicy returns the default RetryPolicy, making up to `maxAttempts` attempts.
+func NewRetryPolicy(maxAttempts int) RetryPolicy {
+	return RetryPolicy{
+		InitialDelay: DefaultRetryInitialDelay,
+		Multiplier:   DefaultRetryMultiplier,
+		MaxDelay:     DefaultRetryMaxDelay,
+		MaxAttempts:  maxAttempts,
+		Retryable:    IsRetryableErr,
+	}
+}
+
+// IsRetryableErr returns true for the errors which are usually transient: timeouts,
+// connections reset or closed by the server, and Redis cluster redirections and
+// failovers; StoreErrors are never retryable.
+func IsRetryableErr(err error) bool {
+	var storeErr *StoreError
+	var netErr net.Error
+	switch {
+	case err == nil, errors.As(err, &storeErr):
+		return false
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return true
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EPIPE), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	}
+	for _, prefix := range retryableRedisErrors {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRetryable returns true if an operation which failed with `err` should be attempted again.
+func (p *RetryPolicy) IsRetryable(err error) bool {
+	if p.Retryable == nil {
+		return IsRetryableErr(err)
+	}
+	return p.Retryable(err)
+}
+
+// Delay returns how long to wait before the `retry`-th retry (starting from 1).
+func (p *RetryPolicy) Delay(retry int) time.Duration {
+	delay := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(retry-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if delay < 1 {
+		return 0
+	}
+	return time.Duration(delay - rand.Float64()*delay/2)
+}
+
+// sleep waits for `delay`, and returns false, without waiting any longer, if `ctx` is
+// done in the meantime.
+func sleep(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// retry runs `op` until it succeeds, or fails with an error which is not retryable (see
+// RetryPolicy) or because a key watched by a transaction changed (redis.TxFailedErr), for
+// up to `MaxAttempts` times, waiting between attempts as the store's `Retry` policy dictates.
+//
+// Each attempt times out after the store's `Timeout`; if `ctx` is done, there are no
+// further attempts. Errors are converted to StoreErrors about `key` (see redisError).
+func (csm *RedisStore) retry(ctx context.Context, key string, op func(ctx context.Context) error) StoreErr {
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, csm.Timeout)
+		err := op(attemptCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			csm.logger.Debug().Err(err).Msgf("gave up accessing key `%s`", key)
+			return contextError(ctx, key)
+		}
+		conflict := errors.Is(err, redis.TxFailedErr)
+		if !conflict && !csm.Retry.IsRetryable(err) {
+			return redisError(err, key)
+		}
+		if attempt >= csm.Retry.MaxAttempts {
+			csm.logger.Error().Err(err).Msgf("max retries reached accessing key `%s`, giving up", key)
+			if conflict {
+				return TooManyAttempts(key)
+			}
+			return redisError(err, key)
+		}
+		delay := csm.Retry.Delay(attempt)
+		csm.logger.Trace().Err(err).Msgf("retrying key `%s` after %v, attempts left: %d", key,
+			delay, csm.Retry.MaxAttempts-attempt)
+		if !sleep(ctx, delay) {
+			return contextError(ctx, key)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	storage2 "github.com/massenz/go-statemachine/pkg/storage"
+)
+
+var _ = Describe("Retry Policy", func() {
+	It("retries transient errors", func() {
+		Ω(storage2.IsRetryableErr(context.DeadlineExceeded)).To(BeTrue())
+		Ω(storage2.IsRetryableErr(fmt.Errorf("read: %w", syscall.ECONNRESET))).To(BeTrue())
+		Ω(storage2.IsRetryableErr(io.EOF)).To(BeTrue())
+		Ω(storage2.IsRetryableErr(errors.New("MOVED 3999 127.0.0.1:6381"))).To(BeTrue())
+		Ω(storage2.IsRetryableErr(errors.New("TRYAGAIN Multiple keys request during rehashing of slot"))).To(
+			BeTrue())
+	})
+	It("does not retry other errors", func() {
+		Ω(storage2.IsRetryableErr(nil)).To(BeFalse())
+		Ω(storage2.IsRetryableErr(redis.Nil)).To(BeFalse())
+		Ω(storage2.IsRetryableErr(errors.New("WRONGTYPE Operation against a key"))).To(BeFalse())
+		Ω(storage2.IsRetryableErr(storage2.TimeoutError("fsm:test#fake-fsm"))).To(BeFalse())
+		Ω(storage2.IsRetryableErr(context.Canceled)).To(BeFalse())
+	})
+	It("uses a custom classifier, if any", func() {
+		policy := storage2.NewRetryPolicy(3)
+		policy.Retryable = func(err error) bool { return err == io.ErrClosedPipe }
+		Ω(policy.IsRetryable(io.ErrClosedPipe)).To(BeTrue())
+		Ω(policy.IsRetryable(io.EOF)).To(BeFalse())
+	})
+	It("backs off exponentially, with jitter, up to the max delay", func() {
+		policy := storage2.RetryPolicy{
+			InitialDelay: 100 * time.Millisecond,
+			Multiplier:   2,
+			MaxDelay:     time.Second,
+			MaxAttempts:  10,
+		}
+		for retry, max := range map[int]time.Duration{
+			1: 100 * time.Millisecond,
+			2: 200 * time.Millisecond,
+			3: 400 * time.Millisecond,
+			5: time.Second,
+			9: time.Second,
+		} {
+			for i := 0; i < 20; i++ {
+				delay := policy.Delay(retry)
+				Ω(delay).To(BeNumerically("<=", max))
+				Ω(delay).To(BeNumerically(">=", max/2))
+			}
+		}
+	})
+	Context("when Redis cannot be reached", func() {
+		var store storage2.StoreManager
+		BeforeEach(func() {
+			// Nothing listens on port 1, so all connections are refused.
+			store = storage2.NewRedisStore("localhost:1", false, storage2.DefaultRedisDb,
+				storage2.DefaultTimeout, storage2.RetryPolicy{
+					InitialDelay: 10 * time.Millisecond,
+					Multiplier:   2,
+					MaxDelay:     time.Minute,
+					MaxAttempts:  3,
+				})
+		})
+		It("gives up after the max attempts", func() {
+			_, err := store.GetConfig(bkgnd, "test:v1")
+			Ω(err).To(MatchError(storage2.ErrStore))
+		})
+		It("stops retrying as soon as the context is done", func() {
+			store.(*storage2.RedisStore).Retry.InitialDelay = time.Minute
+			ctx, cancel := context.WithTimeout(bkgnd, 100*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			_, err := store.GetConfig(ctx, "test:v1")
+			Ω(err).To(MatchError(storage2.ErrTimeout))
+			Ω(time.Since(start)).To(BeNumerically("<", time.Second))
+		})
+	})
+})
@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/massenz/go-statemachine/pkg/api"
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+// A ScanFilter selects the FSMs scanned by ScanStateMachines: those which match all of its
+// non-empty fields.
+type ScanFilter struct {
+	// Version is the version of the FSMs' Configuration.
+	Version string
+	// States are the states the FSMs may be in, or be nested in (see api.InState).
+	States []string
+	// UpdatedAfter and UpdatedBefore bound the time at which the FSMs were last stored:
+	// the former is inclusive, the latter is not.
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+}
+
+// A ScanFunc is called by ScanStateMachines with each of the FSMs it finds; if it returns an
+// error, the scan stops.
+type ScanFunc func(id string, fsm *protos.FiniteStateMachine) error
+
+// updatedBetween returns true if the (Unix, in milliseconds) time `updated` at which an FSM
+// was stored is within the filter's bounds.
+func (f *ScanFilter) updatedBetween(updated float64) bool {
+	if !f.UpdatedAfter.IsZero() && updated < float64(f.UpdatedAfter.UnixMilli()) {
+		return false
+	}
+	if !f.UpdatedBefore.IsZero() && updated >= float64(f.UpdatedBefore.UnixMilli()) {
+		return false
+	}
+	return true
+}
+
+// matches returns true if the `fsm`, configured with `cfgName`, is configured with the
+// filter's version, and is in one of its states.
+func (f *ScanFilter) matches(cfgName string, fsm *protos.FiniteStateMachine) bool {
+	if f.Version != "" && fsm.GetConfigId() != cfgName+api.ConfigurationVersionSeparator+f.Version {
+		return false
+	}
+	if len(f.States) == 0 {
+		return true
+	}
+	for _, state := range f.States {
+		if api.InState(fsm.GetState(), state) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotInUse returns an InUseError if any FSM is configured with the Configuration `cfg`.
+//
+// This relies on ScanStateMachines finding all the FSMs, including those which were stored
+// before they were indexed (see RedisStore.backfillIndex): if they cannot all be found, the
+// scan fails, and so does the check.
+func checkNotInUse(ctx context.Context, store FSMStore, cfg *protos.Configuration) StoreErr {
+	versionId := api.GetVersionId(cfg)
+	return store.ScanStateMachines(ctx, cfg.Name, ScanFilter{Version: cfg.Version},
+		func(id string, _ *protos.FiniteStateMachine) error {
+			return InUseError(NewKeyForConfig(versionId))
+		})
+}
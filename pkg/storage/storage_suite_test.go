@@ -19,19 +19,27 @@ import (
 	. "github.com/onsi/gomega"
 )
 
+// bkgnd is the context with which the store is accessed by the tests.
+var bkgnd = context.Background()
+
 func TestStorage(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Storage Suite")
 }
 
 var container *internals.Container
+
+// clusterContainer runs a Redis Cluster, for the tests of the keys used with clusters.
+var clusterContainer *internals.Container
 var _ = BeforeSuite(func() {
 	var err error
 	container, err = internals.NewRedisContainer(context.Background())
 	Ω(err).ToNot(HaveOccurred())
 	Ω(container).ToNot(BeNil())
+	clusterContainer, err = internals.NewRedisClusterContainer(context.Background())
+	Ω(err).ToNot(HaveOccurred())
 	// Note the timeout here is in seconds (and it's not a time.Duration either)
-}, 5.0)
+}, 10.0)
 
 var _ = AfterSuite(func() {
 	if container != nil {
@@ -39,4 +47,8 @@ var _ = AfterSuite(func() {
 		err := container.Stop(context.Background(), &timeout)
 		Expect(err).ToNot(HaveOccurred())
 	}
-}, 2.0)
+	if clusterContainer != nil {
+		timeout, _ := time.ParseDuration("2s")
+		Expect(clusterContainer.Stop(context.Background(), &timeout)).ToNot(HaveOccurred())
+	}
+}, 4.0)
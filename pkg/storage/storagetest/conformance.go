@@ -0,0 +1,776 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+// Package storagetest is a test kit for StoreManager implementations: RunConformance checks
+// that a store behaves like the RedisStore, regardless of how it keeps its data.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/massenz/go-statemachine/pkg/api"
+	"github.com/massenz/go-statemachine/pkg/storage"
+	protos "github.com/massenz/statemachine-proto/golang/api"
+)
+
+const (
+	cfgName = "conformance"
+	// ttl is the time-to-live of the expiring Events and outcomes, and expiryTimeout how
+	// long to wait for them to expire.
+	ttl           = 50 * time.Millisecond
+	expiryTimeout = 2 * time.Second
+	// concurrency is the number of Events sent concurrently to the same FSM.
+	concurrency = 10
+)
+
+// bkgnd is the context with which the stores are accessed by the conformance tests.
+var bkgnd = context.Background()
+
+// A Factory returns a new, empty, store for each of the conformance tests; any clean-up
+// should be registered with `t.Cleanup`.
+type Factory func(t *testing.T) storage.StoreManager
+
+// A conformanceTest is run against a store with the `v1` and `v2` Configurations.
+type conformanceTest struct {
+	name string
+	test func(t *testing.T, g *WithT, store storage.StoreManager)
+}
+
+// RunConformance runs, each as a subtest with a new store obtained from the `factory`, the
+// conformance tests, which exercise all the methods of the StoreManager: a store which
+// passes them all can be used by the server in place of the RedisStore.
+func RunConformance(t *testing.T, factory Factory) {
+	for _, ct := range conformanceTests {
+		ct := ct
+		t.Run(ct.name, func(t *testing.T) {
+			g := NewWithT(t)
+			store := factory(t)
+			g.Expect(store).ToNot(BeNil())
+			g.Expect(store.PutConfig(bkgnd, newConfig("v1"))).To(Succeed())
+			g.Expect(store.PutConfig(bkgnd, newConfig("v2"))).To(Succeed())
+			ct.test(t, g, store)
+		})
+	}
+}
+
+// newConfig returns the Configuration used by the conformance tests; the `v2` version
+// only differs in its version.
+func newConfig(version string) *protos.Configuration {
+	return &protos.Configuration{
+		Name:    cfgName,
+		Version: version,
+		States: []string{"pending", "shipping", "shipping/packed", "shipping/in_transit",
+			"delivered", "lost"},
+		StartingState: "pending",
+		Transitions: []*protos.Transition{
+			{From: "pending", Event: "scan / incr(scans)"},
+			{From: "pending", To: "shipping/packed", Event: "pack / label"},
+			{From: "shipping/packed", To: "shipping/in_transit", Event: "ship"},
+			{From: "shipping/in_transit", To: "lost", Event: "lose after(1h)"},
+			{From: "shipping/in_transit", To: "delivered", Event: "deliver / notify, invoice"},
+			{From: "delivered", To: api.FinalState},
+			{From: "lost", To: api.FinalState},
+		},
+	}
+}
+
+// putFSM stores a new FSM `id`, in the `pending` state of the `v1` Configuration.
+func putFSM(g *WithT, store storage.StoreManager, id string) {
+	g.Expect(store.PutStateMachine(bkgnd, id, &protos.FiniteStateMachine{
+		ConfigId: api.GetVersionId(newConfig("v1")),
+		State:    "pending",
+	})).To(Succeed())
+	g.Expect(store.UpdateState(bkgnd, cfgName, id, "", "pending")).To(Succeed())
+}
+
+// send sends the events, one after the other, to the FSM `id`.
+func send(g *WithT, store storage.StoreManager, id string, events ...string) *api.ConfiguredStateMachine {
+	var sm *api.ConfiguredStateMachine
+	var err error
+	for _, evt := range events {
+		sm, err = store.TxProcessEvent(bkgnd, id, cfgName, api.NewEvent(evt))
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+	return sm
+}
+
+// expectStoreError checks that `err` is a StoreError of the given `kind`, about `key`.
+func expectStoreError(g *WithT, err error, kind error, key string) {
+	g.Expect(err).To(MatchError(kind))
+	var storeErr *storage.StoreError
+	g.Expect(errors.As(err, &storeErr)).To(BeTrue())
+	g.Expect(storeErr.Key).To(Equal(key))
+}
+
+// allPages returns the items of all the Pages returned by `get`, asking for `size` items
+// at a time.
+func allPages(g *WithT, size int, get func(req storage.PageRequest) (*storage.Page, storage.StoreErr)) []string {
+	var items []string
+	req := storage.PageRequest{Size: size}
+	for {
+		page, err := get(req)
+		g.Expect(err).ToNot(HaveOccurred())
+		items = append(items, page.Items...)
+		if page.NextToken == "" {
+			return items
+		}
+		req.Token = page.NextToken
+	}
+}
+
+// scan returns the IDs of the FSMs found by ScanStateMachines with the `filter`.
+func scan(g *WithT, store storage.StoreManager, filter storage.ScanFilter) []string {
+	var ids []string
+	g.Expect(store.ScanStateMachines(bkgnd, cfgName, filter, func(id string, fsm *protos.FiniteStateMachine) error {
+		g.Expect(fsm.GetConfigId()).To(HavePrefix(cfgName))
+		ids = append(ids, id)
+		return nil
+	})).To(Succeed())
+	return ids
+}
+
+// dueTimer matches the DueTimer of the FSM `id`, regardless of when it was due.
+func dueTimer(id, state, event string) OmegaMatcher {
+	return SatisfyAll(HaveField("Id", id), HaveField("State", state), HaveField("Event", event))
+}
+
+var conformanceTests = []conformanceTest{
+	{"Health", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		g.Expect(store.Health()).To(Succeed())
+	}},
+	{"Context/Canceled", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		ctx, cancel := context.WithCancel(bkgnd)
+		cancel()
+		_, err := store.GetConfig(ctx, cfgName+":v1")
+		expectStoreError(g, err, storage.ErrCanceled, storage.NewKeyForConfig(cfgName+":v1"))
+		_, err = store.TxProcessEvent(ctx, "fsm-1", cfgName, api.NewEvent("scan"))
+		g.Expect(err).To(MatchError(storage.ErrCanceled))
+		g.Expect(store.PutEvent(ctx, api.NewEvent("scan"), cfgName, storage.NeverExpire)).To(
+			MatchError(storage.ErrCanceled))
+		g.Expect(store.GetAllConfigs(ctx)).To(BeEmpty())
+		fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(fsm.State).To(Equal("pending"))
+	}},
+	{"Context/DeadlineExceeded", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		ctx, cancel := context.WithDeadline(bkgnd, time.Now().Add(-time.Second))
+		defer cancel()
+		_, err := store.GetStateMachine(ctx, "fsm-1", cfgName)
+		expectStoreError(g, err, storage.ErrTimeout, storage.NewKeyForMachine("fsm-1", cfgName))
+	}},
+	{"ConfigStore/PutConfig", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		cfg, err := store.GetConfig(bkgnd, cfgName+":v1")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(proto.Equal(cfg, newConfig("v1"))).To(BeTrue())
+		g.Expect(store.PutConfig(bkgnd, nil)).ToNot(Succeed())
+	}},
+	{"ConfigStore/PutConfig/AlreadyExists", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		err := store.PutConfig(bkgnd, newConfig("v1"))
+		expectStoreError(g, err, storage.ErrAlreadyExists, storage.NewKeyForConfig(cfgName+":v1"))
+		g.Expect(store.GetAllVersions(bkgnd, cfgName)).To(HaveLen(2))
+	}},
+	{"ConfigStore/GetConfig/NotFound", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		_, err := store.GetConfig(bkgnd, cfgName+":v3")
+		expectStoreError(g, err, storage.ErrConfigNotFound, storage.NewKeyForConfig(cfgName+":v3"))
+	}},
+	{"ConfigStore/GetAllConfigs", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		g.Expect(store.GetAllConfigs(bkgnd)).To(ConsistOf(cfgName))
+		g.Expect(store.GetAllVersions(bkgnd, cfgName)).To(ConsistOf(cfgName+":v1", cfgName+":v2"))
+		g.Expect(store.GetAllVersions(bkgnd, "missing")).To(BeEmpty())
+	}},
+	{"ConfigStore/GetConfigsPage", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		g.Expect(allPages(g, 1, func(req storage.PageRequest) (*storage.Page, storage.StoreErr) {
+			return store.GetConfigsPage(bkgnd, req)
+		})).To(ConsistOf(cfgName))
+		g.Expect(allPages(g, 1, func(req storage.PageRequest) (*storage.Page, storage.StoreErr) {
+			return store.GetVersionsPage(bkgnd, cfgName, req)
+		})).To(ConsistOf(cfgName+":v1", cfgName+":v2"))
+		page, err := store.GetVersionsPage(bkgnd, "missing", storage.PageRequest{})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(page.Items).To(BeEmpty())
+		g.Expect(page.NextToken).To(BeEmpty())
+		_, err = store.GetConfigsPage(bkgnd, storage.PageRequest{Token: "not a token!"})
+		g.Expect(err).To(MatchError(storage.ErrInvalidData))
+	}},
+	{"ConfigStore/DeleteConfiguration", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		err := store.DeleteConfiguration(bkgnd, cfgName+":v1", false)
+		expectStoreError(g, err, storage.ErrInUse, storage.NewKeyForConfig(cfgName+":v1"))
+		g.Expect(store.DeleteConfiguration(bkgnd, cfgName+":v2", false)).To(Succeed())
+		g.Expect(store.GetAllVersions(bkgnd, cfgName)).To(ConsistOf(cfgName + ":v1"))
+		g.Expect(store.GetAllConfigs(bkgnd)).To(ConsistOf(cfgName))
+
+		g.Expect(store.DeleteConfiguration(bkgnd, cfgName+":v1", true)).To(Succeed())
+		_, err = store.GetConfig(bkgnd, cfgName+":v1")
+		g.Expect(storage.IsNotFoundErr(err)).To(BeTrue())
+		g.Expect(store.GetAllVersions(bkgnd, cfgName)).To(BeEmpty())
+		g.Expect(store.GetAllConfigs(bkgnd)).To(BeEmpty())
+		// The FSM is left in place, but can no longer process events.
+		_, err = store.TxProcessEvent(bkgnd, "fsm-1", cfgName, api.NewEvent("scan"))
+		expectStoreError(g, err, storage.ErrConfigNotFound, storage.NewKeyForConfig(cfgName+":v1"))
+		g.Expect(store.DeleteStateMachine(bkgnd, "fsm-1", cfgName)).To(Succeed())
+
+		err = store.DeleteConfiguration(bkgnd, cfgName+":v3", true)
+		expectStoreError(g, err, storage.ErrConfigNotFound, storage.NewKeyForConfig(cfgName+":v3"))
+	}},
+	{"FSMStore/PutStateMachine", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(fsm.ConfigId).To(Equal(cfgName + ":v1"))
+		g.Expect(fsm.State).To(Equal("pending"))
+		g.Expect(store.PutStateMachine(bkgnd, "fsm-2", nil)).ToNot(Succeed())
+	}},
+	{"FSMStore/TxPutStateMachine", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		g.Expect(store.TxPutStateMachine(bkgnd, "fsm-1", &protos.FiniteStateMachine{
+			ConfigId: api.GetVersionId(newConfig("v1")),
+			State:    "shipping/in_transit",
+		})).To(Succeed())
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "shipping")).To(ConsistOf("fsm-1"))
+		g.Expect(scan(g, store, storage.ScanFilter{})).To(ConsistOf("fsm-1"))
+		due, err := store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(2*time.Hour), -time.Second)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(due).To(ConsistOf(dueTimer("fsm-1", "shipping/in_transit", "lose")))
+
+		// Replacing the FSM moves it out of the state SETs, and cancels the timers, of its
+		// previous state.
+		g.Expect(store.TxPutStateMachine(bkgnd, "fsm-1", &protos.FiniteStateMachine{
+			ConfigId: api.GetVersionId(newConfig("v2")),
+			State:    "delivered",
+		})).To(Succeed())
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "shipping")).To(BeEmpty())
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "delivered")).To(ConsistOf("fsm-1"))
+		due, err = store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(4*time.Hour), time.Hour)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(due).To(BeEmpty())
+		purged, err := store.PurgeCompleted(bkgnd, cfgName, -time.Second)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(purged).To(Equal(1))
+
+		err = store.TxPutStateMachine(bkgnd, "fsm-2", &protos.FiniteStateMachine{
+			ConfigId: cfgName + ":v3",
+			State:    "pending",
+		})
+		g.Expect(errors.Is(err, storage.ErrConfigNotFound)).To(BeTrue())
+		_, err = store.GetStateMachine(bkgnd, "fsm-2", cfgName)
+		g.Expect(storage.IsNotFoundErr(err)).To(BeTrue())
+		g.Expect(store.TxPutStateMachine(bkgnd, "fsm-2", nil)).ToNot(Succeed())
+	}},
+	{"FSMStore/GetStateMachine/NotFound", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		_, err := store.GetStateMachine(bkgnd, "fsm-2", cfgName)
+		expectStoreError(g, err, storage.ErrNotFound, storage.NewKeyForMachine("fsm-2", cfgName))
+		_, err = store.GetStateMachine(bkgnd, "fsm-1", "other")
+		g.Expect(storage.IsNotFoundErr(err)).To(BeTrue())
+	}},
+	{"FSMStore/UpdateState", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		putFSM(g, store, "fsm-2")
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "pending")).To(ConsistOf("fsm-1", "fsm-2"))
+		g.Expect(store.UpdateState(bkgnd, cfgName, "fsm-1", "pending", "shipping/packed")).To(Succeed())
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "pending")).To(ConsistOf("fsm-2"))
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "shipping")).To(ConsistOf("fsm-1"))
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "shipping/packed")).To(ConsistOf("fsm-1"))
+		g.Expect(store.UpdateState(bkgnd, cfgName, "fsm-1", "shipping/packed", "")).To(Succeed())
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "shipping")).To(BeEmpty())
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "lost")).To(BeEmpty())
+	}},
+	{"FSMStore/GetInStatePage", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		var ids []string
+		for _, id := range []string{"fsm-1", "fsm-2", "fsm-3", "fsm-4", "fsm-5"} {
+			putFSM(g, store, id)
+			ids = append(ids, id)
+		}
+		for _, size := range []int{0, 1, 2, 5, 10} {
+			g.Expect(allPages(g, size, func(req storage.PageRequest) (*storage.Page, storage.StoreErr) {
+				return store.GetInStatePage(bkgnd, cfgName, "pending", req)
+			})).To(ConsistOf(ids))
+		}
+		page, err := store.GetInStatePage(bkgnd, cfgName, "shipping", storage.PageRequest{Size: 2})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(page.Items).To(BeEmpty())
+		g.Expect(page.NextToken).To(BeEmpty())
+		_, err = store.GetInStatePage(bkgnd, cfgName, "pending", storage.PageRequest{Token: "not a token!"})
+		g.Expect(err).To(MatchError(storage.ErrInvalidData))
+	}},
+	{"FSMStore/TxProcessEvent", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		sm := send(g, store, "fsm-1", "scan", "pack")
+		g.Expect(sm.FSM.State).To(Equal("shipping/packed"))
+		fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(fsm.State).To(Equal("shipping/packed"))
+		g.Expect(fsm.History).To(HaveLen(2))
+		data, err := api.GetData(fsm)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(data.AsMap()).To(Equal(map[string]interface{}{"scans": 1.0}))
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "pending")).To(BeEmpty())
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "shipping")).To(ConsistOf("fsm-1"))
+	}},
+	{"FSMStore/TxProcessEvent/Rejected", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		_, err := store.TxProcessEvent(bkgnd, "fsm-1", cfgName, api.NewEvent("deliver"))
+		g.Expect(err).To(MatchError(api.UnexpectedTransitionError))
+		fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(fsm.State).To(Equal("pending"))
+		g.Expect(fsm.History).To(BeEmpty())
+		actions, err := store.ClaimActions(bkgnd, cfgName, 10, time.Hour)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(actions).To(BeEmpty())
+	}},
+	{"FSMStore/TxProcessEvent/NotFound", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		_, err := store.TxProcessEvent(bkgnd, "fsm-1", cfgName, api.NewEvent("scan"))
+		expectStoreError(g, err, storage.ErrNotFound, storage.NewKeyForMachine("fsm-1", cfgName))
+		g.Expect(storage.OutcomeCode(err)).To(Equal(protos.EventOutcome_FsmNotFound))
+	}},
+	{"FSMStore/TxProcessEvent/ConfigNotFound", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		g.Expect(store.PutStateMachine(bkgnd, "fsm-1", &protos.FiniteStateMachine{
+			ConfigId: cfgName + ":v3",
+			State:    "pending",
+		})).To(Succeed())
+		_, err := store.TxProcessEvent(bkgnd, "fsm-1", cfgName, api.NewEvent("scan"))
+		expectStoreError(g, err, storage.ErrConfigNotFound, storage.NewKeyForConfig(cfgName+":v3"))
+		g.Expect(storage.OutcomeCode(err)).To(Equal(protos.EventOutcome_ConfigurationNotFound))
+	}},
+	{"FSMStore/TxProcessEvent/Duplicates", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		putFSM(g, store, "fsm-2")
+		evt := api.NewEvent("scan")
+		_, err := store.TxProcessEvent(bkgnd, "fsm-1", cfgName, evt)
+		g.Expect(err).ToNot(HaveOccurred())
+		_, err = store.TxProcessEvent(bkgnd, "fsm-1", cfgName, evt)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(storage.IsAlreadyProcessedErr(err)).To(BeTrue())
+		var duplicate *storage.DuplicateEventError
+		g.Expect(errors.As(err, &duplicate)).To(BeTrue())
+		g.Expect(duplicate.Outcome.GetCode()).To(Equal(protos.EventOutcome_Ok))
+		g.Expect(duplicate.Outcome.GetId()).To(Equal("fsm-1"))
+		_, err = store.TxProcessEvent(bkgnd, "fsm-2", cfgName, evt)
+		g.Expect(err).ToNot(HaveOccurred())
+
+		// The outcome of rejected Events is kept too.
+		rejected := api.NewEvent("deliver")
+		_, err = store.TxProcessEvent(bkgnd, "fsm-1", cfgName, rejected)
+		g.Expect(err).To(MatchError(api.UnexpectedTransitionError))
+		_, err = store.TxProcessEvent(bkgnd, "fsm-1", cfgName, rejected)
+		g.Expect(errors.As(err, &duplicate)).To(BeTrue())
+		g.Expect(duplicate.Outcome.GetCode()).To(Equal(protos.EventOutcome_EventNotAllowed))
+		g.Expect(duplicate.Outcome.GetDetails()).To(Equal(api.UnexpectedTransitionError.Error()))
+
+		store.SetDedupWindow(0)
+		_, err = store.TxProcessEvent(bkgnd, "fsm-1", cfgName, evt)
+		g.Expect(err).ToNot(HaveOccurred())
+		fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(fsm.History).To(HaveLen(2))
+	}},
+	{"FSMStore/TxProcessEvent/Concurrent", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		// Events may fail, if the store gives up on retrying a conflicting transaction,
+		// but none of those which succeed may be lost.
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		succeeded := 0
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := store.TxProcessEvent(bkgnd, "fsm-1", cfgName, api.NewEvent("scan")); err == nil {
+					lock.Lock()
+					succeeded++
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		g.Expect(succeeded).To(BeNumerically(">", 0))
+		fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(fsm.History).To(HaveLen(succeeded))
+		data, err := api.GetData(fsm)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(data.AsMap()).To(Equal(map[string]interface{}{"scans": float64(succeeded)}))
+	}},
+	{"FSMStore/PurgeCompleted", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		putFSM(g, store, "fsm-2")
+		sm := send(g, store, "fsm-1", "pack", "ship", "deliver")
+		g.Expect(sm.IsCompleted()).To(BeTrue())
+		purged, err := store.PurgeCompleted(bkgnd, cfgName, time.Hour)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(purged).To(Equal(0))
+		purged, err = store.PurgeCompleted(bkgnd, cfgName, -time.Second)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(purged).To(Equal(1))
+		_, err = store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+		g.Expect(storage.IsNotFoundErr(err)).To(BeTrue())
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "delivered")).To(BeEmpty())
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "pending")).To(ConsistOf("fsm-2"))
+		g.Expect(scan(g, store, storage.ScanFilter{})).To(ConsistOf("fsm-2"))
+	}},
+	{"FSMStore/ScanStateMachines", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		g.Expect(scan(g, store, storage.ScanFilter{})).To(BeEmpty())
+		putFSM(g, store, "fsm-1")
+		putFSM(g, store, "fsm-2")
+		g.Expect(store.PutStateMachine(bkgnd, "fsm-3", &protos.FiniteStateMachine{
+			ConfigId: cfgName + ":v2",
+			State:    "delivered",
+		})).To(Succeed())
+		g.Expect(scan(g, store, storage.ScanFilter{})).To(ConsistOf("fsm-1", "fsm-2", "fsm-3"))
+		g.Expect(scan(g, store, storage.ScanFilter{Version: "v2"})).To(ConsistOf("fsm-3"))
+		g.Expect(scan(g, store, storage.ScanFilter{Version: "v3"})).To(BeEmpty())
+
+		// Updates by events (and by all other transactions) count as stores.
+		time.Sleep(5 * time.Millisecond)
+		updated := time.Now()
+		time.Sleep(5 * time.Millisecond)
+		send(g, store, "fsm-1", "pack")
+		g.Expect(scan(g, store, storage.ScanFilter{States: []string{"shipping", "delivered"}})).To(
+			ConsistOf("fsm-1", "fsm-3"))
+		g.Expect(scan(g, store, storage.ScanFilter{UpdatedAfter: updated})).To(ConsistOf("fsm-1"))
+		g.Expect(scan(g, store, storage.ScanFilter{UpdatedBefore: updated})).To(ConsistOf("fsm-2", "fsm-3"))
+		g.Expect(scan(g, store, storage.ScanFilter{
+			Version:       "v1",
+			States:        []string{"pending"},
+			UpdatedBefore: updated,
+		})).To(ConsistOf("fsm-2"))
+
+		stop := errors.New("stop")
+		calls := 0
+		g.Expect(store.ScanStateMachines(bkgnd, cfgName, storage.ScanFilter{},
+			func(id string, fsm *protos.FiniteStateMachine) error {
+				calls++
+				return stop
+			})).To(MatchError(stop))
+		g.Expect(calls).To(Equal(1))
+	}},
+	{"FSMStore/DeleteStateMachine", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		putFSM(g, store, "fsm-2")
+		send(g, store, "fsm-1", "pack", "ship")
+		g.Expect(store.DeleteStateMachine(bkgnd, "fsm-1", cfgName)).To(Succeed())
+		_, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+		g.Expect(storage.IsNotFoundErr(err)).To(BeTrue())
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "shipping")).To(BeEmpty())
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "shipping/in_transit")).To(BeEmpty())
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "pending")).To(ConsistOf("fsm-2"))
+		g.Expect(scan(g, store, storage.ScanFilter{})).To(ConsistOf("fsm-2"))
+		// The timer for `lose` was cancelled.
+		due, err := store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(2*time.Hour), time.Hour)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(due).To(BeEmpty())
+
+		err = store.DeleteStateMachine(bkgnd, "fsm-1", cfgName)
+		expectStoreError(g, err, storage.ErrNotFound, storage.NewKeyForMachine("fsm-1", cfgName))
+	}},
+	{"FSMStore/MigrateStateMachine", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		send(g, store, "fsm-1", "pack", "ship")
+		migration, err := api.NewMigration(newConfig("v1"), newConfig("v2"),
+			map[string]string{"shipping/in_transit": "lost"})
+		g.Expect(err).ToNot(HaveOccurred())
+		migrated, err := store.MigrateStateMachine(bkgnd, "fsm-1", migration)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(migrated).To(BeTrue())
+		fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(fsm.ConfigId).To(Equal(cfgName + ":v2"))
+		g.Expect(fsm.State).To(Equal("lost"))
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "shipping")).To(BeEmpty())
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "lost")).To(ConsistOf("fsm-1"))
+		// The timer for `lose` was cancelled, and the FSM completed.
+		due, err := store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(2*time.Hour), time.Hour)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(due).To(BeEmpty())
+		purged, err := store.PurgeCompleted(bkgnd, cfgName, -time.Second)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(purged).To(Equal(1))
+
+		migrated, err = store.MigrateStateMachine(bkgnd, "fsm-2", migration)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(migrated).To(BeFalse())
+	}},
+	{"FSMStore/Migrator", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		for i := 1; i <= 5; i++ {
+			putFSM(g, store, fmt.Sprintf("fsm-%d", i))
+		}
+		send(g, store, "fsm-1", "pack")
+		send(g, store, "fsm-2", "pack", "ship")
+		migration, err := api.NewMigration(newConfig("v1"), newConfig("v2"), nil)
+		g.Expect(err).ToNot(HaveOccurred())
+		migrator := storage.NewMigrator(store, migration)
+		migrator.BatchSize = 2
+		migrated, _, err := migrator.Next(bkgnd, "")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(migrated).ToNot(BeEmpty())
+
+		resumed := storage.NewMigrator(store, migration)
+		resumed.Cursor = migrator.Cursor
+		count, err := resumed.Run(bkgnd, "")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(len(migrated) + count).To(Equal(5))
+		for i := 1; i <= 5; i++ {
+			fsm, err := store.GetStateMachine(bkgnd, fmt.Sprintf("fsm-%d", i), cfgName)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(fsm.ConfigId).To(Equal(cfgName + ":v2"))
+		}
+		again, err := storage.NewMigrator(store, migration).Run(bkgnd, "")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(again).To(Equal(0))
+
+		resumed.Cursor = "not a cursor"
+		_, _, err = resumed.Next(bkgnd, "")
+		g.Expect(err).To(MatchError(storage.ErrInvalidData))
+	}},
+	{"FSMStore/VerifyStateMachine", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		send(g, store, "fsm-1", "pack")
+		v, err := store.VerifyStateMachine(bkgnd, "fsm-1", cfgName, false)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(v.IsConsistent()).To(BeTrue())
+
+		fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+		g.Expect(err).ToNot(HaveOccurred())
+		fsm.State = "delivered"
+		g.Expect(store.PutStateMachine(bkgnd, "fsm-1", fsm)).To(Succeed())
+		g.Expect(store.UpdateState(bkgnd, cfgName, "fsm-1", "shipping/packed", "delivered")).To(Succeed())
+		v, err = store.VerifyStateMachine(bkgnd, "fsm-1", cfgName, true)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(v.Replayed).To(Equal("shipping/packed"))
+		g.Expect(v.Repaired).To(BeTrue())
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "shipping/packed")).To(ConsistOf("fsm-1"))
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "delivered")).To(BeEmpty())
+		v, err = store.VerifyStateMachine(bkgnd, "fsm-1", cfgName, false)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(v.IsConsistent()).To(BeTrue())
+
+		_, err = store.VerifyStateMachine(bkgnd, "fsm-2", cfgName, false)
+		g.Expect(storage.IsNotFoundErr(err)).To(BeTrue())
+	}},
+	{"FSMStore/VerifyStateMachine/Migrated", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		send(g, store, "fsm-1", "pack", "ship")
+		migration, err := api.NewMigration(newConfig("v1"), newConfig("v2"),
+			map[string]string{"shipping/in_transit": "lost"})
+		g.Expect(err).ToNot(HaveOccurred())
+		_, err = store.MigrateStateMachine(bkgnd, "fsm-1", migration)
+		g.Expect(err).ToNot(HaveOccurred())
+		v, err := store.VerifyStateMachine(bkgnd, "fsm-1", cfgName, false)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(v.IsConsistent()).To(BeTrue(), v.Error)
+
+		fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+		g.Expect(err).ToNot(HaveOccurred())
+		fsm.State = "delivered"
+		g.Expect(store.PutStateMachine(bkgnd, "fsm-1", fsm)).To(Succeed())
+		g.Expect(store.UpdateState(bkgnd, cfgName, "fsm-1", "lost", "delivered")).To(Succeed())
+		v, err = store.VerifyStateMachine(bkgnd, "fsm-1", cfgName, true)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(v.Replayed).To(Equal("lost"))
+		g.Expect(v.Repaired).To(BeTrue())
+		// The repair does not revert the migration.
+		fsm, err = store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(fsm.ConfigId).To(Equal(cfgName + ":v2"))
+		g.Expect(fsm.State).To(Equal("lost"))
+		g.Expect(fsm.History).To(HaveLen(3))
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "lost")).To(ConsistOf("fsm-1"))
+		v, err = store.VerifyStateMachine(bkgnd, "fsm-1", cfgName, false)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(v.IsConsistent()).To(BeTrue(), v.Error)
+	}},
+	{"FSMStore/RollbackStateMachine", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		send(g, store, "fsm-1", "pack", "ship", "deliver")
+		sm, err := store.RollbackStateMachine(bkgnd, "fsm-1", cfgName, 1)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(sm.FSM.State).To(Equal("shipping/in_transit"))
+		fsm, err := store.GetStateMachine(bkgnd, "fsm-1", cfgName)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(fsm.State).To(Equal("shipping/in_transit"))
+		g.Expect(fsm.History).To(HaveLen(4))
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "shipping")).To(ConsistOf("fsm-1"))
+		g.Expect(store.GetAllInState(bkgnd, cfgName, "delivered")).To(BeEmpty())
+		// The FSM is no longer completed, and its timer is running again.
+		purged, err := store.PurgeCompleted(bkgnd, cfgName, -time.Second)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(purged).To(Equal(0))
+		due, err := store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(2*time.Hour), time.Hour)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(due).To(ConsistOf(dueTimer("fsm-1", "shipping/in_transit", "lose")))
+
+		_, err = store.RollbackStateMachine(bkgnd, "fsm-1", cfgName, 4)
+		g.Expect(err).To(HaveOccurred())
+	}},
+	{"TimerStore", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		putFSM(g, store, "fsm-2")
+		send(g, store, "fsm-1", "pack", "ship")
+		g.Expect(store.ScheduleTimers(bkgnd, cfgName, "fsm-2", []api.Timer{
+			{State: "pending", Event: "expire", Timeout: time.Minute},
+		})).To(Succeed())
+		due, err := store.ClaimDueTimers(bkgnd, cfgName, time.Now(), time.Hour)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(due).To(BeEmpty())
+		due, err = store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(2*time.Hour), time.Hour)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(due).To(ConsistOf(
+			dueTimer("fsm-1", "shipping/in_transit", "lose"),
+			dueTimer("fsm-2", "pending", "expire")))
+		due, err = store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(2*time.Hour), time.Hour)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(due).To(BeEmpty())
+	}},
+	{"TimerStore/LeaseExpired", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		send(g, store, "fsm-1", "pack", "ship")
+		due, err := store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(2*time.Hour), -time.Second)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(due).To(ConsistOf(dueTimer("fsm-1", "shipping/in_transit", "lose")))
+		lose := due[0]
+		// The timer is claimed again once its lease expired, and is still due at the same time.
+		due, err = store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(3*time.Hour), time.Hour)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(due).To(ConsistOf(lose))
+		// Processing the timer's event removes it.
+		_, err = store.TxProcessEvent(bkgnd, "fsm-1", cfgName,
+			api.NewTimerEvent(api.Timer{State: lose.State, Event: lose.Event}))
+		g.Expect(err).ToNot(HaveOccurred())
+		due, err = store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(4*time.Hour), time.Hour)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(due).To(BeEmpty())
+	}},
+	{"TimerStore/DiscardTimer", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		send(g, store, "fsm-1", "pack", "ship")
+		due, err := store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(2*time.Hour), -time.Second)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(due).To(HaveLen(1))
+		lose := due[0]
+		// Timers restarted since they were claimed are not discarded.
+		restarted := lose
+		restarted.Due = lose.Due.Add(-time.Minute)
+		g.Expect(store.DiscardTimer(bkgnd, cfgName, restarted)).To(Succeed())
+		due, err = store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(2*time.Hour), time.Hour)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(due).To(ConsistOf(lose))
+
+		g.Expect(store.DiscardTimer(bkgnd, cfgName, lose)).To(Succeed())
+		due, err = store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(4*time.Hour), time.Hour)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(due).To(BeEmpty())
+	}},
+	{"TimerStore/Cancelled", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		send(g, store, "fsm-1", "pack", "ship", "deliver")
+		due, err := store.ClaimDueTimers(bkgnd, cfgName, time.Now().Add(2*time.Hour), time.Hour)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(due).To(BeEmpty())
+	}},
+	{"ActionStore", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		send(g, store, "fsm-1", "pack", "ship", "deliver")
+		// Actions can be claimed from the millisecond after they were caused.
+		time.Sleep(2 * time.Millisecond)
+		claimed, err := store.ClaimActions(bkgnd, cfgName, 2, time.Hour)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(claimed).To(HaveLen(2))
+		more, err := store.ClaimActions(bkgnd, cfgName, 10, time.Hour)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(more).To(HaveLen(1))
+		// Actions caused by the same transition are claimed in the order they were caused.
+		var names []string
+		for _, action := range append(claimed, more...) {
+			g.Expect(action.FsmId).To(Equal("fsm-1"))
+			names = append(names, action.Name)
+		}
+		g.Expect(names).To(ConsistOf("label", "notify", "invoice"))
+		g.Expect(names[2]).To(Equal("invoice"))
+		for _, action := range append(claimed, more...) {
+			g.Expect(store.AckAction(bkgnd, cfgName, action.Id)).To(Succeed())
+		}
+		actions, err := store.ClaimActions(bkgnd, cfgName, 10, -time.Second)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(actions).To(BeEmpty())
+	}},
+	{"ActionStore/LeaseExpired", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		putFSM(g, store, "fsm-1")
+		send(g, store, "fsm-1", "pack")
+		actions, err := store.ClaimActions(bkgnd, cfgName, 10, -time.Second)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(actions).To(HaveLen(1))
+		again, err := store.ClaimActions(bkgnd, cfgName, 10, time.Hour)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(again).To(HaveLen(1))
+		g.Expect(again[0].Id).To(Equal(actions[0].Id))
+	}},
+	{"EventStore/PutEvent", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		evt := api.NewEvent("scan")
+		evt.Details = `{"location": "depot"}`
+		g.Expect(store.PutEvent(bkgnd, evt, cfgName, storage.NeverExpire)).To(Succeed())
+		found, err := store.GetEvent(bkgnd, evt.EventId, cfgName)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(proto.Equal(found, evt)).To(BeTrue())
+		_, err = store.GetEvent(bkgnd, evt.EventId, "other")
+		g.Expect(storage.IsNotFoundErr(err)).To(BeTrue())
+		g.Expect(store.PutEvent(bkgnd, nil, cfgName, storage.NeverExpire)).ToNot(Succeed())
+	}},
+	{"EventStore/AddEventOutcome", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		outcome := &protos.EventOutcome{Code: protos.EventOutcome_Ok, Id: "fsm-1", Config: cfgName}
+		g.Expect(store.AddEventOutcome(bkgnd, "evt-1", cfgName, outcome, storage.NeverExpire)).To(Succeed())
+		found, err := store.GetOutcomeForEvent(bkgnd, "evt-1", cfgName)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(proto.Equal(found, outcome)).To(BeTrue())
+		_, err = store.GetOutcomeForEvent(bkgnd, "evt-2", cfgName)
+		g.Expect(storage.IsNotFoundErr(err)).To(BeTrue())
+		g.Expect(store.AddEventOutcome(bkgnd, "evt-2", cfgName, nil, storage.NeverExpire)).ToNot(Succeed())
+	}},
+	{"EventStore/DeleteEvent", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		evt := api.NewEvent("scan")
+		g.Expect(store.PutEvent(bkgnd, evt, cfgName, storage.NeverExpire)).To(Succeed())
+		g.Expect(store.AddEventOutcome(bkgnd, evt.EventId, cfgName, &protos.EventOutcome{Id: "fsm-1"},
+			storage.NeverExpire)).To(Succeed())
+		g.Expect(store.DeleteEvent(bkgnd, evt.EventId, cfgName)).To(Succeed())
+		_, err := store.GetEvent(bkgnd, evt.EventId, cfgName)
+		g.Expect(storage.IsNotFoundErr(err)).To(BeTrue())
+		_, err = store.GetOutcomeForEvent(bkgnd, evt.EventId, cfgName)
+		g.Expect(storage.IsNotFoundErr(err)).To(BeTrue())
+
+		err = store.DeleteEvent(bkgnd, evt.EventId, cfgName)
+		expectStoreError(g, err, storage.ErrNotFound, storage.NewKeyForEvent(evt.EventId, cfgName))
+	}},
+	{"EventStore/Expiry", func(t *testing.T, g *WithT, store storage.StoreManager) {
+		evt := api.NewEvent("scan")
+		g.Expect(store.PutEvent(bkgnd, evt, cfgName, ttl)).To(Succeed())
+		g.Expect(store.AddEventOutcome(bkgnd, evt.EventId, cfgName, &protos.EventOutcome{Id: "fsm-1"},
+			ttl)).To(Succeed())
+		kept := api.NewEvent("scan")
+		g.Expect(store.PutEvent(bkgnd, kept, cfgName, storage.NeverExpire)).To(Succeed())
+		g.Eventually(func() bool {
+			_, err := store.GetEvent(bkgnd, evt.EventId, cfgName)
+			return err != nil && storage.IsNotFoundErr(err)
+		}, expiryTimeout, ttl).Should(BeTrue())
+		g.Eventually(func() bool {
+			_, err := store.GetOutcomeForEvent(bkgnd, evt.EventId, cfgName)
+			return err != nil && storage.IsNotFoundErr(err)
+		}, expiryTimeout, ttl).Should(BeTrue())
+		_, err := store.GetEvent(bkgnd, kept.EventId, cfgName)
+		g.Expect(err).ToNot(HaveOccurred())
+	}},
+}
@@ -10,74 +10,90 @@
 package storage
 
 import (
-	"fmt"
-	"regexp"
+	"context"
 	"time"
 
+	"github.com/massenz/go-statemachine/pkg/api"
 	protos "github.com/massenz/statemachine-proto/golang/api"
 )
 
-type StoreErr = error
-
-func Error(msg string) func(string) StoreErr {
-	return func(key string) error {
-		return fmt.Errorf(msg, key)
-	}
-}
-
-var (
-	AlreadyExistsError  = Error("key %s already exists")
-	GenericStoreError   = Error("store error: %v")
-	InvalidDataError    = Error("error storing invalid data: %v")
-	NotFoundError       = Error("key %s not found")
-	NotImplementedError = Error("functionality %s has not been implemented yet")
-	TooManyAttempts     = Error("retries exceeded")
-)
-
-func IsNotFoundErr(err StoreErr) bool {
-	// Define the regular expression pattern
-	pattern := `^key\s+(\S+)\s+not\sfound$`
-
-	// Compile the regular expression pattern
-	re := regexp.MustCompile(pattern)
-
-	// Use the FindStringSubmatch function to get the matched groups
-	matches := re.FindStringSubmatch(err.Error())
-
-	// The first element of the matches slice is the whole matched string, so we skip it
-	return len(matches) > 1
-}
-
 type ConfigStore interface {
-	GetConfig(versionId string) (*protos.Configuration, StoreErr)
-	PutConfig(cfg *protos.Configuration) StoreErr
+	GetConfig(ctx context.Context, versionId string) (*protos.Configuration, StoreErr)
+	PutConfig(ctx context.Context, cfg *protos.Configuration) StoreErr
 
 	// GetAllConfigs returns all the `Configurations` that exist in the store, regardless of
 	// the version, and whether they are used or not by an FSM.
-	GetAllConfigs() []string
+	GetAllConfigs(ctx context.Context) []string
 
 	// GetAllVersions returns the full `name:version` ID of all the Configurations whose
 	// name matches `name`.
-	GetAllVersions(name string) []string
+	GetAllVersions(ctx context.Context, name string) []string
+
+	// GetConfigsPage returns a Page of the names of the Configurations, as GetAllConfigs
+	// does; see PageRequest for how to iterate through all of them.
+	GetConfigsPage(ctx context.Context, req PageRequest) (*Page, StoreErr)
+
+	// GetVersionsPage returns a Page of the full `name:version` IDs of the Configurations
+	// whose name matches `name`, as GetAllVersions does.
+	GetVersionsPage(ctx context.Context, name string, req PageRequest) (*Page, StoreErr)
+
+	// DeleteConfiguration removes the Configuration `versionId` (and its name, if it was
+	// the last of its versions).
+	//
+	// Unless `force` is true, an InUseError is returned if any FSM is still configured with
+	// it (see ScanStateMachines); forcibly removing a Configuration leaves its FSMs unable
+	// to process Events, until migrated to another version.
+	DeleteConfiguration(ctx context.Context, versionId string, force bool) StoreErr
 }
 
 type FSMStore interface {
 	// GetStateMachine will find the FSM with `id and that is configured via a `Configuration` whose
 	// `name` matches `cfg` (without the `version`).
-	GetStateMachine(id string, cfg string) (*protos.FiniteStateMachine, StoreErr)
+	GetStateMachine(ctx context.Context, id string, cfg string) (*protos.FiniteStateMachine, StoreErr)
 
 	// PutStateMachine creates or updates the FSM whose `id` is given.
 	// No further action is taken: no check that the referenced `Configuration` exists, and the
 	// `state` SETs are not updated either: it is the caller's responsibility to call the
-	// `UpdateState` method (possibly with an empty `oldState`, in the case of creation).
-	PutStateMachine(id string, fsm *protos.FiniteStateMachine) StoreErr
+	// `UpdateState` method (possibly with an empty `oldState`, in the case of creation), or
+	// to use TxPutStateMachine instead.
+	PutStateMachine(ctx context.Context, id string, fsm *protos.FiniteStateMachine) StoreErr
+
+	// TxPutStateMachine creates or replaces the FSM `id` in a transaction, which also moves
+	// it to the `state` SETs of its state, starts its timers and records its completion (if
+	// its state is a terminal one), as TxProcessEvent does.
+	//
+	// If the FSM replaces an existing one, it is moved from the `state` SETs of the latter,
+	// whose timers are cancelled; the Configuration the FSM refers to must exist.
+	TxPutStateMachine(ctx context.Context, id string, fsm *protos.FiniteStateMachine) StoreErr
 
 	// GetAllInState looks up all the FSMs that are currently in the given `state` and
 	// are configured with a `Configuration` whose name matches `cfg` (regardless of the
 	// configuration's version).
 	//
+	// The `state` may also be a compound state, in which case all the FSMs in any of its
+	// nested states are returned.
+	//
 	// It returns the IDs for the FSMs.
-	GetAllInState(cfg string, state string) []string
+	GetAllInState(ctx context.Context, cfg string, state string) []string
+
+	// GetInStatePage returns a Page of the IDs of the FSMs in the given `state`, as
+	// GetAllInState does; see PageRequest for how to iterate through all of them.
+	GetInStatePage(ctx context.Context, cfg string, state string, req PageRequest) (*Page, StoreErr)
+
+	// ScanStateMachines calls `fn` with each of the FSMs configured with (any version of) the
+	// `cfgName` Configuration which match the `filter`, regardless of their state; it stops
+	// at the first error returned by `fn`, and returns it.
+	//
+	// FSMs are looked up in an index of the FSMs of each Configuration, which is updated
+	// whenever an FSM is stored (by PutStateMachine, as well as by the transactions which
+	// update FSMs), a page (see PageRequest) at a time: FSMs stored or removed during the scan
+	// may or may not be found.
+	ScanStateMachines(ctx context.Context, cfgName string, filter ScanFilter, fn ScanFunc) StoreErr
+
+	// DeleteStateMachine removes the FSM `id`, configured with `cfgName`, along with its
+	// entries in the `state` SETs and in the index of the FSMs, its timers and its
+	// completion, in a transaction.
+	DeleteStateMachine(ctx context.Context, id string, cfgName string) StoreErr
 
 	// UpdateState will move the FSM's `id` from/to the respective Redis SETs.
 	//
@@ -86,35 +102,136 @@ type FSMStore interface {
 	// (or not, as the case may be).
 	//
 	// `oldState` may be empty in the case of a new FSM being created.
-	UpdateState(cfgName string, id string, oldState string, newState string) StoreErr
+	//
+	// The FSM is also moved from/to the SETs of the compound states that `oldState` and
+	// `newState` are nested in (see api.StateSeparator).
+	UpdateState(ctx context.Context, cfgName string, id string, oldState string, newState string) StoreErr
 
 	// TxProcessEvent processes an Event for the FSM in a transaction, guaranteeing that
 	// there will be no races when updating the FSM state.
-	TxProcessEvent(id, cfgName string, evt *protos.Event) StoreErr
+	//
+	// It returns the FSM (along with its Configuration) as updated by the Event; if this
+	// caused the FSM to reach a terminal state, its completion is also recorded.
+	//
+	// The timers for the states the FSM leaves are cancelled, and those for the states it
+	// enters are started (see api.ExitedStates and api.EnteredStates); the Actions caused by
+	// the transition are stored in the same transaction, waiting to be dispatched.
+	//
+	// The FSM's data (see api.GetData), as updated by the transition, is stored along with it.
+	//
+	// Events are deduplicated by their `EventId`: if the FSM already processed (or rejected)
+	// an Event with the same ID within the deduplication window (see SetDedupWindow), it is
+	// not processed again, and a DuplicateEventError is returned, with the outcome the Event
+	// was first processed with.
+	TxProcessEvent(ctx context.Context, id, cfgName string, evt *protos.Event) (*api.ConfiguredStateMachine, StoreErr)
+
+	// PurgeCompleted removes all the FSMs configured with `cfgName` which reached a terminal
+	// state more than `retention` ago, along with their entries in the `state` SETs.
+	//
+	// It returns the number of FSMs removed.
+	PurgeCompleted(ctx context.Context, cfgName string, retention time.Duration) (int, StoreErr)
+
+	// MigrateStateMachine moves the FSM `id` to the target Configuration of the `migration`
+	// (see api.Migration) in a transaction, which also updates the `state` SETs, the FSM's
+	// timers and its completion.
+	//
+	// It returns `false` (and no error) if the FSM is not configured with the migration's
+	// original Configuration, for example because it was already migrated.
+	MigrateStateMachine(ctx context.Context, id string, migration *api.Migration) (bool, StoreErr)
+
+	// VerifyStateMachine replays the History of the FSM `id` (see api.Replay) and checks
+	// that its state and data, and the `state` SETs, agree with it.
+	//
+	// If `repair` is true, and they do not, the FSM's state and data are replaced with the
+	// replayed ones, along with its `state` SETs, its timers and its completion, in a
+	// single transaction; FSMs whose History is not valid are never repaired.
+	VerifyStateMachine(ctx context.Context, id, cfgName string, repair bool) (*Verification, StoreErr)
+
+	// RollbackStateMachine reverts the last `steps` transitions of the FSM `id` (see
+	// api.ConfiguredStateMachine.Rollback) in a transaction, which also updates the `state`
+	// SETs, the FSM's timers and its completion.
+	//
+	// It returns the FSM (along with its Configuration) as rolled back.
+	RollbackStateMachine(ctx context.Context, id, cfgName string, steps int) (*api.ConfiguredStateMachine, StoreErr)
+}
+
+// A DueTimer is a Timer (see api.Timer) which is due to fire for the FSM `Id` since `Due`.
+type DueTimer struct {
+	Id    string
+	State string
+	Event string
+	Due   time.Time
+}
+
+type TimerStore interface {
+	// ScheduleTimers starts the `timers` for the FSM `id`, which just entered their state; each
+	// of them will be due after its `Timeout`.
+	//
+	// Timers are cancelled (and restarted for the new state, if any) by `TxProcessEvent`, in
+	// the same transaction that moves the FSM out of their state.
+	ScheduleTimers(ctx context.Context, cfgName string, id string, timers []api.Timer) StoreErr
+
+	// ClaimDueTimers returns all the timers for FSMs configured with `cfgName` which are due
+	// at `now`.
+	//
+	// Claimed timers are not returned again for the `lease` duration, even if several servers
+	// share the same store: `TxProcessEvent` removes a timer along with processing its Event
+	// (or rejecting it), and unless that happens by then, the timer will be claimed again, so
+	// that it fires at least once, even if the claimant fails.
+	//
+	// A timer claimed again keeps its `Due` time, until it is restarted.
+	ClaimDueTimers(ctx context.Context, cfgName string, now time.Time, lease time.Duration) ([]DueTimer, StoreErr)
+
+	// DiscardTimer removes a `timer` which should not fire (e.g., because its FSM is no
+	// longer in the timer's state), unless it was restarted since it was claimed.
+	DiscardTimer(ctx context.Context, cfgName string, timer DueTimer) StoreErr
+}
+
+type ActionStore interface {
+	// ClaimActions returns up to `count` of the Actions waiting to be dispatched, caused by
+	// FSMs configured with `cfgName`.
+	//
+	// Claimed Actions are not returned again for the `lease` duration: unless acknowledged
+	// with `AckAction` by then, they will be claimed again, so that they are dispatched at
+	// least once, even if the claimant fails.
+	ClaimActions(ctx context.Context, cfgName string, count int, lease time.Duration) ([]*api.Action, StoreErr)
+
+	// AckAction removes an Action from the store, once it has been dispatched.
+	AckAction(ctx context.Context, cfgName string, id string) StoreErr
 }
 
 type EventStore interface {
-	GetEvent(id string, cfg string) (*protos.Event, StoreErr)
-	PutEvent(event *protos.Event, cfg string, ttl time.Duration) StoreErr
+	GetEvent(ctx context.Context, id string, cfg string) (*protos.Event, StoreErr)
+	PutEvent(ctx context.Context, event *protos.Event, cfg string, ttl time.Duration) StoreErr
 
 	// AddEventOutcome adds the outcome of an event to the storage, given the `eventId` and the
 	// "type" (`Configuration.Name`) of the FSM that received the event.
 	//
 	// Optionally, it will remove the outcome after a given `ttl` (time-to-live); use
 	// `NeverExpire` to keep the outcome forever.
-	AddEventOutcome(eventId string, cfgName string, response *protos.EventOutcome,
+	AddEventOutcome(ctx context.Context, eventId string, cfgName string, response *protos.EventOutcome,
 		ttl time.Duration) StoreErr
 
 	// GetOutcomeForEvent returns the outcome of an event, given the `eventId` and the "type" of the
 	// FSM that received the event.
-	GetOutcomeForEvent(eventId string, cfgName string) (*protos.EventOutcome, StoreErr)
+	GetOutcomeForEvent(ctx context.Context, eventId string, cfgName string) (*protos.EventOutcome, StoreErr)
+
+	// DeleteEvent removes the event `eventId`, and its outcome, given the "type" of the FSM
+	// that received the event; it returns a NotFoundError if neither exists.
+	DeleteEvent(ctx context.Context, eventId string, cfgName string) StoreErr
 }
 
 type StoreManager interface {
 	ConfigStore
 	FSMStore
+	TimerStore
+	ActionStore
 	EventStore
 	SetTimeout(duration time.Duration)
 	GetTimeout() time.Duration
+
+	// SetDedupWindow sets how long the IDs of the Events processed by each FSM are kept, to
+	// detect duplicates (see TxProcessEvent); a zero `window` disables deduplication.
+	SetDedupWindow(window time.Duration)
 	Health() error
 }
@@ -1,19 +1,70 @@
 package storage_test
 
 import (
+	"errors"
+	"fmt"
+
+	"github.com/massenz/go-statemachine/pkg/api"
 	"github.com/massenz/go-statemachine/pkg/storage"
+	protos "github.com/massenz/statemachine-proto/golang/api"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
 )
 
 var _ = Describe("Types", func() {
 
-	It("should correctly match a regex", func() {
+	It("should match NotFound errors", func() {
 		res := storage.IsNotFoundErr(storage.NotFoundError("fsm:test#fake-fsm"))
 		Expect(res).To(BeTrue())
 	})
-	It("should not match the wrong regex", func() {
+	It("should not match other errors as NotFound", func() {
 		res := storage.IsNotFoundErr(storage.AlreadyExistsError("fsm:test#fake-fsm"))
 		Expect(res).ToNot(BeTrue())
+		Expect(storage.IsNotFoundErr(fmt.Errorf("key fsm:test#fake-fsm not found"))).To(BeFalse())
+		Expect(storage.IsNotFoundErr(nil)).To(BeFalse())
+	})
+	It("should carry their kind and key, even when wrapped", func() {
+		err := fmt.Errorf("cannot process event: %w", storage.TimeoutError("fsm:test#fake-fsm"))
+		Expect(errors.Is(err, storage.ErrTimeout)).To(BeTrue())
+		Expect(errors.Is(err, storage.ErrNotFound)).To(BeFalse())
+		var storeErr *storage.StoreError
+		Expect(errors.As(err, &storeErr)).To(BeTrue())
+		Expect(storeErr.Key).To(Equal("fsm:test#fake-fsm"))
+		Expect(storeErr.Error()).To(Equal("timed out accessing key fsm:test#fake-fsm"))
+	})
+	It("should only carry the keys they are about", func() {
+		err := storage.ConfigNotFoundError(storage.NewKeyForConfig("test:v1"))
+		Expect(storage.IsNotFoundErr(err)).To(BeTrue())
+		Expect(errors.Is(err, storage.ErrConfigNotFound)).To(BeTrue())
+		Expect(errors.Is(storage.NotFoundError("fsm:test#fake-fsm"), storage.ErrConfigNotFound)).To(BeFalse())
+		var storeErr *storage.StoreError
+		Expect(errors.As(storage.GenericStoreError("connection refused"), &storeErr)).To(BeTrue())
+		Expect(storeErr.Key).To(BeEmpty())
+		Expect(storeErr.Error()).To(Equal("store error: connection refused"))
+	})
+	It("should map to gRPC status codes", func() {
+		Expect(storage.StatusCode(nil)).To(Equal(codes.OK))
+		Expect(storage.StatusCode(storage.NotFoundError("fsm:test#fake-fsm"))).To(Equal(codes.NotFound))
+		Expect(storage.StatusCode(storage.AlreadyExistsError("configs:test:v1"))).To(
+			Equal(codes.AlreadyExists))
+		Expect(storage.StatusCode(storage.TooManyAttempts("fsm:test#fake-fsm"))).To(Equal(codes.Aborted))
+		Expect(storage.StatusCode(storage.InvalidDataError("nil event"))).To(Equal(codes.InvalidArgument))
+		Expect(storage.StatusCode(storage.CanceledError("fsm:test#fake-fsm"))).To(Equal(codes.Canceled))
+		Expect(storage.StatusCode(storage.InUseError("configs#test:v1"))).To(Equal(codes.FailedPrecondition))
+		Expect(storage.StatusCode(api.GuardNotSatisfiedError)).To(Equal(codes.FailedPrecondition))
+		Expect(storage.StatusCode(fmt.Errorf("unknown"))).To(Equal(codes.Internal))
+	})
+	It("should map to EventOutcome codes", func() {
+		Expect(storage.OutcomeCode(storage.NotFoundError(storage.NewKeyForMachine("fake-fsm", "test")))).To(
+			Equal(protos.EventOutcome_FsmNotFound))
+		Expect(storage.OutcomeCode(storage.ConfigNotFoundError(storage.NewKeyForConfig("test:v1")))).To(
+			Equal(protos.EventOutcome_ConfigurationNotFound))
+		Expect(storage.OutcomeCode(api.GuardNotSatisfiedError)).To(
+			Equal(protos.EventOutcome_TransitionNotAllowed))
+		Expect(storage.OutcomeCode(api.UnexpectedTransitionError)).To(
+			Equal(protos.EventOutcome_EventNotAllowed))
+		Expect(storage.OutcomeCode(storage.TimeoutError("fsm:test#fake-fsm"))).To(
+			Equal(protos.EventOutcome_InternalError))
 	})
 })
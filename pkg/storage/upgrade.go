@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package storage
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/massenz/go-statemachine/pkg/api"
+)
+
+// globEscaper escapes the characters which are special in the patterns of SCAN MATCH.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// legacyPrefixes are the prefixes of the keys which are followed by the name of the
+// Configuration (see NewKeyForMachine, etc.).
+var legacyPrefixes = []string{
+	FsmPrefix + KeyPrefixComponentsSeparator,
+	EventsPrefix + KeyPrefixComponentsSeparator,
+	ActionsPrefix + KeyPrefixComponentsSeparator,
+}
+
+// UpgradeKeys renames the keys stored (with a Redis Cluster) by earlier releases, which did not
+// carry the name of the Configuration as their hash tag (see keyName), and returns how many were
+// renamed; with a single Redis server, the keys are not hash-tagged, and there is nothing to do.
+//
+// Keys are moved one at a time (as they are moved across the hash slots of the cluster); those
+// which already exist with their new name are left alone: this should be run before the servers
+// using the new keys are started.
+func (csm *RedisStore) UpgradeKeys(ctx context.Context) (int, StoreErr) {
+	if !csm.isCluster {
+		return 0, nil
+	}
+	upgraded := 0
+	configs := ConfigsPrefix + KeyPrefixIDSeparator
+	for _, name := range csm.GetAllConfigs(ctx) {
+		legacy := globEscaper.Replace(name)
+		// The SET of the versions, and the versions themselves (configs#<name>:<version>).
+		patterns := [][2]string{
+			{configs, legacy},
+			{configs, legacy + api.ConfigurationVersionSeparator + "*"},
+		}
+		for _, prefix := range legacyPrefixes {
+			patterns = append(patterns, [2]string{prefix, legacy + KeyPrefixIDSeparator + "*"},
+				[2]string{prefix, legacy + KeyPrefixComponentsSeparator + "*"})
+		}
+		for _, pattern := range patterns {
+			prefix := pattern[0]
+			count, err := csm.upgradeKeys(ctx, globEscaper.Replace(prefix)+pattern[1], prefix, name)
+			upgraded += count
+			if err != nil {
+				return upgraded, err
+			}
+		}
+	}
+	csm.logger.Info().Msgf("upgraded %d keys", upgraded)
+	return upgraded, nil
+}
+
+// upgradeKeys moves the keys matching `pattern`, tagging the `name` which follows their `prefix`.
+func (csm *RedisStore) upgradeKeys(ctx context.Context, pattern, prefix, name string) (int, StoreErr) {
+	var keys []string
+	var mu sync.Mutex
+	scan := func(ctx context.Context, client *redis.Client) error {
+		var cursor uint64
+		for {
+			var page []string
+			var next uint64
+			err := csm.retry(ctx, pattern, func(ctx context.Context) (err error) {
+				page, next, err = client.Scan(ctx, cursor, pattern, DefaultPageSize).Result()
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			keys = append(keys, page...)
+			mu.Unlock()
+			if next == 0 {
+				return nil
+			}
+			cursor = next
+		}
+	}
+	// Each master only returns the keys in its own hash slots.
+	err := csm.client.(*redis.ClusterClient).ForEachMaster(ctx, scan)
+	if err != nil {
+		csm.logger.Error().Err(err).Msgf("could not scan the keys matching %s", pattern)
+		return 0, redisError(err, pattern)
+	}
+	upgraded := 0
+	for _, key := range keys {
+		newKey := prefix + hashTag(name) + strings.TrimPrefix(key, prefix+name)
+		moved, err := csm.moveKey(ctx, key, newKey)
+		if err != nil {
+			return upgraded, err
+		}
+		if moved {
+			upgraded++
+		}
+	}
+	return upgraded, nil
+}
+
+// moveKey copies the value (and expiry) of `key` to `newKey`, unless the latter already
+// exists, and then removes `key`.
+func (csm *RedisStore) moveKey(ctx context.Context, key, newKey string) (bool, StoreErr) {
+	moved := false
+	err := csm.retry(ctx, key, func(ctx context.Context) error {
+		value, err := csm.client.Dump(ctx, key).Result()
+		if err == redis.Nil {
+			// The key expired, or was removed, in the meantime.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		ttl, err := csm.client.PTTL(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if ttl < 0 {
+			ttl = NeverExpire
+		}
+		err = csm.client.Restore(ctx, newKey, ttl, value).Err()
+		if err != nil && strings.HasPrefix(err.Error(), "BUSYKEY") {
+			csm.logger.Warn().Msgf("not upgrading `%s`, as `%s` already exists", key, newKey)
+			return nil
+		}
+		moved = err == nil
+		return err
+	})
+	if err == nil && moved {
+		err = csm.retry(ctx, key, func(ctx context.Context) error {
+			return csm.client.Del(ctx, key).Err()
+		})
+	}
+	if err != nil {
+		csm.logger.Error().Err(err).Msgf("could not upgrade `%s` to `%s`", key, newKey)
+		return false, err
+	}
+	return moved, nil
+}
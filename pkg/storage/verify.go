@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2022 AlertAvert.com.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Author: Marco Massenzio (marco@alertavert.com)
+ */
+
+package storage
+
+import (
+	"context"
+	"sort"
+
+	"github.com/massenz/go-statemachine/pkg/api"
+)
+
+// A Verification describes how a stored FSM differs from the one rebuilt by replaying its
+// History (see api.Replay), and whether the `state` SETs agree with its state.
+type Verification struct {
+	Id string `json:"id"`
+	// State is the FSM's stored state, and Replayed (if different) the one obtained by
+	// replaying its History.
+	State    string `json:"state"`
+	Replayed string `json:"replayed,omitempty"`
+	// Data is true if the FSM's stored data differs from the replayed one.
+	Data bool `json:"data,omitempty"`
+	// MissingFrom are the `state` SETs which should contain the FSM, but do not; ExtraIn
+	// those which contain it, but should not.
+	MissingFrom []string `json:"missing_from,omitempty"`
+	ExtraIn     []string `json:"extra_in,omitempty"`
+	// Error, if not empty, is the reason the History is not valid for the FSM's
+	// Configuration: the FSM's state cannot be verified, nor repaired.
+	Error    string `json:"error,omitempty"`
+	Repaired bool   `json:"repaired,omitempty"`
+}
+
+// IsConsistent returns true if the FSM's state and data agree with its History, and the
+// `state` SETs with its state.
+func (v *Verification) IsConsistent() bool {
+	return v.Error == "" && v.Replayed == "" && !v.Data && len(v.MissingFrom) == 0 &&
+		len(v.ExtraIn) == 0
+}
+
+// VerifyAll verifies (and, if `repair` is true, repairs) the FSMs `ids`, configured with
+// any version of the `cfgName` Configuration, or all those which are found in any of
+// the `state` SETs, if `ids` is empty.
+//
+// It returns how many FSMs were verified, and the Verifications of those which were not
+// consistent.
+func VerifyAll(ctx context.Context, store StoreManager, cfgName string, ids []string, repair bool) (int, []*Verification, StoreErr) {
+	if len(ids) == 0 {
+		ids = allStateMachines(ctx, store, cfgName)
+	}
+	var inconsistent []*Verification
+	for _, id := range ids {
+		v, err := store.VerifyStateMachine(ctx, id, cfgName, repair)
+		if err != nil {
+			return 0, inconsistent, err
+		}
+		if !v.IsConsistent() {
+			inconsistent = append(inconsistent, v)
+		}
+	}
+	return len(ids), inconsistent, nil
+}
+
+// allStateMachines returns the sorted IDs of the FSMs in any of the top-level states of any
+// version of the `cfgName` Configuration (which include all the nested ones).
+func allStateMachines(ctx context.Context, store StoreManager, cfgName string) []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, versionId := range store.GetAllVersions(ctx, cfgName) {
+		cfg, err := store.GetConfig(ctx, versionId)
+		if err != nil {
+			continue
+		}
+		for _, s := range cfg.States {
+			if api.Parent(s) != "" {
+				continue
+			}
+			for _, id := range store.GetAllInState(ctx, cfgName, s) {
+				if !seen[id] {
+					seen[id] = true
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}